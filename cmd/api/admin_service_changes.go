@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+func (app *application) listServiceChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.ServiceChangeFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	input.ServiceID = int64(app.readInt(qs, "service_id", 0, v))
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "created_at")
+	input.Filters.SortSafelist = data.ServiceChangeSortSafelist
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.ServiceChangeStatuses...), "status", "invalid status")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	changes, metadata, err := app.models.ServiceChange.List(r.Context(), input.ServiceChangeFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"service_changes": changes, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadPendingServiceChange() helper loads the change identified by the
+// "id" URL parameter, sending the appropriate error response and returning nil if
+// it can't or if the change has already been reviewed.
+func (app *application) adminReadPendingServiceChange(w http.ResponseWriter, r *http.Request) *data.ServiceChange {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	change, err := app.models.ServiceChange.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	if change.Status != data.ServiceChangePending {
+		app.errorResponse(w, r, http.StatusConflict, "the change has already been "+change.Status)
+		return nil
+	}
+	return change
+}
+
+// The adminSaveServiceChangeReview() helper saves the admin's decision on a change,
+// sending the appropriate error response and returning false if it can't. Of two
+// admins reviewing the same change at once only one succeeds.
+func (app *application) adminSaveServiceChangeReview(w http.ResponseWriter, r *http.Request, change *data.ServiceChange) bool {
+	err := app.models.ServiceChange.Update(r.Context(), change)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	return true
+}
+
+// The approveServiceChangeHandler() applies a partner's change to the service: the
+// description is replaced, prices are updated or added for the user types in the
+// change, and removed for the priced user types that aren't in it. The approval is
+// saved first, so that a change racing with its own rejection is never applied.
+func (app *application) approveServiceChangeHandler(w http.ResponseWriter, r *http.Request) {
+	change := app.adminReadPendingServiceChange(w, r)
+	if change == nil {
+		return
+	}
+
+	service, err := app.models.Service.GetById(r.Context(), change.ServiceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorResponse(w, r, http.StatusConflict, "the service has been deleted and must be restored first")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	change.Review(data.ServiceChangeApproved, app.contextGetUser(r).ID, "")
+	if !app.adminSaveServiceChangeReview(w, r, change) {
+		return
+	}
+
+	service.Description = change.Description
+	err = app.models.Service.Update(r.Context(), service)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	prices, err := app.models.Price.GetByServiceId(r.Context(), service.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	proposed := make(map[string]int)
+	for _, price := range change.Prices {
+		proposed[price.UserType] = price.Price
+	}
+
+	for _, price := range prices {
+		if !validator.In(price.UserType, data.PricedUserTypes...) {
+			continue
+		}
+		amount, ok := proposed[price.UserType]
+		delete(proposed, price.UserType)
+		switch {
+		case !ok:
+			err = app.models.Price.SoftDelete(r.Context(), price.ID)
+		case amount != price.Price:
+			price.Price = amount
+			err = app.models.Price.Update(r.Context(), price)
+		}
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Whatever is left is priced for the first time. Going through change.Prices
+	// keeps the order the partner gave.
+	for _, price := range change.Prices {
+		if _, ok := proposed[price.UserType]; !ok {
+			continue
+		}
+		err = app.models.Price.Insert(r.Context(), &data.Price{ServiceID: service.ID, Price: price.Price, UserType: price.UserType})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"service_change": change}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) rejectServiceChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Note string `json:"note"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The partner needs to know what to fix before proposing the change again.
+	v := validator.New()
+	v.Check(input.Note != "", "note", "must be provided")
+	v.Check(len(input.Note) <= 500, "note", "must not be more than 500 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	change := app.adminReadPendingServiceChange(w, r)
+	if change == nil {
+		return
+	}
+
+	change.Review(data.ServiceChangeRejected, app.contextGetUser(r).ID, input.Note)
+	if !app.adminSaveServiceChangeReview(w, r, change) {
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"service_change": change}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
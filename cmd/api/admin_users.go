@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The inviteUserHandler() lets an admin create an account of any user type. The
+// account starts out deactivated with a random password nobody knows; the invitee
+// receives an activation token by email and chooses their own password with
+// PUT /v1/users/activated.
+func (app *application) inviteUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Username  string `json:"username"`
+		UserType  string `json:"user_type"`
+		CompanyID int64  `json:"company_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := &data.User{
+		FirstName:   input.FirstName,
+		LastName:    input.LastName,
+		Email:       input.Email,
+		Username:    input.Username,
+		Activated:   false,
+		UserType:    input.UserType,
+		CompanyID:   input.CompanyID,
+		Preferences: data.DefaultPreferences(),
+	}
+
+	// The invitee never learns this password: it only exists so that the account
+	// can't be logged into before it has been activated.
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(user.Username != "", "username", "must be provided")
+	v.Check(user.Username == "" || validator.Matches(user.Username, validator.UsernameRX), "username", "must contain only letters, digits and single dashes")
+	data.ValidateUserType(v, user.UserType)
+	data.ValidateUserCompany(v, user)
+	data.ValidateUser(v, user)
+	if !app.checkUserCompany(w, r, v, user) {
+		return
+	}
+
+	err = app.models.User.Insert(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateUsername):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err := app.models.Token.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		emailData := map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"firstName":       user.FirstName,
+			"username":        user.Username,
+		}
+
+		err := app.sendEmail(user.Email, "user_invitation.tmpl", emailData)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"user_id": fmt.Sprint(user.ID),
+			})
+		}
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/users/%d", user.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The checkUserCompany() helper completes the validation of a user by checking that
+// their company exists. It sends the appropriate error response and returns false
+// if the user isn't valid or the check fails.
+func (app *application) checkUserCompany(w http.ResponseWriter, r *http.Request, v *validator.Validator, user *data.User) bool {
+	if v.Valid() && user.CompanyID != 0 {
+		err := app.models.Company.Exists(r.Context(), int(user.CompanyID))
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("company_id", "must refer to an existing company")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	return true
+}
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.UserFilter
+		data.Filters
+		IncludeDeleted *bool
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.UserType = app.readString(qs, "user_type", "")
+	input.CompanyID = int64(app.readInt(qs, "company_id", 0, v))
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Deleted = app.readBool(qs, "deleted", v)
+	input.IncludeDeleted = app.readBool(qs, "include_deleted", v)
+	input.Search = app.readString(qs, "search", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = data.UserSortSafelist
+
+	if input.UserType != "" {
+		data.ValidateUserType(v, input.UserType)
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Deleted users are only listed when asked for, either alongside the others
+	// (include_deleted=true) or on their own (deleted=true).
+	ctx := r.Context()
+	if input.IncludeDeleted != nil && *input.IncludeDeleted || input.Deleted != nil && *input.Deleted {
+		ctx = data.ContextWithDeleted(ctx)
+	}
+
+	users, metadata, err := app.models.User.List(ctx, input.UserFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadUser() helper loads the user identified by the "id" URL parameter,
+// sending the appropriate error response and returning nil if it can't. Deleted
+// users are included, so that admins can look at them and restore them.
+func (app *application) adminReadUser(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	user, err := app.models.User.Get(data.ContextWithDeleted(r.Context()), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// The adminReadOtherUser() helper is like adminReadUser(), but refuses to act on the
+// admin's own account, so that an admin can't lock themselves out.
+func (app *application) adminReadOtherUser(w http.ResponseWriter, r *http.Request) *data.User {
+	user := app.adminReadUser(w, r)
+	if user == nil {
+		return nil
+	}
+	if user.ID == app.contextGetUser(r).ID {
+		app.errorResponse(w, r, http.StatusConflict, "you cannot perform this action on your own account")
+		return nil
+	}
+	return user
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.adminReadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminUpdateUser() helper saves the changes made to a (non-deleted) user and
+// writes the response.
+func (app *application) adminUpdateUser(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.DeletedAt.Valid {
+		app.errorResponse(w, r, http.StatusConflict, "the user has been deleted and must be restored first")
+		return
+	}
+
+	err := app.models.User.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserTypeHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.adminReadOtherUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		UserType  string `json:"user_type"`
+		CompanyID *int64 `json:"company_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user.UserType = input.UserType
+	// A user who changes to a type that can't belong to a company leaves theirs,
+	// unless the admin says otherwise.
+	switch {
+	case input.CompanyID != nil:
+		user.CompanyID = *input.CompanyID
+	case !validator.In(user.UserType, data.UserTypePartner, data.UserTypeB2BClient):
+		user.CompanyID = 0
+	}
+
+	v := validator.New()
+	data.ValidateUserType(v, user.UserType)
+	data.ValidateUserCompany(v, user)
+	if !app.checkUserCompany(w, r, v, user) {
+		return
+	}
+
+	app.adminUpdateUser(w, r, user)
+}
+
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.adminReadOtherUser(w, r)
+	if user == nil {
+		return
+	}
+
+	user.Activated = false
+
+	// Log the user out everywhere.
+	err := app.models.Token.DeleteAllForUser(r.Context(), data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.adminUpdateUser(w, r, user)
+}
+
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.adminReadOtherUser(w, r)
+	if user == nil {
+		return
+	}
+
+	user.Activated = true
+
+	app.adminUpdateUser(w, r, user)
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.adminReadOtherUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.models.User.SoftDelete(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Token.DeleteAllForUser(r.Context(), data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.User.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.adminReadUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/concierge/service/internal/data"
+)
+
+// seedCompany creates a company called name.
+func seedCompany(t *testing.T, app *application, name string) *data.Company {
+	t.Helper()
+
+	company := &data.Company{Name: name, FullName: name + " LLP"}
+	err := app.models.Company.Insert(context.Background(), company)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return company
+}
+
+func TestInviteUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "client@example.com", "client", 0)
+	company := seedCompany(t, app, "Resto")
+
+	code, body := ts.newClient().do(http.MethodPost, "/v1/admin/users", `{}`)
+	wantStatus(t, code, body, http.StatusUnauthorized)
+	code, body = ts.loggedIn("client@example.com").do(http.MethodPost, "/v1/admin/users", `{}`)
+	wantStatus(t, code, body, http.StatusForbidden)
+
+	admin := ts.loggedIn("admin@example.com")
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"unknown type", `{"first_name":"C","last_name":"D","email":"c@example.com","username":"cd","user_type":"god"}`, http.StatusUnprocessableEntity},
+		{"partner without company", `{"first_name":"P","last_name":"Q","email":"p@example.com","username":"pq","user_type":"partner"}`, http.StatusUnprocessableEntity},
+		{"partner of unknown company", `{"first_name":"P","last_name":"Q","email":"p@example.com","username":"pq","user_type":"partner","company_id":99}`, http.StatusUnprocessableEntity},
+		{"client with company", `{"first_name":"P","last_name":"Q","email":"p@example.com","username":"pq","user_type":"client","company_id":1}`, http.StatusUnprocessableEntity},
+		{"client", `{"first_name":"C","last_name":"D","email":"c@example.com","username":"cd","user_type":"client"}`, http.StatusCreated},
+		{"duplicate email", `{"first_name":"C","last_name":"D","email":"c@example.com","username":"cd2","user_type":"client"}`, http.StatusUnprocessableEntity},
+		{"partner", `{"first_name":"P","last_name":"Q","email":"p@example.com","username":"pq","user_type":"partner","company_id":1}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := admin.do(http.MethodPost, "/v1/admin/users", tt.body)
+			wantStatus(t, code, body, tt.wantCode)
+		})
+	}
+
+	// Invited users can't log in until they have activated their account.
+	partner, err := app.models.User.GetByEmail(context.Background(), "p@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partner.Activated || partner.CompanyID != company.ID {
+		t.Errorf("got activated %t, company %d; want false, %d", partner.Activated, partner.CompanyID, company.ID)
+	}
+
+	// The open user creation endpoint of old is gone.
+	code, body = admin.do(http.MethodPost, "/debug", `{}`)
+	wantStatus(t, code, body, http.StatusNotFound)
+}
+
+func TestManageUsers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "bob@example.com", "client", 0)
+	seedUser(t, app, "carol@example.com", "b2bclient", 0)
+	admin := ts.loggedIn("admin@example.com")
+
+	code, body := admin.get("/v1/admin/users?search=bo&page_size=1")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"email":"bob@example.com"`, `"total_records":1`)
+
+	code, body = admin.get("/v1/admin/users?sort=-email&activated=true")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":3`)
+
+	code, body = admin.get("/v1/admin/users?sort=password&activated=maybe")
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	wantContains(t, body, `"sort"`, `"activated"`)
+
+	code, body = admin.do(http.MethodPut, "/v1/admin/users/2/type", `{"user_type":"csmanager"}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"user_type":"csmanager"`)
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/users/2/deactivate", "")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"activated":false`)
+
+	// Admins can't lock themselves out.
+	code, body = admin.do(http.MethodPost, "/v1/admin/users/1/deactivate", "")
+	wantStatus(t, code, body, http.StatusConflict)
+
+	code, body = admin.do(http.MethodDelete, "/v1/admin/users/3", "")
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.get("/v1/admin/users")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":2`)
+	code, body = admin.get("/v1/admin/users?deleted=true")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"email":"carol@example.com"`, `"total_records":1`)
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/users/3/restore", "")
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.do(http.MethodPost, "/v1/admin/users/3/restore", "")
+	wantStatus(t, code, body, http.StatusNotFound)
+}
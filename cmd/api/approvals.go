@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/document"
+	"github.com/concierge/service/internal/events"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The insertBooking() helper inserts a booking a client is making. Bookings of B2B
+// clients go through the spending controls of their company, see
+// data.ApprovalStore.InsertBooking(): if one needs approval, the approval is
+// returned and the approvers are mailed. Bookings of B2C clients never need
+// approval.
+func (app *application) insertBooking(ctx context.Context, client *data.User, booking *data.Booking) (*data.Approval, error) {
+	if client.CompanyID == 0 {
+		return nil, app.models.Booking.Insert(ctx, booking)
+	}
+
+	approval, err := app.models.Approval.InsertBooking(ctx, client, booking)
+	if err != nil {
+		return nil, err
+	}
+	if approval != nil {
+		app.emailApprovers(approval, client, booking)
+	}
+	return approval, nil
+}
+
+// The emailApprovers() helper mails the activated approvers of a company about an
+// approval, in the background. The client who made the booking isn't mailed, even
+// if they are an approver, as they can't approve their own bookings.
+func (app *application) emailApprovers(approval *data.Approval, client *data.User, booking *data.Booking) {
+	app.background(func() {
+		ctx := context.Background()
+
+		controls, err := app.models.Approval.Controls(ctx, approval.CompanyID)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"approval_id": fmt.Sprint(approval.ID)})
+			return
+		}
+
+		for _, id := range controls.ApproverIDs {
+			properties := map[string]string{"approval_id": fmt.Sprint(approval.ID), "user_id": fmt.Sprint(id)}
+
+			approver, err := app.models.User.Get(ctx, id)
+			if err != nil {
+				if !errors.Is(err, data.ErrRecordNotFound) {
+					app.logger.PrintError(err, properties)
+				}
+				continue
+			}
+			if !approver.Activated || approver.CompanyID != approval.CompanyID || approver.ID == client.ID {
+				continue
+			}
+
+			emailData := map[string]interface{}{
+				"firstName":    approver.FirstName,
+				"employeeName": client.FirstName + " " + client.LastName,
+				"approvalID":   approval.ID,
+				"bookingID":    booking.ID,
+				"date":         booking.StartsAt.UTC().Format("02 Jan 2006 15:04"),
+				"amount":       document.Money(approval.Amount),
+				"reasons":      approval.Reasons,
+			}
+			err = app.sendEmail(approver.Email, "approval_request.tmpl", emailData)
+			if err != nil {
+				app.logger.PrintError(err, properties)
+			}
+		}
+	})
+}
+
+// The awaitingApproval() helper reports whether a booking needs an approval it
+// hasn't been given yet.
+func (app *application) awaitingApproval(ctx context.Context, bookingID int64) (bool, error) {
+	approval, err := app.models.Approval.GetForBooking(ctx, bookingID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return approval.Status != data.ApprovalApproved, nil
+}
+
+// The listApprovals() helper writes a page of the approvals matching filter, with
+// the page and the status taken from the query string.
+func (app *application) listApprovals(w http.ResponseWriter, r *http.Request, filter data.ApprovalFilter) {
+	var input struct {
+		data.ApprovalFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.ApprovalFilter = filter
+	input.Status = app.readString(qs, "status", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = data.ApprovalSortSafelist
+
+	data.ValidateApprovalFilter(v, input.ApprovalFilter)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	approvals, metadata, err := app.models.Approval.List(r.Context(), input.ApprovalFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"approvals": approvals, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	filter := data.ApprovalFilter{CompanyID: int64(app.readInt(r.URL.Query(), "company_id", 0, v))}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.listApprovals(w, r, filter)
+}
+
+// The isApprover() helper reports whether the logged in B2B client approves the
+// bookings of their company, sending the appropriate error response and returning
+// false if they don't.
+func (app *application) isApprover(w http.ResponseWriter, r *http.Request) bool {
+	user := app.contextGetUser(r)
+
+	controls, err := app.models.Approval.Controls(r.Context(), user.CompanyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !controls.IsApprover(user.ID) {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+	return true
+}
+
+func (app *application) listCompanyApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.isApprover(w, r) {
+		return
+	}
+
+	app.listApprovals(w, r, data.ApprovalFilter{CompanyID: app.contextGetUser(r).CompanyID})
+}
+
+// The approverReadApproval() helper loads the approval identified by the "id" URL
+// parameter for one of the company's approvers, sending the appropriate error
+// response and returning nil if it can't. Other companies' approvals are reported
+// as not found.
+func (app *application) approverReadApproval(w http.ResponseWriter, r *http.Request) *data.Approval {
+	if !app.isApprover(w, r) {
+		return nil
+	}
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	approval, err := app.models.Approval.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	if approval.CompanyID != app.contextGetUser(r).CompanyID {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return approval
+}
+
+func (app *application) showApprovalHandler(w http.ResponseWriter, r *http.Request) {
+	approval := app.approverReadApproval(w, r)
+	if approval == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"approval": approval}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The decideApproval() helper approves or rejects a booking and writes the
+// response. Rejected bookings are cancelled, free of charge, and give their slot
+// back. The client who made the booking is mailed the decision.
+func (app *application) decideApproval(w http.ResponseWriter, r *http.Request, status string) {
+	approval := app.approverReadApproval(w, r)
+	if approval == nil {
+		return
+	}
+
+	var input struct {
+		Note string `json:"note"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The client has to know why their booking was turned down.
+	v := validator.New()
+	v.Check(status != data.ApprovalRejected || input.Note != "", "note", "must be provided")
+	v.Check(len(input.Note) <= 500, "note", "must not be more than 500 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	switch {
+	case approval.Status != data.ApprovalPending:
+		app.errorResponse(w, r, http.StatusConflict, "the booking has already been "+approval.Status)
+		return
+	case approval.RequestedByID == user.ID:
+		app.errorResponse(w, r, http.StatusForbidden, "you can't approve or reject your own bookings")
+		return
+	}
+
+	booking, err := app.models.Booking.Get(r.Context(), approval.BookingID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if booking.Cancelled() {
+		app.errorResponse(w, r, http.StatusConflict, "the booking has been cancelled")
+		return
+	}
+
+	reservation := booking.ReservationID
+	approval.Decide(status, user.ID, input.Note)
+	err = app.models.Approval.Decide(r.Context(), approval, booking)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if status == data.ApprovalRejected {
+		app.releaseSlot(r, reservation)
+		app.publishBooking(r, eventBookingUpdated, booking)
+	}
+
+	app.emailDecision(approval, user)
+	app.publish(eventApprovalDecided, envelope{"approval": approval}, events.Audience{
+		UserIDs:   []int64{approval.RequestedByID},
+		Concierge: true,
+	})
+	// Once approved, the booking is the partner's to accept.
+	if status == data.ApprovalApproved {
+		app.publishBooking(r, eventBookingUpdated, booking)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"approval": approval}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The emailDecision() helper mails the client who made a booking that it was
+// approved or rejected, in the background.
+func (app *application) emailDecision(approval *data.Approval, approver *data.User) {
+	app.background(func() {
+		properties := map[string]string{"approval_id": fmt.Sprint(approval.ID)}
+
+		client, err := app.models.User.Get(context.Background(), approval.RequestedByID)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, properties)
+			}
+			return
+		}
+
+		emailData := map[string]interface{}{
+			"firstName":    client.FirstName,
+			"bookingID":    approval.BookingID,
+			"amount":       document.Money(approval.Amount),
+			"status":       approval.Status,
+			"approverName": approver.FirstName + " " + approver.LastName,
+			"note":         approval.Note,
+			"rejected":     approval.Status == data.ApprovalRejected,
+		}
+		err = app.sendEmail(client.Email, "approval_decision.tmpl", emailData)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+	})
+}
+
+func (app *application) approveHandler(w http.ResponseWriter, r *http.Request) {
+	app.decideApproval(w, r, data.ApprovalApproved)
+}
+
+func (app *application) rejectHandler(w http.ResponseWriter, r *http.Request) {
+	app.decideApproval(w, r, data.ApprovalRejected)
+}
+
+// The showBudgetsHandler() shows a B2B client the budgets they spend against, their
+// company's and their own, with what was spent in a month: the current one, or the
+// one given as "month" in the query string, e.g. 2024-01.
+func (app *application) showBudgetsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	qs := r.URL.Query()
+
+	month := app.readString(qs, "month", time.Now().UTC().Format(data.InvoicePeriodLayout))
+	from, err := time.Parse(data.InvoicePeriodLayout, month)
+	if err != nil {
+		app.failedValidationResponse(w, r, map[string]string{"month": "must be a month in YYYY-MM format"})
+		return
+	}
+	from, to := data.BudgetMonth(from)
+
+	controls, err := app.models.Approval.Controls(r.Context(), user.CompanyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	uses := []data.BudgetUse{}
+	for _, budget := range controls.BudgetsFor(user.ID) {
+		spent, err := app.models.Approval.Spent(r.Context(), user.CompanyID, budget.UserID, from, to)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		uses = append(uses, data.BudgetUse{Budget: budget, Spent: spent})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"month": month, "budgets": uses}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadCompany() helper loads the company identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadCompany(w http.ResponseWriter, r *http.Request) *data.Company {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	company, err := app.models.Company.GetById(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return company
+}
+
+func (app *application) showSpendingControlsHandler(w http.ResponseWriter, r *http.Request) {
+	company := app.adminReadCompany(w, r)
+	if company == nil {
+		return
+	}
+
+	controls, err := app.models.Approval.Controls(r.Context(), company.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"spending_controls": controls}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateSpendingControlsHandler() replaces the budgets, approval rules and
+// approvers of a company. The employees given budgets or made approvers must be
+// B2B clients of the company.
+func (app *application) updateSpendingControlsHandler(w http.ResponseWriter, r *http.Request) {
+	company := app.adminReadCompany(w, r)
+	if company == nil {
+		return
+	}
+
+	var input struct {
+		Budgets     []*data.Budget       `json:"budgets"`
+		Rules       []*data.ApprovalRule `json:"rules"`
+		ApproverIDs []int64              `json:"approver_ids"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	controls := &data.SpendingControls{
+		CompanyID:   company.ID,
+		Budgets:     input.Budgets,
+		Rules:       input.Rules,
+		ApproverIDs: input.ApproverIDs,
+	}
+	if controls.Budgets == nil {
+		controls.Budgets = []*data.Budget{}
+	}
+	if controls.Rules == nil {
+		controls.Rules = []*data.ApprovalRule{}
+	}
+	if controls.ApproverIDs == nil {
+		controls.ApproverIDs = []int64{}
+	}
+
+	v := validator.New()
+	if data.ValidateSpendingControls(v, controls); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	employee := func(key string, id int64) bool {
+		user, err := app.models.User.Get(r.Context(), id)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError(key, "does not exist")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return false
+		default:
+			v.Check(user.UserType == data.UserTypeB2BClient && user.CompanyID == company.ID, key, "must be a B2B client of the company")
+		}
+		return true
+	}
+	for i, budget := range controls.Budgets {
+		if budget.UserID != 0 && !employee(fmt.Sprintf("budgets[%d].user_id", i), budget.UserID) {
+			return
+		}
+	}
+	for _, id := range controls.ApproverIDs {
+		if !employee("approver_ids", id) {
+			return
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Approval.SetControls(r.Context(), controls)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	controls, err = app.models.Approval.Controls(r.Context(), company.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"spending_controls": controls}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestApprovals(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	acme := seedCompany(t, app, "Acme")
+	resto := seedCompany(t, app, "Resto")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	employee := seedUser(t, app, "employee@example.com", "b2bclient", acme.ID)
+	approver := seedUser(t, app, "approver@example.com", "b2bclient", acme.ID)
+	outsider := seedUser(t, app, "outsider@example.com", "b2bclient", 0)
+	seedUser(t, app, "partner@example.com", "partner", resto.ID)
+	seedService(t, app, resto, map[string]int{"b2bclient": 1000})
+	seedRequest(t, app, employee)
+	admin := ts.loggedIn("admin@example.com")
+	emp := ts.loggedIn("employee@example.com")
+	appr := ts.loggedIn("approver@example.com")
+	partner := ts.loggedIn("partner@example.com")
+
+	code, body := admin.do(http.MethodPut, "/v1/admin/companies/1/spending-controls", fmt.Sprintf(`{"approver_ids":[%d]}`, outsider.ID))
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	controls := fmt.Sprintf(`{
+		"budgets":[{"monthly_limit":5000},{"user_id":%d,"monthly_limit":3000}],
+		"rules":[{"kind":"amount_above","threshold":1500},{"kind":"over_budget"}],
+		"approver_ids":[%d]
+	}`, employee.ID, approver.ID)
+	code, body = admin.do(http.MethodPut, "/v1/admin/companies/1/spending-controls", controls)
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.get("/v1/admin/companies/1/spending-controls")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"threshold":1500`)
+
+	window := bookingWindow(time.Now().Add(48 * time.Hour))
+	book := func(quantity int) (int, string) {
+		return emp.do(http.MethodPost, "/v1/requests/1/bookings", fmt.Sprintf(`{"service_id":1,"quantity":%d,%s}`, quantity, window))
+	}
+
+	code, body = book(1)
+	wantStatus(t, code, body, http.StatusCreated)
+	code, body = book(2)
+	wantStatus(t, code, body, http.StatusCreated)
+	wantContains(t, body, "more than 1500")
+	// 1000 more takes the employee to 4000 of a 3000 budget.
+	code, body = book(1)
+	wantStatus(t, code, body, http.StatusCreated)
+	wantContains(t, body, "budget")
+
+	code, body = emp.get("/v1/budgets")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"spent":4000`)
+	code, body = emp.get("/v1/approvals")
+	wantStatus(t, code, body, http.StatusForbidden)
+	code, body = appr.get("/v1/approvals?status=pending")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":2`)
+
+	// The partner doesn't see a booking, let alone act on it, until it is approved.
+	code, body = partner.get("/v1/partner/bookings")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`)
+	code, body = partner.get("/v1/partner/bookings/2")
+	wantStatus(t, code, body, http.StatusNotFound)
+	code, body = partner.do(http.MethodPost, "/v1/partner/bookings/2/accept", "")
+	wantStatus(t, code, body, http.StatusNotFound)
+
+	code, body = appr.do(http.MethodPost, "/v1/approvals/1/reject", `{}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	code, body = appr.do(http.MethodPost, "/v1/approvals/1/approve", `{"note":"ok"}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"approved"`)
+	code, body = appr.do(http.MethodPost, "/v1/approvals/1/approve", `{}`)
+	wantStatus(t, code, body, http.StatusConflict)
+	code, body = partner.do(http.MethodPost, "/v1/partner/bookings/2/accept", "")
+	wantStatus(t, code, body, http.StatusOK)
+
+	code, body = appr.do(http.MethodPost, "/v1/approvals/2/reject", `{"note":"too much"}`)
+	wantStatus(t, code, body, http.StatusOK)
+	booking, err := app.models.Booking.Get(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !booking.Cancelled() {
+		t.Error("the booking of a rejected approval isn't cancelled")
+	}
+	code, body = partner.get("/v1/partner/bookings")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":2`)
+	code, body = partner.get("/v1/partner/bookings/3")
+	wantStatus(t, code, body, http.StatusNotFound)
+	code, body = admin.get("/v1/admin/approvals?company_id=1&status=rejected")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`)
+
+	// A booking cancelled while waiting for approval can't be approved any more.
+	code, body = book(2)
+	wantStatus(t, code, body, http.StatusCreated)
+	code, body = emp.do(http.MethodPost, "/v1/bookings/4/cancel", `{"reason":"plans changed"}`)
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = appr.do(http.MethodPost, "/v1/approvals/3/approve", `{}`)
+	wantStatus(t, code, body, http.StatusConflict)
+	code, body = admin.get("/v1/admin/approvals?company_id=1&status=withdrawn")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`)
+
+	// Without an over_budget rule, going over the budget is refused outright.
+	code, body = admin.do(http.MethodPut, "/v1/admin/companies/1/spending-controls", `{"budgets":[{"monthly_limit":3500}]}`)
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = book(1)
+	wantStatus(t, code, body, http.StatusConflict)
+}
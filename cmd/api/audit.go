@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The clientIP() helper returns the IP address of the client that sent the request,
+// without the port.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// The listAuditLogHandler() lets an admin search the audit log by actor, entity and
+// time range, e.g. GET /v1/admin/audit?entity_type=price&entity_id=7&from=2024-01-01T00:00:00Z
+// The log is best effort: a change whose entry couldn't be written is missing
+// from it, and logged as an error instead.
+func (app *application) listAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+	input.EntityType = app.readString(qs, "entity_type", "")
+	input.EntityID = int64(app.readInt(qs, "entity_id", 0, v))
+	input.Action = app.readString(qs, "action", "")
+	input.From = app.readTime(qs, "from", v)
+	input.To = app.readTime(qs, "to", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = data.AuditSortSafelist
+
+	data.ValidateAuditFilter(v, input.AuditFilter)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.Audit.List(r.Context(), input.AuditFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_log": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
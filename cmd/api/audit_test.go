@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "bob@example.com", "client", 0)
+	seedUser(t, app, "cs@example.com", "csmanager", 0)
+	admin := ts.loggedIn("admin@example.com")
+
+	code, body := admin.do(http.MethodPut, "/v1/admin/users/2/type", `{"user_type":"b2bclient"}`)
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.do(http.MethodDelete, "/v1/admin/users/2", "")
+	wantStatus(t, code, body, http.StatusOK)
+
+	code, body = admin.get("/v1/admin/audit?actor_id=1&entity_type=user&action=update&from=2000-01-01T00:00:00Z")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`, `"actor_id":1`, `"entity_id":2`, `"user_type":{"before":"client","after":"b2bclient"}`)
+
+	code, body = admin.get("/v1/admin/audit?entity_type=user&action=delete")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`)
+
+	code, body = admin.get("/v1/admin/audit?entity_type=spaceship&from=yesterday")
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	wantContains(t, body, `"entity_type"`, `"from"`)
+
+	code, body = ts.loggedIn("cs@example.com").get("/v1/admin/audit")
+	wantStatus(t, code, body, http.StatusForbidden)
+}
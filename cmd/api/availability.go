@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The reserveSlot() helper reserves the capacity a booking needs in the slot of its
+// service matching the booking's window, returning the ID of the reservation. A
+// service without a schedule has no capacity limit, so nothing is reserved and
+// the ID is 0.
+func (app *application) reserveSlot(ctx context.Context, booking *data.Booking) (int64, error) {
+	schedule, err := app.models.Availability.GetSchedule(ctx, booking.ServiceID)
+	if err != nil {
+		return 0, err
+	}
+	if schedule.Empty() {
+		return 0, nil
+	}
+
+	slot, ok := schedule.SlotAt(booking.StartsAt, booking.EndsAt)
+	if !ok {
+		return 0, data.ErrNoSlot
+	}
+
+	reservation, err := app.models.Availability.Reserve(ctx, booking.ServiceID, slot, booking.Quantity)
+	if err != nil {
+		return 0, err
+	}
+	return reservation.ID, nil
+}
+
+// The releaseSlot() helper gives back the capacity held by a reservation. It is
+// called once the booking no longer refers to the reservation, so a failure only
+// leaves the capacity taken and is logged rather than reported to the client.
+func (app *application) releaseSlot(r *http.Request, reservationID int64) {
+	if reservationID == 0 {
+		return
+	}
+	err := app.models.Availability.Release(r.Context(), reservationID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"reservation_id": fmt.Sprint(reservationID),
+		})
+	}
+}
+
+// The slotErrorResponse() helper sends the response for an error returned by
+// reserveSlot().
+func (app *application) slotErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, data.ErrNoSlot):
+		v := validator.New()
+		v.AddError("starts_at", "must be the start of a slot of the service, see its free slots")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrSlotUnavailable):
+		app.errorResponse(w, r, http.StatusConflict, err.Error())
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showServiceSlotsHandler() lists the slots of a service with capacity left
+// between two dates, both included, at most 31 days apart. Without dates it shows
+// the coming week. Dates are those of the time zone of the service's schedule.
+// Services without a schedule have no slots: they can be booked for any time.
+func (app *application) showServiceSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	service, err := app.models.Service.GetById(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	schedule, err := app.models.Availability.GetSchedule(r.Context(), service.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	loc := schedule.Location()
+	now := time.Now().In(loc)
+	from := app.readDate(qs, "from", data.StartOfDay(now), v)
+	to := app.readDate(qs, "to", from.AddDate(0, 0, 6), v)
+
+	v.Check(!to.Before(from), "to", "must not be before from")
+	v.Check(to.Sub(from) <= 30*24*time.Hour, "to", "must not be more than 31 days after from")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// readDate() gives midnight UTC, the dates are meant in the schedule's time zone.
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+	// Slots that have already started can't be booked any more.
+	if from.Before(now) {
+		from = now
+	}
+
+	reservations, err := app.models.Availability.Reservations(r.Context(), service.ID, from, to)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	slots := []data.Slot{}
+	if from.Before(to) {
+		slots = data.FreeSlots(schedule, reservations, from, to)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"slots": slots}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showSchedule() helper writes the schedule of a service.
+func (app *application) showSchedule(w http.ResponseWriter, r *http.Request, service *data.Service) {
+	schedule, err := app.models.Availability.GetSchedule(r.Context(), service.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"schedule": schedule}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateSchedule() helper replaces the schedule of a service with the one in
+// the request body. Both lists are replaced as a whole; sending two empty lists
+// removes the capacity limit of the service. The time zone is kept unless the body
+// names another one.
+func (app *application) updateSchedule(w http.ResponseWriter, r *http.Request, service *data.Service) {
+	var input struct {
+		TimeZone   *string                     `json:"time_zone"`
+		Windows    data.WeeklyWindows          `json:"windows"`
+		Exceptions data.AvailabilityExceptions `json:"exceptions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	current, err := app.models.Availability.GetSchedule(r.Context(), service.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	schedule := &data.Schedule{
+		ServiceID:  service.ID,
+		TimeZone:   current.TimeZone,
+		Windows:    input.Windows,
+		Exceptions: input.Exceptions,
+	}
+	if input.TimeZone != nil {
+		schedule.TimeZone = *input.TimeZone
+	}
+	if schedule.Windows == nil {
+		schedule.Windows = data.WeeklyWindows{}
+	}
+	if schedule.Exceptions == nil {
+		schedule.Exceptions = data.AvailabilityExceptions{}
+	}
+
+	v := validator.New()
+	if data.ValidateSchedule(v, schedule); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Availability.SetSchedule(r.Context(), schedule)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"schedule": schedule}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadService() helper loads the service identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadService(w http.ResponseWriter, r *http.Request) *data.Service {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	service, err := app.models.Service.GetById(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return service
+}
+
+// The partnerReadService() helper is adminReadService() for partners: services of
+// other companies are reported as not found.
+func (app *application) partnerReadService(w http.ResponseWriter, r *http.Request) *data.Service {
+	service := app.adminReadService(w, r)
+	if service == nil {
+		return nil
+	}
+	if int64(service.CompanyID) != app.contextGetUser(r).CompanyID {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return service
+}
+
+func (app *application) showScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	service := app.adminReadService(w, r)
+	if service == nil {
+		return
+	}
+
+	app.showSchedule(w, r, service)
+}
+
+func (app *application) updateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	service := app.adminReadService(w, r)
+	if service == nil {
+		return
+	}
+
+	app.updateSchedule(w, r, service)
+}
+
+func (app *application) showPartnerScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	service := app.partnerReadService(w, r)
+	if service == nil {
+		return
+	}
+
+	app.showSchedule(w, r, service)
+}
+
+// The updatePartnerScheduleHandler() lets partners manage the availability of their
+// services themselves: unlike descriptions and prices (see
+// proposeServiceChangeHandler()) it changes too often to go through approval.
+func (app *application) updatePartnerScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	service := app.partnerReadService(w, r)
+	if service == nil {
+		return
+	}
+
+	app.updateSchedule(w, r, service)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityAndSlots(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	resto := seedCompany(t, app, "Resto")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "partner@example.com", "partner", resto.ID)
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	seedService(t, app, resto, map[string]int{"client": 100})
+	seedRequest(t, app, alice)
+	admin := ts.loggedIn("admin@example.com")
+	client := ts.loggedIn("client@example.com")
+
+	code, body := admin.do(http.MethodPut, "/v1/admin/services/1/availability", `{"windows":[{"weekday":1,"start":"19:00","end":"18:00","slot_minutes":60,"capacity":1}]}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	code, body = admin.do(http.MethodPut, "/v1/admin/services/1/availability", `{"windows":[{"weekday":1,"start":"9:00","end":"18:00","slot_minutes":60,"capacity":1}]}`)
+	wantStatus(t, code, body, http.StatusBadRequest)
+	code, body = admin.do(http.MethodPut, "/v1/admin/services/1/availability", `{"time_zone":"Mars/Olympus_Mons","windows":[]}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	wantContains(t, body, `"time_zone"`)
+
+	// Two two-hour slots every evening, for two parties each, but closed on the
+	// day after day.
+	var windows []string
+	for weekday := 0; weekday < 7; weekday++ {
+		windows = append(windows, fmt.Sprintf(`{"weekday":%d,"start":"18:00","end":"22:00","slot_minutes":120,"capacity":2}`, weekday))
+	}
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 5)
+	schedule := fmt.Sprintf(`{"windows":[%s],"exceptions":[{"date":%q,"windows":[]}]}`, strings.Join(windows, ","), day.AddDate(0, 0, 1).Format("2006-01-02"))
+	code, body = admin.do(http.MethodPut, "/v1/admin/services/1/availability", schedule)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"start":"18:00"`, `"time_zone":"UTC"`)
+
+	slots := fmt.Sprintf("/v1/services/1/slots?from=%s&to=%s", day.Format("2006-01-02"), day.AddDate(0, 0, 1).Format("2006-01-02"))
+	wantSlots := func(n int) string {
+		t.Helper()
+		code, body := client.get(slots)
+		wantStatus(t, code, body, http.StatusOK)
+		if got := strings.Count(body, "starts_at"); got != n {
+			t.Fatalf("got %d free slots; want %d: %s", got, n, body)
+		}
+		return body
+	}
+	wantSlots(2)
+	code, body = client.get("/v1/services/1/slots?from=2030-01-01&to=2030-03-01")
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+
+	first := day.Add(18 * time.Hour)
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"not a slot", fmt.Sprintf(`{"service_id":1,%s}`, bookingWindow(first.Add(time.Hour))), http.StatusUnprocessableEntity},
+		{"more than the capacity", fmt.Sprintf(`{"service_id":1,"quantity":3,%s}`, bookingWindow(first)), http.StatusConflict},
+		{"the whole slot", fmt.Sprintf(`{"service_id":1,"quantity":2,%s}`, bookingWindow(first)), http.StatusCreated},
+		{"a full slot", fmt.Sprintf(`{"service_id":1,%s}`, bookingWindow(first)), http.StatusConflict},
+		{"a closed day", fmt.Sprintf(`{"service_id":1,%s}`, bookingWindow(first.AddDate(0, 0, 1))), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := client.do(http.MethodPost, "/v1/requests/1/bookings", tt.body)
+			wantStatus(t, code, body, tt.wantCode)
+		})
+	}
+	wantSlots(1)
+
+	// Moving the booking frees its old slot.
+	code, body = client.do(http.MethodPut, "/v1/bookings/1/schedule", "{"+bookingWindow(first.Add(2*time.Hour))+"}")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, wantSlots(1), first.Format(time.RFC3339))
+
+	// Cancelling it frees the new one.
+	code, body = client.do(http.MethodPost, "/v1/bookings/1/cancel", `{}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, wantSlots(2), `"available":2`)
+
+	// Partners manage the schedules of their own services.
+	code, body = ts.loggedIn("partner@example.com").do(http.MethodPut, "/v1/partner/services/1/availability", `{"windows":[]}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"exceptions":[]`)
+
+	// Windows are on the wall clock of the schedule's time zone, which is kept until
+	// another one is named.
+	code, body = admin.do(http.MethodPut, "/v1/admin/services/1/availability", `{"time_zone":"Asia/Tokyo","windows":[]}`)
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.do(http.MethodPut, "/v1/admin/services/1/availability", `{"windows":[`+strings.Join(windows, ",")+`]}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"time_zone":"Asia/Tokyo"`)
+	tokyo := time.FixedZone("JST", 9*60*60)
+	wantContains(t, wantSlots(4), time.Date(day.Year(), day.Month(), day.Day(), 18, 0, 0, 0, tokyo).Format(time.RFC3339))
+
+	code, body = admin.get("/v1/admin/audit?entity_type=availability")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":4`)
+}
@@ -1,29 +1,9 @@
 package main
 
 import (
-	"html/template"
 	"net/http"
 )
 
 func (app *application) B2CClientPageHandler(w http.ResponseWriter, r *http.Request) {
-	files := []string{
-		"./ui/pages/b2c/client-page.html",
-	}
-
-	ts, err := template.ParseFiles(files...)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Use the ExecuteTemplate() method to write the content of the "base"
-	// template as the response body.
-
-	// The last parameter to Execute() represents any dynamic data that we
-	// want to pass in, which for now we'll leave as nil.
-	//err = ts.ExecuteTemplate(w, "base", "smth smth smth smth data")
-	err = ts.Execute(w, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	app.render(w, r, http.StatusOK, "b2c.html", app.newTemplateData(r))
 }
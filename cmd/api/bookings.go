@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The bookService() helper books the service given in the request body for a
+// client's request and writes the response. The price is resolved for the type of
+// the client the request was made by and copied into the booking. If the service
+// has a schedule, the booking must be for one of its slots and takes Quantity
+// units of its capacity.
+func (app *application) bookService(w http.ResponseWriter, r *http.Request, request *data.Request) {
+	var input struct {
+		ServiceID int64     `json:"service_id"`
+		Quantity  int       `json:"quantity"`
+		PartySize int       `json:"party_size"`
+		StartsAt  time.Time `json:"starts_at"`
+		EndsAt    time.Time `json:"ends_at"`
+	}
+	input.Quantity = 1
+	input.PartySize = 1
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	booking := &data.Booking{
+		RequestID:        request.ID,
+		ServiceID:        input.ServiceID,
+		Quantity:         input.Quantity,
+		PartySize:        input.PartySize,
+		StartsAt:         input.StartsAt,
+		EndsAt:           input.EndsAt,
+		PartnerStatus:    data.PartnerStatusPending,
+		FulfilmentStatus: data.FulfilmentNotStarted,
+	}
+
+	v := validator.New()
+	v.Check(input.ServiceID > 0, "service_id", "must be provided")
+	if data.ValidateBooking(v, booking); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Service.GetById(r.Context(), input.ServiceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("service_id", "must refer to an existing service")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The client may have been deleted since making the request; what they were
+	// charged still depends on who they were.
+	client, err := app.models.User.Get(data.ContextWithDeleted(r.Context()), request.ClientID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	prices, err := app.models.Price.GetByServiceId(r.Context(), input.ServiceID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	priced := false
+	for _, price := range prices {
+		if price.UserType == client.UserType {
+			booking.UnitPrice = price.Price
+			priced = true
+			break
+		}
+	}
+	if !priced {
+		v.AddError("service_id", "is not offered to this client")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	sub, err := app.subscriptionFor(r.Context(), client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if sub != nil {
+		booking.UnitPrice = sub.Plan.DiscountedPrice(booking.UnitPrice)
+	}
+
+	booking.ReservationID, err = app.reserveSlot(r.Context(), booking)
+	if err != nil {
+		app.slotErrorResponse(w, r, err)
+		return
+	}
+
+	approval, err := app.insertBooking(r.Context(), client, booking)
+	if err != nil {
+		app.releaseSlot(r, booking.ReservationID)
+		switch {
+		case errors.Is(err, data.ErrOverBudget):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.publishBooking(r, eventBookingCreated, booking)
+
+	response := envelope{"booking": booking}
+	if approval != nil {
+		response["approval"] = approval
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, response, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listBookings() helper writes a page of the bookings made for a request, with
+// the page taken from the query string.
+func (app *application) listBookings(w http.ResponseWriter, r *http.Request, request *data.Request) {
+	var input struct {
+		data.BookingFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.RequestID = request.ID
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = data.BookingSortSafelist
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bookings, metadata, err := app.models.Booking.List(r.Context(), input.BookingFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"bookings": bookings, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateBooking() helper saves the changes made to a booking and publishes
+// them, sending the appropriate error response and returning false if it can't.
+func (app *application) updateBooking(w http.ResponseWriter, r *http.Request, booking *data.Booking) bool {
+	err := app.models.Booking.Update(r.Context(), booking)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	app.publishBooking(r, eventBookingUpdated, booking)
+	return true
+}
+
+// The rescheduleBooking() helper moves a booking to the window given in the request
+// body. Clients can't move a booking that starts within the free cancellation
+// notice; admins can, as they agree the new time with the partner themselves.
+func (app *application) rescheduleBooking(w http.ResponseWriter, r *http.Request, booking *data.Booking, byAdmin bool) {
+	var input struct {
+		StartsAt time.Time `json:"starts_at"`
+		EndsAt   time.Time `json:"ends_at"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateBookingWindow(v, input.StartsAt, input.EndsAt); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := time.Now()
+	err = booking.CheckChangeable(now)
+	if err == nil && !byAdmin && booking.WithinNotice(now) {
+		err = data.ErrBookingTooLate
+	}
+	if err != nil {
+		app.errorResponse(w, r, http.StatusConflict, err.Error())
+		return
+	}
+
+	// The new slot is reserved before the old one is given back, so that a failed
+	// move leaves the booking where it was.
+	previous := booking.ReservationID
+	moved := !input.StartsAt.Equal(booking.StartsAt) || !input.EndsAt.Equal(booking.EndsAt)
+	booking.Reschedule(input.StartsAt, input.EndsAt)
+	if moved || previous == 0 {
+		booking.ReservationID, err = app.reserveSlot(r.Context(), booking)
+		if err != nil {
+			app.slotErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !app.updateBooking(w, r, booking) {
+		if booking.ReservationID != previous {
+			app.releaseSlot(r, booking.ReservationID)
+		}
+		return
+	}
+	if booking.ReservationID != previous {
+		app.releaseSlot(r, previous)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"booking": booking}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The cancelBooking() helper cancels a booking. A client cancelling late is charged
+// the fee worked out by data.Booking.CancellationFeeAt(); admins cancel for free.
+func (app *application) cancelBooking(w http.ResponseWriter, r *http.Request, booking *data.Booking, byAdmin bool) {
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := time.Now()
+	if err := booking.CheckChangeable(now); err != nil {
+		app.errorResponse(w, r, http.StatusConflict, err.Error())
+		return
+	}
+
+	fee := 0
+	if !byAdmin {
+		fee = booking.CancellationFeeAt(now)
+	}
+	// A booking still waiting for approval has its approval withdrawn with it.
+	reservation := booking.ReservationID
+	_, err = app.models.Approval.CancelBooking(r.Context(), booking, input.Reason, fee)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.publishBooking(r, eventBookingUpdated, booking)
+	app.releaseSlot(r, reservation)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"booking": booking}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadRequest() helper loads the request identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadRequest(w http.ResponseWriter, r *http.Request) *data.Request {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	request, err := app.models.Request.GetByRequestID(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return request
+}
+
+// The adminReadBooking() helper loads the booking identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadBooking(w http.ResponseWriter, r *http.Request) *data.Booking {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	booking, err := app.models.Booking.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return booking
+}
+
+// The createBookingHandler() books a catalog service for a client's request. The
+// partner company providing the service then sees the booking in their cabinet
+// and accepts or declines it.
+func (app *application) createBookingHandler(w http.ResponseWriter, r *http.Request) {
+	request := app.adminReadRequest(w, r)
+	if request == nil {
+		return
+	}
+
+	app.bookService(w, r, request)
+}
+
+// The listRequestBookingsHandler() shows the admin the bookings made for a request
+// and how far each partner is with theirs.
+func (app *application) listRequestBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	request := app.adminReadRequest(w, r)
+	if request == nil {
+		return
+	}
+
+	app.listBookings(w, r, request)
+}
+
+func (app *application) adminRescheduleBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.adminReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	app.rescheduleBooking(w, r, booking, true)
+}
+
+func (app *application) adminCancelBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.adminReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	app.cancelBooking(w, r, booking, true)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+)
+
+// bookingWindow returns the "starts_at" and "ends_at" fields of a two-hour booking
+// starting at start.
+func bookingWindow(start time.Time) string {
+	return fmt.Sprintf(`"starts_at":%q,"ends_at":%q`, start.Format(time.RFC3339), start.Add(2*time.Hour).Format(time.RFC3339))
+}
+
+func TestClientRequests(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "client@example.com", "client", 0)
+	seedUser(t, app, "other@example.com", "b2bclient", 0)
+	client := ts.loggedIn("client@example.com")
+
+	code, body := ts.loggedIn("admin@example.com").get("/v1/requests")
+	wantStatus(t, code, body, http.StatusForbidden)
+
+	code, body = client.do(http.MethodPost, "/v1/requests", `{"type":""}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	code, body = client.do(http.MethodPost, "/v1/requests", `{"type":"dinner","description":"A table for two"}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	wantContains(t, body, `"status":"new"`)
+
+	code, body = client.get("/v1/requests")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"description":"A table for two"`)
+	code, body = client.get("/v1/requests/1")
+	wantStatus(t, code, body, http.StatusOK)
+
+	code, body = ts.loggedIn("other@example.com").get("/v1/requests/1")
+	wantStatus(t, code, body, http.StatusNotFound)
+}
+
+func TestClientBookings(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	ctx := context.Background()
+	resto := seedCompany(t, app, "Resto")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	bob := seedUser(t, app, "b2b@example.com", "b2bclient", 0)
+	dinner := seedService(t, app, resto, map[string]int{"client": 100})
+	request := seedRequest(t, app, alice)
+	seedRequest(t, app, bob)
+	admin := ts.loggedIn("admin@example.com")
+	client := ts.loggedIn("client@example.com")
+	b2b := ts.loggedIn("b2b@example.com")
+	start := time.Now().Add(72 * time.Hour).UTC().Truncate(time.Second)
+
+	// The service has no price for B2B clients.
+	code, body := b2b.do(http.MethodPost, "/v1/requests/2/bookings", fmt.Sprintf(`{"service_id":%d,%s}`, dinner.ID, bookingWindow(start)))
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	wantContains(t, body, "not offered")
+
+	code, body = client.do(http.MethodPost, "/v1/requests/1/bookings", fmt.Sprintf(`{"service_id":%d,"starts_at":"2000-01-01T00:00:00Z","ends_at":"1999-01-01T00:00:00Z"}`, dinner.ID))
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+
+	code, body = client.do(http.MethodPost, "/v1/requests/1/bookings", fmt.Sprintf(`{"service_id":%d,"quantity":2,"party_size":4,%s}`, dinner.ID, bookingWindow(start)))
+	wantStatus(t, code, body, http.StatusCreated)
+	wantContains(t, body, `"unit_price":100`, `"partner_status":"pending"`)
+
+	// The booking keeps the price it was made at.
+	prices, err := app.models.Price.GetByServiceId(ctx, dinner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices[0].Price = 500
+	err = app.models.Price.Update(ctx, prices[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body = client.get("/v1/bookings/1")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"unit_price":100`)
+	code, body = b2b.get("/v1/bookings/1")
+	wantStatus(t, code, body, http.StatusNotFound)
+
+	// Moving an accepted booking needs the partner to accept it again.
+	booking, err := app.models.Booking.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	booking.PartnerStatus = data.PartnerStatusAccepted
+	err = app.models.Booking.Update(ctx, booking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body = client.do(http.MethodPut, "/v1/bookings/1/schedule", "{"+bookingWindow(start.Add(24*time.Hour))+"}")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"partner_status":"pending"`)
+
+	// Within the notice period, clients can't move an accepted booking and pay a
+	// fee to cancel it: half of 2 x 100.
+	booking, err = app.models.Booking.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	booking.StartsAt = time.Now().Add(2 * time.Hour)
+	booking.PartnerStatus = data.PartnerStatusAccepted
+	err = app.models.Booking.Update(ctx, booking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body = client.do(http.MethodPut, "/v1/bookings/1/schedule", "{"+bookingWindow(start)+"}")
+	wantStatus(t, code, body, http.StatusConflict)
+	code, body = client.do(http.MethodPost, "/v1/bookings/1/cancel", `{"reason":"sick"}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"cancellation_fee":100`)
+	code, body = client.do(http.MethodPost, "/v1/bookings/1/cancel", `{}`)
+	wantStatus(t, code, body, http.StatusConflict)
+	code, body = admin.do(http.MethodPut, "/v1/admin/bookings/1/schedule", "{"+bookingWindow(start)+"}")
+	wantStatus(t, code, body, http.StatusConflict)
+
+	// Admins cancel for free, at the current price.
+	code, body = admin.do(http.MethodPost, fmt.Sprintf("/v1/admin/requests/%d/bookings", request.ID), fmt.Sprintf(`{"service_id":%d,%s}`, dinner.ID, bookingWindow(start)))
+	wantStatus(t, code, body, http.StatusCreated)
+	code, body = admin.do(http.MethodPost, "/v1/admin/bookings/2/cancel", `{}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"cancellation_fee":0`, `"unit_price":500`)
+
+	code, body = client.get("/v1/requests/1/bookings?sort=-starts_at")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":2`)
+}
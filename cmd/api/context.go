@@ -14,6 +14,14 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// requestIDContextKey is the key for the correlation ID assigned to every request by
+// the requestID() middleware.
+const requestIDContextKey = contextKey("request_id")
+
+// csrfTokenContextKey is the key for the CSRF token set by the csrfProtect()
+// middleware.
+const csrfTokenContextKey = contextKey("csrf_token")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -38,3 +46,35 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetRequestID() method returns a new copy of the request with the given
+// correlation ID added to the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() method retrieves the correlation ID from the request
+// context, returning an empty string if the requestID() middleware hasn't run.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, ok := r.Context().Value(requestIDContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+func (app *application) contextSetCSRFToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), csrfTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetCSRFToken() method returns the CSRF token for the forms on the page,
+// or an empty string outside of csrfProtect().
+func (app *application) contextGetCSRFToken(r *http.Request) string {
+	token, ok := r.Context().Value(csrfTokenContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return token
+}
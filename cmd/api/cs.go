@@ -1 +1,9 @@
 package main
+
+import (
+	"net/http"
+)
+
+func (app *application) CSPageHandler(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, http.StatusOK, "cs.html", app.newTemplateData(r))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// CSRF protection for the HTML forms uses the double submit pattern: the browser
+// gets a random token in a cookie, pages put the same token in a hidden form field
+// (or scripts in the X-CSRF-Token header), and state-changing requests are only
+// accepted when the two match. Another site can make the browser send the cookie,
+// but it can't read it to fill in the field.
+const (
+	csrfCookieName = "csrf_token"
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfTokenBytes = 32
+)
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, csrfTokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validCSRFToken(token string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(b) == csrfTokenBytes
+}
+
+// setCSRFCookie hands the browser a new token. The cookie is a session cookie, so
+// the token goes away with the browser session.
+func (app *application) setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   app.cookieSecure(),
+		SameSite: app.config.cookie.sameSite,
+	})
+}
+
+// The csrfProtect() middleware guards the HTML routes. Every request gets a token in
+// its context for the templates to render, and POST, PUT, PATCH and DELETE requests
+// are rejected unless they send back the token from the cookie.
+func (app *application) csrfProtect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Cookie")
+
+		var token string
+		if cookie, err := r.Cookie(csrfCookieName); err == nil && validCSRFToken(cookie.Value) {
+			token = cookie.Value
+		} else {
+			token, err = newCSRFToken()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.setCSRFCookie(w, token)
+		}
+
+		r = app.contextSetCSRFToken(r, token)
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		default:
+			sent := r.Header.Get(csrfHeaderName)
+			if sent == "" {
+				sent = r.PostFormValue(csrfFieldName)
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				app.invalidCSRFTokenResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// renewCSRFToken replaces the token on login, so that a token planted before the
+// user authenticated can't be used afterwards.
+func (app *application) renewCSRFToken(w http.ResponseWriter) error {
+	token, err := newCSRFToken()
+	if err != nil {
+		return err
+	}
+	app.setCSRFCookie(w, token)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoginCSRF(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+
+	c := ts.newClient()
+	form := url.Values{"emailD": {"admin@example.com"}, "passwordD": {testPassword}}
+
+	post := func(form url.Values, headers ...string) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/login", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		code, _, _ := c.send(req)
+		return code
+	}
+
+	if code := post(form); code != http.StatusForbidden {
+		t.Errorf("without a token: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	// The landing page renders the token it set in the cookie.
+	code, body := c.get("/")
+	wantStatus(t, code, body, http.StatusOK)
+	token := c.cookie(csrfCookieName)
+	wantContains(t, body, `name="csrf_token" value="`+token+`"`)
+
+	wrong := url.Values{"csrf_token": {token + "x"}}
+	for k, v := range form {
+		wrong[k] = v
+	}
+	if code := post(wrong); code != http.StatusForbidden {
+		t.Errorf("with a wrong token: got %d; want %d", code, http.StatusForbidden)
+	}
+
+	sessionID := c.cookie(sessionCookieName)
+	if code := post(form, "X-CSRF-Token", token); code != http.StatusSeeOther {
+		t.Fatalf("with the token in a header: got %d; want %d", code, http.StatusSeeOther)
+	}
+
+	// Logging in rotates both the session ID and the CSRF token.
+	if c.cookie(sessionCookieName) == sessionID || c.cookie(csrfCookieName) == token {
+		t.Error("the session ID or the CSRF token wasn't rotated on login")
+	}
+	code, body = c.get("/my-cabinet-admin")
+	wantStatus(t, code, body, http.StatusOK)
+
+	// A session ID planted before login is useless afterwards.
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/my-cabinet-admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+	if code, _, _ := ts.newClient().send(req); code == http.StatusOK {
+		t.Error("the pre-login session ID still works")
+	}
+
+	// A tampered session cookie gets a fresh session rather than an error.
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "garbage"})
+	if code, _, _ := ts.newClient().send(req); code != http.StatusOK {
+		t.Errorf("with a tampered session cookie: got %d; want %d", code, http.StatusOK)
+	}
+}
@@ -3,15 +3,29 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 )
 
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
 
-// The logError() method is a generic helper for logging an error message.
+// The logError() method is a generic helper for logging an error message along
+// with the request method, URL, request ID and (when known) the user ID, so that a
+// single request can be traced through the logs.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.Print(err)
+	properties := map[string]string{
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+		"request_id":     app.contextGetRequestID(r),
+	}
+
+	user := app.contextGetUser(r)
+	if user != nil && !user.IsAnonymous() {
+		properties["user_id"] = strconv.FormatInt(user.ID, 10)
+	}
+
+	app.logger.PrintError(err, properties)
 }
 
 // The errorResponse() method is a generic helper for sending JSON-formatted error
@@ -56,6 +70,11 @@ func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the request body must be sent as application/json"
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
@@ -90,3 +109,8 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or missing CSRF token, reload the page and try again"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
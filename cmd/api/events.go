@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/events"
+)
+
+// Types of the events streamed at /v1/events. The data of an event is the object
+// named after its type, as the API returns it to whoever receives the event.
+const (
+	eventRequestCreated  = "request.created"
+	eventRequestUpdated  = "request.updated"
+	eventRequestAssigned = "request.assigned"
+	eventMessageCreated  = "message.created"
+	eventBookingCreated  = "booking.created"
+	eventBookingUpdated  = "booking.updated"
+	eventApprovalDecided = "approval.decided"
+	// eventResync tells a subscriber that reconnected that some of the events it
+	// missed are gone, so it has to read what it shows from the API again.
+	eventResync = "resync"
+)
+
+const (
+	// eventsHeartbeat is how often an idle stream gets a comment, so that proxies
+	// don't take it for a dead connection.
+	eventsHeartbeat = 10 * time.Second
+	// eventsWriteTimeout is how long each write to a stream may take. Streams stay
+	// open for as long as their client does, so the server's WriteTimeout, which
+	// covers a whole response, is pushed back before every write instead.
+	eventsWriteTimeout = 10 * time.Second
+	// eventsRetry is how long browsers wait before reconnecting a stream that
+	// ended, passing the ID of the last event they got so nothing is lost.
+	eventsRetry = 2 * time.Second
+)
+
+// writeDeadliner is implemented by the response writers of net/http that can push
+// back the write deadline of their connection.
+type writeDeadliner interface {
+	SetWriteDeadline(deadline time.Time) error
+}
+
+// setWriteDeadline sets the write deadline of the connection behind w, looking
+// through the response writers of middleware that wrap it, the way
+// http.ResponseController does. It reports whether w supports it.
+func setWriteDeadline(w http.ResponseWriter, deadline time.Time) bool {
+	for {
+		switch t := w.(type) {
+		case writeDeadliner:
+			return t.SetWriteDeadline(deadline) == nil
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// The publish() helper publishes an event, logging rather than failing the request
+// if it can't: the change it reports has been made either way.
+func (app *application) publish(eventType string, data interface{}, to events.Audience) {
+	err := app.events.Publish(eventType, data, to)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"event": eventType})
+	}
+}
+
+// The publishBooking() helper tells the client who made a booking, the concierge
+// and the partners of the company providing it that the booking was made or
+// changed. Partners get it as they see it in their own endpoints, and only once
+// the booking is theirs to see: not while it waits for the approval of the
+// client's company, nor after the company rejected it.
+func (app *application) publishBooking(r *http.Request, eventType string, booking *data.Booking) {
+	request, err := app.models.Request.GetByRequestID(r.Context(), booking.RequestID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"event": eventType})
+		return
+	}
+	app.publish(eventType, envelope{"booking": booking}, events.Audience{
+		UserIDs:   []int64{request.ClientID},
+		Concierge: true,
+	})
+
+	awaiting, err := app.awaitingApproval(r.Context(), booking.ID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"event": eventType})
+		return
+	}
+	if awaiting {
+		return
+	}
+
+	service, err := app.models.Service.GetById(r.Context(), booking.ServiceID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"event": eventType})
+		return
+	}
+	app.publish(eventType, envelope{"booking": newPartnerBooking(booking, request)}, events.Audience{
+		CompanyID: int64(service.CompanyID),
+	})
+}
+
+// The publishMessage() helper tells the concierge and, unless the message is an
+// internal note, the client of the request about a new message.
+func (app *application) publishMessage(request *data.Request, message *data.Message) {
+	to := events.Audience{Concierge: true}
+	if !message.Internal {
+		to.UserIDs = []int64{request.ClientID}
+	}
+	app.publish(eventMessageCreated, envelope{"message": message}, to)
+}
+
+// The streamEventsHandler() streams the events for the logged in user as
+// Server-Sent Events: clients hear about their own requests, bookings and
+// messages, the concierge about everything, and partners about the bookings of
+// their company. Each event carries an ID; a client reconnecting with it in the
+// Last-Event-ID header first gets the events it missed, or a "resync" event if they
+// are no longer kept.
+func (app *application) streamEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || !setWriteDeadline(w, time.Now().Add(eventsWriteTimeout)) {
+		app.serverErrorResponse(w, r, errors.New("streaming is not supported by the response writer"))
+		return
+	}
+
+	var lastID int64
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 0 {
+			app.badRequestResponse(w, r, errors.New("Last-Event-ID must be the ID of an event"))
+			return
+		}
+		lastID = id
+	}
+
+	user := app.contextGetUser(r)
+	sub := &events.Subscriber{
+		UserID:    user.ID,
+		Concierge: user.UserType == data.UserTypeCSManager || user.UserType == data.UserTypeAdmin,
+	}
+	if user.UserType == data.UserTypePartner {
+		sub.CompanyID = user.CompanyID
+	}
+
+	missed, complete, err := app.events.Subscribe(sub, lastID)
+	if err != nil {
+		switch {
+		case errors.Is(err, events.ErrClosed):
+			app.errorResponse(w, r, http.StatusServiceUnavailable, "the server is shutting down")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer app.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep buffering reverse proxies (nginx) from holding the events back.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+	if !complete {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", eventResync)
+	}
+	for _, e := range missed {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			// The hub closes the channel when it drops a subscriber that fell
+			// behind, or when the server shuts down.
+			if !ok {
+				return
+			}
+			setWriteDeadline(w, time.Now().Add(eventsWriteTimeout))
+			writeEvent(w, e)
+		case <-heartbeat.C:
+			setWriteDeadline(w, time.Now().Add(eventsWriteTimeout))
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event in the text/event-stream format. Its data is JSON,
+// which never spans several lines.
+func writeEvent(w http.ResponseWriter, e *events.Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+}
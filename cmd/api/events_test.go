@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStream is an open event stream, read line by line.
+type testStream struct {
+	t     *testing.T
+	res   *http.Response
+	lines chan string
+}
+
+func (c *testClient) stream(lastID string) *testStream {
+	c.ts.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, c.ts.URL+"/v1/events", nil)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		c.ts.t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusOK)
+	}
+
+	s := &testStream{t: c.ts.t, res: res, lines: make(chan string, 100)}
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			s.lines <- scanner.Text()
+		}
+		close(s.lines)
+	}()
+	c.ts.t.Cleanup(s.close)
+	return s
+}
+
+// waitFor reads the stream up to a line containing substr, failing the test if
+// one containing any of unwanted comes first.
+func (s *testStream) waitFor(substr string, unwanted ...string) {
+	s.t.Helper()
+
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatalf("the stream ended before %q", substr)
+			}
+			for _, u := range unwanted {
+				if strings.Contains(line, u) {
+					s.t.Fatalf("got %q before %q", line, substr)
+				}
+			}
+			if strings.Contains(line, substr) {
+				return
+			}
+		case <-timeout:
+			s.t.Fatalf("timed out waiting for %q", substr)
+		}
+	}
+}
+
+// ended reports whether the server ended the stream within a few seconds.
+func (s *testStream) ended() bool {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case _, ok := <-s.lines:
+			if !ok {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func (s *testStream) close() {
+	s.res.Body.Close()
+}
+
+func TestEvents(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "cs@example.com", "csmanager", 0)
+	seedUser(t, app, "client@example.com", "client", 0)
+
+	code, body := ts.newClient().get("/v1/events")
+	wantStatus(t, code, body, http.StatusUnauthorized)
+
+	cs := ts.loggedIn("cs@example.com")
+	client := ts.loggedIn("client@example.com")
+	csStream := cs.stream("")
+	if ct := csStream.res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got Content-Type %q", ct)
+	}
+	csStream.waitFor("retry:")
+	clientStream := client.stream("")
+	clientStream.waitFor("retry:")
+
+	code, body = client.do(http.MethodPost, "/v1/requests", `{"type":"dinner","description":"Somewhere quiet"}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	csStream.waitFor("event: request.created")
+	csStream.waitFor(`"description":"Somewhere quiet"`)
+
+	// Internal notes only go to the concierge.
+	code, body = cs.do(http.MethodPost, "/v1/cs/requests/1/messages", `{"body":"Big tipper","internal":true}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	code, body = cs.do(http.MethodPost, "/v1/cs/requests/1/messages", `{"body":"Hello"}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	clientStream.waitFor(`"body":"Hello"`, "Big tipper")
+	clientStream.close()
+
+	// Events 1-3 were the request and the two messages.
+	code, body = cs.do(http.MethodPost, "/v1/cs/requests/1/messages", `{"body":"Booked for 8pm"}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	replay := client.stream("3")
+	replay.waitFor("id: 4")
+	replay.waitFor("Booked for 8pm")
+	client.stream("1").waitFor("Hello", "Big tipper")
+	client.stream("999").waitFor("event: resync")
+
+	code, body = cs.do(http.MethodPatch, "/v1/cs/requests/1", `{"assignee_id":2}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	code, body = cs.do(http.MethodPatch, "/v1/cs/requests/1", `{"status":"lost"}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	code, body = cs.do(http.MethodPatch, "/v1/cs/requests/1", `{"status":"in_progress","assignee_id":1}`)
+	wantStatus(t, code, body, http.StatusOK)
+	replay.waitFor("event: request.updated")
+	replay.waitFor("event: request.assigned")
+	replay.waitFor(`"assignee_id":1`)
+	code, body = client.do(http.MethodPatch, "/v1/cs/requests/1", `{"status":"done"}`)
+	wantStatus(t, code, body, http.StatusForbidden)
+
+	app.events.Close()
+	if !replay.ended() {
+		t.Error("the stream is still open after the hub was closed")
+	}
+}
+
+func TestBookingEventsAwaitApproval(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	acme := seedCompany(t, app, "Acme")
+	resto := seedCompany(t, app, "Resto")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	employee := seedUser(t, app, "employee@example.com", "b2bclient", acme.ID)
+	approver := seedUser(t, app, "approver@example.com", "b2bclient", acme.ID)
+	seedUser(t, app, "partner@example.com", "partner", resto.ID)
+	seedService(t, app, resto, map[string]int{"b2bclient": 1000})
+	seedRequest(t, app, employee)
+
+	controls := fmt.Sprintf(`{"rules":[{"kind":"always"}],"approver_ids":[%d]}`, approver.ID)
+	code, body := ts.loggedIn("admin@example.com").do(http.MethodPut, "/v1/admin/companies/1/spending-controls", controls)
+	wantStatus(t, code, body, http.StatusOK)
+
+	emp := ts.loggedIn("employee@example.com")
+	empStream := emp.stream("")
+	empStream.waitFor("retry:")
+	partnerStream := ts.loggedIn("partner@example.com").stream("")
+	partnerStream.waitFor("retry:")
+
+	code, body = emp.do(http.MethodPost, "/v1/requests/1/bookings", fmt.Sprintf(`{"service_id":1,%s}`, bookingWindow(time.Now().Add(48*time.Hour))))
+	wantStatus(t, code, body, http.StatusCreated)
+	empStream.waitFor("event: booking.created")
+
+	// The partner first hears of the booking once it is approved.
+	code, body = ts.loggedIn("approver@example.com").do(http.MethodPost, "/v1/approvals/1/approve", `{}`)
+	wantStatus(t, code, body, http.StatusOK)
+	partnerStream.waitFor("event: booking.updated", "event: booking.created")
+}
+
+func TestEventsOutliveWriteTimeout(t *testing.T) {
+	app := newTestApplication(t)
+	srv := httptest.NewUnstartedServer(app.routes())
+	srv.Config.WriteTimeout = time.Second
+	srv.Start()
+	t.Cleanup(srv.Close)
+	ts := &testServer{Server: srv, t: t}
+	seedUser(t, app, "cs@example.com", "csmanager", 0)
+	seedUser(t, app, "client@example.com", "client", 0)
+
+	csStream := ts.loggedIn("cs@example.com").stream("")
+	csStream.waitFor("retry:")
+	time.Sleep(1500 * time.Millisecond)
+
+	code, body := ts.loggedIn("client@example.com").do(http.MethodPost, "/v1/requests", `{"type":"dinner"}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	csStream.waitFor("event: request.created")
+}
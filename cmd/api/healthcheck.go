@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+)
+
+// The healthcheckHandler() is a liveness probe: it only tells the orchestrator that
+// the process is up and serving HTTP, without touching any dependency.
+func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"status": "available",
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readinessTimeout is how long the readiness checks have, together, before a
+// dependency that hasn't answered counts as unavailable.
+const readinessTimeout = 2 * time.Second
+
+// The readinessHandler() checks every dependency the application needs to serve
+// traffic: the database pool, the schema migration state and the SMTP server. The
+// checks run concurrently and the handler answers 503 Service Unavailable if any of
+// them fails, so that a rolling deploy doesn't route traffic to an instance that
+// can't handle it. The endpoint is public, so why a check failed is only logged.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		checks = make(map[string]interface{})
+		ready  = true
+	)
+
+	record := func(name string, result map[string]interface{}, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			ready = false
+			result["status"] = "unavailable"
+			app.logger.PrintError(err, map[string]string{"check": name})
+		} else {
+			result["status"] = "available"
+		}
+		checks[name] = result
+	}
+
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		err := app.models.System.Ping(ctx)
+		record("database", map[string]interface{}{}, err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		result := map[string]interface{}{}
+		version, dirty, err := app.models.System.MigrationVersion(ctx)
+		if err == nil {
+			result["version"] = version
+			result["dirty"] = dirty
+			if dirty {
+				err = errors.New("the last migration failed and must be fixed manually")
+			}
+		} else if errors.Is(err, data.ErrNoMigrations) {
+			result["version"] = nil
+		}
+		record("migrations", result, err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		err := app.mailer.Ping(ctx)
+		record("mail", map[string]interface{}{}, err)
+	}()
+
+	wg.Wait()
+
+	status := http.StatusOK
+	env := envelope{"status": "ready", "checks": checks}
+	if !ready {
+		status = http.StatusServiceUnavailable
+		env["status"] = "unavailable"
+	}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
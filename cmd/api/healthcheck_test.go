@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/concierge/service/internal/mailer"
+)
+
+func TestHealthcheck(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	code, body := ts.newClient().get("/v1/healthcheck")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"status":"available"`, `"environment":"development"`)
+}
+
+func TestReadiness(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	// The in-memory database is always there, but the test mailer has no SMTP
+	// server to talk to.
+	code, body := ts.newClient().get("/v1/readiness")
+	wantStatus(t, code, body, http.StatusServiceUnavailable)
+	wantContains(t, body, `"status":"unavailable"`, `"database":{"status":"available"}`, `"mail":{"status":"unavailable"}`)
+	// The endpoint is public: why a check failed is for the logs only.
+	if strings.Contains(body, "error") || strings.Contains(body, mailer.ErrNotConfigured.Error()) {
+		t.Errorf("the response gives the error away: %s", body)
+	}
+}
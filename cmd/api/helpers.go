@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/concierge/service/internal/data"
 	"github.com/concierge/service/internal/validator"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -147,16 +149,64 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readBool() helper reads an optional boolean query string parameter. It returns
+// nil if the parameter is absent, so that callers can tell "false" from "not given".
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+	return &b
+}
+
+// The readTime() helper reads an optional RFC 3339 timestamp such as
+// "2024-01-31T00:00:00Z" from the query string, returning the zero time if it's
+// absent.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return time.Time{}
+	}
+	return t
+}
+
+// The readDate() helper reads an optional date such as "2024-01-31" from the query
+// string, returning defaultValue if it's absent. The date is midnight UTC.
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	t, err := time.Parse(data.DateLayout, s)
+	if err != nil {
+		v.AddError(key, "must be a date in YYYY-MM-DD format")
+		return defaultValue
+	}
+	return t
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
+	app.backgroundTasks.Add(1)
 	// Launch a background goroutine.
 	go func() {
 		defer app.wg.Done()
+		defer app.backgroundTasks.Add(-1)
 		// Recover any panic.
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.Print(err)
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
 			}
 		}()
 		// Execute the arbitrary function that we passed as the parameter.
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/document"
+	"github.com/concierge/service/internal/mailer"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The generateInvoices() helper generates the invoices of every company with
+// something to be billed for a period. Companies whose invoice has already been
+// issued are skipped: what they still owe goes on their next invoice.
+func (app *application) generateInvoices(ctx context.Context, period string) ([]*data.Invoice, error) {
+	_, end, err := data.InvoicePeriodBounds(period)
+	if err != nil {
+		return nil, err
+	}
+
+	companies, err := app.models.Invoice.BillableCompanies(ctx, end)
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := []*data.Invoice{}
+	for _, companyID := range companies {
+		invoice, err := app.models.Invoice.Generate(ctx, companyID, period)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrInvoiceIssued), errors.Is(err, data.ErrNothingToInvoice):
+				continue
+			default:
+				return invoices, err
+			}
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, nil
+}
+
+// The runInvoiceJob() method generates the invoices of the previous month and marks
+// the invoices that weren't paid in time as overdue: once at startup and then once
+// a day, until ctx is cancelled. Generating again only adds what has been
+// completed since, so the drafts stay up to date until finance issues them.
+func (app *application) runInvoiceJob(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		app.updateInvoices(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *application) updateInvoices(ctx context.Context) {
+	now := time.Now().UTC()
+	period := now.AddDate(0, 0, -now.Day()).Format(data.InvoicePeriodLayout)
+
+	invoices, err := app.generateInvoices(ctx, period)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"job": "invoices", "period": period})
+	}
+
+	overdue, err := app.models.Invoice.MarkOverdue(ctx, now)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"job": "invoices"})
+	}
+
+	app.logger.PrintInfo("updated invoices", map[string]string{
+		"period":    period,
+		"generated": strconv.Itoa(len(invoices)),
+		"overdue":   strconv.Itoa(len(overdue)),
+	})
+}
+
+// The invoiceDocument() helper gathers what the invoice templates need to render an
+// invoice. The company may have been deleted since it was invoiced.
+func (app *application) invoiceDocument(ctx context.Context, invoice *data.Invoice) (document.Invoice, error) {
+	company, err := app.models.Company.GetById(data.ContextWithDeleted(ctx), invoice.CompanyID)
+	if err != nil {
+		return document.Invoice{}, err
+	}
+	return document.Invoice{Invoice: invoice, Company: company}, nil
+}
+
+// invoiceFilename returns the name the PDF of an invoice is downloaded and mailed
+// under.
+func invoiceFilename(invoice *data.Invoice) string {
+	if invoice.Number == "" {
+		return fmt.Sprintf("invoice-draft-%d.pdf", invoice.ID)
+	}
+	return fmt.Sprintf("invoice-%s.pdf", invoice.Number)
+}
+
+// The writeInvoicePDF() helper sends the PDF of an invoice as a download.
+func (app *application) writeInvoicePDF(w http.ResponseWriter, r *http.Request, invoice *data.Invoice) {
+	doc, err := app.invoiceDocument(r.Context(), invoice)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err = document.InvoicePDF(buf, doc)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", invoiceFilename(invoice)))
+	w.Write(buf.Bytes())
+}
+
+// The emailInvoice() helper mails the PDF of an issued invoice to the activated B2B
+// clients of the invoiced company, in the background. Failures are logged per
+// recipient, so that one bad address doesn't stop the others from being mailed.
+func (app *application) emailInvoice(invoice *data.Invoice) {
+	app.background(func() {
+		ctx := context.Background()
+		properties := map[string]string{"invoice_id": fmt.Sprint(invoice.ID)}
+
+		doc, err := app.invoiceDocument(ctx, invoice)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+			return
+		}
+		pdf := new(bytes.Buffer)
+		err = document.InvoicePDF(pdf, doc)
+		if err != nil {
+			app.logger.PrintError(err, properties)
+			return
+		}
+		attachment := mailer.Attachment{Filename: invoiceFilename(invoice), Data: pdf.Bytes()}
+
+		activated := true
+		filter := data.UserFilter{UserType: data.UserTypeB2BClient, CompanyID: invoice.CompanyID, Activated: &activated}
+		filters := data.Filters{Page: 1, PageSize: 100, Sort: "id", SortSafelist: data.UserSortSafelist}
+		for {
+			users, metadata, err := app.models.User.List(ctx, filter, filters)
+			if err != nil {
+				app.logger.PrintError(err, properties)
+				return
+			}
+
+			for _, user := range users {
+				emailData := map[string]interface{}{
+					"firstName":   user.FirstName,
+					"number":      invoice.Number,
+					"companyName": doc.Company.FullName,
+					"period":      document.PeriodName(invoice.Period),
+					"total":       document.Money(invoice.Total),
+					"dueDate":     invoice.DueAt.Time.UTC().Format("02 Jan 2006"),
+				}
+				err := app.sendEmail(user.Email, "invoice.tmpl", emailData, attachment)
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{
+						"invoice_id": fmt.Sprint(invoice.ID),
+						"user_id":    fmt.Sprint(user.ID),
+					})
+				}
+			}
+
+			if filters.Page >= metadata.LastPage {
+				return
+			}
+			filters.Page++
+		}
+	})
+}
+
+// The adminReadInvoice() helper loads the invoice identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadInvoice(w http.ResponseWriter, r *http.Request) *data.Invoice {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	invoice, err := app.models.Invoice.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return invoice
+}
+
+// The clientReadInvoice() helper is adminReadInvoice() for B2B clients: drafts and
+// the invoices of other companies are reported as not found.
+func (app *application) clientReadInvoice(w http.ResponseWriter, r *http.Request) *data.Invoice {
+	invoice := app.adminReadInvoice(w, r)
+	if invoice == nil {
+		return nil
+	}
+	if invoice.CompanyID != app.contextGetUser(r).CompanyID || invoice.Status == data.InvoiceDraft {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return invoice
+}
+
+// The listInvoices() helper writes a page of the invoices matching filter, with the
+// page and further filters taken from the query string.
+func (app *application) listInvoices(w http.ResponseWriter, r *http.Request, filter data.InvoiceFilter) {
+	var input struct {
+		data.InvoiceFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.InvoiceFilter = filter
+	input.Period = app.readString(qs, "period", "")
+	input.Status = app.readString(qs, "status", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-period")
+	input.Filters.SortSafelist = data.InvoiceSortSafelist
+
+	data.ValidateInvoiceFilter(v, input.InvoiceFilter)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	invoices, metadata, err := app.models.Invoice.List(r.Context(), input.InvoiceFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invoices": invoices, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listInvoicesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	companyID := app.readInt(r.URL.Query(), "company_id", 0, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.listInvoices(w, r, data.InvoiceFilter{CompanyID: int64(companyID)})
+}
+
+// The generateInvoicesHandler() generates the invoices of a month that is over,
+// either for one company or for every company with something to be billed. The
+// job started by serve() does the latter every day for the previous month, so this
+// is for catching up, e.g. after a booking was marked completed late.
+func (app *application) generateInvoicesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Period    string `json:"period"`
+		CompanyID int64  `json:"company_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateInvoicePeriod(v, input.Period)
+	v.Check(input.CompanyID >= 0, "company_id", "must not be negative")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.CompanyID == 0 {
+		invoices, err := app.generateInvoices(r.Context(), input.Period)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"invoices": invoices}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	invoice, err := app.models.Invoice.Generate(r.Context(), input.CompanyID, input.Period)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNothingToInvoice):
+			v.AddError("company_id", "has nothing to be invoiced for this period")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrInvoiceIssued):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invoice": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.adminReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"invoice": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showInvoiceHTMLHandler() renders an invoice as a web page, e.g. for finance to
+// check a draft before issuing it.
+func (app *application) showInvoiceHTMLHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.adminReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	doc, err := app.invoiceDocument(r.Context(), invoice)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err = document.InvoiceHTML(buf, doc)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (app *application) showInvoicePDFHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.adminReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	app.writeInvoicePDF(w, r, invoice)
+}
+
+// The issueInvoiceHandler() numbers a draft invoice, makes it due after the payment
+// terms set with -invoice-payment-terms and mails it to the company's B2B
+// clients. Nothing can be added to the invoice once it is issued.
+func (app *application) issueInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.adminReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	if invoice.Status != data.InvoiceDraft {
+		app.errorResponse(w, r, http.StatusConflict, "the invoice is already "+invoice.Status)
+		return
+	}
+
+	err := app.models.Invoice.Issue(r.Context(), invoice, time.Now().Add(app.config.invoices.paymentTerms))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.emailInvoice(invoice)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invoice": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The markInvoicePaidHandler() records the payment of an issued or overdue invoice.
+func (app *application) markInvoicePaidHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.adminReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	if !invoice.Open() {
+		app.errorResponse(w, r, http.StatusConflict, "only issued invoices can be paid, this one is "+invoice.Status)
+		return
+	}
+
+	invoice.MarkPaid()
+	err := app.models.Invoice.Update(r.Context(), invoice)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invoice": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The sendInvoiceHandler() mails an issued invoice to the company's B2B clients
+// again, e.g. as a reminder once it is overdue.
+func (app *application) sendInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.adminReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	if invoice.Status == data.InvoiceDraft {
+		app.errorResponse(w, r, http.StatusConflict, "the invoice must be issued first")
+		return
+	}
+
+	app.emailInvoice(invoice)
+
+	err := app.writeJSON(w, http.StatusAccepted, envelope{"message": "the invoice will be emailed to the company"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listClientInvoicesHandler() shows B2B clients the invoices issued to their
+// company.
+func (app *application) listClientInvoicesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listInvoices(w, r, data.InvoiceFilter{CompanyID: app.contextGetUser(r).CompanyID, Issued: true})
+}
+
+func (app *application) showClientInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.clientReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"invoice": invoice}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showClientInvoicePDFHandler(w http.ResponseWriter, r *http.Request) {
+	invoice := app.clientReadInvoice(w, r)
+	if invoice == nil {
+		return
+	}
+
+	app.writeInvoicePDF(w, r, invoice)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+)
+
+func TestInvoices(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.invoices.paymentTerms = 14 * 24 * time.Hour
+	ts := newTestServer(t, app)
+	ctx := context.Background()
+	acme := seedCompany(t, app, "Acme")
+	resto := seedCompany(t, app, "Resto")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	employee := seedUser(t, app, "b2b@example.com", "b2bclient", acme.ID)
+	seedUser(t, app, "loner@example.com", "b2bclient", 0)
+	dinner := seedService(t, app, resto, nil)
+	request := seedRequest(t, app, employee)
+	admin := ts.loggedIn("admin@example.com")
+
+	now := time.Now().UTC()
+	endOfLastMonth := now.AddDate(0, 0, -now.Day())
+	period := endOfLastMonth.Format(data.InvoicePeriodLayout)
+
+	// Completed bookings are billed in full, cancelled ones for their fee and the
+	// others not at all.
+	book := func(completed bool, fee int) {
+		t.Helper()
+		booking := &data.Booking{
+			RequestID: request.ID, ServiceID: dinner.ID, UnitPrice: 1000, Quantity: 3, PartySize: 1,
+			StartsAt: endOfLastMonth.Add(-48 * time.Hour), EndsAt: endOfLastMonth.Add(-46 * time.Hour),
+			PartnerStatus: data.PartnerStatusAccepted, FulfilmentStatus: "not_started",
+		}
+		err := app.models.Booking.Insert(ctx, booking)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if completed {
+			booking.FulfilmentStatus = "completed"
+			booking.CompletedAt.Valid, booking.CompletedAt.Time = true, endOfLastMonth.Add(-40*time.Hour)
+		}
+		if fee > 0 {
+			booking.Cancel("Changed plans", fee)
+			booking.CancelledAt.Time = endOfLastMonth.Add(-50 * time.Hour)
+		}
+		err = app.models.Booking.Update(ctx, booking)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	book(true, 0)
+	book(false, 500)
+	book(false, 0)
+
+	code, body := admin.do(http.MethodPost, "/v1/admin/invoices", `{"period":"2999-01"}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	code, body = admin.do(http.MethodPost, "/v1/admin/invoices", fmt.Sprintf(`{"period":%q}`, period))
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total":3500`)
+
+	// Regenerating a draft picks up what was completed since.
+	book(true, 0)
+	code, body = admin.do(http.MethodPost, "/v1/admin/invoices", fmt.Sprintf(`{"period":%q,"company_id":%d}`, period, acme.ID))
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total":6500`)
+
+	code, body = admin.get("/v1/admin/invoices/1/html")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, "Draft invoice")
+	code, body = admin.get("/v1/admin/invoices/1/pdf")
+	wantStatus(t, code, body, http.StatusOK)
+	if !strings.HasPrefix(body, "%PDF") {
+		t.Errorf("not a PDF: %.20q", body)
+	}
+	code, body = admin.do(http.MethodPost, "/v1/admin/invoices/1/paid", "")
+	wantStatus(t, code, body, http.StatusConflict)
+
+	// Clients don't see drafts.
+	employeeClient := ts.loggedIn("b2b@example.com")
+	code, body = employeeClient.get("/v1/invoices")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"invoices":[]`)
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/invoices/1/issue", "")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, fmt.Sprintf("INV-%d-00001", now.Year()))
+	code, body = admin.do(http.MethodPost, "/v1/admin/invoices/1/issue", "")
+	wantStatus(t, code, body, http.StatusConflict)
+	code, body = admin.do(http.MethodPost, "/v1/admin/invoices", fmt.Sprintf(`{"period":%q,"company_id":%d}`, period, acme.ID))
+	wantStatus(t, code, body, http.StatusConflict)
+
+	code, body = employeeClient.get("/v1/invoices")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`)
+	code, body = employeeClient.get("/v1/invoices/1/pdf")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, "INVOICE INV-")
+
+	code, body = ts.loggedIn("loner@example.com").get("/v1/invoices")
+	wantStatus(t, code, body, http.StatusForbidden)
+
+	overdue, err := app.models.Invoice.MarkOverdue(ctx, now.Add(15*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overdue) != 1 {
+		t.Fatalf("got %d overdue invoices; want 1", len(overdue))
+	}
+	code, body = admin.do(http.MethodPost, "/v1/admin/invoices/1/paid", "")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"status":"paid"`)
+}
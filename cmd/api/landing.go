@@ -1,31 +1,15 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"github.com/concierge/service/internal/data"
-	"github.com/go-session/session/v3"
-	"html/template"
 	"net/http"
 	"strings"
 	"time"
 )
 
 func (app *application) showLandingPageHandler(w http.ResponseWriter, r *http.Request) {
-	files := []string{
-		"./ui/index.html", // the order... matters?
-	}
-
-	ts, err := template.ParseFiles(files...)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	err = ts.Execute(w, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	app.render(w, r, http.StatusOK, "landing.html", app.newTemplateData(r))
 }
 
 func (app *application) RegFormHandler(w http.ResponseWriter, r *http.Request) {
@@ -46,7 +30,7 @@ func (app *application) RegFormHandler(w http.ResponseWriter, r *http.Request) {
 		CreatedAt:   time.Time{},
 	}
 
-	err = app.models.RegForm.Insert(regForm)
+	err = app.models.RegForm.Insert(r.Context(), regForm)
 	if err != nil {
 		//app.serverErrorResponse(w, r, err)
 		http.Redirect(w, r, "http://localhost:8080", http.StatusInternalServerError)
@@ -66,7 +50,7 @@ func (app *application) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	email := strings.Split(r.FormValue("emailD"), " ")
 	pswd := strings.Split(r.FormValue("passwordD"), " ")
 
-	user, err := app.models.User.GetByEmail(email[0])
+	user, err := app.models.User.GetByEmail(r.Context(), email[0])
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -91,7 +75,7 @@ func (app *application) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "http://localhost:8080", http.StatusSeeOther)
 		return
 	}
-	token, err := app.models.Token.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Token.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -99,10 +83,26 @@ func (app *application) LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	//d := "Bearer " + token.Plaintext
 
-	store, err := session.Start(context.Background(), w, r)
+	// Logging in moves the browser to a new session ID and CSRF token, so that ones
+	// planted before login (session fixation) are useless afterwards.
+	store, err := app.renewSession(w, r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	store.Set("Bearer", token.Plaintext)
 
 	err = store.Save()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.renewCSRFToken(w)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	//r.Header.Add("Vary", "Authorization")
 	//r.Header.Add("Authorization", d)
 
@@ -116,6 +116,9 @@ func (app *application) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	} else if user.UserType == "client" {
 		http.Redirect(w, r, "http://localhost:8080/my-cabinet", http.StatusSeeOther)
 		return
+	} else if user.UserType == data.UserTypePartner {
+		http.Redirect(w, r, "http://localhost:8080/my-cabinet-partner", http.StatusSeeOther)
+		return
 	}
 	//http.Redirect(w, r, "http://localhost:8080", http.StatusSeeOther)
 }
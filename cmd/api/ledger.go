@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The debitBooking() helper pays for a completed booking from the deposit of its
+// client: their own, or else their company's. Bookings without a deposit to pay
+// them from are left alone, as are those already paid by card or invoiced. If the
+// deposit doesn't cover the booking, it isn't debited at all and is paid like any
+// other booking, by card or on the company's invoice.
+func (app *application) debitBooking(ctx context.Context, booking *data.Booking) error {
+	if booking.Total() <= 0 || booking.InvoiceID != 0 {
+		return nil
+	}
+
+	payments, _, err := app.models.Payment.List(ctx, data.PaymentFilter{BookingID: booking.ID}, data.Filters{
+		Page:         1,
+		PageSize:     100,
+		Sort:         "id",
+		SortSafelist: data.PaymentSortSafelist,
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range payments {
+		if p.Status == data.PaymentAuthorized || p.Status == data.PaymentCaptured {
+			return nil
+		}
+	}
+
+	request, err := app.models.Request.GetByRequestID(ctx, booking.RequestID)
+	if err != nil {
+		return err
+	}
+	client, err := app.models.User.Get(ctx, request.ClientID)
+	if err != nil {
+		return err
+	}
+
+	account, err := app.models.Ledger.GetAccountFor(ctx, client.ID, client.CompanyID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	err = app.models.Ledger.Post(ctx, &data.LedgerTransaction{
+		AccountID: account.ID,
+		Kind:      data.LedgerDebit,
+		Amount:    booking.Total(),
+		BookingID: booking.ID,
+		Note:      fmt.Sprintf("Booking #%d", booking.ID),
+	})
+	if errors.Is(err, data.ErrBookingDebited) {
+		return nil
+	}
+	return err
+}
+
+// The logDebitBooking() helper debits a booking that has just been completed,
+// logging rather than returning failures: the booking was completed all the same.
+func (app *application) logDebitBooking(ctx context.Context, booking *data.Booking) {
+	properties := map[string]string{"booking_id": fmt.Sprint(booking.ID)}
+
+	err := app.debitBooking(ctx, booking)
+	switch {
+	case err == nil:
+	case errors.Is(err, data.ErrInsufficientFunds):
+		app.logger.PrintInfo("the deposit of the client doesn't cover the booking", properties)
+	default:
+		app.logger.PrintError(err, properties)
+	}
+}
+
+func (app *application) listAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AccountFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Kind = app.readString(qs, "kind", "")
+	input.UserID = int64(app.readInt(qs, "user_id", 0, v))
+	input.CompanyID = int64(app.readInt(qs, "company_id", 0, v))
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = data.AccountSortSafelist
+
+	data.ValidateAccountFilter(v, input.AccountFilter)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	accounts, metadata, err := app.models.Ledger.ListAccounts(r.Context(), input.AccountFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"accounts": accounts, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The openAccountHandler() opens a deposit account for a client, or for a company
+// whose B2B clients then all pay from it.
+func (app *application) openAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID    int64 `json:"user_id"`
+		CompanyID int64 `json:"company_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	account := &data.Account{UserID: input.UserID, CompanyID: input.CompanyID}
+
+	v := validator.New()
+	if data.ValidateAccount(v, account); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if account.UserID != 0 {
+		user, err := app.models.User.Get(r.Context(), account.UserID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "does not exist")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		default:
+			v.Check(user.IsClient(), "user_id", "must be a client")
+		}
+	} else {
+		_, err := app.models.Company.GetById(r.Context(), account.CompanyID)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("company_id", "does not exist")
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Ledger.Open(r.Context(), account)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateAccount):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/accounts/%d", account.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"account": account}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadAccount() helper loads the account identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadAccount(w http.ResponseWriter, r *http.Request) *data.Account {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	account, err := app.models.Ledger.GetAccount(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return account
+}
+
+// The clientReadAccount() helper loads the deposit account the logged in client
+// pays from, sending the appropriate error response and returning nil if they
+// have none.
+func (app *application) clientReadAccount(w http.ResponseWriter, r *http.Request) *data.Account {
+	user := app.contextGetUser(r)
+
+	account, err := app.models.Ledger.GetAccountFor(r.Context(), user.ID, user.CompanyID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return account
+}
+
+func (app *application) showAccountHandler(w http.ResponseWriter, r *http.Request) {
+	account := app.adminReadAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"account": account}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showClientAccountHandler(w http.ResponseWriter, r *http.Request) {
+	account := app.clientReadAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"account": account}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The postTransaction() helper reads a transaction of the given kind from the
+// request body and posts it on the deposit account identified by the "id" URL
+// parameter. Like payments, transactions need an Idempotency-Key header: posting
+// again with the same key returns the transaction posted the first time.
+func (app *application) postTransaction(w http.ResponseWriter, r *http.Request, kind string) {
+	account := app.adminReadAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	var input struct {
+		Amount    int    `json:"amount"`
+		BookingID int64  `json:"booking_id"`
+		Note      string `json:"note"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := app.readIdempotencyKey(w, r)
+	if key == "" {
+		return
+	}
+
+	txn := &data.LedgerTransaction{
+		AccountID:      account.ID,
+		Kind:           kind,
+		Amount:         input.Amount,
+		BookingID:      input.BookingID,
+		Note:           input.Note,
+		IdempotencyKey: key,
+	}
+
+	v := validator.New()
+	if data.ValidateLedgerTransaction(v, txn); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if account.Kind != data.AccountDeposit {
+		app.errorResponse(w, r, http.StatusConflict, "transactions can only be posted on deposit accounts")
+		return
+	}
+
+	existing, err := app.models.Ledger.GetTransaction(r.Context(), account.ID, key)
+	switch {
+	case err == nil:
+		app.writeTransaction(w, r, http.StatusOK, existing)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Ledger.Post(r.Context(), txn)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateIdempotencyKey):
+			// A retry sent at the same time got there first.
+			existing, err := app.models.Ledger.GetTransaction(r.Context(), account.ID, key)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.writeTransaction(w, r, http.StatusOK, existing)
+		case errors.Is(err, data.ErrInsufficientFunds), errors.Is(err, data.ErrRefundExceedsDebit):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeTransaction(w, r, http.StatusCreated, txn)
+}
+
+func (app *application) writeTransaction(w http.ResponseWriter, r *http.Request, status int, txn *data.LedgerTransaction) {
+	err := app.writeJSON(w, status, envelope{"transaction": txn}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The topUpAccountHandler() records money a client prepaid into their deposit.
+func (app *application) topUpAccountHandler(w http.ResponseWriter, r *http.Request) {
+	app.postTransaction(w, r, data.LedgerTopUp)
+}
+
+// The refundAccountHandler() gives back to the deposit some or all of what was
+// debited from it for a booking.
+func (app *application) refundAccountHandler(w http.ResponseWriter, r *http.Request) {
+	app.postTransaction(w, r, data.LedgerRefund)
+}
+
+// The payOutAccountHandler() records money paid back to the client out of their
+// deposit, e.g. when they close it.
+func (app *application) payOutAccountHandler(w http.ResponseWriter, r *http.Request) {
+	app.postTransaction(w, r, data.LedgerPayout)
+}
+
+// The writeStatement() helper sends the statement of an account for the period
+// given by the "from" and "to" dates of the query string, both included, which
+// default to the current month so far. It is sent as JSON, or as a CSV download
+// with format=csv.
+func (app *application) writeStatement(w http.ResponseWriter, r *http.Request, account *data.Account) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := app.readDate(qs, "from", today.AddDate(0, 0, 1-today.Day()), v)
+	to := app.readDate(qs, "to", today, v)
+	format := app.readString(qs, "format", "json")
+
+	data.ValidateStatementPeriod(v, from, to)
+	v.Check(validator.In(format, "json", "csv"), "format", "must be json or csv")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	statement, err := app.models.Ledger.Statement(r.Context(), account.ID, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if format == "json" {
+		err = app.writeJSON(w, http.StatusOK, envelope{"statement": statement}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	filename := fmt.Sprintf("statement-%d-%s-%s.csv", account.ID, from.Format(data.DateLayout), to.Format(data.DateLayout))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "transaction_id", "kind", "booking_id", "note", "amount", "balance"})
+	cw.Write([]string{from.Format(data.DateLayout), "", "opening_balance", "", "", "", strconv.Itoa(statement.OpeningBalance)})
+	for _, line := range statement.Lines {
+		bookingID := ""
+		if line.BookingID != 0 {
+			bookingID = strconv.FormatInt(line.BookingID, 10)
+		}
+		cw.Write([]string{
+			line.Date.UTC().Format(time.RFC3339),
+			strconv.FormatInt(line.TransactionID, 10),
+			line.Kind,
+			bookingID,
+			line.Note,
+			strconv.Itoa(line.Amount),
+			strconv.Itoa(line.Balance),
+		})
+	}
+	cw.Write([]string{to.Format(data.DateLayout), "", "closing_balance", "", "", "", strconv.Itoa(statement.ClosingBalance)})
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		app.logger.PrintError(err, map[string]string{"account_id": fmt.Sprint(account.ID)})
+	}
+}
+
+func (app *application) showAccountStatementHandler(w http.ResponseWriter, r *http.Request) {
+	account := app.adminReadAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	app.writeStatement(w, r, account)
+}
+
+func (app *application) showClientAccountStatementHandler(w http.ResponseWriter, r *http.Request) {
+	account := app.clientReadAccount(w, r)
+	if account == nil {
+		return
+	}
+
+	app.writeStatement(w, r, account)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDepositAccounts(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	ctx := context.Background()
+	resto := seedCompany(t, app, "Resto")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	seedUser(t, app, "partner@example.com", "partner", resto.ID)
+	dinner := seedService(t, app, resto, nil)
+	seedBookings(t, app, seedRequest(t, app, alice), dinner.ID, 3)
+	admin := ts.loggedIn("admin@example.com")
+	client := ts.loggedIn("client@example.com")
+	partner := ts.loggedIn("partner@example.com")
+
+	// Accounts 1 and 2 are the system's cash and revenue accounts.
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		key      string
+		wantCode int
+		wantBody string
+	}{
+		{"client in a company", "/v1/admin/accounts", `{"user_id":2,"company_id":1}`, "", http.StatusUnprocessableEntity, ""},
+		{"not a client", "/v1/admin/accounts", `{"user_id":1}`, "", http.StatusUnprocessableEntity, ""},
+		{"opened", "/v1/admin/accounts", `{"user_id":2}`, "", http.StatusCreated, `"id":3`},
+		{"opened twice", "/v1/admin/accounts", `{"user_id":2}`, "", http.StatusConflict, ""},
+		{"top-up of a system account", "/v1/admin/accounts/1/top-ups", `{"amount":100}`, "x", http.StatusConflict, ""},
+		{"top-up", "/v1/admin/accounts/3/top-ups", `{"amount":3000,"note":"wire"}`, "t1", http.StatusCreated, `"balance":3000`},
+		{"top-up retried", "/v1/admin/accounts/3/top-ups", `{"amount":3000,"note":"wire"}`, "t1", http.StatusOK, `"balance":3000`},
+		{"payout above the balance", "/v1/admin/accounts/3/payouts", `{"amount":5000}`, "p1", http.StatusConflict, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := admin.do(http.MethodPost, tt.path, tt.body, "Idempotency-Key", tt.key)
+			wantStatus(t, code, body, tt.wantCode)
+			wantContains(t, body, tt.wantBody)
+		})
+	}
+
+	// The deposit covers one of two bookings completed at the same time, not both.
+	var wg sync.WaitGroup
+	for _, id := range []string{"1", "2"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			partner.do(http.MethodPut, "/v1/partner/bookings/"+id+"/fulfilment", `{"fulfilment_status":"completed"}`)
+		}(id)
+	}
+	wg.Wait()
+
+	for id, want := range map[int64]int{1: -3000, 2: 2000, 3: 1000} {
+		account, err := app.models.Ledger.GetAccount(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Balance != want {
+			t.Errorf("account %d: got balance %d; want %d", id, account.Balance, want)
+		}
+	}
+
+	debited := int64(1)
+	if ok, _ := app.models.Ledger.BookingDebited(ctx, 2); ok {
+		debited = 2
+	}
+	refund := func(body string) (int, string) {
+		return admin.do(http.MethodPost, "/v1/admin/accounts/3/refunds", body, "Idempotency-Key", "r1")
+	}
+	code, body := refund(`{"amount":3000,"booking_id":` + strconv.FormatInt(debited, 10) + `}`)
+	wantStatus(t, code, body, http.StatusConflict)
+	code, body = refund(`{"amount":500}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	code, body = refund(`{"amount":500,"booking_id":` + strconv.FormatInt(debited, 10) + `}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	wantContains(t, body, `"balance":1500`)
+
+	code, body = client.get("/v1/account")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"balance":1500`)
+
+	code, body = client.get("/v1/account/statement")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"closing_balance":1500`)
+	if n := strings.Count(body, `"transaction_id"`); n != 3 {
+		t.Errorf("got %d statement lines; want 3: %s", n, body)
+	}
+	code, body = client.get("/v1/account/statement?format=csv")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, "closing_balance")
+	code, body = client.get("/v1/account/statement?from=2020-01-01&to=2022-01-01")
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+	code, body = client.get("/v1/account/statement?from=" + tomorrow + "&to=" + tomorrow)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"opening_balance":1500`)
+
+	// A booking paid from the deposit can't be paid by card as well.
+	code, body = client.do(http.MethodPost, "/v1/bookings/"+strconv.FormatInt(debited, 10)+"/payments", `{"payment_method":"tok_visa"}`, "Idempotency-Key", "k1")
+	wantStatus(t, code, body, http.StatusConflict)
+
+	code, body = admin.get("/v1/admin/accounts?kind=deposit")
+	wantStatus(t, code, body, http.StatusOK)
+	if n := strings.Count(body, `"kind"`); n != 1 {
+		t.Errorf("got %d deposit accounts; want 1: %s", n, body)
+	}
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
-	"fmt"
+	"github.com/concierge/service/internal/events"
+	"github.com/concierge/service/internal/jsonlog"
 	"github.com/concierge/service/internal/mailer"
-	"log"
+	"github.com/concierge/service/internal/payment"
+	"github.com/concierge/service/ui"
+	"html/template"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/concierge/service/internal/data"
@@ -29,6 +35,40 @@ type config struct {
 		maxIdleConns int
 		maxIdleTime  string
 	}
+	metrics struct {
+		token string
+	}
+	debug struct {
+		routes bool
+	}
+	softDelete struct {
+		retention time.Duration
+	}
+	invoices struct {
+		paymentTerms time.Duration
+	}
+	payments struct {
+		provider      string
+		allowFake     bool
+		webhookSecret string
+		currency      string
+	}
+	templates struct {
+		reload bool
+	}
+	ui struct {
+		dir string
+	}
+	cookie struct {
+		secure   bool
+		sameSite http.SameSite
+	}
+	hsts struct {
+		maxAge time.Duration
+	}
+	cors struct {
+		trustedOrigins []string
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -40,10 +80,21 @@ type config struct {
 
 type application struct {
 	config config
-	logger *log.Logger
+	logger *jsonlog.Logger
 	models data.Models
 	mailer mailer.Mailer
+	// payments is the payment processor clients pay for their bookings through.
+	payments payment.Gateway
+	// events streams changes to requests and bookings to the users watching them.
+	events *events.Hub
 	wg     sync.WaitGroup
+
+	// backgroundTasks mirrors the number of goroutines tracked by wg, which can't be
+	// read from a sync.WaitGroup directly.
+	backgroundTasks atomic.Int64
+	metrics         *appMetrics
+	templateCache   map[string]*template.Template
+	assets          *assets
 }
 
 func main() {
@@ -63,33 +114,125 @@ func main() {
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Concierge Service <no-reply@example.com>", "SMTP sender")
+
+	flag.StringVar(&cfg.metrics.token, "metrics-token", "", "Bearer token for scraping /debug/metrics (admins can always read it)")
+
+	flag.DurationVar(&cfg.softDelete.retention, "soft-delete-retention", 90*24*time.Hour, "How long soft-deleted rows are kept before being purged (0 keeps them forever)")
+
+	flag.DurationVar(&cfg.invoices.paymentTerms, "invoice-payment-terms", 14*24*time.Hour, "How long B2B companies have to pay an invoice once it is issued")
+
+	flag.StringVar(&cfg.payments.provider, "payment-provider", "fake", "Payment processor: fake (an in-memory stand-in for development and testing)")
+	flag.BoolVar(&cfg.payments.allowFake, "payment-allow-fake", false, "Allow the fake payment processor outside development")
+	flag.StringVar(&cfg.payments.webhookSecret, "payment-webhook-secret", "", "Secret the payment processor signs its webhooks with")
+	flag.StringVar(&cfg.payments.currency, "payment-currency", "KZT", "ISO 4217 code of the currency prices are in")
+
+	flag.BoolVar(&cfg.debug.routes, "debug-routes", false, "Mount the /debug helper routes (only honoured when env is development)")
+
+	flag.BoolVar(&cfg.templates.reload, "templates-reload", false, "Parse the HTML templates again on every request (only honoured when env is development)")
+
+	flag.BoolVar(&cfg.cookie.secure, "cookie-secure", true, "Mark the session and CSRF cookies Secure (only honoured outside development, which runs over plain HTTP)")
+	cookieSameSite := flag.String("cookie-samesite", "lax", "SameSite mode of the session and CSRF cookies: lax, strict or none")
+
+	flag.DurationVar(&cfg.hsts.maxAge, "hsts-max-age", 2*365*24*time.Hour, "Strict-Transport-Security max-age (never sent in development, 0 disables it)")
+
+	// A front end on another site only gets the session cookie with -cookie-samesite=none.
+	flag.Func("cors-trusted-origins", "Origins allowed to call the /v1 API from a browser (space separated)", func(val string) error {
+		cfg.cors.trustedOrigins = strings.Fields(val)
+		return nil
+	})
+
+	flag.StringVar(&cfg.ui.dir, "ui-dir", "", "Serve the templates and static files from this directory instead of the copy embedded in the binary (only honoured when env is development)")
+
 	flag.Parse() // give our config file values
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+
+	sameSite, err := parseSameSite(*cookieSameSite)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	cfg.cookie.sameSite = sameSite
+	// Browsers reject SameSite=None cookies that aren't Secure.
+	if sameSite == http.SameSiteNoneMode && (!cfg.cookie.secure || cfg.env == "development") {
+		logger.PrintFatal(errors.New("-cookie-samesite=none needs Secure cookies, which are off in development or with -cookie-secure=false"), nil)
+	}
 
 	db, err := openDB(cfg)
 	if err != nil {
-		logger.Fatal(err)
+		logger.PrintFatal(err, nil)
 	}
 	defer db.Close()
-	logger.Printf("database connection pool established")
+	logger.PrintInfo("database connection pool established", nil)
+
+	if cfg.debug.routes && cfg.env != "development" {
+		logger.PrintInfo("ignoring -debug-routes outside of the development environment", map[string]string{
+			"env": cfg.env,
+		})
+	}
+
+	if cfg.templates.reload && cfg.env != "development" {
+		logger.PrintInfo("ignoring -templates-reload outside of the development environment", map[string]string{
+			"env": cfg.env,
+		})
+	}
+
+	// The ui files are embedded in the binary. In development they can be read from
+	// disk instead, so that changes to them don't need a rebuild.
+	uiAssets := newAssets(ui.Files, true)
+	if cfg.ui.dir != "" {
+		if cfg.env == "development" {
+			uiAssets = newAssets(os.DirFS(cfg.ui.dir), false)
+		} else {
+			logger.PrintInfo("ignoring -ui-dir outside of the development environment", map[string]string{
+				"env": cfg.env,
+			})
+		}
+	}
+
+	gateway, err := newPaymentGateway(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if cfg.payments.provider == "fake" && cfg.env != "development" {
+		logger.PrintInfo("using the fake payment processor: no money is taken", map[string]string{
+			"env": cfg.env,
+		})
+	}
+
+	// Parse the templates up front, so that a broken template stops the server from
+	// starting instead of failing requests later on.
+	templateCache, err := newTemplateCache(uiAssets)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
+		config:        cfg,
+		logger:        logger,
+		models:        data.NewModels(db, logger),
+		mailer:        mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		payments:      gateway,
+		events:        events.NewHub(64, 1000),
+		templateCache: templateCache,
+		assets:        uiAssets,
 	}
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	app.metrics = app.newAppMetrics()
+
+	err = app.initSessions()
+	if err != nil {
+		logger.PrintFatal(err, nil)
 	}
 
-	logger.Printf("starting %s server on %s", cfg.env, srv.Addr)
-	err = srv.ListenAndServe()
-	logger.Fatal(err)
+	err = app.serve()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 }
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
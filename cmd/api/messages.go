@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The readMessage() helper reads a message from the request body. Messages with
+// attachments are posted as multipart/form-data, with the text in the "body"
+// field, "internal" set to true for internal notes, and the files in
+// "attachments", and an X-Requested-With header (see requireJSON()); messages
+// without can also be posted as JSON.
+func (app *application) readMessage(w http.ResponseWriter, r *http.Request, message *data.Message) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		var input struct {
+			Body     string `json:"body"`
+			Internal bool   `json:"internal"`
+		}
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			return err
+		}
+		message.Body = input.Body
+		message.Internal = input.Internal
+		return nil
+	}
+
+	maxBytes := int64(data.MaxMessageAttachments*data.MaxAttachmentSize + 1_048_576)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	err := r.ParseMultipartForm(1_048_576)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		}
+		return fmt.Errorf("body contains badly-formed multipart data: %w", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	message.Body = r.FormValue("body")
+	if s := r.FormValue("internal"); s != "" {
+		message.Internal, err = strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("internal must be a boolean value")
+		}
+	}
+
+	for _, header := range r.MultipartForm.File["attachments"] {
+		file, err := header.Open()
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		contentType := header.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = http.DetectContentType(content)
+		}
+		message.Attachments = append(message.Attachments, &data.Attachment{
+			Filename:    header.Filename,
+			ContentType: contentType,
+			Size:        len(content),
+			Content:     content,
+		})
+	}
+	return nil
+}
+
+// The postMessage() helper posts a message read from the request body to the
+// thread of a request, as the logged in user. Only the concierge can write
+// internal notes.
+func (app *application) postMessage(w http.ResponseWriter, r *http.Request, request *data.Request, concierge bool) {
+	message := &data.Message{RequestID: request.ID, AuthorID: app.contextGetUser(r).ID}
+
+	err := app.readMessage(w, r, message)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(concierge || !message.Internal, "internal", "only the concierge can write internal messages")
+	if data.ValidateMessage(v, message); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Message.Insert(r.Context(), message)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.publishMessage(request, message)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listMessages() helper writes a page of the thread of a request, with the
+// internal notes if internal is true. The page starts after the message given as
+// "cursor" in the query string; "next_cursor" in the response is the cursor of the
+// next page, or null on the last one. Clients polling for new messages pass the ID
+// of the last message they have.
+func (app *application) listMessages(w http.ResponseWriter, r *http.Request, request *data.Request, internal bool) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	cursor := data.MessageCursor{
+		After: int64(app.readInt(qs, "cursor", 0, v)),
+		Limit: app.readInt(qs, "limit", 20, v),
+	}
+	if data.ValidateMessageCursor(v, cursor); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	messages, next, err := app.models.Message.List(r.Context(), request.ID, internal, cursor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var nextCursor interface{}
+	if next != 0 {
+		nextCursor = next
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"messages": messages, "next_cursor": nextCursor}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The markMessagesRead() helper records that the logged in user has read the
+// thread of a request up to the message given as "up_to" in the request body.
+func (app *application) markMessagesRead(w http.ResponseWriter, r *http.Request, request *data.Request, internal bool) {
+	var input struct {
+		UpTo int64 `json:"up_to"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.UpTo > 0, "up_to", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	read, err := app.models.Message.MarkRead(r.Context(), request.ID, app.contextGetUser(r).ID, input.UpTo, internal)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"read": read}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readAttachment() helper loads the attachment identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) readAttachment(w http.ResponseWriter, r *http.Request) *data.Attachment {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	attachment, err := app.models.Message.GetAttachment(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return attachment
+}
+
+// The writeAttachment() helper sends an attachment as a download, so that browsers
+// never render what clients upload.
+func (app *application) writeAttachment(w http.ResponseWriter, attachment *data.Attachment) {
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachment.Filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(attachment.Content)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(attachment.Content)
+}
+
+func (app *application) listClientMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if request := app.clientReadRequest(w, r); request != nil {
+		app.listMessages(w, r, request, false)
+	}
+}
+
+func (app *application) postClientMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if request := app.clientReadRequest(w, r); request != nil {
+		app.postMessage(w, r, request, false)
+	}
+}
+
+func (app *application) markClientMessagesReadHandler(w http.ResponseWriter, r *http.Request) {
+	if request := app.clientReadRequest(w, r); request != nil {
+		app.markMessagesRead(w, r, request, false)
+	}
+}
+
+// The showClientAttachmentHandler() sends a client an attachment of a message of
+// one of their requests. Attachments of internal notes and of other clients'
+// requests are reported as not found.
+func (app *application) showClientAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	attachment := app.readAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+
+	request, err := app.models.Request.GetByRequestID(r.Context(), attachment.RequestID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if attachment.Internal || request.ClientID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.writeAttachment(w, attachment)
+}
+
+func (app *application) listConciergeMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if request := app.adminReadRequest(w, r); request != nil {
+		app.listMessages(w, r, request, true)
+	}
+}
+
+func (app *application) postConciergeMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if request := app.adminReadRequest(w, r); request != nil {
+		app.postMessage(w, r, request, true)
+	}
+}
+
+func (app *application) markConciergeMessagesReadHandler(w http.ResponseWriter, r *http.Request) {
+	if request := app.adminReadRequest(w, r); request != nil {
+		app.markMessagesRead(w, r, request, true)
+	}
+}
+
+func (app *application) showConciergeAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if attachment := app.readAttachment(w, r); attachment != nil {
+		app.writeAttachment(w, attachment)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/concierge/service/internal/data"
+)
+
+func TestMessages(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	ctx := context.Background()
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	seedUser(t, app, "other@example.com", "client", 0)
+	seedUser(t, app, "cs@example.com", "csmanager", 0)
+	seedRequest(t, app, alice)
+	client := ts.loggedIn("client@example.com")
+	other := ts.loggedIn("other@example.com")
+	cs := ts.loggedIn("cs@example.com")
+
+	tests := []struct {
+		name     string
+		c        *testClient
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{"internal note by the client", client, http.MethodPost, "/v1/requests/1/messages", `{"body":"hi","internal":true}`, http.StatusUnprocessableEntity},
+		{"blank message", client, http.MethodPost, "/v1/requests/1/messages", `{"body":" "}`, http.StatusUnprocessableEntity},
+		{"message by the client", client, http.MethodPost, "/v1/requests/1/messages", `{"body":"Table for 4 please"}`, http.StatusCreated},
+		{"thread of someone else", other, http.MethodGet, "/v1/requests/1/messages", "", http.StatusNotFound},
+		{"concierge thread by the client", client, http.MethodGet, "/v1/cs/requests/1/messages", "", http.StatusForbidden},
+		{"internal note", cs, http.MethodPost, "/v1/cs/requests/1/messages", `{"body":"VIP, check allergies","internal":true}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := tt.c.do(tt.method, tt.path, tt.body)
+			wantStatus(t, code, body, tt.wantCode)
+		})
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("body", "Here is the menu")
+	fw, err := mw.CreateFormFile("attachments", "menu.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("soup\nfish\n"))
+	mw.Close()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/cs/requests/1/messages", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	code, _, body := cs.send(req)
+	wantStatus(t, code, body, http.StatusCreated)
+	wantContains(t, body, `"filename":"menu.txt"`)
+	for i := 0; i < 3; i++ {
+		code, body = cs.do(http.MethodPost, "/v1/cs/requests/1/messages", `{"body":"More options"}`)
+		wantStatus(t, code, body, http.StatusCreated)
+	}
+
+	// The client pages through the five messages that aren't internal notes.
+	code, body = client.get("/v1/requests/1/messages?limit=2")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"next_cursor":3`)
+	if strings.Contains(body, "VIP") {
+		t.Errorf("the client sees an internal note: %s", body)
+	}
+	code, body = client.get("/v1/requests/1/messages?limit=2&cursor=3")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"next_cursor":5`)
+	code, body = client.get("/v1/requests/1/messages?limit=2&cursor=5")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"next_cursor":null`, `"id":6`)
+	code, body = cs.get("/v1/cs/requests/1/messages")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, "VIP")
+
+	code, body = client.get("/v1/attachments/1")
+	wantStatus(t, code, body, http.StatusOK)
+	if body != "soup\nfish" {
+		t.Errorf("got attachment %q", body)
+	}
+	code, body = other.get("/v1/attachments/1")
+	wantStatus(t, code, body, http.StatusNotFound)
+
+	code, body = client.do(http.MethodPost, "/v1/requests/1/messages/read", `{"up_to":6}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `{"read":4}`)
+	code, body = cs.do(http.MethodPost, "/v1/cs/requests/1/messages/read", `{"up_to":1}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `{"read":1}`)
+	code, body = client.get("/v1/requests/1/messages?limit=1")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"read_by":[{"user_id":4`)
+
+	// Six messages posted and two receipts.
+	admin := ts.loggedIn("admin@example.com")
+	code, body = admin.get("/v1/admin/audit?entity_type=message")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":8`)
+	code, body = admin.get("/v1/admin/audit?entity_type=message&entity_id=1")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, "Table for 4 please")
+
+	// Erasing the client's personal data erases what they wrote, in the audit log
+	// too.
+	err = app.models.PersonalData.Erase(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body = admin.get("/v1/admin/audit?entity_type=message&entity_id=1")
+	wantStatus(t, code, body, http.StatusOK)
+	if strings.Contains(body, "Table for 4 please") {
+		t.Errorf("the audit log keeps an erased message: %s", body)
+	}
+	messages, _, err := app.models.Message.List(ctx, 1, true, data.MessageCursor{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].Body != data.ErasedMessageBody {
+		t.Errorf("got body %q; want %q", messages[0].Body, data.ErasedMessageBody)
+	}
+}
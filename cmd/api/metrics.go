@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/concierge/service/internal/mailer"
+	"github.com/concierge/service/internal/metrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+// appMetrics groups every metric the application exposes at /debug/metrics.
+type appMetrics struct {
+	registry *metrics.Registry
+
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	mailSent        *metrics.CounterVec
+}
+
+// newAppMetrics builds the metrics registry. Values that are already tracked
+// elsewhere (the database pool and the background goroutine count) are read at
+// scrape time instead of being copied around.
+func (app *application) newAppMetrics() *appMetrics {
+	registry := metrics.NewRegistry()
+
+	m := &appMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("http_requests_total",
+			"Total number of HTTP requests by method, route pattern and status code.",
+			"method", "route", "status"),
+		requestDuration: registry.NewHistogramVec("http_request_duration_seconds",
+			"HTTP request latency by method and route pattern.",
+			nil, "method", "route"),
+		mailSent: registry.NewCounterVec("mail_sent_total",
+			"Total number of emails handed to the SMTP server, by template and result.",
+			"template", "result"),
+	}
+
+	registry.NewGaugeFunc("background_goroutines",
+		"Number of background tasks started with app.background() that are still running.",
+		func() float64 { return float64(app.backgroundTasks.Load()) })
+
+	registry.NewGaugeFunc("event_streams",
+		"Number of clients currently connected to /v1/events.",
+		func() float64 { return float64(app.events.Subscribers()) })
+	registry.NewCounterFunc("event_streams_dropped_total",
+		"Total number of event streams ended for falling behind.",
+		func() float64 { return float64(app.events.Dropped()) })
+
+	registry.NewGaugeFunc("db_max_open_connections", "Maximum number of open connections to the database.",
+		func() float64 { return float64(app.models.System.Stats().MaxOpenConnections) })
+	registry.NewGaugeFunc("db_open_connections", "The number of established connections both in use and idle.",
+		func() float64 { return float64(app.models.System.Stats().OpenConnections) })
+	registry.NewGaugeFunc("db_in_use_connections", "The number of connections currently in use.",
+		func() float64 { return float64(app.models.System.Stats().InUse) })
+	registry.NewGaugeFunc("db_idle_connections", "The number of idle connections.",
+		func() float64 { return float64(app.models.System.Stats().Idle) })
+
+	registry.NewCounterFunc("db_wait_count_total", "The total number of connections waited for.",
+		func() float64 { return float64(app.models.System.Stats().WaitCount) })
+	registry.NewCounterFunc("db_wait_duration_seconds_total", "The total time blocked waiting for a new connection.",
+		func() float64 { return app.models.System.Stats().WaitDuration.Seconds() })
+	registry.NewCounterFunc("db_max_idle_closed_total", "The total number of connections closed due to SetMaxIdleConns.",
+		func() float64 { return float64(app.models.System.Stats().MaxIdleClosed) })
+	registry.NewCounterFunc("db_max_idle_time_closed_total", "The total number of connections closed due to SetConnMaxIdleTime.",
+		func() float64 { return float64(app.models.System.Stats().MaxIdleTimeClosed) })
+	registry.NewCounterFunc("db_max_lifetime_closed_total", "The total number of connections closed due to SetConnMaxLifetime.",
+		func() float64 { return float64(app.models.System.Stats().MaxLifetimeClosed) })
+
+	return m
+}
+
+// metricsResponseWriter records the status code written by the wrapped handler.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	statusCode    int
+	headerWritten bool
+}
+
+func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
+	if !mw.headerWritten {
+		mw.statusCode = statusCode
+		mw.headerWritten = true
+	}
+	mw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	mw.headerWritten = true
+	return mw.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers keep working through the wrapper.
+func (mw *metricsResponseWriter) Flush() {
+	if flusher, ok := mw.ResponseWriter.(http.Flusher); ok {
+		mw.headerWritten = true
+		flusher.Flush()
+	}
+}
+
+func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+// The recordMetrics() middleware records the count, latency and status code of every
+// request. Requests are labelled with the route pattern they matched (e.g.
+// "/v1/admin/users/:id") rather than the raw path, so that the number of series
+// stays bounded.
+func (app *application) recordMetrics(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// Resolve the route up front: ServeFiles rewrites r.URL.Path in place.
+		route := routePattern(router, r.Method, r.URL.Path)
+		mw := &metricsResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		next.ServeHTTP(mw, r)
+
+		app.metrics.requests.Inc(r.Method, route, strconv.Itoa(mw.statusCode))
+		app.metrics.requestDuration.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+// routePattern reconstructs the httprouter pattern that path matched by putting the
+// parameter names back in place of their values. httprouter v1.3.0 doesn't expose
+// the matched pattern directly. Unmatched paths are reported as "unmatched".
+func routePattern(router *httprouter.Router, method, path string) string {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	handle, params, _ := router.Lookup(method, path)
+	if handle == nil {
+		return "unmatched"
+	}
+	if len(params) == 0 {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	next := 0
+	for _, param := range params {
+		// Catch-all parameters swallow the rest of the path, including the leading
+		// slash.
+		if strings.HasPrefix(param.Value, "/") {
+			prefix := strings.TrimSuffix(path, param.Value)
+			return prefix + "/*" + param.Key
+		}
+		for i := next; i < len(segments); i++ {
+			if segments[i] == param.Value {
+				segments[i] = ":" + param.Key
+				next = i + 1
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// The requireMetricsAccess() middleware protects /debug/metrics. Scrapers can
+// authenticate with "Authorization: Bearer <metrics-token>" when a token is
+// configured; otherwise only a logged-in admin can read the metrics.
+func (app *application) requireMetricsAccess(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.config.metrics.token != "" {
+			header := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(header, "Bearer ")
+			if token != header && subtle.ConstantTimeCompare([]byte(token), []byte(app.config.metrics.token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		user := app.contextGetUser(r)
+		if user == nil || user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+		if user.UserType != "admin" {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := app.metrics.registry.WriteTo(w)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The sendEmail() helper sends an email through app.mailer and records the outcome
+// in the mail_sent_total metric. Use it instead of calling app.mailer.Send()
+// directly.
+func (app *application) sendEmail(recipient, templateFile string, data interface{}, attachments ...mailer.Attachment) error {
+	err := app.mailer.Send(recipient, templateFile, data, attachments...)
+	if err != nil {
+		app.metrics.mailSent.Inc(templateFile, "failure")
+		return err
+	}
+	app.metrics.mailSent.Inc(templateFile, "success")
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMetricsAccess(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.metrics.token = "scrape-token"
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "client@example.com", "client", 0)
+
+	anonymous := ts.newClient()
+	anonymous.get("/v1/healthcheck")
+
+	tests := []struct {
+		name     string
+		client   *testClient
+		headers  []string
+		wantCode int
+	}{
+		{"anonymous", anonymous, nil, http.StatusUnauthorized},
+		{"wrong token", anonymous, []string{"Authorization", "Bearer nope"}, http.StatusUnauthorized},
+		{"scraper", anonymous, []string{"Authorization", "Bearer scrape-token"}, http.StatusOK},
+		{"client", ts.loggedIn("client@example.com"), nil, http.StatusForbidden},
+		{"admin", ts.loggedIn("admin@example.com"), nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := tt.client.do(http.MethodGet, "/debug/metrics", "", tt.headers...)
+			wantStatus(t, code, body, tt.wantCode)
+			if code == http.StatusOK {
+				wantContains(t, body, `http_requests_total{method="GET",route="/v1/healthcheck",status="200"} 1`)
+			}
+		})
+	}
+}
@@ -1,15 +1,165 @@
 package main
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/concierge/service/internal/data"
 	"github.com/concierge/service/internal/validator"
-	"github.com/go-session/session/v3"
+	"mime"
 	"net/http"
+	"regexp"
+	"strings"
 )
 
+// requestIDRX restricts incoming X-Request-ID values to something safe to echo back
+// in headers and to write into the logs.
+var requestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+// The requestID() middleware makes sure every request carries a correlation ID. An
+// X-Request-ID header set by a proxy or client in front of us is propagated as-is
+// (if it looks sane), otherwise a new random ID is generated. The ID is stored in
+// the request context for logError() and echoed in the response headers so a
+// customer complaint can be matched to our logs.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			randomBytes := make([]byte, 16)
+			_, err := rand.Read(randomBytes)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestID(r, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contentSecurityPolicy allows the pages to load our own files plus the web fonts
+// (Google Fonts, Typekit) and the Google Maps embed on the landing page. Inline
+// style attributes are allowed because the templates and Chart.js use them; inline
+// scripts are not.
+var contentSecurityPolicy = strings.Join([]string{
+	"default-src 'self'",
+	"script-src 'self'",
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com https://use.typekit.net https://p.typekit.net",
+	"font-src 'self' https://fonts.gstatic.com https://use.typekit.net",
+	"img-src 'self' data:",
+	"frame-src https://www.google.com",
+	"object-src 'none'",
+	"base-uri 'self'",
+	"form-action 'self'",
+	"frame-ancestors 'none'",
+}, "; ")
+
+// The secureHeaders() middleware sets the browser security headers on every
+// response. HSTS is only sent outside development, where the server is reached over
+// plain HTTP.
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		w.Header().Set("X-Frame-Options", "deny")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+
+		if app.config.env != "development" && app.config.hsts.maxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(app.config.hsts.maxAge.Seconds())))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The enableCORS() middleware lets the trusted origins (-cors-trusted-origins) call
+// the JSON API from a browser. Only /v1 routes are opened up; the HTML pages stay
+// same-origin. The API is authenticated by the session cookie, so credentials are
+// allowed, which is why the origin is always echoed back instead of "*".
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+		if origin != "" && app.trustedOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
+			// A preflight request asks whether the real request may be sent. Answer it
+			// here, there is no handler to route it to.
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID, X-Requested-With, Idempotency-Key")
+				w.Header().Set("Access-Control-Max-Age", "3600")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// messagesPathRX matches the routes messages are posted to, which also take
+// attachments as multipart/form-data.
+var messagesPathRX = regexp.MustCompile(`^/v1/(cs/)?requests/[0-9]+/messages$`)
+
+// The requireJSON() middleware closes the /v1 API to cross-site forms. The API is
+// authenticated by the session cookie, and a form on another site can post to it
+// as text/plain, urlencoded or multipart without a CORS preflight. So every POST,
+// PUT, PATCH and DELETE has to say that it sends JSON, which only a script allowed
+// by CORS can, and is answered 415 Unsupported Media Type otherwise, body or not.
+// Messages with attachments are the exception: they are multipart, and have to carry
+// an X-Requested-With header instead, which a form can't set either. The payment
+// webhook is authenticated by its signature, not a cookie, so it is left alone.
+func (app *application) requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/v1/") || r.URL.Path == "/v1/payments/webhook" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch {
+		case mediaType == "application/json":
+		case mediaType == "multipart/form-data" && r.Method == http.MethodPost &&
+			messagesPathRX.MatchString(r.URL.Path) && r.Header.Get("X-Requested-With") != "":
+		default:
+			app.unsupportedMediaTypeResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) trustedOrigin(origin string) bool {
+	for _, trusted := range app.config.cors.trustedOrigins {
+		if origin == trusted {
+			return true
+		}
+	}
+	return false
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function (which will always be run in the event of a panic
@@ -53,9 +203,31 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 //	})
 //}
 
+// The auditActor() middleware tells the data layer who is behind the request, so
+// that the changes it makes are attributed in the audit log. It must run after
+// authenticate().
+func (app *application) auditActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := data.AuditActor{
+			IP:        app.clientIP(r),
+			RequestID: app.contextGetRequestID(r),
+		}
+		if user := app.contextGetUser(r); user != nil && !user.IsAnonymous() {
+			actor.UserID = user.ID
+		}
+
+		ctx := data.ContextWithAuditActor(r.Context(), actor)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		store, err := session.Start(context.Background(), w, r)
+		store, err := app.startSession(w, r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		tokenI, ok := store.Get("Bearer")
 
 		if !ok {
@@ -79,11 +251,21 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: Notice that we are using
 		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.User.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.User.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+				// The token has expired or was revoked (password change, deactivation).
+				// Forget it and carry on as an anonymous user, otherwise the stale
+				// session cookie would lock the browser out of every page.
+				store.Delete("Bearer")
+				err = store.Save()
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+				r = app.contextSetUser(r, data.AnonymousUser)
+				next.ServeHTTP(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
@@ -133,7 +315,7 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 		// Retrieve the user from the request context.
 		user := app.contextGetUser(r)
 		// Get the slice of permissions for the user.
-		//permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		//permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		//if err != nil {
 		if user.UserType != code {
 			//app.serverErrorResponse(w, r, err)
@@ -155,3 +337,89 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	//print(1)
 	return app.requireActivatedUser(fn)
 }
+
+// The requireAPIPermission() middleware is the JSON API counterpart of
+// requirePermission(): instead of redirecting to the landing page it answers with a
+// JSON error, which is what API clients expect.
+func (app *application) requireAPIPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user.UserType != code {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireActivatedAPIUser(fn)
+}
+
+// The requirePartner() middleware only lets through partners, who always belong to
+// a company (see data.ValidateUserCompany). Handlers behind it only show the
+// partner what concerns that company.
+func (app *application) requirePartner(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetUser(r).CompanyID == 0 {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireAPIPermission(data.UserTypePartner, fn)
+}
+
+// The requireClient() middleware only lets through B2C and B2B clients. Handlers
+// behind it only show the client their own requests and bookings.
+func (app *application) requireClient(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !app.contextGetUser(r).IsClient() {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireActivatedAPIUser(fn)
+}
+
+// The requireB2BClient() middleware only lets through B2B clients who belong to a
+// company. Handlers behind it only show the client what concerns that company.
+func (app *application) requireB2BClient(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetUser(r).CompanyID == 0 {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireAPIPermission(data.UserTypeB2BClient, fn)
+}
+
+// The requireConcierge() middleware only lets through the concierge's own staff: CS
+// managers and admins. Handlers behind it see every client's requests.
+func (app *application) requireConcierge(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user.UserType != data.UserTypeCSManager && user.UserType != data.UserTypeAdmin {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireActivatedAPIUser(fn)
+}
+
+// The requireActivatedAPIUser() middleware lets through any logged-in user whose
+// account is activated, whatever their user type.
+func (app *application) requireActivatedAPIUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user == nil || user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
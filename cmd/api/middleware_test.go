@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecureHeaders(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.hsts.maxAge = time.Hour
+	ts := newTestServer(t, app)
+	c := ts.newClient()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, header, _ := c.send(req)
+	want := map[string]string{
+		"Content-Security-Policy": contentSecurityPolicy,
+		"X-Frame-Options":         "deny",
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "strict-origin-when-cross-origin",
+		// HSTS is never sent in development, which runs over plain HTTP.
+		"Strict-Transport-Security": "",
+	}
+	for name, value := range want {
+		if got := header.Get(name); got != value {
+			t.Errorf("%s: got %q; want %q", name, got, value)
+		}
+	}
+
+	app.config.env = "production"
+	_, header, _ = c.send(req.Clone(req.Context()))
+	if got := header.Get("Strict-Transport-Security"); got != "max-age=3600; includeSubDomains" {
+		t.Errorf("Strict-Transport-Security in production: got %q", got)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.cors.trustedOrigins = []string{"https://app.example.com"}
+	ts := newTestServer(t, app)
+	c := ts.newClient()
+
+	send := func(method, path string, headers ...string) http.Header {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		_, header, _ := c.send(req)
+		return header
+	}
+
+	header := send(http.MethodGet, "/v1/healthcheck", "Origin", "https://app.example.com")
+	if header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("trusted origin: got %v", header)
+	}
+
+	header = send(http.MethodOptions, "/v1/me", "Origin", "https://app.example.com", "Access-Control-Request-Method", "PATCH")
+	if header.Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("trusted preflight: got %v", header)
+	}
+
+	header = send(http.MethodOptions, "/v1/me", "Origin", "https://evil.example.com", "Access-Control-Request-Method", "PATCH")
+	if header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("untrusted preflight: got %v", header)
+	}
+
+	// The HTML pages stay same-origin.
+	header = send(http.MethodGet, "/", "Origin", "https://app.example.com")
+	if header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("HTML page: got %v", header)
+	}
+}
+
+func TestRequireJSON(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	seedRequest(t, app, alice)
+	client := ts.loggedIn("client@example.com")
+
+	const multipartBody = "--b\r\nContent-Disposition: form-data; name=\"body\"\r\n\r\nHello\r\n--b--\r\n"
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		headers     []string
+		wantCode    int
+	}{
+		{"JSON", http.MethodPost, "/v1/requests", "application/json", `{"type":"dinner"}`, nil, http.StatusCreated},
+		{"JSON with a charset", http.MethodPost, "/v1/requests", "application/json; charset=utf-8", `{"type":"dinner"}`, nil, http.StatusCreated},
+		{"plain text form", http.MethodPost, "/v1/requests", "text/plain", `{"type":"dinner"}`, nil, http.StatusUnsupportedMediaType},
+		{"urlencoded form", http.MethodPatch, "/v1/me", "application/x-www-form-urlencoded", "first_name=Eve", nil, http.StatusUnsupportedMediaType},
+		{"no body and no Content-Type", http.MethodPost, "/v1/requests/1/messages/read", "", "", nil, http.StatusUnsupportedMediaType},
+		{"multipart message", http.MethodPost, "/v1/requests/1/messages", "multipart/form-data; boundary=b", multipartBody, []string{"X-Requested-With", "XMLHttpRequest"}, http.StatusCreated},
+		{"multipart message from a form", http.MethodPost, "/v1/requests/1/messages", "multipart/form-data; boundary=b", multipartBody, nil, http.StatusUnsupportedMediaType},
+		{"multipart elsewhere", http.MethodPost, "/v1/requests", "multipart/form-data; boundary=b", multipartBody, []string{"X-Requested-With", "XMLHttpRequest"}, http.StatusUnsupportedMediaType},
+		{"read", http.MethodGet, "/v1/requests/1/messages", "", "", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			for i := 0; i+1 < len(tt.headers); i += 2 {
+				req.Header.Set(tt.headers[i], tt.headers[i+1])
+			}
+			code, _, body := client.send(req)
+			wantStatus(t, code, body, tt.wantCode)
+		})
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// partnerBooking is a booking as the partner providing the service sees it: with
+// what the client asked for, but not who the client is.
+type partnerBooking struct {
+	*data.Booking
+	Request partnerRequest `json:"request"`
+}
+
+type partnerRequest struct {
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newPartnerBooking(booking *data.Booking, request *data.Request) *partnerBooking {
+	return &partnerBooking{
+		Booking: booking,
+		Request: partnerRequest{
+			Type:        request.Type,
+			Description: request.Description,
+			Status:      request.Status,
+			CreatedAt:   request.CreatedAt,
+		},
+	}
+}
+
+// partnerService is a service together with its current prices.
+type partnerService struct {
+	*data.Service
+	Prices []*data.Price `json:"prices"`
+}
+
+// listPartnerBookings returns a page of the bookings for the services of the
+// company, with the requests they were made for. Bookings waiting for the approval
+// of the client's company, or rejected by it, are left out.
+func (app *application) listPartnerBookings(r *http.Request, filter data.BookingFilter, filters data.Filters) ([]*partnerBooking, data.Metadata, error) {
+	filter.SentToPartner = true
+	bookings, metadata, err := app.models.Booking.List(r.Context(), filter, filters)
+	if err != nil {
+		return nil, data.Metadata{}, err
+	}
+
+	result := make([]*partnerBooking, 0, len(bookings))
+	for _, booking := range bookings {
+		request, err := app.models.Request.GetByRequestID(r.Context(), booking.RequestID)
+		if err != nil {
+			return nil, data.Metadata{}, err
+		}
+		result = append(result, newPartnerBooking(booking, request))
+	}
+	return result, metadata, nil
+}
+
+// The partnerReadBooking() helper loads the booking identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+// Bookings for other companies' services are reported as not found, and so are
+// the ones the partner hasn't been sent because they wait for the approval of the
+// client's company or were rejected by it.
+func (app *application) partnerReadBooking(w http.ResponseWriter, r *http.Request) *partnerBooking {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	booking, err := app.models.Booking.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	// A service withdrawn from the catalog still has to be delivered for the
+	// bookings made before, so deleted services count too.
+	service, err := app.models.Service.GetById(data.ContextWithDeleted(r.Context()), booking.ServiceID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+	if int64(service.CompanyID) != app.contextGetUser(r).CompanyID {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	awaiting, err := app.awaitingApproval(r.Context(), booking.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+	if awaiting {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	request, err := app.models.Request.GetByRequestID(r.Context(), booking.RequestID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return newPartnerBooking(booking, request)
+}
+
+// The partnerUpdateBooking() helper saves the changes made to a booking and writes
+// the response.
+func (app *application) partnerUpdateBooking(w http.ResponseWriter, r *http.Request, booking *partnerBooking) {
+	if !app.updateBooking(w, r, booking.Booking) {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"booking": booking}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPartnerBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.BookingFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.CompanyID = app.contextGetUser(r).CompanyID
+	input.PartnerStatus = app.readString(qs, "partner_status", "")
+	input.FulfilmentStatus = app.readString(qs, "fulfilment_status", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = data.BookingSortSafelist
+
+	data.ValidateBookingFilter(v, input.BookingFilter)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	bookings, metadata, err := app.listPartnerBookings(r, input.BookingFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"bookings": bookings, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showPartnerBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.partnerReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"booking": booking}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) acceptPartnerBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.partnerReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	switch {
+	case booking.Cancelled():
+		app.errorResponse(w, r, http.StatusConflict, data.ErrBookingCancelled.Error())
+		return
+	case booking.PartnerStatus != data.PartnerStatusPending:
+		app.errorResponse(w, r, http.StatusConflict, "the booking has already been "+booking.PartnerStatus)
+		return
+	}
+
+	booking.PartnerStatus = data.PartnerStatusAccepted
+
+	app.partnerUpdateBooking(w, r, booking)
+}
+
+func (app *application) declinePartnerBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.partnerReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The concierge has to find the client another provider, so they need to know
+	// why.
+	v := validator.New()
+	v.Check(input.Reason != "", "reason", "must be provided")
+	v.Check(len(input.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	switch {
+	case booking.Cancelled():
+		app.errorResponse(w, r, http.StatusConflict, data.ErrBookingCancelled.Error())
+		return
+	case booking.PartnerStatus != data.PartnerStatusPending:
+		app.errorResponse(w, r, http.StatusConflict, "the booking has already been "+booking.PartnerStatus)
+		return
+	}
+
+	// A declined booking no longer holds its slot. If the client reschedules it, a
+	// new one is reserved.
+	reservation := booking.ReservationID
+	booking.PartnerStatus = data.PartnerStatusDeclined
+	booking.PartnerNote = input.Reason
+	booking.ReservationID = 0
+
+	if !app.updateBooking(w, r, booking.Booking) {
+		return
+	}
+	app.releaseSlot(r, reservation)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"booking": booking}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updatePartnerBookingFulfilmentHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.partnerReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	var input struct {
+		FulfilmentStatus string `json:"fulfilment_status"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.In(input.FulfilmentStatus, data.FulfilmentStatuses...), "fulfilment_status", "invalid fulfilment status")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	switch {
+	case booking.Cancelled():
+		app.errorResponse(w, r, http.StatusConflict, data.ErrBookingCancelled.Error())
+		return
+	case booking.PartnerStatus != data.PartnerStatusAccepted:
+		app.errorResponse(w, r, http.StatusConflict, "the booking must be accepted first")
+		return
+	case !data.CanAdvanceFulfilment(booking.FulfilmentStatus, input.FulfilmentStatus):
+		app.errorResponse(w, r, http.StatusConflict, "the booking is already "+booking.FulfilmentStatus)
+		return
+	}
+
+	booking.Advance(input.FulfilmentStatus)
+
+	if !app.updateBooking(w, r, booking.Booking) {
+		return
+	}
+
+	// Clients with a deposit pay for their bookings from it once they are provided.
+	if booking.FulfilmentStatus == data.FulfilmentCompleted {
+		app.logDebitBooking(r.Context(), booking.Booking)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"booking": booking}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPartnerServicesHandler(w http.ResponseWriter, r *http.Request) {
+	services, err := app.models.Service.GetAllForCompany(r.Context(), app.contextGetUser(r).CompanyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	result := make([]*partnerService, 0, len(services))
+	for _, service := range services {
+		prices, err := app.models.Price.GetByServiceId(r.Context(), service.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		result = append(result, &partnerService{Service: service, Prices: prices})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"services": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The proposeServiceChangeHandler() lets a partner change the description and
+// prices of one of their services. The change only takes effect once an admin has
+// approved it. Fields that are left out keep their current values; prices are
+// replaced as a whole, so a user type left out of the list loses its price.
+func (app *application) proposeServiceChangeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	service, err := app.models.Service.GetById(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if int64(service.CompanyID) != user.CompanyID {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Description *string             `json:"description"`
+		Prices      data.ProposedPrices `json:"prices"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.Description == nil && input.Prices == nil {
+		v.AddError("description", "either description or prices must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	change := &data.ServiceChange{
+		ServiceID:    service.ID,
+		ProposedByID: user.ID,
+		Description:  service.Description,
+		Prices:       input.Prices,
+		Status:       data.ServiceChangePending,
+	}
+	if input.Description != nil {
+		change.Description = *input.Description
+	}
+	if change.Prices == nil {
+		prices, err := app.models.Price.GetByServiceId(r.Context(), service.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		change.Prices = data.ProposedPrices{}
+		for _, price := range prices {
+			if validator.In(price.UserType, data.PricedUserTypes...) {
+				change.Prices = append(change.Prices, data.ProposedPrice{UserType: price.UserType, Price: price.Price})
+			}
+		}
+	}
+
+	if data.ValidateServiceChange(v, change); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.ServiceChange.Insert(r.Context(), change)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPendingServiceChange):
+			app.errorResponse(w, r, http.StatusConflict, "a change to this service is already awaiting approval")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"service_change": change}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPartnerServiceChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.ServiceChangeFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.CompanyID = app.contextGetUser(r).CompanyID
+	input.Status = app.readString(qs, "status", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = data.ServiceChangeSortSafelist
+
+	if input.Status != "" {
+		v.Check(validator.In(input.Status, data.ServiceChangeStatuses...), "status", "invalid status")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	changes, metadata, err := app.models.ServiceChange.List(r.Context(), input.ServiceChangeFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"service_changes": changes, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The PartnerPageHandler() shows the partner the bookings waiting for an answer
+// and the ones being fulfilled, leaving out cancelled ones. Everything else is done through the /v1/partner API.
+func (app *application) PartnerPageHandler(w http.ResponseWriter, r *http.Request) {
+	td := app.newTemplateData(r)
+
+	// A zero CompanyID would match every company. Validation keeps partners from
+	// being without one, but the page must not depend on that.
+	companyID := app.contextGetUser(r).CompanyID
+	if companyID == 0 {
+		app.render(w, r, http.StatusOK, "partner.html", td)
+		return
+	}
+
+	filters := data.Filters{Page: 1, PageSize: 100, Sort: "-created_at", SortSafelist: data.BookingSortSafelist}
+	for _, status := range []string{data.PartnerStatusPending, data.PartnerStatusAccepted} {
+		filter := data.BookingFilter{CompanyID: companyID, PartnerStatus: status}
+		bookings, _, err := app.listPartnerBookings(r, filter, filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, booking := range bookings {
+			if !booking.Cancelled() && booking.FulfilmentStatus != data.FulfilmentCompleted {
+				td.Bookings = append(td.Bookings, booking)
+			}
+		}
+	}
+
+	app.render(w, r, http.StatusOK, "partner.html", td)
+}
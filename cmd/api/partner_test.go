@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/concierge/service/internal/data"
+)
+
+// seedService creates a service provided by a company, with a price for each of
+// the user types in prices.
+func seedService(t *testing.T, app *application, company *data.Company, prices map[string]int) *data.Service {
+	t.Helper()
+
+	ctx := context.Background()
+	service := &data.Service{Name: "Dinner", Description: "A table for the evening", Type: "restaurant", CompanyID: int(company.ID), CreatedByID: 1}
+	err := app.models.Service.Insert(ctx, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for userType, price := range prices {
+		err = app.models.Price.Insert(ctx, &data.Price{ServiceID: service.ID, UserType: userType, Price: price})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return service
+}
+
+func TestPartnerBookings(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	resto := seedCompany(t, app, "Resto")
+	other := seedCompany(t, app, "Other")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "partner@example.com", "partner", resto.ID)
+	client := seedUser(t, app, "client@example.com", "client", 0)
+	dinner := seedService(t, app, resto, map[string]int{"client": 100})
+	elsewhere := seedService(t, app, other, map[string]int{"client": 5})
+	request := seedRequest(t, app, client)
+	admin := ts.loggedIn("admin@example.com")
+
+	for _, service := range []int64{dinner.ID, elsewhere.ID} {
+		code, body := admin.do(http.MethodPost, fmt.Sprintf("/v1/admin/requests/%d/bookings", request.ID),
+			fmt.Sprintf(`{"service_id":%d,"starts_at":"2099-01-01T19:00:00Z","ends_at":"2099-01-01T21:00:00Z"}`, service))
+		wantStatus(t, code, body, http.StatusCreated)
+	}
+
+	partner := ts.loggedIn("partner@example.com")
+
+	// Partners only see the bookings of their own company, and not who the client
+	// is.
+	code, body := partner.get("/v1/partner/bookings")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`, `"description":"A table for two"`)
+	if strings.Contains(body, `"client_id"`) {
+		t.Errorf("the partner can see the client: %s", body)
+	}
+	code, body = partner.get("/v1/partner/bookings/2")
+	wantStatus(t, code, body, http.StatusNotFound)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{"fulfil before accepting", http.MethodPut, "/v1/partner/bookings/1/fulfilment", `{"fulfilment_status":"in_progress"}`, http.StatusConflict},
+		{"accept", http.MethodPost, "/v1/partner/bookings/1/accept", "", http.StatusOK},
+		{"decline once accepted", http.MethodPost, "/v1/partner/bookings/1/decline", `{"reason":"full"}`, http.StatusConflict},
+		{"start", http.MethodPut, "/v1/partner/bookings/1/fulfilment", `{"fulfilment_status":"in_progress"}`, http.StatusOK},
+		{"go back", http.MethodPut, "/v1/partner/bookings/1/fulfilment", `{"fulfilment_status":"not_started"}`, http.StatusConflict},
+		{"complete", http.MethodPut, "/v1/partner/bookings/1/fulfilment", `{"fulfilment_status":"completed"}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := partner.do(tt.method, tt.path, tt.body)
+			wantStatus(t, code, body, tt.wantCode)
+		})
+	}
+
+	code, body = admin.get("/v1/admin/audit?entity_type=booking&entity_id=1&action=update")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":3`)
+
+	code, body = partner.get("/v1/admin/users")
+	wantStatus(t, code, body, http.StatusForbidden)
+}
+
+func TestPartnerServiceChanges(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	resto := seedCompany(t, app, "Resto")
+	other := seedCompany(t, app, "Other")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "partner@example.com", "partner", resto.ID)
+	dinner := seedService(t, app, resto, map[string]int{"client": 100, "b2bclient": 90})
+	elsewhere := seedService(t, app, other, map[string]int{"client": 5})
+	admin := ts.loggedIn("admin@example.com")
+	partner := ts.loggedIn("partner@example.com")
+	changes := fmt.Sprintf("/v1/partner/services/%d/changes", dinner.ID)
+
+	code, body := partner.do(http.MethodPost, fmt.Sprintf("/v1/partner/services/%d/changes", elsewhere.ID), `{"description":"x"}`)
+	wantStatus(t, code, body, http.StatusNotFound)
+	code, body = partner.do(http.MethodPost, changes, `{"prices":[{"user_type":"admin","price":1}]}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+
+	code, body = partner.do(http.MethodPost, changes, `{"description":"Now with a view"}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	// One change at a time.
+	code, body = partner.do(http.MethodPost, changes, `{"description":"Now with two views"}`)
+	wantStatus(t, code, body, http.StatusConflict)
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/service-changes/1/reject", `{"note":"typo"}`)
+	wantStatus(t, code, body, http.StatusOK)
+
+	code, body = partner.do(http.MethodPost, changes, `{"description":"Now with a view","prices":[{"user_type":"client","price":120}]}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	code, body = admin.get("/v1/admin/service-changes?status=pending")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":1`)
+	code, body = admin.do(http.MethodPost, "/v1/admin/service-changes/2/approve", "")
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.do(http.MethodPost, "/v1/admin/service-changes/2/reject", `{"note":"too late"}`)
+	wantStatus(t, code, body, http.StatusConflict)
+
+	// Partners see the prices of their services, except the B2B ones.
+	code, body = partner.get("/v1/partner/services")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, "Now with a view", `"price":120`)
+	if strings.Contains(body, "b2bclient") {
+		t.Errorf("the partner can see B2B prices: %s", body)
+	}
+
+	service, err := app.models.Service.GetById(context.Background(), dinner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Description != "Now with a view" {
+		t.Errorf("got description %q; want the approved one", service.Description)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/payment"
+	"github.com/concierge/service/internal/validator"
+)
+
+// newPaymentGateway returns the payment processor selected with -payment-provider.
+// The fake one takes no money, so outside development it has to be asked for with
+// -payment-allow-fake as well.
+func newPaymentGateway(cfg config) (payment.Gateway, error) {
+	switch cfg.payments.provider {
+	case "fake":
+		if cfg.env != "development" && !cfg.payments.allowFake {
+			return nil, fmt.Errorf("the fake payment processor takes no money: pick a real one with -payment-provider, or pass -payment-allow-fake to use it in the %s environment anyway", cfg.env)
+		}
+		return payment.NewFake(cfg.payments.webhookSecret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", cfg.payments.provider)
+	}
+}
+
+// The readIdempotencyKey() helper returns the Idempotency-Key header of the request,
+// sending the appropriate error response and returning "" if it is missing or
+// invalid.
+func (app *application) readIdempotencyKey(w http.ResponseWriter, r *http.Request) string {
+	key := r.Header.Get("Idempotency-Key")
+
+	v := validator.New()
+	if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return ""
+	}
+	return key
+}
+
+// The paymentGatewayResponse() helper sends the response for an error returned by
+// the payment processor.
+func (app *application) paymentGatewayResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, payment.ErrInvalidAmount), errors.Is(err, payment.ErrUnknownPayment):
+		app.errorResponse(w, r, http.StatusConflict, err.Error())
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The writePayment() helper writes a payment. Declined payments are answered with
+// 402 Payment Required, whether they were just declined or are being replayed.
+func (app *application) writePayment(w http.ResponseWriter, r *http.Request, status int, p *data.Payment) {
+	if p.Status == data.PaymentFailed {
+		status = http.StatusPaymentRequired
+	}
+	err := app.writeJSON(w, status, envelope{"payment": p}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The payBookingHandler() lets a B2C client pay for one of their bookings: the
+// total of the booking is authorized on their payment method and captured by an
+// admin once the booking has been provided. B2B clients are invoiced instead.
+//
+// The request must carry an Idempotency-Key header. Sending it again with the same
+// key, e.g. after a timeout, returns the payment made the first time rather than
+// charging the client twice.
+func (app *application) payBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.clientReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	var input struct {
+		PaymentMethod string `json:"payment_method"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := app.readIdempotencyKey(w, r)
+	if key == "" {
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.PaymentMethod != "", "payment_method", "must be provided")
+	v.Check(len(input.PaymentMethod) <= 255, "payment_method", "must not be more than 255 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	existing, err := app.models.Payment.GetByIdempotencyKey(r.Context(), user.ID, key)
+	switch {
+	case err == nil && existing.BookingID != booking.ID:
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "the idempotency key was already used to pay for another booking")
+		return
+	case err == nil:
+		app.writePayment(w, r, http.StatusOK, existing)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	switch {
+	case booking.Cancelled():
+		app.errorResponse(w, r, http.StatusConflict, data.ErrBookingCancelled.Error())
+		return
+	case booking.PartnerStatus == data.PartnerStatusDeclined:
+		app.errorResponse(w, r, http.StatusConflict, "the booking was declined by the partner")
+		return
+	case booking.Total() <= 0:
+		app.errorResponse(w, r, http.StatusConflict, "the booking is free")
+		return
+	}
+
+	debited, err := app.models.Ledger.BookingDebited(r.Context(), booking.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if debited {
+		app.errorResponse(w, r, http.StatusConflict, "the booking was paid from the deposit")
+		return
+	}
+
+	// The key sent to the processor is scoped to the client, as ours are.
+	result, err := app.payments.Authorize(r.Context(), payment.AuthorizeRequest{
+		Amount:         booking.Total(),
+		Currency:       app.config.payments.currency,
+		PaymentMethod:  input.PaymentMethod,
+		Reference:      fmt.Sprintf("booking-%d", booking.ID),
+		IdempotencyKey: fmt.Sprintf("user-%d-%s", user.ID, key),
+	})
+	if err != nil {
+		app.paymentGatewayResponse(w, r, err)
+		return
+	}
+
+	p := &data.Payment{
+		BookingID:      booking.ID,
+		UserID:         user.ID,
+		Amount:         booking.Total(),
+		Currency:       app.config.payments.currency,
+		Status:         data.PaymentAuthorized,
+		Provider:       app.payments.Name(),
+		ProviderRef:    result.Ref,
+		IdempotencyKey: key,
+	}
+	if result.Status == payment.StatusDeclined {
+		p.Status = data.PaymentFailed
+		p.DeclineReason = result.DeclineReason
+	}
+
+	err = app.models.Payment.Insert(r.Context(), p)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateIdempotencyKey):
+			// A retry sent at the same time got there first.
+			existing, err := app.models.Payment.GetByIdempotencyKey(r.Context(), user.ID, key)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.writePayment(w, r, http.StatusOK, existing)
+		case errors.Is(err, data.ErrBookingPaid):
+			// Another payment for the booking got there first, so the money held
+			// for this one is released.
+			_, err := app.payments.Refund(r.Context(), result.Ref, p.Amount, fmt.Sprintf("user-%d-%s-void", user.ID, key))
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"booking_id":   fmt.Sprint(booking.ID),
+					"provider_ref": result.Ref,
+				})
+			}
+			app.errorResponse(w, r, http.StatusConflict, data.ErrBookingPaid.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writePayment(w, r, http.StatusCreated, p)
+}
+
+// The listPayments() helper writes a page of the payments matching filter, with the
+// page and further filters taken from the query string.
+func (app *application) listPayments(w http.ResponseWriter, r *http.Request, filter data.PaymentFilter) {
+	var input struct {
+		data.PaymentFilter
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.PaymentFilter = filter
+	input.Status = app.readString(qs, "status", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = data.PaymentSortSafelist
+
+	data.ValidatePaymentFilter(v, input.PaymentFilter)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	payments, metadata, err := app.models.Payment.List(r.Context(), input.PaymentFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"payments": payments, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listBookingPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.clientReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	app.listPayments(w, r, data.PaymentFilter{BookingID: booking.ID})
+}
+
+func (app *application) listPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	filter := data.PaymentFilter{
+		BookingID: int64(app.readInt(qs, "booking_id", 0, v)),
+		UserID:    int64(app.readInt(qs, "user_id", 0, v)),
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.listPayments(w, r, filter)
+}
+
+// The adminReadPayment() helper loads the payment identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadPayment(w http.ResponseWriter, r *http.Request) *data.Payment {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	p, err := app.models.Payment.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return p
+}
+
+// The capturePaymentHandler() takes the money authorized by a payment, typically
+// once the booking has been provided. Capturing again is harmless: the processor
+// is called with the same idempotency key.
+func (app *application) capturePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.adminReadPayment(w, r)
+	if p == nil {
+		return
+	}
+
+	if p.Status != data.PaymentAuthorized {
+		app.errorResponse(w, r, http.StatusConflict, "only authorized payments can be captured, this one is "+p.Status)
+		return
+	}
+
+	_, err := app.payments.Capture(r.Context(), p.ProviderRef, p.Amount, fmt.Sprintf("payment-%d-capture", p.ID))
+	if err != nil {
+		app.paymentGatewayResponse(w, r, err)
+		return
+	}
+
+	p.Move(data.PaymentCaptured)
+	err = app.models.Payment.Update(r.Context(), p)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writePayment(w, r, http.StatusOK, p)
+}
+
+// The refundPaymentHandler() refunds some or, without an amount, all of what is
+// left of a captured payment. Refunding an authorized payment releases the money
+// held instead, all of it. Like payments, refunds need an Idempotency-Key header,
+// so that a retried refund isn't made twice.
+func (app *application) refundPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	p := app.adminReadPayment(w, r)
+	if p == nil {
+		return
+	}
+
+	var input struct {
+		Amount int `json:"amount"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := app.readIdempotencyKey(w, r)
+	if key == "" {
+		return
+	}
+
+	_, err = app.models.Payment.GetRefund(r.Context(), p.ID, key)
+	switch {
+	case err == nil:
+		app.writePayment(w, r, http.StatusOK, p)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if input.Amount == 0 {
+		input.Amount = p.Refundable()
+	}
+
+	v := validator.New()
+	switch p.Status {
+	case data.PaymentAuthorized:
+		v.Check(input.Amount == p.Amount, "amount", "must be the whole amount for a payment that hasn't been captured")
+	case data.PaymentCaptured:
+		v.Check(input.Amount > 0, "amount", "must be greater than zero")
+		v.Check(input.Amount <= p.Refundable(), "amount", fmt.Sprintf("must not be more than the %d left to refund", p.Refundable()))
+	default:
+		app.errorResponse(w, r, http.StatusConflict, "only authorized and captured payments can be refunded, this one is "+p.Status)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	result, err := app.payments.Refund(r.Context(), p.ProviderRef, input.Amount, fmt.Sprintf("payment-%d-refund-%s", p.ID, key))
+	if err != nil {
+		app.paymentGatewayResponse(w, r, err)
+		return
+	}
+
+	status := data.PaymentCaptured
+	switch result.Status {
+	case payment.StatusVoided:
+		status = data.PaymentVoided
+	case payment.StatusRefunded:
+		status = data.PaymentRefunded
+	}
+
+	refund := &data.PaymentRefund{PaymentID: p.ID, Amount: input.Amount, IdempotencyKey: key}
+	refunded, err := app.models.Payment.Refund(r.Context(), refund, result.Refunded, status)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateIdempotencyKey):
+			// A retry sent at the same time got there first.
+			app.writePayment(w, r, http.StatusOK, p)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writePayment(w, r, http.StatusOK, refunded)
+}
+
+// applyPaymentEvent makes the change a webhook event reports to a payment,
+// reporting whether there was one. Events can arrive late, more than once or out
+// of order, so they only ever move the payment on.
+func applyPaymentEvent(p *data.Payment, event *payment.Event) bool {
+	switch event.Type {
+	case payment.EventCaptured:
+		return p.Move(data.PaymentCaptured)
+	case payment.EventRefunded:
+		if event.Amount <= p.Refunded {
+			return false
+		}
+		p.Refunded = event.Amount
+		if p.Refunded >= p.Amount {
+			p.Move(data.PaymentRefunded)
+		}
+		return true
+	case payment.EventFailed:
+		if !p.Move(data.PaymentFailed) {
+			return false
+		}
+		p.DeclineReason = event.Reason
+		return true
+	}
+	return false
+}
+
+// The paymentWebhookHandler() receives the events the payment processor reports,
+// e.g. refunds made from its dashboard. It isn't authenticated: the signature of
+// the request proves it comes from the processor. Any answer but 200 OK makes the
+// processor deliver the event again later.
+func (app *application) paymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	event, err := app.payments.VerifyWebhook(payload, r.Header)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	provider := app.payments.Name()
+	seen, err := app.models.Payment.EventSeen(r.Context(), provider, event.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !seen {
+		// The payment may not have been recorded yet if the processor was quick to
+		// report it; answering 404 has the event delivered again.
+		p, err := app.models.Payment.GetByProviderRef(r.Context(), provider, event.Ref)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if applyPaymentEvent(p, event) {
+			err = app.models.Payment.Update(r.Context(), p)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrEditConflict):
+					app.editConflictResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		}
+
+		err = app.models.Payment.RecordEvent(r.Context(), provider, event.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "event handled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
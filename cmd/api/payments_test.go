@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/payment"
+)
+
+// seedBookings creates n bookings of two units at 1000 each for a request,
+// accepted by the partner and starting in two days.
+func seedBookings(t *testing.T, app *application, request *data.Request, serviceID int64, n int) {
+	t.Helper()
+
+	start := time.Now().Add(48 * time.Hour)
+	for i := 0; i < n; i++ {
+		booking := &data.Booking{
+			RequestID: request.ID, ServiceID: serviceID, UnitPrice: 1000, Quantity: 2, PartySize: 1,
+			StartsAt: start, EndsAt: start.Add(time.Hour),
+			PartnerStatus: data.PartnerStatusAccepted, FulfilmentStatus: "not_started",
+		}
+		err := app.models.Booking.Insert(context.Background(), booking)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPayments(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	resto := seedCompany(t, app, "Resto")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	dinner := seedService(t, app, resto, nil)
+	seedBookings(t, app, seedRequest(t, app, alice), dinner.ID, 2)
+	admin := ts.loggedIn("admin@example.com")
+	client := ts.loggedIn("client@example.com")
+
+	pay := `{"payment_method":"tok_visa"}`
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		key      string
+		wantCode int
+	}{
+		{"no idempotency key", "/v1/bookings/1/payments", pay, "", http.StatusUnprocessableEntity},
+		{"declined", "/v1/bookings/1/payments", `{"payment_method":"tok_declined"}`, "k0", http.StatusPaymentRequired},
+		{"declined again", "/v1/bookings/1/payments", `{"payment_method":"tok_declined"}`, "k0", http.StatusPaymentRequired},
+		{"authorized", "/v1/bookings/1/payments", pay, "k1", http.StatusCreated},
+		{"retried", "/v1/bookings/1/payments", pay, "k1", http.StatusOK},
+		{"key reused for another booking", "/v1/bookings/2/payments", pay, "k1", http.StatusUnprocessableEntity},
+		{"paid already", "/v1/bookings/1/payments", pay, "k2", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := client.do(http.MethodPost, tt.path, tt.body, "Idempotency-Key", tt.key)
+			wantStatus(t, code, body, tt.wantCode)
+		})
+	}
+
+	code, body := client.get("/v1/bookings/1/payments")
+	wantStatus(t, code, body, http.StatusOK)
+	if n := strings.Count(body, `"booking_id"`); n != 2 {
+		t.Errorf("got %d payments; want the declined one and the authorized one: %s", n, body)
+	}
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/payments/2/capture", "")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"status":"captured"`)
+	code, body = admin.do(http.MethodPost, "/v1/admin/payments/2/capture", "")
+	wantStatus(t, code, body, http.StatusConflict)
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/payments/2/refund", `{"amount":5000}`, "Idempotency-Key", "r1")
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+	for i := 0; i < 2; i++ {
+		code, body = admin.do(http.MethodPost, "/v1/admin/payments/2/refund", `{"amount":500}`, "Idempotency-Key", "r1")
+		wantStatus(t, code, body, http.StatusOK)
+		wantContains(t, body, `"refunded":500`)
+	}
+	code, body = admin.do(http.MethodPost, "/v1/admin/payments/2/refund", `{}`, "Idempotency-Key", "r2")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"status":"refunded"`)
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	ctx := context.Background()
+	resto := seedCompany(t, app, "Resto")
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	dinner := seedService(t, app, resto, nil)
+	seedBookings(t, app, seedRequest(t, app, alice), dinner.ID, 1)
+
+	code, body := ts.loggedIn("client@example.com").do(http.MethodPost, "/v1/bookings/1/payments", `{"payment_method":"tok_visa"}`, "Idempotency-Key", "k1")
+	wantStatus(t, code, body, http.StatusCreated)
+	p, err := app.models.Payment.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := app.payments.(*payment.Fake)
+	event, header, err := fake.Webhook(payment.Event{ID: "evt_1", Type: payment.EventCaptured, Ref: p.ProviderRef, Amount: p.Amount})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(header http.Header) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/payments/webhook", strings.NewReader(string(event)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		code, _, _ := ts.newClient().send(req)
+		return code
+	}
+
+	// The processor may deliver the same event more than once.
+	for i := 0; i < 2; i++ {
+		if code := send(header.Clone()); code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", code, http.StatusOK)
+		}
+	}
+	forged := http.Header{}
+	forged.Set(payment.FakeSignatureHeader, "t=1,v1=00")
+	if code := send(forged); code != http.StatusBadRequest {
+		t.Errorf("forged webhook: got status %d; want %d", code, http.StatusBadRequest)
+	}
+
+	p, err = app.models.Payment.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != data.PaymentCaptured {
+		t.Errorf("got status %q; want %q", p.Status, data.PaymentCaptured)
+	}
+}
+
+func TestNewPaymentGateway(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       string
+		allowFake bool
+		wantErr   bool
+	}{
+		{name: "development", env: "development"},
+		{name: "production", env: "production", wantErr: true},
+		{name: "production allowed", env: "production", allowFake: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.env = tt.env
+			cfg.payments.provider = "fake"
+			cfg.payments.allowFake = tt.allowFake
+
+			_, err := newPaymentGateway(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The exportCurrentUserHandler() lets a user download everything we hold about
+// them.
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.writePersonalData(w, r, app.contextGetUser(r).ID)
+}
+
+// The exportUserHandler() lets an admin answer a data subject access request on
+// behalf of a user, including a deleted or erased one.
+func (app *application) exportUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.adminReadUser(w, r)
+	if user == nil {
+		return
+	}
+	app.writePersonalData(w, r, user.ID)
+}
+
+// The writePersonalData() helper sends the personal data export of a user, either
+// as a single JSON document (?format=json, the default) or as a ZIP archive with
+// one JSON file per table and the files attached to the user's messages
+// (?format=zip).
+func (app *application) writePersonalData(w http.ResponseWriter, r *http.Request, userID int64) {
+	format := app.readString(r.URL.Query(), "format", "json")
+
+	v := validator.New()
+	if v.Check(validator.In(format, "json", "zip"), "format", "must be json or zip"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	export, err := app.models.PersonalData.Export(r.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if format == "json" {
+		headers := make(http.Header)
+		headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d.json"`, userID))
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"personal_data": export}, headers)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"user.json", export.User},
+		{"requests.json", export.Requests},
+		{"messages.json", export.Messages},
+		{"bookings.json", export.Bookings},
+		{"payments.json", export.Payments},
+		{"refunds.json", export.Refunds},
+		{"accounts.json", export.Accounts},
+		{"statements.json", export.Statements},
+		{"subscriptions.json", export.Subscriptions},
+		{"approvals.json", export.Approvals},
+		{"tokens.json", export.Tokens},
+		{"registration_forms.json", export.RegForms},
+		{"audit_log.json", export.AuditLog},
+	}
+
+	// Encode everything before writing the headers, so that an error can still be
+	// reported with a proper response.
+	names := make([]string, len(files))
+	contents := make([][]byte, len(files))
+	for i, file := range files {
+		names[i] = file.name
+		contents[i], err = json.MarshalIndent(file.content, "", "\t")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The files attached to messages go as they were uploaded, prefixed with their
+	// ID as file names needn't be unique.
+	for _, message := range export.Messages {
+		for _, attachment := range message.Attachments {
+			names = append(names, fmt.Sprintf("attachments/%d-%s", attachment.ID, path.Base(attachment.Filename)))
+			contents = append(contents, attachment.Content)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d.zip"`, userID))
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	for i, name := range names {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: export.ExportedAt}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		_, err = fw.Write(contents[i])
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The eraseUserHandler() anonymizes a user's personal data in answer to an erasure
+// request. The user's requests and other records are kept, but nothing in them can
+// be traced back to the person any more. This can't be undone.
+func (app *application) eraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.adminReadOtherUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.models.PersonalData.Erase(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "personal data successfully erased"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
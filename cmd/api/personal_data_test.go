@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/concierge/service/internal/data"
+)
+
+// seedRequest creates a new request made by client.
+func seedRequest(t *testing.T, app *application, client *data.User) *data.Request {
+	t.Helper()
+
+	request := &data.Request{ClientID: client.ID, Type: "dinner", Description: "A table for two", Status: data.RequestStatusNew}
+	err := app.models.Request.Insert(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestExportAndErasePersonalData(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	bob := seedUser(t, app, "bob@example.com", "client", 0)
+	request := seedRequest(t, app, bob)
+	admin := ts.loggedIn("admin@example.com")
+
+	service := seedService(t, app, seedCompany(t, app, "Le Bistro"), nil)
+	seedBookings(t, app, request, service.ID, 1)
+	booking, err := app.models.Booking.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	booking.Cancel("Bob has the flu", 0)
+	err = app.models.Booking.Update(context.Background(), booking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Message.Insert(context.Background(), &data.Message{
+		RequestID: request.ID, AuthorID: bob.ID, Body: "Here is the menu",
+		Attachments: []*data.Attachment{{Filename: "menu.txt", ContentType: "text/plain", Size: 5, Content: []byte("Soup!")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := ts.loggedIn("bob@example.com").get("/v1/me/export")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"email":"bob@example.com"`, `"description":"A table for two"`,
+		`"cancel_reason":"Bob has the flu"`, `"filename":"menu.txt"`)
+
+	code, body = admin.get("/v1/admin/users/2/export?format=zip")
+	wantStatus(t, code, body, http.StatusOK)
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	for _, want := range []string{"user.json", "requests.json", "bookings.json", "attachments/1-menu.txt"} {
+		if !contains(names, want) {
+			t.Errorf("got files %v; want %s among them", names, want)
+		}
+	}
+
+	code, body = admin.get("/v1/admin/users/2/export?format=xml")
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+
+	// Admins can't erase themselves.
+	code, body = admin.do(http.MethodPost, "/v1/admin/users/1/erase", "")
+	wantStatus(t, code, body, http.StatusConflict)
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/users/2/erase", "")
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.get("/v1/admin/users/2/export")
+	wantStatus(t, code, body, http.StatusOK)
+	if strings.Contains(body, "bob@example.com") || strings.Contains(body, "A table for two") ||
+		strings.Contains(body, "Bob has the flu") || strings.Contains(body, "menu.txt") {
+		t.Errorf("personal data left after erasure: %s", body)
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The subscriptionFor() helper returns the subscription a client is covered by,
+// their own or else their company's, renewed up to now. It returns nil if they
+// aren't subscribed to any plan.
+func (app *application) subscriptionFor(ctx context.Context, client *data.User) (*data.Subscription, error) {
+	sub, err := app.models.Plan.GetSubscriptionFor(ctx, client.ID, client.CompanyID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sub.Renew(time.Now())
+	return sub, nil
+}
+
+// The useQuota() helper counts a request the logged in client is making against
+// the quota of their plan, sending the appropriate error response and returning
+// false if it's used up. sub is nil for clients without a plan, who aren't limited.
+func (app *application) useQuota(w http.ResponseWriter, r *http.Request, sub *data.Subscription) bool {
+	if sub == nil {
+		return true
+	}
+
+	err := app.models.Plan.UseQuota(r.Context(), sub, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrQuotaExceeded):
+			message := fmt.Sprintf("the %d requests a month of the %s plan are used up until %s",
+				sub.Plan.RequestQuota, sub.Plan.Name, sub.RenewsAt.UTC().Format(data.DateLayout))
+			app.errorResponse(w, r, http.StatusConflict, message)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	return true
+}
+
+// The releaseQuota() helper gives back a request counted by useQuota() that
+// couldn't be made after all, logging rather than returning failures.
+func (app *application) releaseQuota(r *http.Request, sub *data.Subscription) {
+	if sub == nil {
+		return
+	}
+
+	err := app.models.Plan.ReleaseQuota(r.Context(), sub)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"subscription_id": fmt.Sprint(sub.ID)})
+	}
+}
+
+func (app *application) listPlansHandler(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.models.Plan.List(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"plans": plans}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPlanHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name          string `json:"name"`
+		RequestQuota  int    `json:"request_quota"`
+		ResponseHours int    `json:"response_hours"`
+		Discount      int    `json:"discount"`
+		MonthlyFee    int    `json:"monthly_fee"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	plan := &data.Plan{
+		Name:          input.Name,
+		RequestQuota:  input.RequestQuota,
+		ResponseHours: input.ResponseHours,
+		Discount:      input.Discount,
+		MonthlyFee:    input.MonthlyFee,
+	}
+
+	v := validator.New()
+	if data.ValidatePlan(v, plan); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Plan.Insert(r.Context(), plan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePlanName):
+			v.AddError("name", "a plan with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/plans/%d", plan.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"plan": plan}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadPlan() helper loads the plan identified by the "id" URL parameter,
+// sending the appropriate error response and returning nil if it can't.
+func (app *application) adminReadPlan(w http.ResponseWriter, r *http.Request) *data.Plan {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	plan, err := app.models.Plan.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return plan
+}
+
+func (app *application) showPlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan := app.adminReadPlan(w, r)
+	if plan == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"plan": plan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updatePlanHandler() changes a plan for everyone subscribed to it, from now
+// on: requests already made keep their response deadline and bookings their
+// price.
+func (app *application) updatePlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan := app.adminReadPlan(w, r)
+	if plan == nil {
+		return
+	}
+
+	var input struct {
+		Name          *string `json:"name"`
+		RequestQuota  *int    `json:"request_quota"`
+		ResponseHours *int    `json:"response_hours"`
+		Discount      *int    `json:"discount"`
+		MonthlyFee    *int    `json:"monthly_fee"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		plan.Name = *input.Name
+	}
+	if input.RequestQuota != nil {
+		plan.RequestQuota = *input.RequestQuota
+	}
+	if input.ResponseHours != nil {
+		plan.ResponseHours = *input.ResponseHours
+	}
+	if input.Discount != nil {
+		plan.Discount = *input.Discount
+	}
+	if input.MonthlyFee != nil {
+		plan.MonthlyFee = *input.MonthlyFee
+	}
+
+	v := validator.New()
+	if data.ValidatePlan(v, plan); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Plan.Update(r.Context(), plan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePlanName):
+			v.AddError("name", "a plan with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"plan": plan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deletePlanHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Plan.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrPlanInUse):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "plan successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showSubscription() helper writes the subscription of a user, if userID isn't
+// 0, or else of a company.
+func (app *application) showSubscription(w http.ResponseWriter, r *http.Request, userID, companyID int64) {
+	sub, err := app.models.Plan.GetSubscription(r.Context(), userID, companyID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	sub.Renew(time.Now())
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscription": sub}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The putSubscription() helper subscribes a user, if userID isn't 0, or else a
+// company to the plan given in the request body, or moves their subscription to
+// it. New subscriptions renew a month from now unless told otherwise; moved ones
+// keep their renewal date and the requests already made in the current period.
+func (app *application) putSubscription(w http.ResponseWriter, r *http.Request, userID, companyID int64) {
+	var input struct {
+		PlanID   int64      `json:"plan_id"`
+		RenewsAt *time.Time `json:"renews_at"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	now := time.Now()
+
+	sub, err := app.models.Plan.GetSubscription(r.Context(), userID, companyID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		sub = &data.Subscription{UserID: userID, CompanyID: companyID, RenewsAt: now.AddDate(0, 1, 0)}
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	default:
+		sub.Renew(now)
+	}
+
+	sub.PlanID = input.PlanID
+	if input.RenewsAt != nil {
+		sub.RenewsAt = *input.RenewsAt
+		sub.PeriodStart = sub.RenewsAt.AddDate(0, -1, 0)
+	}
+
+	v := validator.New()
+	if data.ValidateSubscription(v, sub, now); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	status := http.StatusOK
+	if sub.ID == 0 {
+		status = http.StatusCreated
+		err = app.models.Plan.Subscribe(r.Context(), sub)
+	} else {
+		err = app.models.Plan.UpdateSubscription(r.Context(), sub)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("plan_id", "must refer to an existing plan")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateSubscription), errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	sub, err = app.models.Plan.GetSubscription(r.Context(), userID, companyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, status, envelope{"subscription": sub}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteSubscription() helper ends the subscription of a user, if userID isn't
+// 0, or else of a company, straight away.
+func (app *application) deleteSubscription(w http.ResponseWriter, r *http.Request, userID, companyID int64) {
+	err := app.models.Plan.Unsubscribe(r.Context(), userID, companyID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "subscription successfully ended"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The adminReadClient() helper is like adminReadUser(), but only accepts clients,
+// B2C or B2B, as only they can be subscribed to a plan.
+func (app *application) adminReadClient(w http.ResponseWriter, r *http.Request) *data.User {
+	user := app.adminReadUser(w, r)
+	if user == nil {
+		return nil
+	}
+	if !user.IsClient() {
+		app.errorResponse(w, r, http.StatusConflict, "only clients can be subscribed to a plan")
+		return nil
+	}
+	return user
+}
+
+func (app *application) showUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if user := app.adminReadClient(w, r); user != nil {
+		app.showSubscription(w, r, user.ID, 0)
+	}
+}
+
+func (app *application) updateUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if user := app.adminReadClient(w, r); user != nil {
+		app.putSubscription(w, r, user.ID, 0)
+	}
+}
+
+func (app *application) deleteUserSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if user := app.adminReadClient(w, r); user != nil {
+		app.deleteSubscription(w, r, user.ID, 0)
+	}
+}
+
+func (app *application) showCompanySubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if company := app.adminReadCompany(w, r); company != nil {
+		app.showSubscription(w, r, 0, company.ID)
+	}
+}
+
+func (app *application) updateCompanySubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if company := app.adminReadCompany(w, r); company != nil {
+		app.putSubscription(w, r, 0, company.ID)
+	}
+}
+
+func (app *application) deleteCompanySubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if company := app.adminReadCompany(w, r); company != nil {
+		app.deleteSubscription(w, r, 0, company.ID)
+	}
+}
+
+// The showClientSubscriptionHandler() shows a client the plan they are covered by,
+// their own or their company's, with how many of its requests they have made in
+// the current period.
+func (app *application) showClientSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	sub, err := app.subscriptionFor(r.Context(), app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if sub == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"subscription": sub}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
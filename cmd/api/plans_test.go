@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlansAndSubscriptions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	acme := seedCompany(t, app, "Acme")
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	alice := seedUser(t, app, "client@example.com", "client", 0)
+	seedUser(t, app, "employee@example.com", "b2bclient", acme.ID)
+	seedService(t, app, acme, map[string]int{"client": 999})
+	admin := ts.loggedIn("admin@example.com")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"plan created", http.MethodPost, "/v1/admin/plans", `{"name":"Basic","request_quota":2,"response_hours":24,"discount":10,"monthly_fee":1000}`, http.StatusCreated, ""},
+		{"name taken", http.MethodPost, "/v1/admin/plans", `{"name":"Basic"}`, http.StatusUnprocessableEntity, ""},
+		{"discount too high", http.MethodPost, "/v1/admin/plans", `{"name":"Private","discount":100}`, http.StatusUnprocessableEntity, ""},
+		{"unlimited plan created", http.MethodPost, "/v1/admin/plans", `{"name":"Premium","request_quota":0,"response_hours":2,"discount":20,"monthly_fee":5000}`, http.StatusCreated, ""},
+		{"plan updated", http.MethodPatch, "/v1/admin/plans/2", `{"discount":25}`, http.StatusOK, `"discount":25`},
+		{"admin subscribed", http.MethodPut, "/v1/admin/users/1/subscription", `{"plan_id":1}`, http.StatusConflict, ""},
+		{"no such plan", http.MethodPut, "/v1/admin/users/2/subscription", `{"plan_id":9}`, http.StatusUnprocessableEntity, ""},
+		{"renewal too far", http.MethodPut, "/v1/admin/users/2/subscription", `{"plan_id":1,"renews_at":"2999-01-01T00:00:00Z"}`, http.StatusUnprocessableEntity, ""},
+		{"client subscribed", http.MethodPut, "/v1/admin/users/2/subscription", `{"plan_id":1}`, http.StatusCreated, `"name":"Basic"`},
+		{"company subscribed", http.MethodPut, "/v1/admin/companies/1/subscription", `{"plan_id":2}`, http.StatusCreated, ""},
+		{"plan in use deleted", http.MethodDelete, "/v1/admin/plans/1", "", http.StatusConflict, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := admin.do(tt.method, tt.path, tt.body)
+			wantStatus(t, code, body, tt.wantCode)
+			wantContains(t, body, tt.wantBody)
+		})
+	}
+
+	// Of four requests made at once, only the two the quota allows are created.
+	client := ts.loggedIn("client@example.com")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	codes := make(map[int]int)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := client.do(http.MethodPost, "/v1/requests", `{"type":"dinner"}`)
+			mu.Lock()
+			codes[code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if codes[http.StatusCreated] != 2 || codes[http.StatusConflict] != 2 {
+		t.Fatalf("got status codes %v; want two 201s and two 409s", codes)
+	}
+	code, body := client.get("/v1/subscription")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"requests_used":2`)
+
+	ctx := context.Background()
+	requests, err := app.models.Request.GetAllForClient(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := requests[0]; !r.RespondBy.Valid || r.RespondBy.Time.Sub(r.CreatedAt) < 23*time.Hour {
+		t.Errorf("got respond_by %v for a request made at %v; want a day later", r.RespondBy, r.CreatedAt)
+	}
+
+	// 999 less 10%, rounded in the client's favour.
+	code, body = client.do(http.MethodPost, "/v1/requests/1/bookings", `{"service_id":1,`+bookingWindow(time.Now().Add(48*time.Hour))+`}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	wantContains(t, body, `"unit_price":899`)
+
+	// Once the period is over the quota starts again.
+	sub, err := app.models.Plan.GetSubscription(ctx, alice.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.RenewsAt = time.Now().Add(-time.Hour)
+	err = app.models.Plan.UpdateSubscription(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body = client.do(http.MethodPost, "/v1/requests", `{"type":"dinner"}`)
+	wantStatus(t, code, body, http.StatusCreated)
+	code, body = client.get("/v1/subscription")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"requests_used":1`)
+
+	// Employees use their company's plan.
+	emp := ts.loggedIn("employee@example.com")
+	code, body = emp.get("/v1/subscription")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"Premium"`)
+	for i := 0; i < 3; i++ {
+		code, body = emp.do(http.MethodPost, "/v1/requests", `{"type":"transfer"}`)
+		wantStatus(t, code, body, http.StatusCreated)
+	}
+
+	code, body = admin.do(http.MethodDelete, "/v1/admin/companies/1/subscription", "")
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = emp.get("/v1/subscription")
+	wantStatus(t, code, body, http.StatusNotFound)
+	code, body = admin.do(http.MethodDelete, "/v1/admin/plans/2", "")
+	wantStatus(t, code, body, http.StatusOK)
+
+	code, body = admin.get("/v1/admin/audit?entity_type=subscription")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":4`)
+}
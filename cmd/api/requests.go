@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/events"
+	"github.com/concierge/service/internal/validator"
+)
+
+// The clientReadRequest() helper loads the request identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+// Other clients' requests are reported as not found.
+func (app *application) clientReadRequest(w http.ResponseWriter, r *http.Request) *data.Request {
+	request := app.adminReadRequest(w, r)
+	if request == nil {
+		return nil
+	}
+	if request.ClientID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return request
+}
+
+// The clientReadBooking() helper loads the booking identified by the "id" URL
+// parameter, sending the appropriate error response and returning nil if it can't.
+// Bookings made for other clients' requests are reported as not found.
+func (app *application) clientReadBooking(w http.ResponseWriter, r *http.Request) *data.Booking {
+	booking := app.adminReadBooking(w, r)
+	if booking == nil {
+		return nil
+	}
+
+	request, err := app.models.Request.GetByRequestID(r.Context(), booking.RequestID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	if request.ClientID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return booking
+}
+
+func (app *application) createRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Type        string `json:"type"`
+		Description string `json:"description"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := app.contextGetUser(r)
+	request := &data.Request{
+		ClientID:    client.ID,
+		Type:        input.Type,
+		Description: input.Description,
+		Status:      data.RequestStatusNew,
+	}
+
+	v := validator.New()
+	if data.ValidateRequest(v, request); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Clients with a plan can make so many requests a month, and have them
+	// answered within the response time of the plan.
+	sub, err := app.subscriptionFor(r.Context(), client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !app.useQuota(w, r, sub) {
+		return
+	}
+	if sub != nil {
+		request.RespondBy = sub.Plan.RespondBy(time.Now())
+	}
+
+	err = app.models.Request.Insert(r.Context(), request)
+	if err != nil {
+		app.releaseQuota(r, sub)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.publish(eventRequestCreated, envelope{"request": request}, events.Audience{Concierge: true})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"request": request}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	requests, err := app.models.Request.GetAllForClient(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"requests": requests}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showRequestHandler(w http.ResponseWriter, r *http.Request) {
+	request := app.clientReadRequest(w, r)
+	if request == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"request": request}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateConciergeRequestHandler() lets the concierge move a request on to
+// another status and assign it to one of its managers, or unassign it with an
+// assignee_id of 0. The client and the concierge hear about either change.
+func (app *application) updateConciergeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	request := app.adminReadRequest(w, r)
+	if request == nil {
+		return
+	}
+
+	var input struct {
+		Status     *string `json:"status"`
+		AssigneeID *int64  `json:"assignee_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	status, assigneeID := request.Status, request.AssigneeID
+	if input.Status != nil {
+		request.Status = *input.Status
+	}
+	if input.AssigneeID != nil {
+		request.AssigneeID = *input.AssigneeID
+	}
+
+	v := validator.New()
+	if data.ValidateRequest(v, request); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if request.AssigneeID != 0 && request.AssigneeID != assigneeID {
+		assignee, err := app.models.User.Get(r.Context(), request.AssigneeID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if err != nil || !assignee.Activated || assignee.UserType != data.UserTypeCSManager && assignee.UserType != data.UserTypeAdmin {
+			v.AddError("assignee_id", "must be an activated concierge manager")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Request.Update(r.Context(), request)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	to := events.Audience{UserIDs: []int64{request.ClientID}, Concierge: true}
+	if request.Status != status {
+		app.publish(eventRequestUpdated, envelope{"request": request}, to)
+	}
+	if request.AssigneeID != assigneeID {
+		app.publish(eventRequestAssigned, envelope{"request": request}, to)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"request": request}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createRequestBookingHandler() lets a client order a catalog service for one of
+// their requests, at the price of the service for their user type less the discount
+// of their plan.
+func (app *application) createRequestBookingHandler(w http.ResponseWriter, r *http.Request) {
+	request := app.clientReadRequest(w, r)
+	if request == nil {
+		return
+	}
+
+	app.bookService(w, r, request)
+}
+
+func (app *application) listClientRequestBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	request := app.clientReadRequest(w, r)
+	if request == nil {
+		return
+	}
+
+	app.listBookings(w, r, request)
+}
+
+func (app *application) showBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.clientReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"booking": booking}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) rescheduleBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.clientReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	app.rescheduleBooking(w, r, booking, false)
+}
+
+func (app *application) cancelBookingHandler(w http.ResponseWriter, r *http.Request) {
+	booking := app.clientReadBooking(w, r)
+	if booking == nil {
+		return
+	}
+
+	app.cancelBooking(w, r, booking, false)
+}
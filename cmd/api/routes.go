@@ -1,48 +1,176 @@
 package main
 
 import (
+	"github.com/concierge/service/internal/data"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 )
 
+// debugRoutesEnabled reports whether the /debug helper routes should be mounted.
+// Both conditions are required so that a stray flag in a production deployment
+// can't expose them.
+func (app *application) debugRoutesEnabled() bool {
+	return app.config.env == "development" && app.config.debug.routes
+}
+
 func (app *application) routes() http.Handler {
 	router := httprouter.New()
 
-	router.ServeFiles("/css/*filepath", http.Dir("./ui/css/"))
-	router.ServeFiles("/img/*filepath", http.Dir("./ui/img/"))
-	router.ServeFiles("/js/*filepath", http.Dir("./ui/js/"))
-	router.ServeFiles("/pages/*filepath", http.Dir("./ui/pages/"))
-	router.ServeFiles("/scss/*filepath", http.Dir("./ui/scss/"))
-	router.ServeFiles("/vendor/*filepath", http.Dir("./ui/vendor/"))
+	// Static files. Only these directories are public: the templates in ui/html are
+	// rendered by the handlers, and raw sources aren't served at all.
+	router.HandlerFunc(http.MethodGet, "/css/*filepath", app.staticHandler("css"))
+	router.HandlerFunc(http.MethodGet, "/img/*filepath", app.staticHandler("img"))
+	router.HandlerFunc(http.MethodGet, "/js/*filepath", app.staticHandler("js"))
+	router.HandlerFunc(http.MethodGet, "/vendor/*filepath", app.staticHandler("vendor"))
+
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/readiness", app.readinessHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/payments/webhook", app.paymentWebhookHandler)
 
-	//router.ServeFiles("/css/*filepath", http.Dir("C:\\Users\\mapol\\IdeaProjects\\concierge\\ui\\css"))
-	//router.ServeFiles("/img/*filepath", http.Dir("C:\\Users\\mapol\\IdeaProjects\\concierge\\ui\\img"))
-	//router.ServeFiles("/js/*filepath", http.Dir("C:\\Users\\mapol\\IdeaProjects\\concierge\\ui\\js"))
-	//router.ServeFiles("/pages/*filepath", http.Dir("C:\\Users\\mapol\\IdeaProjects\\concierge\\ui\\pages"))
-	//router.ServeFiles("/scss/*filepath", http.Dir("C:\\Users\\mapol\\IdeaProjects\\concierge\\ui\\scss"))
-	//router.ServeFiles("/vendor/*filepath", http.Dir("C:\\Users\\mapol\\IdeaProjects\\concierge\\ui\\vendor"))
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/me", app.requireActivatedAPIUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/me", app.requireActivatedAPIUser(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/me/password", app.requireActivatedAPIUser(app.updateCurrentUserPasswordHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/me/export", app.requireActivatedAPIUser(app.exportCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/events", app.requireActivatedAPIUser(app.streamEventsHandler))
+
+	// The HTML pages below are used from a browser with a session cookie, so every
+	// form posted to them has to carry the CSRF token, see csrfProtect().
 
 	// LandingPage
-	router.HandlerFunc(http.MethodGet, "/", app.showLandingPageHandler)
-	router.HandlerFunc(http.MethodPost, "/regForm", app.RegFormHandler)
-	router.HandlerFunc(http.MethodPost, "/login", app.LoginHandler)
+	router.HandlerFunc(http.MethodGet, "/", app.csrfProtect(app.showLandingPageHandler))
+	router.HandlerFunc(http.MethodPost, "/regForm", app.csrfProtect(app.RegFormHandler))
+	router.HandlerFunc(http.MethodPost, "/login", app.csrfProtect(app.LoginHandler))
 
 	// Admin
-	router.HandlerFunc(http.MethodGet, "/my-cabinet-admin/services", app.requirePermission("admin", app.GetAddServicesPageHandler))
-	router.HandlerFunc(http.MethodPost, "/my-cabinet-admin/services", app.requirePermission("admin", app.PostAddServicesHandler))
-	router.HandlerFunc(http.MethodGet, "/my-cabinet-admin", app.requirePermission("admin", app.showAdminPageHandler))
-	router.HandlerFunc(http.MethodGet, "/my-cabinet-admin/register-users", app.requirePermission("admin", app.showAdminRegisterUsersPageHandler))
+	router.HandlerFunc(http.MethodGet, "/my-cabinet-admin/services", app.csrfProtect(app.requirePermission("admin", app.GetAddServicesPageHandler)))
+	router.HandlerFunc(http.MethodPost, "/my-cabinet-admin/services", app.csrfProtect(app.requirePermission("admin", app.PostAddServicesHandler)))
+	router.HandlerFunc(http.MethodGet, "/my-cabinet-admin", app.csrfProtect(app.requirePermission("admin", app.showAdminPageHandler)))
+	router.HandlerFunc(http.MethodGet, "/my-cabinet-admin/register-users", app.csrfProtect(app.requirePermission("admin", app.showAdminRegisterUsersPageHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requireAPIPermission(data.UserTypeAdmin, app.listUsersHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users", app.requireAPIPermission(data.UserTypeAdmin, app.inviteUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requireAPIPermission(data.UserTypeAdmin, app.showUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requireAPIPermission(data.UserTypeAdmin, app.deleteUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/type", app.requireAPIPermission(data.UserTypeAdmin, app.updateUserTypeHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/deactivate", app.requireAPIPermission(data.UserTypeAdmin, app.deactivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/reactivate", app.requireAPIPermission(data.UserTypeAdmin, app.reactivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/restore", app.requireAPIPermission(data.UserTypeAdmin, app.restoreUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/export", app.requireAPIPermission(data.UserTypeAdmin, app.exportUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/erase", app.requireAPIPermission(data.UserTypeAdmin, app.eraseUserHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/admin/restore/:entity/:id", app.requireAPIPermission(data.UserTypeAdmin, app.restoreHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit", app.requireAPIPermission(data.UserTypeAdmin, app.listAuditLogHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/requests/:id/bookings", app.requireAPIPermission(data.UserTypeAdmin, app.listRequestBookingsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/requests/:id/bookings", app.requireAPIPermission(data.UserTypeAdmin, app.createBookingHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/bookings/:id/schedule", app.requireAPIPermission(data.UserTypeAdmin, app.adminRescheduleBookingHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/bookings/:id/cancel", app.requireAPIPermission(data.UserTypeAdmin, app.adminCancelBookingHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/services/:id/availability", app.requireAPIPermission(data.UserTypeAdmin, app.showScheduleHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/services/:id/availability", app.requireAPIPermission(data.UserTypeAdmin, app.updateScheduleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invoices", app.requireAPIPermission(data.UserTypeAdmin, app.listInvoicesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invoices", app.requireAPIPermission(data.UserTypeAdmin, app.generateInvoicesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invoices/:id", app.requireAPIPermission(data.UserTypeAdmin, app.showInvoiceHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invoices/:id/html", app.requireAPIPermission(data.UserTypeAdmin, app.showInvoiceHTMLHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invoices/:id/pdf", app.requireAPIPermission(data.UserTypeAdmin, app.showInvoicePDFHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invoices/:id/issue", app.requireAPIPermission(data.UserTypeAdmin, app.issueInvoiceHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invoices/:id/paid", app.requireAPIPermission(data.UserTypeAdmin, app.markInvoicePaidHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invoices/:id/send", app.requireAPIPermission(data.UserTypeAdmin, app.sendInvoiceHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/payments", app.requireAPIPermission(data.UserTypeAdmin, app.listPaymentsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/payments/:id/capture", app.requireAPIPermission(data.UserTypeAdmin, app.capturePaymentHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/payments/:id/refund", app.requireAPIPermission(data.UserTypeAdmin, app.refundPaymentHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/accounts", app.requireAPIPermission(data.UserTypeAdmin, app.listAccountsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/accounts", app.requireAPIPermission(data.UserTypeAdmin, app.openAccountHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/accounts/:id", app.requireAPIPermission(data.UserTypeAdmin, app.showAccountHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/accounts/:id/statement", app.requireAPIPermission(data.UserTypeAdmin, app.showAccountStatementHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/accounts/:id/top-ups", app.requireAPIPermission(data.UserTypeAdmin, app.topUpAccountHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/accounts/:id/refunds", app.requireAPIPermission(data.UserTypeAdmin, app.refundAccountHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/accounts/:id/payouts", app.requireAPIPermission(data.UserTypeAdmin, app.payOutAccountHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/companies/:id/spending-controls", app.requireAPIPermission(data.UserTypeAdmin, app.showSpendingControlsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/companies/:id/spending-controls", app.requireAPIPermission(data.UserTypeAdmin, app.updateSpendingControlsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/approvals", app.requireAPIPermission(data.UserTypeAdmin, app.listApprovalsHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/plans", app.requireAPIPermission(data.UserTypeAdmin, app.listPlansHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/plans", app.requireAPIPermission(data.UserTypeAdmin, app.createPlanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/plans/:id", app.requireAPIPermission(data.UserTypeAdmin, app.showPlanHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/plans/:id", app.requireAPIPermission(data.UserTypeAdmin, app.updatePlanHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/plans/:id", app.requireAPIPermission(data.UserTypeAdmin, app.deletePlanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/subscription", app.requireAPIPermission(data.UserTypeAdmin, app.showUserSubscriptionHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/subscription", app.requireAPIPermission(data.UserTypeAdmin, app.updateUserSubscriptionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/subscription", app.requireAPIPermission(data.UserTypeAdmin, app.deleteUserSubscriptionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/companies/:id/subscription", app.requireAPIPermission(data.UserTypeAdmin, app.showCompanySubscriptionHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/companies/:id/subscription", app.requireAPIPermission(data.UserTypeAdmin, app.updateCompanySubscriptionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/companies/:id/subscription", app.requireAPIPermission(data.UserTypeAdmin, app.deleteCompanySubscriptionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/service-changes", app.requireAPIPermission(data.UserTypeAdmin, app.listServiceChangesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/service-changes/:id/approve", app.requireAPIPermission(data.UserTypeAdmin, app.approveServiceChangeHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/service-changes/:id/reject", app.requireAPIPermission(data.UserTypeAdmin, app.rejectServiceChangeHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/services/:id/slots", app.requireActivatedAPIUser(app.showServiceSlotsHandler))
+
+	// Clients, both B2C and B2B
+	router.HandlerFunc(http.MethodGet, "/v1/requests", app.requireClient(app.listRequestsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/requests", app.requireClient(app.createRequestHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/requests/:id", app.requireClient(app.showRequestHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/requests/:id/bookings", app.requireClient(app.listClientRequestBookingsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/requests/:id/bookings", app.requireClient(app.createRequestBookingHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/requests/:id/messages", app.requireClient(app.listClientMessagesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/requests/:id/messages", app.requireClient(app.postClientMessageHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/requests/:id/messages/read", app.requireClient(app.markClientMessagesReadHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/attachments/:id", app.requireClient(app.showClientAttachmentHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/bookings/:id", app.requireClient(app.showBookingHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/bookings/:id/schedule", app.requireClient(app.rescheduleBookingHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/bookings/:id/cancel", app.requireClient(app.cancelBookingHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/bookings/:id/payments", app.requireClient(app.listBookingPaymentsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/account", app.requireClient(app.showClientAccountHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/account/statement", app.requireClient(app.showClientAccountStatementHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/subscription", app.requireClient(app.showClientSubscriptionHandler))
 
 	// B2B
-	router.HandlerFunc(http.MethodGet, "/my-cabinet-b-client", app.requirePermission("b2bclient", app.B2BClientPageHandler))
+	router.HandlerFunc(http.MethodGet, "/my-cabinet-b-client", app.csrfProtect(app.requirePermission("b2bclient", app.B2BClientPageHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/invoices", app.requireB2BClient(app.listClientInvoicesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/invoices/:id", app.requireB2BClient(app.showClientInvoiceHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/invoices/:id/pdf", app.requireB2BClient(app.showClientInvoicePDFHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/budgets", app.requireB2BClient(app.showBudgetsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/approvals", app.requireB2BClient(app.listCompanyApprovalsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/approvals/:id", app.requireB2BClient(app.showApprovalHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/approvals/:id/approve", app.requireB2BClient(app.approveHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/approvals/:id/reject", app.requireB2BClient(app.rejectHandler))
 
 	// B2C
-	router.HandlerFunc(http.MethodGet, "/my-cabinet", app.requirePermission("client", app.B2CClientPageHandler))
+	router.HandlerFunc(http.MethodGet, "/my-cabinet", app.csrfProtect(app.requirePermission("client", app.B2CClientPageHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/bookings/:id/payments", app.requireAPIPermission(data.UserTypeClient, app.payBookingHandler))
 
 	// Concierge
-	//router.HandlerFunc(http.MethodGet, "/my-cabinet", app.CSPageHandler)
+	router.HandlerFunc(http.MethodGet, "/my-cabinet-cs", app.csrfProtect(app.requirePermission(data.UserTypeCSManager, app.CSPageHandler)))
+
+	router.HandlerFunc(http.MethodPatch, "/v1/cs/requests/:id", app.requireConcierge(app.updateConciergeRequestHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/cs/requests/:id/messages", app.requireConcierge(app.listConciergeMessagesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/cs/requests/:id/messages", app.requireConcierge(app.postConciergeMessageHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/cs/requests/:id/messages/read", app.requireConcierge(app.markConciergeMessagesReadHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/cs/attachments/:id", app.requireConcierge(app.showConciergeAttachmentHandler))
 
 	// Partner
+	router.HandlerFunc(http.MethodGet, "/my-cabinet-partner", app.csrfProtect(app.requirePermission(data.UserTypePartner, app.PartnerPageHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/partner/bookings", app.requirePartner(app.listPartnerBookingsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/partner/bookings/:id", app.requirePartner(app.showPartnerBookingHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/partner/bookings/:id/accept", app.requirePartner(app.acceptPartnerBookingHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/partner/bookings/:id/decline", app.requirePartner(app.declinePartnerBookingHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/partner/bookings/:id/fulfilment", app.requirePartner(app.updatePartnerBookingFulfilmentHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/partner/services", app.requirePartner(app.listPartnerServicesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/partner/services/:id/availability", app.requirePartner(app.showPartnerScheduleHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/partner/services/:id/availability", app.requirePartner(app.updatePartnerScheduleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/partner/services/:id/changes", app.requirePartner(app.proposeServiceChangeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/partner/service-changes", app.requirePartner(app.listPartnerServiceChangesHandler))
 
 	//mux := http.NewServeMux()
 	//fileServer := http.FileServer(http.Dir("./ui/static(delete)/"))
@@ -51,8 +179,15 @@ func (app *application) routes() http.Handler {
 	//mux.HandleFunc("/", app.homePageHandler)
 	//mux.HandleFunc("/auth", app.authorizationPageHandler)
 
-	router.HandlerFunc(http.MethodPost, "/debug", app.PostAddUsersHandler)
-	router.HandlerFunc(http.MethodPost, "/debug/token", app.createAuthenticationTokenHandler)
+	// The metrics endpoint has its own access control and is needed in production,
+	// so it isn't affected by the debug routes switch below.
+	router.HandlerFunc(http.MethodGet, "/debug/metrics", app.requireMetricsAccess(app.metricsHandler))
+
+	// Debug routes are only mounted in development, and only when explicitly asked for
+	// with -debug-routes.
+	if app.debugRoutesEnabled() {
+		router.HandlerFunc(http.MethodPost, "/debug/token", app.createAuthenticationTokenHandler)
+	}
 
-	return app.recoverPanic(app.authenticate(router))
+	return app.recordMetrics(router, app.requestID(app.recoverPanic(app.secureHeaders(app.enableCORS(app.requireJSON(app.authenticate(app.auditActor(router))))))))
 }
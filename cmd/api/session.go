@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-session/session/v3"
+)
+
+// sessionCookieName is the cookie holding the browser session ID.
+const sessionCookieName = "concierge_session"
+
+// parseSameSite converts the value of the -cookie-samesite flag.
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid SameSite value %q (want lax, strict or none)", value)
+	}
+}
+
+// cookieSecure reports whether cookies should be marked Secure. Development runs
+// over plain HTTP, where browsers would drop them.
+func (app *application) cookieSecure() bool {
+	return app.config.env != "development" && app.config.cookie.secure
+}
+
+// initSessions configures the session manager. It has to run before the first
+// session is started.
+//
+// The session ID is only ever read from the cookie: go-session also accepts it in
+// the query string and form values by default, which would let a link fix a
+// victim's session. Cookies are HttpOnly; note that go-session additionally drops
+// the Secure flag for requests that didn't arrive over TLS from a public address.
+func (app *application) initSessions() error {
+	// The sessions live in memory and don't survive a restart, so a new signing key
+	// on every start costs nothing.
+	sign := make([]byte, 32)
+	_, err := rand.Read(sign)
+	if err != nil {
+		return err
+	}
+
+	session.InitManager(
+		session.SetCookieName(sessionCookieName),
+		session.SetSign(sign),
+		session.SetSecure(app.cookieSecure()),
+		session.SetSameSite(app.config.cookie.sameSite),
+		session.SetEnableSIDInURLQuery(false),
+	)
+	return nil
+}
+
+// startSession resumes the browser's session, or starts a new one. A session cookie
+// that can't be decoded, e.g. one signed before a restart, is thrown away and a
+// new session is started in its place.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request) (session.Store, error) {
+	store, err := session.Start(r.Context(), w, r)
+	if err != nil && removeCookie(r, sessionCookieName) {
+		store, err = session.Start(r.Context(), w, r)
+	}
+	return store, err
+}
+
+// renewSession moves the session to a new ID, keeping its values. It is called on
+// login so that a session ID planted in the browser beforehand (session fixation)
+// is worthless once the user has authenticated.
+func (app *application) renewSession(w http.ResponseWriter, r *http.Request) (session.Store, error) {
+	store, err := session.Refresh(r.Context(), w, r)
+	if err != nil && removeCookie(r, sessionCookieName) {
+		store, err = session.Refresh(r.Context(), w, r)
+	}
+	return store, err
+}
+
+// removeCookie deletes the named cookie from the request headers and reports
+// whether it was there.
+func removeCookie(r *http.Request, name string) bool {
+	cookies := r.Cookies()
+	found := false
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			found = true
+			continue
+		}
+		r.AddCookie(cookie)
+	}
+	return found
+}
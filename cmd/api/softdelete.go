@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The restoreHandler() undoes the soft deletion of a service, price, company,
+// request or user, e.g. POST /v1/admin/restore/company/3.
+func (app *application) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var store data.SoftDeleteStore
+	switch httprouter.ParamsFromContext(r.Context()).ByName("entity") {
+	case data.AuditEntityService:
+		store = app.models.Service
+	case data.AuditEntityPrice:
+		store = app.models.Price
+	case data.AuditEntityCompany:
+		store = app.models.Company
+	case data.AuditEntityRequest:
+		store = app.models.Request
+	case data.AuditEntityUser:
+		store = app.models.User
+	default:
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = store.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "successfully restored"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The runPurgeJob() method hard-deletes rows that have been soft deleted for longer
+// than the configured retention period: once at startup and then once a day, until
+// ctx is cancelled.
+func (app *application) runPurgeJob(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		app.purgeDeleted(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *application) purgeDeleted(ctx context.Context) {
+	cutoff := time.Now().Add(-app.config.softDelete.retention)
+
+	purged, err := app.models.PurgeDeleted(ctx, cutoff)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"job": "purge"})
+	}
+
+	properties := map[string]string{"deleted_before": cutoff.Format(time.RFC3339)}
+	for table, count := range purged {
+		properties[table] = strconv.Itoa(count)
+	}
+	app.logger.PrintInfo("purged soft-deleted rows", properties)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRestoreAndPurge(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	seedUser(t, app, "bob@example.com", "client", 0)
+	seedUser(t, app, "eve@example.com", "client", 0)
+	admin := ts.loggedIn("admin@example.com")
+
+	code, body := admin.do(http.MethodDelete, "/v1/admin/users/2", "")
+	wantStatus(t, code, body, http.StatusOK)
+
+	code, body = admin.get("/v1/admin/users?include_deleted=true")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":3`)
+
+	code, body = admin.do(http.MethodPost, "/v1/admin/restore/user/2", "")
+	wantStatus(t, code, body, http.StatusOK)
+	code, body = admin.do(http.MethodPost, "/v1/admin/restore/user/2", "")
+	wantStatus(t, code, body, http.StatusNotFound)
+	code, body = admin.do(http.MethodPost, "/v1/admin/restore/spaceship/2", "")
+	wantStatus(t, code, body, http.StatusNotFound)
+
+	// Rows deleted longer ago than the retention period are purged for good.
+	code, body = admin.do(http.MethodDelete, "/v1/admin/users/3", "")
+	wantStatus(t, code, body, http.StatusOK)
+	app.config.softDelete.retention = -time.Hour
+	app.purgeDeleted(context.Background())
+
+	code, body = admin.get("/v1/admin/users?include_deleted=true")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"total_records":2`)
+
+	code, body = admin.get("/v1/admin/audit?action=purge&entity_type=user")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"entity_id":3`, `"total_records":1`)
+}
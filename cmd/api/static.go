@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// staticExtensions lists the kinds of files served from the static directories.
+// Everything else in there (scss and less sources, package manifests, READMEs) is
+// only needed to build the assets and isn't served.
+var staticExtensions = map[string]bool{
+	".css":   true,
+	".js":    true,
+	".map":   true,
+	".svg":   true,
+	".png":   true,
+	".jpg":   true,
+	".jpeg":  true,
+	".gif":   true,
+	".webp":  true,
+	".ico":   true,
+	".woff":  true,
+	".woff2": true,
+	".ttf":   true,
+	".eot":   true,
+	".mp4":   true,
+}
+
+// assets gives access to the ui files, either the copy embedded in the binary or,
+// in development, a directory on disk. It also computes the content hashes used to
+// version asset URLs.
+type assets struct {
+	fsys fs.FS
+
+	// cacheHashes is false when serving from disk, so that edited files get a new
+	// hash straight away.
+	cacheHashes bool
+	mu          sync.Mutex
+	hashes      map[string]string
+}
+
+func newAssets(fsys fs.FS, cacheHashes bool) *assets {
+	return &assets{
+		fsys:        fsys,
+		cacheHashes: cacheHashes,
+		hashes:      make(map[string]string),
+	}
+}
+
+// hash returns a short hash of the content of the named file.
+func (a *assets) hash(name string) (string, error) {
+	if a.cacheHashes {
+		a.mu.Lock()
+		hash, ok := a.hashes[name]
+		a.mu.Unlock()
+		if ok {
+			return hash, nil
+		}
+	}
+
+	content, err := fs.ReadFile(a.fsys, name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:8])
+
+	if a.cacheHashes {
+		a.mu.Lock()
+		a.hashes[name] = hash
+		a.mu.Unlock()
+	}
+	return hash, nil
+}
+
+// url returns the URL of the asset at urlPath ("/css/main.css") with its content hash
+// appended ("/css/main.css?v=1a2b3c4d5e6f7a8b"). Because the URL changes whenever
+// the file does, browsers can cache it for good. If the file can't be read the path
+// is returned unchanged, and the request for it will fail on its own.
+func (a *assets) url(urlPath string) string {
+	hash, err := a.hash(strings.TrimPrefix(urlPath, "/"))
+	if err != nil {
+		return urlPath
+	}
+	return urlPath + "?v=" + hash
+}
+
+// staticHandler serves the files below dir. Requests carrying the current content
+// hash (see assets.url) may be cached for a year; anything else has to be
+// revalidated, which the ETag makes cheap. Directories aren't listed.
+func (app *application) staticHandler(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		name := path.Join(dir, path.Clean("/"+params.ByName("filepath")))
+
+		if !staticExtensions[strings.ToLower(path.Ext(name))] {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		hash, err := app.assets.hash(name)
+		if err != nil {
+			switch {
+			case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		file, err := app.assets.fsys.Open(name)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		defer file.Close()
+
+		content, ok := file.(io.ReadSeeker)
+		if !ok {
+			app.serverErrorResponse(w, r, errors.New("static file does not support seeking"))
+			return
+		}
+
+		w.Header().Set("ETag", `"`+hash+`"`)
+		if r.URL.Query().Get("v") == hash {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+
+		// Embedded files have no modification time, so the ETag is what conditional
+		// requests are answered with.
+		http.ServeContent(w, r, name, time.Time{}, content)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestStaticFiles(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	c := ts.newClient()
+
+	code, body := c.get("/")
+	wantStatus(t, code, body, http.StatusOK)
+	m := regexp.MustCompile(`/css/main.css\?v=([0-9a-f]+)`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("the landing page doesn't link to a content-hashed stylesheet")
+	}
+
+	get := func(path string, headers ...string) (int, http.Header) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		code, header, _ := c.send(req)
+		return code, header
+	}
+
+	code, header := get("/css/main.css?v=" + m[1])
+	if code != http.StatusOK || header.Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Errorf("hashed URL: got %d with Cache-Control %q", code, header.Get("Cache-Control"))
+	}
+	code, header = get("/css/main.css")
+	if code != http.StatusOK || header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("plain URL: got %d with Cache-Control %q", code, header.Get("Cache-Control"))
+	}
+	code, _ = get("/css/main.css", "If-None-Match", `"`+m[1]+`"`)
+	if code != http.StatusNotModified {
+		t.Errorf("conditional request: got %d; want %d", code, http.StatusNotModified)
+	}
+
+	for _, path := range []string{"/vendor/jquery/jquery.min.js", "/img/logo3.webp"} {
+		if code, _ := get(path); code != http.StatusOK {
+			t.Errorf("%s: got %d; want %d", path, code, http.StatusOK)
+		}
+	}
+
+	// Sources, templates and directory listings aren't served.
+	for _, path := range []string{"/scss/sb-admin-2.scss", "/vendor/bootstrap-scss/scss/_close.scss", "/html/base.html", "/img/../html/base.html", "/css/", "/css/nope.css"} {
+		if code, _ := get(path); code != http.StatusNotFound && code != http.StatusMovedPermanently {
+			t.Errorf("%s: got %d; want it hidden", path, code)
+		}
+	}
+}
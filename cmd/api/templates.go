@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+)
+
+// templateData holds everything the HTML templates can use. Pages read the fields
+// they need and ignore the rest.
+type templateData struct {
+	CurrentYear int
+	CurrentPath string
+	CSRFToken   string
+	User        *data.User
+	RegForms    []*data.RegForm
+	Bookings    []*partnerBooking
+}
+
+// newTemplateData returns the fields shared by every page: the layout needs the
+// current user for the sidebar and topbar, and the path to highlight the active
+// sidebar item. Forms include CSRFToken in a hidden csrf_token field.
+func (app *application) newTemplateData(r *http.Request) *templateData {
+	td := &templateData{
+		CurrentYear: time.Now().Year(),
+		CurrentPath: r.URL.Path,
+		CSRFToken:   app.contextGetCSRFToken(r),
+	}
+	if user := app.contextGetUser(r); user != nil && !user.IsAnonymous() {
+		td.User = user
+	}
+	return td
+}
+
+// navItem is a single link in the sidebar.
+type navItem struct {
+	Href   string
+	Icon   string
+	Label  string
+	Active bool
+}
+
+func humanDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("02 Jan 2006 at 15:04")
+}
+
+var functions = template.FuncMap{
+	"humanDate": humanDate,
+	"navItem": func(currentPath, href, icon, label string) navItem {
+		return navItem{Href: href, Icon: icon, Label: label, Active: currentPath == href}
+	},
+}
+
+// newTemplateCache parses every page in html/pages once, together with the base
+// layout and the partials, and returns them keyed by file name ("admin.html").
+// Pages that use the layout start with {{template "base" .}} and define "title" and
+// "main"; pages that don't, like the landing page, are complete documents.
+//
+// Besides the shared functions, templates can call {{asset "/css/main.css"}} to get
+// the content-hashed URL of a static file.
+func newTemplateCache(a *assets) (map[string]*template.Template, error) {
+	cache := map[string]*template.Template{}
+	fsys := a.fsys
+
+	pages, err := fs.Glob(fsys, "html/pages/*.html")
+	if err != nil {
+		return nil, err
+	}
+	// An empty cache means the ui directory we were pointed at isn't one, which is
+	// better reported now than as a 500 on every page.
+	if len(pages) == 0 {
+		return nil, errors.New("no HTML templates found in html/pages")
+	}
+
+	for _, page := range pages {
+		name := path.Base(page)
+
+		patterns := []string{
+			"html/base.html",
+			"html/partials/*.html",
+			page,
+		}
+
+		ts, err := template.New(name).Funcs(functions).Funcs(template.FuncMap{"asset": a.url}).ParseFS(fsys, patterns...)
+		if err != nil {
+			return nil, err
+		}
+
+		cache[name] = ts
+	}
+
+	return cache, nil
+}
+
+// templateReloadEnabled reports whether templates should be parsed again on every
+// render, so that edits show up without restarting the server (which needs -ui-dir,
+// the embedded copy never changes). Like the debug routes it is only honoured in
+// development.
+func (app *application) templateReloadEnabled() bool {
+	return app.config.env == "development" && app.config.templates.reload
+}
+
+// render executes the page into a buffer and only writes the response once that has
+// succeeded, so that a template error results in a clean 500 rather than half a page
+// followed by an error message.
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, page string, td *templateData) {
+	cache := app.templateCache
+	if app.templateReloadEnabled() {
+		var err error
+		cache, err = newTemplateCache(app.assets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	ts, ok := cache[page]
+	if !ok {
+		app.serverErrorResponse(w, r, fmt.Errorf("the template %s does not exist", page))
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err := ts.ExecuteTemplate(buf, page, td)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCabinetPages(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	company := seedCompany(t, app, "Resto")
+
+	tests := []struct {
+		email    string
+		userType string
+		path     string
+	}{
+		{"admin@example.com", "admin", "/my-cabinet-admin"},
+		{"cs@example.com", "csmanager", "/my-cabinet-cs"},
+		{"b2b@example.com", "b2bclient", "/my-cabinet-b-client"},
+		{"client@example.com", "client", "/my-cabinet"},
+		{"partner@example.com", "partner", "/my-cabinet-partner"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.userType, func(t *testing.T) {
+			companyID := int64(0)
+			if tt.userType == "partner" {
+				companyID = company.ID
+			}
+			seedUser(t, app, tt.email, tt.userType, companyID)
+
+			code, body := ts.loggedIn(tt.email).get(tt.path)
+			wantStatus(t, code, body, http.StatusOK)
+			wantContains(t, body, "Test User", "nav-item active", "</html>")
+			if n := strings.Count(body, "<!DOCTYPE html>"); n != 1 {
+				t.Errorf("got %d doctypes; want 1", n)
+			}
+		})
+	}
+
+	// Other users' cabinets are off limits.
+	code, body := ts.loggedIn("client@example.com").get("/my-cabinet-admin")
+	if code == http.StatusOK {
+		t.Errorf("client got the admin cabinet: %s", body)
+	}
+}
+
+func TestTemplateErrorsAreNotPartiallyWritten(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "admin@example.com", "admin", 0)
+	admin := ts.loggedIn("admin@example.com")
+
+	app.templateCache["admin.html"] = template.Must(template.New("admin.html").Parse(`<p>partial output</p>{{.Nope}}`))
+
+	code, body := admin.get("/my-cabinet-admin")
+	wantStatus(t, code, body, http.StatusInternalServerError)
+	if strings.Contains(body, "partial output") {
+		t.Errorf("got a half-rendered page: %s", body)
+	}
+}
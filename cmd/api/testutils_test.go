@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/concierge/service/internal/data"
+	"github.com/concierge/service/internal/events"
+	"github.com/concierge/service/internal/jsonlog"
+	"github.com/concierge/service/internal/payment"
+	"github.com/concierge/service/ui"
+)
+
+// testPassword is the password of every user created with seedUser().
+const testPassword = "pa55word123"
+
+// newTestApplication returns an application backed by the in-memory models, with
+// the embedded UI, the fake payment processor and a mailer that isn't configured,
+// so that nothing leaves the process.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := &application{
+		logger:   jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		models:   data.NewMemoryModels(),
+		payments: payment.NewFake("test-webhook-secret"),
+		events:   events.NewHub(64, 1000),
+		assets:   newAssets(ui.Files, true),
+	}
+	app.config.env = "development"
+	app.config.cookie.sameSite = http.SameSiteLaxMode
+	app.config.payments.currency = "KZT"
+	app.metrics = app.newAppMetrics()
+
+	templateCache, err := newTemplateCache(app.assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.templateCache = templateCache
+
+	err = app.initSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Background tasks (mostly emails) must be done before the next test swaps
+	// the models out from under them.
+	t.Cleanup(app.wg.Wait)
+	return app
+}
+
+type testServer struct {
+	*httptest.Server
+	t *testing.T
+}
+
+func newTestServer(t *testing.T, app *application) *testServer {
+	ts := httptest.NewServer(app.routes())
+	t.Cleanup(ts.Close)
+	return &testServer{Server: ts, t: t}
+}
+
+// testClient is a browser: it keeps its cookies and doesn't follow redirects.
+type testClient struct {
+	*http.Client
+	ts *testServer
+}
+
+func (ts *testServer) newClient() *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return &testClient{
+		Client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		ts: ts,
+	}
+}
+
+// loggedIn returns a client logged in as the user with the given email, which must
+// have been created with seedUser().
+func (ts *testServer) loggedIn(email string) *testClient {
+	ts.t.Helper()
+
+	c := ts.newClient()
+	c.get("/")
+
+	form := url.Values{
+		"emailD":     {email},
+		"passwordD":  {testPassword},
+		"csrf_token": {c.cookie(csrfCookieName)},
+	}
+	res, err := c.PostForm(ts.URL+"/login", form)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	res.Body.Close()
+	// Users without a cabinet of their own (CS managers, B2B clients) aren't
+	// redirected anywhere.
+	if res.StatusCode != http.StatusSeeOther && res.StatusCode != http.StatusOK {
+		ts.t.Fatalf("logging in as %s: got status %d", email, res.StatusCode)
+	}
+	return c
+}
+
+func (c *testClient) cookie(name string) string {
+	u, _ := url.Parse(c.ts.URL)
+	for _, cookie := range c.Jar.Cookies(u) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// send sends a request and returns the status code, headers and body of the
+// response.
+func (c *testClient) send(req *http.Request) (int, http.Header, string) {
+	c.ts.t.Helper()
+
+	res, err := c.Do(req)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	return res.StatusCode, res.Header, string(bytes.TrimSpace(body))
+}
+
+// do sends a request to the API, with body as JSON, followed by headers as name,
+// value pairs.
+func (c *testClient) do(method, path, body string, headers ...string) (int, string) {
+	c.ts.t.Helper()
+
+	req, err := http.NewRequest(method, c.ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	code, _, resBody := c.send(req)
+	return code, resBody
+}
+
+func (c *testClient) get(path string) (int, string) {
+	c.ts.t.Helper()
+	return c.do(http.MethodGet, path, "")
+}
+
+// seedUser creates an activated user of the given type, who belongs to the
+// company with ID companyID unless it is 0.
+func seedUser(t *testing.T, app *application, email, userType string, companyID int64) *data.User {
+	t.Helper()
+
+	user := &data.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     email,
+		Username:  strings.Split(email, "@")[0],
+		UserType:  userType,
+		CompanyID: companyID,
+		Activated: true,
+	}
+	err := user.Password.Set(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.User.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// wantStatus fails the test if a response doesn't have the expected status code.
+func wantStatus(t *testing.T, code int, body string, want int) {
+	t.Helper()
+	if code != want {
+		t.Fatalf("got status %d; want %d: %s", code, want, body)
+	}
+}
+
+// wantContains fails the test if a response body doesn't contain every one of
+// substrs.
+func wantContains(t *testing.T, body string, substrs ...string) {
+	t.Helper()
+	for _, s := range substrs {
+		if !strings.Contains(body, s) {
+			t.Fatalf("want body to contain %q: %s", s, body)
+		}
+	}
+}
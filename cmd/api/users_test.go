@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCurrentUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	seedUser(t, app, "bob@example.com", "client", 0)
+
+	code, body := ts.newClient().get("/v1/me")
+	wantStatus(t, code, body, http.StatusUnauthorized)
+
+	bob := ts.loggedIn("bob@example.com")
+	code, body = bob.get("/v1/me")
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"email":"bob@example.com"`, `"contact_channel":"email"`)
+
+	code, body = bob.do(http.MethodPatch, "/v1/me", `{"first_name":"Bobby","preferences":{"dietary_needs":["vegan"],"preferred_languages":["en","ru"],"notifications":{"sms":true}}}`)
+	wantStatus(t, code, body, http.StatusOK)
+	wantContains(t, body, `"first_name":"Bobby"`, `"dietary_needs":["vegan"]`, `"preferred_languages":["en","ru"]`, `"sms":true`)
+
+	code, body = bob.do(http.MethodPatch, "/v1/me", `{"preferences":{"contact_channel":"pigeon","preferred_languages":["english"]}}`)
+	wantStatus(t, code, body, http.StatusUnprocessableEntity)
+
+	code, body = bob.do(http.MethodPut, "/v1/me/password", `{"current_password":"wrong-password","new_password":"newpassword1"}`)
+	wantStatus(t, code, body, http.StatusUnauthorized)
+	code, body = bob.do(http.MethodPut, "/v1/me/password", `{"current_password":"`+testPassword+`","new_password":"newpassword1"}`)
+	wantStatus(t, code, body, http.StatusOK)
+
+	// Changing the password logs every session out.
+	code, body = bob.get("/v1/me")
+	wantStatus(t, code, body, http.StatusUnauthorized)
+}
@@ -7,15 +7,15 @@ require github.com/julienschmidt/httprouter v1.3.0
 require (
 	github.com/PuerkitoBio/goquery v1.8.0 // indirect
 	github.com/andybalholm/cascadia v1.3.1 // indirect
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
-	github.com/go-session/session/v3 v3.1.7 // indirect
-	golang.org/x/crypto v0.5.0 // indirect
 	golang.org/x/net v0.5.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
 
 require (
+	github.com/go-mail/mail/v2 v2.3.0
+	github.com/go-session/session/v3 v3.1.7
 	github.com/golang-migrate/migrate/v4 v4.15.2
 	github.com/joho/godotenv v1.4.0
 	github.com/lib/pq v1.10.0
+	golang.org/x/crypto v0.5.0
 )
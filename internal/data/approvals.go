@@ -0,0 +1,667 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+	"github.com/lib/pq"
+)
+
+// ErrOverBudget is returned by ApprovalReasons when a booking would take a budget
+// over its limit and the company's rules don't let it through with approval.
+var ErrOverBudget = errors.New("the booking would exceed the monthly budget")
+
+// Bookings made by B2B clients that need approval wait for one of the company's
+// approvers to approve or reject them. Rejected bookings are cancelled. Cancelling
+// a booking still waiting for approval withdraws the approval.
+const (
+	ApprovalPending   = "pending"
+	ApprovalApproved  = "approved"
+	ApprovalRejected  = "rejected"
+	ApprovalWithdrawn = "withdrawn"
+)
+
+var ApprovalStatuses = []string{ApprovalPending, ApprovalApproved, ApprovalRejected, ApprovalWithdrawn}
+
+// Kinds of approval rule. RuleAmountAbove has bookings costing more than the
+// threshold approved, RuleAlways every booking. RuleOverBudget lets bookings that
+// would take a budget over its limit through with approval; without it they are
+// refused.
+const (
+	RuleAmountAbove = "amount_above"
+	RuleOverBudget  = "over_budget"
+	RuleAlways      = "always"
+)
+
+var ApprovalRuleKinds = []string{RuleAmountAbove, RuleOverBudget, RuleAlways}
+
+// Budget is what a company, or one of its employees when UserID is set, may spend
+// in a calendar month.
+type Budget struct {
+	UserID       int64 `json:"user_id,omitempty"`
+	MonthlyLimit int   `json:"monthly_limit"`
+}
+
+type ApprovalRule struct {
+	Kind      string `json:"kind"`
+	Threshold int    `json:"threshold,omitempty"`
+}
+
+// SpendingControls are the budgets, approval rules and approvers of a company.
+type SpendingControls struct {
+	CompanyID   int64           `json:"company_id"`
+	Budgets     []*Budget       `json:"budgets"`
+	Rules       []*ApprovalRule `json:"rules"`
+	ApproverIDs []int64         `json:"approver_ids"`
+}
+
+// BudgetsFor returns the budgets a booking made by a user counts against: the
+// company's and the user's own.
+func (c *SpendingControls) BudgetsFor(userID int64) []*Budget {
+	budgets := []*Budget{}
+	for _, budget := range c.Budgets {
+		if budget.UserID == 0 || budget.UserID == userID {
+			budgets = append(budgets, budget)
+		}
+	}
+	return budgets
+}
+
+// IsApprover reports whether a user approves the company's bookings.
+func (c *SpendingControls) IsApprover(userID int64) bool {
+	for _, id := range c.ApproverIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// BudgetMonth returns the bounds of the calendar month, in UTC, that a booking
+// starting at t counts against.
+func BudgetMonth(t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// BudgetUse is a budget with what was spent against it in a month.
+type BudgetUse struct {
+	*Budget
+	Spent int `json:"spent"`
+}
+
+// ApprovalReasons is the rule engine: it returns why a booking costing amount needs
+// approval under rules, given the budgets it counts against, or no reasons if it
+// doesn't need any. It fails with ErrOverBudget if the booking would take a budget
+// over its limit and there is no RuleOverBudget.
+func ApprovalReasons(rules []*ApprovalRule, amount int, uses []BudgetUse) ([]string, error) {
+	reasons := []string{}
+	overBudget := false
+	for _, rule := range rules {
+		switch rule.Kind {
+		case RuleAlways:
+			reasons = append(reasons, "every booking needs approval")
+		case RuleAmountAbove:
+			if amount > rule.Threshold {
+				reasons = append(reasons, fmt.Sprintf("the booking costs more than %d", rule.Threshold))
+			}
+		case RuleOverBudget:
+			overBudget = true
+		}
+	}
+
+	for _, use := range uses {
+		if use.Spent+amount <= use.MonthlyLimit {
+			continue
+		}
+		if !overBudget {
+			return nil, ErrOverBudget
+		}
+		owner := "the company"
+		if use.UserID != 0 {
+			owner = "the employee"
+		}
+		reasons = append(reasons, fmt.Sprintf("the booking takes the monthly budget of %s over its limit of %d", owner, use.MonthlyLimit))
+	}
+	return reasons, nil
+}
+
+// bookingApproval runs the controls of a B2B client's company on a booking they
+// are making, and returns the pending approval it needs, or nil if it doesn't need
+// any. The booking counts against the budgets of the month it starts in; spent
+// returns what was spent against a budget, as Spent() does.
+func bookingApproval(controls *SpendingControls, client *User, booking *Booking, spent func(userID int64, from, to time.Time) (int, error)) (*Approval, error) {
+	from, to := BudgetMonth(booking.StartsAt)
+	uses := []BudgetUse{}
+	for _, budget := range controls.BudgetsFor(client.ID) {
+		s, err := spent(budget.UserID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		uses = append(uses, BudgetUse{Budget: budget, Spent: s})
+	}
+
+	reasons, err := ApprovalReasons(controls.Rules, booking.Total(), uses)
+	if err != nil || len(reasons) == 0 {
+		return nil, err
+	}
+	return &Approval{
+		CompanyID:     client.CompanyID,
+		RequestedByID: client.ID,
+		Amount:        booking.Total(),
+		Reasons:       reasons,
+		Status:        ApprovalPending,
+	}, nil
+}
+
+// Approval is a booking of a B2B client awaiting, or given, the approval of their
+// company. Amount is what the booking cost when it was made and Reasons why it
+// needed approval.
+type Approval struct {
+	ID            int64     `json:"id"`
+	BookingID     int64     `json:"booking_id"`
+	CompanyID     int64     `json:"company_id"`
+	RequestedByID int64     `json:"requested_by_id"`
+	Amount        int       `json:"amount"`
+	Reasons       []string  `json:"reasons"`
+	Status        string    `json:"status"`
+	DecidedByID   int64     `json:"decided_by_id,omitempty"`
+	Note          string    `json:"note"`
+	CreatedAt     time.Time `json:"created_at"`
+	DecidedAt     NullTime  `json:"decided_at"`
+	Version       int32     `json:"version"`
+}
+
+func (a *Approval) Decide(status string, approverID int64, note string) {
+	a.Status = status
+	a.DecidedByID = approverID
+	a.Note = note
+	a.DecidedAt = nullTimeNow()
+}
+
+func ValidateSpendingControls(v *validator.Validator, c *SpendingControls) {
+	v.Check(len(c.Budgets) <= 1000, "budgets", "must not contain more than 1000 budgets")
+	users := make(map[int64]bool)
+	for i, budget := range c.Budgets {
+		key := fmt.Sprintf("budgets[%d]", i)
+		v.Check(budget.MonthlyLimit > 0, key+".monthly_limit", "must be greater than zero")
+		v.Check(budget.UserID >= 0, key+".user_id", "must not be negative")
+		v.Check(!users[budget.UserID], key+".user_id", "must not have more than one budget")
+		users[budget.UserID] = true
+	}
+
+	v.Check(len(c.Rules) <= 20, "rules", "must not contain more than 20 rules")
+	for i, rule := range c.Rules {
+		key := fmt.Sprintf("rules[%d]", i)
+		v.Check(validator.In(rule.Kind, ApprovalRuleKinds...), key+".kind", "invalid kind")
+		if rule.Kind == RuleAmountAbove {
+			v.Check(rule.Threshold > 0, key+".threshold", "must be greater than zero")
+		} else {
+			v.Check(rule.Threshold == 0, key+".threshold", "must only be set for "+RuleAmountAbove+" rules")
+		}
+	}
+
+	v.Check(len(c.ApproverIDs) <= 100, "approver_ids", "must not contain more than 100 approvers")
+	approvers := make(map[int64]bool)
+	for _, id := range c.ApproverIDs {
+		v.Check(!approvers[id], "approver_ids", "must not contain duplicate values")
+		approvers[id] = true
+	}
+}
+
+// ApprovalFilter narrows down the approvals returned by List(). Zero values mean
+// "don't filter on this field".
+type ApprovalFilter struct {
+	CompanyID int64
+	Status    string
+}
+
+func ValidateApprovalFilter(v *validator.Validator, f ApprovalFilter) {
+	if f.Status != "" {
+		v.Check(validator.In(f.Status, ApprovalStatuses...), "status", "invalid status")
+	}
+}
+
+// ApprovalSortSafelist lists the values accepted for the sort parameter of List().
+var ApprovalSortSafelist = []string{"id", "amount", "created_at", "-id", "-amount", "-created_at"}
+
+type ApprovalModel struct {
+	DB *sql.DB
+}
+
+func (m ApprovalModel) Controls(ctx context.Context, companyID int64) (*SpendingControls, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return loadControls(ctx, m.DB, companyID)
+}
+
+func loadControls(ctx context.Context, q queryer, companyID int64) (*SpendingControls, error) {
+	controls := &SpendingControls{CompanyID: companyID, Budgets: []*Budget{}, Rules: []*ApprovalRule{}, ApproverIDs: []int64{}}
+
+	rows, err := q.QueryContext(ctx, `
+SELECT COALESCE(user_id, 0), monthly_limit
+FROM budget
+WHERE company_id = $1
+ORDER BY user_id NULLS FIRST`, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var budget Budget
+		if err := rows.Scan(&budget.UserID, &budget.MonthlyLimit); err != nil {
+			return nil, err
+		}
+		controls.Budgets = append(controls.Budgets, &budget)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q.QueryContext(ctx, `SELECT kind, threshold FROM approval_rule WHERE company_id = $1 ORDER BY id`, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rule ApprovalRule
+		if err := rows.Scan(&rule.Kind, &rule.Threshold); err != nil {
+			return nil, err
+		}
+		controls.Rules = append(controls.Rules, &rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q.QueryContext(ctx, `SELECT user_id FROM approver WHERE company_id = $1 ORDER BY user_id`, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		controls.ApproverIDs = append(controls.ApproverIDs, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return controls, nil
+}
+
+// SetControls replaces the spending controls of a company.
+func (m ApprovalModel) SetControls(ctx context.Context, controls *SpendingControls) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockCompany(ctx, tx, controls.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"budget", "approval_rule", "approver"} {
+		_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE company_id = $1`, controls.CompanyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, budget := range controls.Budgets {
+		query := `INSERT INTO budget (company_id, user_id, monthly_limit) VALUES ($1, NULLIF($2, 0), $3)`
+		_, err = tx.ExecContext(ctx, query, controls.CompanyID, budget.UserID, budget.MonthlyLimit)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rule := range controls.Rules {
+		query := `INSERT INTO approval_rule (company_id, kind, threshold) VALUES ($1, $2, $3)`
+		_, err = tx.ExecContext(ctx, query, controls.CompanyID, rule.Kind, rule.Threshold)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range controls.ApproverIDs {
+		query := `INSERT INTO approver (company_id, user_id) VALUES ($1, $2)`
+		_, err = tx.ExecContext(ctx, query, controls.CompanyID, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Spent returns what the users of a company, or only the user with userID if it
+// isn't 0, spent on bookings starting from from, inclusive, to to, exclusive:
+// their total, or the cancellation fee for cancelled bookings.
+func (m ApprovalModel) Spent(ctx context.Context, companyID, userID int64, from, to time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return spent(ctx, m.DB, companyID, userID, from, to)
+}
+
+func spent(ctx context.Context, q queryer, companyID, userID int64, from, to time.Time) (int, error) {
+	query := `
+SELECT COALESCE(SUM(CASE WHEN booking.cancelled_at IS NULL THEN booking.unit_price * booking.quantity ELSE booking.cancellation_fee END), 0)
+FROM booking
+INNER JOIN request ON request.id = booking.request_id
+INNER JOIN users ON users.id = request.client_id
+WHERE users.company_id = $1 AND ($2 = 0 OR users.id = $2)
+AND booking.starts_at >= $3 AND booking.starts_at < $4`
+
+	var total int
+	err := q.QueryRowContext(ctx, query, companyID, userID, from, to).Scan(&total)
+	return total, err
+}
+
+// lockCompany locks the row of a company until the end of tx, so that bookings
+// checked against its spending controls, and changes to them, are made one at a
+// time.
+func lockCompany(ctx context.Context, tx *sql.Tx, companyID int64) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM company WHERE id = $1 FOR NO KEY UPDATE`, companyID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// InsertBooking inserts a booking made by a B2B client, running the spending
+// controls of their company on it first. If the booking needs approval, the
+// pending approval is inserted with it and returned; otherwise the approval is nil.
+// It fails with ErrOverBudget if the booking would take a budget over its limit
+// and the company's rules don't let it through with approval.
+//
+// The company is locked while the booking is checked and inserted, so that two
+// bookings made at once can't both fit in what is left of a budget.
+func (m ApprovalModel) InsertBooking(ctx context.Context, client *User, booking *Booking) (*Approval, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = lockCompany(ctx, tx, client.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	controls, err := loadControls(ctx, tx, client.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	approval, err := bookingApproval(controls, client, booking, func(userID int64, from, to time.Time) (int, error) {
+		return spent(ctx, tx, client.CompanyID, userID, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertBooking(ctx, tx, booking)
+	if err != nil {
+		return nil, err
+	}
+	if approval != nil {
+		approval.BookingID = booking.ID
+		err = insertApproval(ctx, tx, approval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return approval, tx.Commit()
+}
+
+func (m ApprovalModel) Insert(ctx context.Context, approval *Approval) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return insertApproval(ctx, m.DB, approval)
+}
+
+func insertApproval(ctx context.Context, q queryer, approval *Approval) error {
+	query := `
+INSERT INTO approval (booking_id, company_id, requested_by_id, amount, reasons, status)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at, version`
+	args := []interface{}{
+		approval.BookingID,
+		approval.CompanyID,
+		approval.RequestedByID,
+		approval.Amount,
+		pq.Array(approval.Reasons),
+		approval.Status,
+	}
+
+	return q.QueryRowContext(ctx, query, args...).Scan(&approval.ID, &approval.CreatedAt, &approval.Version)
+}
+
+const approvalColumns = `id, booking_id, company_id, requested_by_id, amount, reasons, status, COALESCE(decided_by_id, 0),
+note, created_at, decided_at, version`
+
+func scanApproval(row interface{ Scan(...interface{}) error }, approval *Approval) error {
+	return row.Scan(
+		&approval.ID,
+		&approval.BookingID,
+		&approval.CompanyID,
+		&approval.RequestedByID,
+		&approval.Amount,
+		pq.Array(&approval.Reasons),
+		&approval.Status,
+		&approval.DecidedByID,
+		&approval.Note,
+		&approval.CreatedAt,
+		&approval.DecidedAt,
+		&approval.Version,
+	)
+}
+
+func (m ApprovalModel) getWhere(ctx context.Context, where string, args ...interface{}) (*Approval, error) {
+	query := `SELECT ` + approvalColumns + ` FROM approval WHERE ` + where
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var approval Approval
+	err := scanApproval(m.DB.QueryRowContext(ctx, query, args...), &approval)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &approval, nil
+}
+
+func (m ApprovalModel) Get(ctx context.Context, id int64) (*Approval, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	return m.getWhere(ctx, `id = $1`, id)
+}
+
+func (m ApprovalModel) GetForBooking(ctx context.Context, bookingID int64) (*Approval, error) {
+	return m.getWhere(ctx, `booking_id = $1`, bookingID)
+}
+
+func (m ApprovalModel) List(ctx context.Context, filter ApprovalFilter, filters Filters) ([]*Approval, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), %s
+FROM approval
+WHERE ($1 = 0 OR company_id = $1)
+AND ($2 = '' OR status = $2)
+ORDER BY %s %s, id ASC
+LIMIT $3 OFFSET $4`, approvalColumns, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{filter.CompanyID, filter.Status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	approvals := []*Approval{}
+
+	for rows.Next() {
+		var approval Approval
+		err := rows.Scan(
+			&totalRecords,
+			&approval.ID,
+			&approval.BookingID,
+			&approval.CompanyID,
+			&approval.RequestedByID,
+			&approval.Amount,
+			pq.Array(&approval.Reasons),
+			&approval.Status,
+			&approval.DecidedByID,
+			&approval.Note,
+			&approval.CreatedAt,
+			&approval.DecidedAt,
+			&approval.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		approvals = append(approvals, &approval)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return approvals, metadata, nil
+}
+
+// Decide saves the decision on an approval. Rejecting it cancels its booking, free
+// of charge: both are saved in one transaction, which locks the booking first, so
+// that a booking is never left live with a rejected approval. Decide fails with
+// ErrEditConflict if the approval or the booking was changed since they were read,
+// e.g. decided by another approver or cancelled by the client. The caller releases
+// the slot reservation of a cancelled booking once it is saved.
+func (m ApprovalModel) Decide(ctx context.Context, approval *Approval, booking *Booking) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int32
+	err = tx.QueryRowContext(ctx, `SELECT version FROM booking WHERE id = $1 FOR UPDATE`, booking.ID).Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrEditConflict
+	case err != nil:
+		return err
+	case version != booking.Version:
+		return ErrEditConflict
+	}
+
+	err = updateApproval(ctx, tx, approval)
+	if err != nil {
+		return err
+	}
+
+	if approval.Status == ApprovalRejected {
+		booking.Cancel("Rejected by the company: "+approval.Note, 0)
+		err = updateBooking(ctx, tx, booking)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CancelBooking cancels a booking and withdraws its pending approval, if it has
+// one, in one transaction, so that a cancelled booking can't be approved any more.
+// It returns the withdrawn approval, or nil. It fails with ErrEditConflict if the
+// booking was changed since it was read. The caller releases the slot reservation
+// of the booking once it is saved.
+func (m ApprovalModel) CancelBooking(ctx context.Context, booking *Booking, reason string, fee int) (*Approval, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	booking.Cancel(reason, fee)
+	err = updateBooking(ctx, tx, booking)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+UPDATE approval
+SET status = $1, version = version + 1
+WHERE booking_id = $2 AND status = $3
+RETURNING ` + approvalColumns
+	var approval Approval
+	err = scanApproval(tx.QueryRowContext(ctx, query, ApprovalWithdrawn, booking.ID, ApprovalPending), &approval)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if approval.ID == 0 {
+		return nil, nil
+	}
+	return &approval, nil
+}
+
+func updateApproval(ctx context.Context, q queryer, approval *Approval) error {
+	query := `
+UPDATE approval
+SET status = $1, decided_by_id = NULLIF($2, 0), note = $3, decided_at = $4, version = version + 1
+WHERE id = $5 AND version = $6
+RETURNING version`
+	args := []interface{}{approval.Status, approval.DecidedByID, approval.Note, approval.DecidedAt, approval.ID, approval.Version}
+
+	err := q.QueryRowContext(ctx, query, args...).Scan(&approval.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seedEmployeeRequest creates an employee of a company and a request they made.
+func seedEmployeeRequest(t *testing.T, m Models, companyID int64) (*User, *Request) {
+	t.Helper()
+
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano() % 1_000_000_000)
+	client := &User{FirstName: "Test", LastName: "Employee", Email: "employee" + suffix + "@example.com", Username: "employee" + suffix, UserType: UserTypeB2BClient, CompanyID: companyID, Activated: true}
+	err := client.Password.Set("pa55word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.User.Insert(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &Request{ClientID: client.ID, Type: "dinner", Description: "A table for two", Status: RequestStatusNew}
+	err = m.Request.Insert(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, request
+}
+
+func TestInsertBookingConcurrently(t *testing.T) {
+	eachStore(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		service := seedService(t, m)
+		companyID := int64(service.CompanyID)
+
+		client, request := seedEmployeeRequest(t, m, companyID)
+
+		// The budget covers three of the ten bookings, and going over it is refused.
+		const price, covered, attempts = 1000, 3, 10
+		controls := &SpendingControls{CompanyID: companyID, Budgets: []*Budget{{MonthlyLimit: covered * price}}}
+		err := m.Approval.SetControls(ctx, controls)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now().Add(48 * time.Hour)
+		var (
+			wg         sync.WaitGroup
+			mu         sync.Mutex
+			inserted   int
+			overBudget int
+		)
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				booking := &Booking{
+					RequestID: request.ID, ServiceID: service.ID, UnitPrice: price, Quantity: 1, PartySize: 1,
+					StartsAt: start, EndsAt: start.Add(time.Hour),
+					PartnerStatus: PartnerStatusPending, FulfilmentStatus: FulfilmentNotStarted,
+				}
+				approval, err := m.Approval.InsertBooking(ctx, client, booking)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil && approval == nil:
+					inserted++
+				case errors.Is(err, ErrOverBudget):
+					overBudget++
+				case err != nil:
+					t.Error(err)
+				default:
+					t.Errorf("got an approval for a booking within the budget: %v", approval.Reasons)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if inserted != covered || overBudget != attempts-covered {
+			t.Errorf("got %d bookings and %d refusals; want %d and %d", inserted, overBudget, covered, attempts-covered)
+		}
+		from, to := BudgetMonth(start)
+		spent, err := m.Approval.Spent(ctx, companyID, 0, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spent != covered*price {
+			t.Errorf("got %d spent; want %d", spent, covered*price)
+		}
+	})
+}
+
+func TestDecideRejection(t *testing.T) {
+	eachStore(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		service := seedService(t, m)
+		companyID := int64(service.CompanyID)
+		client, request := seedEmployeeRequest(t, m, companyID)
+
+		err := m.Approval.SetControls(ctx, &SpendingControls{CompanyID: companyID, Rules: []*ApprovalRule{{Kind: RuleAlways}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now().Add(48 * time.Hour)
+		booking := &Booking{
+			RequestID: request.ID, ServiceID: service.ID, UnitPrice: 1000, Quantity: 1, PartySize: 1,
+			StartsAt: start, EndsAt: start.Add(time.Hour),
+			PartnerStatus: PartnerStatusPending, FulfilmentStatus: FulfilmentNotStarted,
+		}
+		approval, err := m.Approval.InsertBooking(ctx, client, booking)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A rejection based on a booking that has changed since is saved neither on
+		// the approval nor on the booking.
+		stale := *booking
+		booking.StartsAt = start.Add(time.Hour)
+		booking.EndsAt = start.Add(2 * time.Hour)
+		err = m.Booking.Update(ctx, booking)
+		if err != nil {
+			t.Fatal(err)
+		}
+		approval.Decide(ApprovalRejected, client.ID, "Too expensive")
+		err = m.Approval.Decide(ctx, approval, &stale)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Fatalf("got error %v; want ErrEditConflict", err)
+		}
+		saved, err := m.Approval.Get(ctx, approval.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Status != ApprovalPending {
+			t.Errorf("got approval %s; want it still pending", saved.Status)
+		}
+
+		err = m.Approval.Decide(ctx, approval, booking)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved, err = m.Approval.Get(ctx, approval.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancelled, err := m.Booking.Get(ctx, booking.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Status != ApprovalRejected || !cancelled.Cancelled() || cancelled.CancellationFee != 0 {
+			t.Errorf("got approval %s and booking cancelled %t with fee %d; want rejected and cancelled for free",
+				saved.Status, cancelled.Cancelled(), cancelled.CancellationFee)
+		}
+	})
+}
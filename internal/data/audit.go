@@ -0,0 +1,278 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+// Audit actions. Delete is a soft delete that Restore can undo; Purge removes the
+// row for good. Erase anonymizes a user's personal data.
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+	AuditActionPurge   = "purge"
+	AuditActionErase   = "erase"
+)
+
+var AuditActions = []string{AuditActionCreate, AuditActionUpdate, AuditActionDelete, AuditActionRestore, AuditActionPurge, AuditActionErase}
+
+// Entity types recorded in the audit log.
+const (
+	AuditEntityService       = "service"
+	AuditEntityPrice         = "price"
+	AuditEntityCompany       = "company"
+	AuditEntityUser          = "user"
+	AuditEntityRequest       = "request"
+	AuditEntityBooking       = "booking"
+	AuditEntityServiceChange = "service_change"
+	AuditEntityAvailability  = "availability"
+	AuditEntityInvoice       = "invoice"
+	AuditEntityPayment       = "payment"
+	AuditEntityAccount       = "account"
+	AuditEntityLedger        = "ledger_transaction"
+	AuditEntityControls      = "spending_controls"
+	AuditEntityApproval      = "approval"
+	AuditEntityPlan          = "plan"
+	AuditEntitySubscription  = "subscription"
+	AuditEntityMessage       = "message"
+	AuditEntityRegForm       = "reg_form"
+)
+
+var AuditEntityTypes = []string{
+	AuditEntityService,
+	AuditEntityPrice,
+	AuditEntityCompany,
+	AuditEntityUser,
+	AuditEntityRequest,
+	AuditEntityBooking,
+	AuditEntityServiceChange,
+	AuditEntityAvailability,
+	AuditEntityInvoice,
+	AuditEntityPayment,
+	AuditEntityAccount,
+	AuditEntityLedger,
+	AuditEntityControls,
+	AuditEntityApproval,
+	AuditEntityPlan,
+	AuditEntitySubscription,
+	AuditEntityMessage,
+	AuditEntityRegForm,
+}
+
+// AuditEntry records a single change to the data: who (ActorID, 0 when nobody was
+// logged in) did what (Action) to which row (EntityType/EntityID), from where (IP)
+// and as part of which HTTP request (RequestID).
+//
+// Changes maps each field that changed to its value before and after, e.g.
+// {"price": {"before": 100, "after": 120}}. Creates and restores only have "after"
+// values, deletes and purges only "before" values.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	ActorID    int64           `json:"actor_id"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int64           `json:"entity_id"`
+	Changes    json.RawMessage `json:"changes"`
+	IP         string          `json:"ip"`
+	RequestID  string          `json:"request_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditChange is a single field in AuditEntry.Changes.
+type AuditChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// auditIgnoredFields are left out of Changes because they change on every write
+// and say nothing about what the actor did.
+var auditIgnoredFields = map[string]bool{"updated_at": true, "version": true}
+
+// auditChanges compares the JSON representations of before and after, either of
+// which may be nil, and returns the fields that differ.
+func auditChanges(before, after interface{}) (json.RawMessage, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]AuditChange)
+	for field, value := range beforeFields {
+		if !bytes.Equal(value, afterFields[field]) {
+			changes[field] = AuditChange{Before: value, After: afterFields[field]}
+		}
+	}
+	for field, value := range afterFields {
+		if _, ok := beforeFields[field]; !ok {
+			changes[field] = AuditChange{After: value}
+		}
+	}
+	for field := range auditIgnoredFields {
+		delete(changes, field)
+	}
+
+	return json.Marshal(changes)
+}
+
+func auditFields(v interface{}) (map[string]json.RawMessage, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(js, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %T is not a JSON object", v)
+	}
+	return fields, nil
+}
+
+// AuditActor identifies who is making changes through a context. The HTTP layer
+// attaches it to every request context with ContextWithAuditActor(), and the
+// audited stores read it back when they write an entry.
+type AuditActor struct {
+	UserID    int64
+	IP        string
+	RequestID string
+}
+
+type auditActorContextKey struct{}
+
+func ContextWithAuditActor(ctx context.Context, actor AuditActor) context.Context {
+	return context.WithValue(ctx, auditActorContextKey{}, actor)
+}
+
+// auditActorFromContext returns the actor attached to ctx, or the zero AuditActor
+// (the system) if there is none, e.g. in background jobs.
+func auditActorFromContext(ctx context.Context) AuditActor {
+	actor, _ := ctx.Value(auditActorContextKey{}).(AuditActor)
+	return actor
+}
+
+// AuditFilter narrows down the entries returned by List(). Zero values mean "don't
+// filter on this field". From is inclusive and To is exclusive.
+type AuditFilter struct {
+	ActorID    int64
+	EntityType string
+	EntityID   int64
+	Action     string
+	From       time.Time
+	To         time.Time
+}
+
+func ValidateAuditFilter(v *validator.Validator, f AuditFilter) {
+	v.Check(f.ActorID >= 0, "actor_id", "must not be negative")
+	v.Check(f.EntityID >= 0, "entity_id", "must not be negative")
+	if f.EntityType != "" {
+		v.Check(validator.In(f.EntityType, AuditEntityTypes...), "entity_type", "invalid entity type")
+	}
+	if f.Action != "" {
+		v.Check(validator.In(f.Action, AuditActions...), "action", "invalid action")
+	}
+	if !f.From.IsZero() && !f.To.IsZero() {
+		v.Check(f.To.After(f.From), "to", "must be later than from")
+	}
+}
+
+// AuditSortSafelist lists the values accepted for the sort parameter of List().
+var AuditSortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+func (m AuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	query := `
+INSERT INTO audit_log (actor_id, action, entity_type, entity_id, changes, ip, request_id)
+VALUES (NULLIF($1, 0), $2, $3, $4, $5, $6, $7)
+RETURNING id, created_at`
+
+	changes := entry.Changes
+	if len(changes) == 0 {
+		changes = json.RawMessage("{}")
+	}
+	args := []interface{}{entry.ActorID, entry.Action, entry.EntityType, entry.EntityID, []byte(changes), entry.IP, entry.RequestID}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+func (m AuditModel) List(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, COALESCE(actor_id, 0), action, entity_type, entity_id, changes, ip, request_id, created_at
+FROM audit_log
+WHERE ($1 = 0 OR actor_id = $1)
+AND ($2 = '' OR entity_type = $2)
+AND ($3 = 0 OR entity_id = $3)
+AND ($4 = '' OR action = $4)
+AND ($5::timestamptz IS NULL OR created_at >= $5)
+AND ($6::timestamptz IS NULL OR created_at < $6)
+ORDER BY %s %s, id ASC
+LIMIT $7 OFFSET $8`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		filter.ActorID,
+		filter.EntityType,
+		filter.EntityID,
+		filter.Action,
+		nullTime(filter.From),
+		nullTime(filter.To),
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.ActorID,
+			&entry.Action,
+			&entry.EntityType,
+			&entry.EntityID,
+			&changes,
+			&entry.IP,
+			&entry.RequestID,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		entry.Changes = changes
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return entries, metadata, nil
+}
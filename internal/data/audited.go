@@ -0,0 +1,993 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// The audited stores below wrap the stores of every privileged entity so that each
+// mutating call writes an entry to the audit log, whichever handler or job made it.
+// The actor is taken from the context (see ContextWithAuditActor).
+//
+// The audit log is best effort, not a record every change is guaranteed to be in:
+//   - the entry is written after the change has been committed, in a statement of
+//     its own. If writing it fails the error is logged and the call succeeds, as
+//     reporting the change as failed would have callers undo or retry work that
+//     was done; if the process dies in between, the change goes unrecorded;
+//   - the "before" value of an update is read before the change is made, without
+//     a lock, so a change made in between by someone else can show up in it.
+
+// ErrorLogger is where the audited stores report the audit entries they couldn't
+// write. *jsonlog.Logger satisfies it.
+type ErrorLogger interface {
+	PrintError(err error, properties map[string]string)
+}
+
+// withBestEffortAudit wraps the stores in m that need auditing. Audit entries that can't be
+// written are reported to logger, unless it is nil.
+//
+// Tokens aren't audited: one is created at every login and password reset, and
+// their hashes are of no use in the log. The changes they authorize are recorded
+// by the stores they are made through.
+func withBestEffortAudit(m Models, logger ErrorLogger) Models {
+	audit := auditLog{store: m.Audit, logger: logger}
+	m.RegForm = auditedRegFormStore{RegFormStore: m.RegForm, audit: audit}
+	m.Service = auditedServiceStore{ServiceStore: m.Service, audit: audit}
+	m.Price = auditedPriceStore{PriceStore: m.Price, audit: audit}
+	m.Company = auditedCompanyStore{CompanyStore: m.Company, audit: audit}
+	m.User = auditedUserStore{UserStore: m.User, audit: audit}
+	m.Request = auditedRequestStore{RequestStore: m.Request, audit: audit}
+	m.Booking = auditedBookingStore{BookingStore: m.Booking, audit: audit}
+	m.ServiceChange = auditedServiceChangeStore{ServiceChangeStore: m.ServiceChange, audit: audit}
+	m.Availability = auditedAvailabilityStore{AvailabilityStore: m.Availability, audit: audit}
+	m.Invoice = auditedInvoiceStore{InvoiceStore: m.Invoice, audit: audit}
+	m.Payment = auditedPaymentStore{PaymentStore: m.Payment, audit: audit}
+	m.Ledger = auditedLedgerStore{LedgerStore: m.Ledger, audit: audit}
+	m.Approval = auditedApprovalStore{ApprovalStore: m.Approval, audit: audit}
+	m.Plan = auditedPlanStore{PlanStore: m.Plan, audit: audit}
+	m.Message = auditedMessageStore{MessageStore: m.Message, audit: audit}
+	m.PersonalData = auditedPersonalDataStore{PersonalDataStore: m.PersonalData, audit: audit}
+	return m
+}
+
+// auditLog writes the entries of the audited stores.
+type auditLog struct {
+	store  AuditStore
+	logger ErrorLogger
+}
+
+// recordBestEffort writes an entry for a change that has been made, logging the
+// error if it can't.
+func (a auditLog) recordBestEffort(ctx context.Context, action, entityType string, entityID int64, before, after interface{}) {
+	err := a.write(ctx, action, entityType, entityID, before, after)
+	if err != nil {
+		a.failed(err, action, entityType, entityID)
+	}
+}
+
+func (a auditLog) write(ctx context.Context, action, entityType string, entityID int64, before, after interface{}) error {
+	changes, err := auditChanges(before, after)
+	if err != nil {
+		return err
+	}
+
+	actor := auditActorFromContext(ctx)
+	entry := &AuditEntry{
+		ActorID:    actor.UserID,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Changes:    changes,
+		IP:         actor.IP,
+		RequestID:  actor.RequestID,
+	}
+	return a.store.Insert(ctx, entry)
+}
+
+// recordPurgeBestEffort records the rows removed by a Purge(). Their contents were recorded
+// when they were soft deleted, so only the IDs are logged here.
+func (a auditLog) recordPurgeBestEffort(ctx context.Context, entityType string, ids []int64) {
+	for _, id := range ids {
+		a.recordBestEffort(ctx, AuditActionPurge, entityType, id, nil, nil)
+	}
+}
+
+// failed logs that the entry for a change couldn't be written.
+func (a auditLog) failed(err error, action, entityType string, entityID int64) {
+	if a.logger == nil {
+		return
+	}
+	a.logger.PrintError(err, map[string]string{
+		"audit_action": action,
+		"entity_type":  entityType,
+		"entity_id":    strconv.FormatInt(entityID, 10),
+	})
+}
+
+// auditBefore turns the result of looking up a row before changing it into the
+// "before" value of an audit entry. A missing row isn't an error at this point: the
+// store call that follows reports it in its own way.
+func auditBefore(row interface{}, err error) (interface{}, error) {
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return row, nil
+}
+
+type auditedServiceStore struct {
+	ServiceStore
+	audit auditLog
+}
+
+func (s auditedServiceStore) Insert(ctx context.Context, service *Service) error {
+	err := s.ServiceStore.Insert(ctx, service)
+	if err != nil {
+		return err
+	}
+	s.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityService, service.ID, nil, service)
+	return nil
+}
+
+func (s auditedServiceStore) Update(ctx context.Context, service *Service) error {
+	before, err := auditBefore(s.ServiceStore.GetById(ctx, service.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = s.ServiceStore.Update(ctx, service)
+	if err != nil {
+		return err
+	}
+	s.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityService, service.ID, before, service)
+	return nil
+}
+
+func (s auditedServiceStore) Delete(ctx context.Context, id int64) error {
+	before, err := auditBefore(s.ServiceStore.GetById(ContextWithDeleted(ctx), id))
+	if err != nil {
+		return err
+	}
+	err = s.ServiceStore.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.audit.recordBestEffort(ctx, AuditActionPurge, AuditEntityService, id, before, nil)
+	return nil
+}
+
+func (s auditedServiceStore) SoftDelete(ctx context.Context, id int64) error {
+	before, err := auditBefore(s.ServiceStore.GetById(ctx, id))
+	if err != nil {
+		return err
+	}
+	err = s.ServiceStore.SoftDelete(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntityService, id, before, nil)
+	return nil
+}
+
+func (s auditedServiceStore) Restore(ctx context.Context, id int64) error {
+	err := s.ServiceStore.Restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	after, err := s.ServiceStore.GetById(ctx, id)
+	if err != nil {
+		s.audit.failed(err, AuditActionRestore, AuditEntityService, id)
+		return nil
+	}
+	s.audit.recordBestEffort(ctx, AuditActionRestore, AuditEntityService, id, nil, after)
+	return nil
+}
+
+func (s auditedServiceStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	ids, err := s.ServiceStore.Purge(ctx, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	s.audit.recordPurgeBestEffort(ctx, AuditEntityService, ids)
+	return ids, nil
+}
+
+type auditedPriceStore struct {
+	PriceStore
+	audit auditLog
+}
+
+func (p auditedPriceStore) Insert(ctx context.Context, price *Price) error {
+	err := p.PriceStore.Insert(ctx, price)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityPrice, price.ID, nil, price)
+	return nil
+}
+
+func (p auditedPriceStore) Update(ctx context.Context, price *Price) error {
+	before, err := auditBefore(p.PriceStore.Get(ctx, price.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = p.PriceStore.Update(ctx, price)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityPrice, price.ID, before, price)
+	return nil
+}
+
+func (p auditedPriceStore) Delete(ctx context.Context, id int64) error {
+	before, err := auditBefore(p.PriceStore.Get(ContextWithDeleted(ctx), id))
+	if err != nil {
+		return err
+	}
+	err = p.PriceStore.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionPurge, AuditEntityPrice, id, before, nil)
+	return nil
+}
+
+func (p auditedPriceStore) SoftDelete(ctx context.Context, id int64) error {
+	before, err := auditBefore(p.PriceStore.Get(ctx, id))
+	if err != nil {
+		return err
+	}
+	err = p.PriceStore.SoftDelete(ctx, id)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntityPrice, id, before, nil)
+	return nil
+}
+
+func (p auditedPriceStore) Restore(ctx context.Context, id int64) error {
+	err := p.PriceStore.Restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	after, err := p.PriceStore.Get(ctx, id)
+	if err != nil {
+		p.audit.failed(err, AuditActionRestore, AuditEntityPrice, id)
+		return nil
+	}
+	p.audit.recordBestEffort(ctx, AuditActionRestore, AuditEntityPrice, id, nil, after)
+	return nil
+}
+
+func (p auditedPriceStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	ids, err := p.PriceStore.Purge(ctx, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	p.audit.recordPurgeBestEffort(ctx, AuditEntityPrice, ids)
+	return ids, nil
+}
+
+type auditedCompanyStore struct {
+	CompanyStore
+	audit auditLog
+}
+
+func (c auditedCompanyStore) Insert(ctx context.Context, company *Company) error {
+	err := c.CompanyStore.Insert(ctx, company)
+	if err != nil {
+		return err
+	}
+	c.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityCompany, company.ID, nil, company)
+	return nil
+}
+
+func (c auditedCompanyStore) Update(ctx context.Context, company *Company) error {
+	before, err := auditBefore(c.CompanyStore.GetById(ctx, company.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = c.CompanyStore.Update(ctx, company)
+	if err != nil {
+		return err
+	}
+	c.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityCompany, company.ID, before, company)
+	return nil
+}
+
+func (c auditedCompanyStore) Delete(ctx context.Context, id int64) error {
+	before, err := auditBefore(c.CompanyStore.GetById(ContextWithDeleted(ctx), id))
+	if err != nil {
+		return err
+	}
+	err = c.CompanyStore.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	c.audit.recordBestEffort(ctx, AuditActionPurge, AuditEntityCompany, id, before, nil)
+	return nil
+}
+
+func (c auditedCompanyStore) SoftDelete(ctx context.Context, id int64) error {
+	before, err := auditBefore(c.CompanyStore.GetById(ctx, id))
+	if err != nil {
+		return err
+	}
+	err = c.CompanyStore.SoftDelete(ctx, id)
+	if err != nil {
+		return err
+	}
+	c.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntityCompany, id, before, nil)
+	return nil
+}
+
+func (c auditedCompanyStore) Restore(ctx context.Context, id int64) error {
+	err := c.CompanyStore.Restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	after, err := c.CompanyStore.GetById(ctx, id)
+	if err != nil {
+		c.audit.failed(err, AuditActionRestore, AuditEntityCompany, id)
+		return nil
+	}
+	c.audit.recordBestEffort(ctx, AuditActionRestore, AuditEntityCompany, id, nil, after)
+	return nil
+}
+
+func (c auditedCompanyStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	ids, err := c.CompanyStore.Purge(ctx, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	c.audit.recordPurgeBestEffort(ctx, AuditEntityCompany, ids)
+	return ids, nil
+}
+
+type auditedUserStore struct {
+	UserStore
+	audit auditLog
+}
+
+func (u auditedUserStore) Insert(ctx context.Context, user *User) error {
+	err := u.UserStore.Insert(ctx, user)
+	if err != nil {
+		return err
+	}
+	u.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityUser, user.ID, nil, user)
+	return nil
+}
+
+func (u auditedUserStore) Update(ctx context.Context, user *User) error {
+	before, err := auditBefore(u.UserStore.Get(ctx, user.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = u.UserStore.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+	u.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityUser, user.ID, before, user)
+	return nil
+}
+
+func (u auditedUserStore) Delete(ctx context.Context, id int64) error {
+	before, err := auditBefore(u.UserStore.Get(ContextWithDeleted(ctx), id))
+	if err != nil {
+		return err
+	}
+	err = u.UserStore.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	u.audit.recordBestEffort(ctx, AuditActionPurge, AuditEntityUser, id, before, nil)
+	return nil
+}
+
+func (u auditedUserStore) SoftDelete(ctx context.Context, id int64) error {
+	before, err := auditBefore(u.UserStore.Get(ctx, id))
+	if err != nil {
+		return err
+	}
+	err = u.UserStore.SoftDelete(ctx, id)
+	if err != nil {
+		return err
+	}
+	u.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntityUser, id, before, nil)
+	return nil
+}
+
+func (u auditedUserStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	ids, err := u.UserStore.Purge(ctx, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	u.audit.recordPurgeBestEffort(ctx, AuditEntityUser, ids)
+	return ids, nil
+}
+
+func (u auditedUserStore) Restore(ctx context.Context, id int64) error {
+	err := u.UserStore.Restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	after, err := u.UserStore.Get(ctx, id)
+	if err != nil {
+		u.audit.failed(err, AuditActionRestore, AuditEntityUser, id)
+		return nil
+	}
+	u.audit.recordBestEffort(ctx, AuditActionRestore, AuditEntityUser, id, nil, after)
+	return nil
+}
+
+type auditedRequestStore struct {
+	RequestStore
+	audit auditLog
+}
+
+func (r auditedRequestStore) Insert(ctx context.Context, request *Request) error {
+	err := r.RequestStore.Insert(ctx, request)
+	if err != nil {
+		return err
+	}
+	r.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityRequest, request.ID, nil, request)
+	return nil
+}
+
+func (r auditedRequestStore) Update(ctx context.Context, request *Request) error {
+	before, err := auditBefore(r.RequestStore.GetByRequestID(ctx, request.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = r.RequestStore.Update(ctx, request)
+	if err != nil {
+		return err
+	}
+	r.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityRequest, request.ID, before, request)
+	return nil
+}
+
+func (r auditedRequestStore) Delete(ctx context.Context, id int64) error {
+	before, err := auditBefore(r.RequestStore.GetByRequestID(ContextWithDeleted(ctx), id))
+	if err != nil {
+		return err
+	}
+	err = r.RequestStore.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	r.audit.recordBestEffort(ctx, AuditActionPurge, AuditEntityRequest, id, before, nil)
+	return nil
+}
+
+func (r auditedRequestStore) SoftDelete(ctx context.Context, id int64) error {
+	before, err := auditBefore(r.RequestStore.GetByRequestID(ctx, id))
+	if err != nil {
+		return err
+	}
+	err = r.RequestStore.SoftDelete(ctx, id)
+	if err != nil {
+		return err
+	}
+	r.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntityRequest, id, before, nil)
+	return nil
+}
+
+func (r auditedRequestStore) Restore(ctx context.Context, id int64) error {
+	err := r.RequestStore.Restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	after, err := r.RequestStore.GetByRequestID(ctx, id)
+	if err != nil {
+		r.audit.failed(err, AuditActionRestore, AuditEntityRequest, id)
+		return nil
+	}
+	r.audit.recordBestEffort(ctx, AuditActionRestore, AuditEntityRequest, id, nil, after)
+	return nil
+}
+
+func (r auditedRequestStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	ids, err := r.RequestStore.Purge(ctx, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	r.audit.recordPurgeBestEffort(ctx, AuditEntityRequest, ids)
+	return ids, nil
+}
+
+type auditedBookingStore struct {
+	BookingStore
+	audit auditLog
+}
+
+func (b auditedBookingStore) Insert(ctx context.Context, booking *Booking) error {
+	err := b.BookingStore.Insert(ctx, booking)
+	if err != nil {
+		return err
+	}
+	b.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityBooking, booking.ID, nil, booking)
+	return nil
+}
+
+func (b auditedBookingStore) Update(ctx context.Context, booking *Booking) error {
+	before, err := auditBefore(b.BookingStore.Get(ctx, booking.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = b.BookingStore.Update(ctx, booking)
+	if err != nil {
+		return err
+	}
+	b.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityBooking, booking.ID, before, booking)
+	return nil
+}
+
+type auditedServiceChangeStore struct {
+	ServiceChangeStore
+	audit auditLog
+}
+
+func (s auditedServiceChangeStore) Insert(ctx context.Context, change *ServiceChange) error {
+	err := s.ServiceChangeStore.Insert(ctx, change)
+	if err != nil {
+		return err
+	}
+	s.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityServiceChange, change.ID, nil, change)
+	return nil
+}
+
+func (s auditedServiceChangeStore) Update(ctx context.Context, change *ServiceChange) error {
+	before, err := auditBefore(s.ServiceChangeStore.Get(ctx, change.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = s.ServiceChangeStore.Update(ctx, change)
+	if err != nil {
+		return err
+	}
+	s.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityServiceChange, change.ID, before, change)
+	return nil
+}
+
+// auditedAvailabilityStore records changes to schedules under the ID of their
+// service. Reservations aren't recorded: they follow the bookings, which are.
+type auditedAvailabilityStore struct {
+	AvailabilityStore
+	audit auditLog
+}
+
+func (a auditedAvailabilityStore) SetSchedule(ctx context.Context, schedule *Schedule) error {
+	before, err := a.AvailabilityStore.GetSchedule(ctx, schedule.ServiceID)
+	if err != nil {
+		return err
+	}
+	err = a.AvailabilityStore.SetSchedule(ctx, schedule)
+	if err != nil {
+		return err
+	}
+	a.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityAvailability, schedule.ServiceID, before, schedule)
+	return nil
+}
+
+// auditedInvoiceStore records invoices with their lines. The bookings billed by
+// Generate() aren't recorded separately: the lines name them.
+type auditedInvoiceStore struct {
+	InvoiceStore
+	audit auditLog
+}
+
+func (i auditedInvoiceStore) Generate(ctx context.Context, companyID int64, period string) (*Invoice, error) {
+	filter := InvoiceFilter{CompanyID: companyID, Period: period}
+	filters := Filters{Page: 1, PageSize: 1, Sort: "id", SortSafelist: InvoiceSortSafelist}
+	existing, _, err := i.InvoiceStore.List(ctx, filter, filters)
+	if err != nil {
+		return nil, err
+	}
+	var before interface{}
+	if len(existing) > 0 {
+		before, err = auditBefore(i.InvoiceStore.Get(ctx, existing[0].ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	invoice, err := i.InvoiceStore.Generate(ctx, companyID, period)
+	if err != nil {
+		return nil, err
+	}
+	action := AuditActionUpdate
+	if before == nil {
+		action = AuditActionCreate
+	}
+	i.audit.recordBestEffort(ctx, action, AuditEntityInvoice, invoice.ID, before, invoice)
+	return invoice, nil
+}
+
+func (i auditedInvoiceStore) Issue(ctx context.Context, invoice *Invoice, dueAt time.Time) error {
+	before, err := auditBefore(i.InvoiceStore.Get(ctx, invoice.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = i.InvoiceStore.Issue(ctx, invoice, dueAt)
+	if err != nil {
+		return err
+	}
+	i.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityInvoice, invoice.ID, before, invoice)
+	return nil
+}
+
+func (i auditedInvoiceStore) Update(ctx context.Context, invoice *Invoice) error {
+	before, err := auditBefore(i.InvoiceStore.Get(ctx, invoice.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = i.InvoiceStore.Update(ctx, invoice)
+	if err != nil {
+		return err
+	}
+	i.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityInvoice, invoice.ID, before, invoice)
+	return nil
+}
+
+func (i auditedInvoiceStore) MarkOverdue(ctx context.Context, now time.Time) ([]int64, error) {
+	ids, err := i.InvoiceStore.MarkOverdue(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	before := map[string]string{"status": InvoiceIssued}
+	after := map[string]string{"status": InvoiceOverdue}
+	for _, id := range ids {
+		i.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityInvoice, id, before, after)
+	}
+	return ids, nil
+}
+
+// auditedPaymentStore records payments as they move on. The webhook events handled
+// aren't recorded: the changes they make to payments are.
+type auditedPaymentStore struct {
+	PaymentStore
+	audit auditLog
+}
+
+func (p auditedPaymentStore) Insert(ctx context.Context, payment *Payment) error {
+	err := p.PaymentStore.Insert(ctx, payment)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityPayment, payment.ID, nil, payment)
+	return nil
+}
+
+func (p auditedPaymentStore) Update(ctx context.Context, payment *Payment) error {
+	before, err := auditBefore(p.PaymentStore.Get(ctx, payment.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = p.PaymentStore.Update(ctx, payment)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityPayment, payment.ID, before, payment)
+	return nil
+}
+
+func (p auditedPaymentStore) Refund(ctx context.Context, refund *PaymentRefund, refundedTotal int, status string) (*Payment, error) {
+	before, err := auditBefore(p.PaymentStore.Get(ctx, refund.PaymentID))
+	if err != nil {
+		return nil, err
+	}
+	payment, err := p.PaymentStore.Refund(ctx, refund, refundedTotal, status)
+	if err != nil {
+		return nil, err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityPayment, payment.ID, before, payment)
+	return payment, nil
+}
+
+// auditedLedgerStore records the accounts opened and the transactions posted. The
+// balances they change aren't recorded: the ledger itself keeps them.
+type auditedLedgerStore struct {
+	LedgerStore
+	audit auditLog
+}
+
+func (l auditedLedgerStore) Open(ctx context.Context, account *Account) error {
+	err := l.LedgerStore.Open(ctx, account)
+	if err != nil {
+		return err
+	}
+	l.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityAccount, account.ID, nil, account)
+	return nil
+}
+
+func (l auditedLedgerStore) Post(ctx context.Context, txn *LedgerTransaction) error {
+	err := l.LedgerStore.Post(ctx, txn)
+	if err != nil {
+		return err
+	}
+	l.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityLedger, txn.ID, nil, txn)
+	return nil
+}
+
+// auditedApprovalStore records changes to the spending controls of companies under
+// the company's ID, and approvals as they are requested and decided, along with
+// the bookings of B2B clients they are inserted with.
+type auditedApprovalStore struct {
+	ApprovalStore
+	audit auditLog
+}
+
+func (a auditedApprovalStore) SetControls(ctx context.Context, controls *SpendingControls) error {
+	before, err := a.ApprovalStore.Controls(ctx, controls.CompanyID)
+	if err != nil {
+		return err
+	}
+	err = a.ApprovalStore.SetControls(ctx, controls)
+	if err != nil {
+		return err
+	}
+	a.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityControls, controls.CompanyID, before, controls)
+	return nil
+}
+
+func (a auditedApprovalStore) InsertBooking(ctx context.Context, client *User, booking *Booking) (*Approval, error) {
+	approval, err := a.ApprovalStore.InsertBooking(ctx, client, booking)
+	if err != nil {
+		return nil, err
+	}
+	a.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityBooking, booking.ID, nil, booking)
+	if approval != nil {
+		a.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityApproval, approval.ID, nil, approval)
+	}
+	return approval, nil
+}
+
+func (a auditedApprovalStore) Insert(ctx context.Context, approval *Approval) error {
+	err := a.ApprovalStore.Insert(ctx, approval)
+	if err != nil {
+		return err
+	}
+	a.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityApproval, approval.ID, nil, approval)
+	return nil
+}
+
+func (a auditedApprovalStore) Decide(ctx context.Context, approval *Approval, booking *Booking) error {
+	before, err := auditBefore(a.ApprovalStore.Get(ctx, approval.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	bookingBefore := *booking
+	err = a.ApprovalStore.Decide(ctx, approval, booking)
+	if err != nil {
+		return err
+	}
+	a.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityApproval, approval.ID, before, approval)
+	if approval.Status == ApprovalRejected {
+		a.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityBooking, booking.ID, &bookingBefore, booking)
+	}
+	return nil
+}
+
+func (a auditedApprovalStore) CancelBooking(ctx context.Context, booking *Booking, reason string, fee int) (*Approval, error) {
+	before, err := auditBefore(a.ApprovalStore.GetForBooking(ctx, booking.ID))
+	if err != nil {
+		return nil, err
+	}
+	bookingBefore := *booking
+	approval, err := a.ApprovalStore.CancelBooking(ctx, booking, reason, fee)
+	if err != nil {
+		return nil, err
+	}
+	a.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityBooking, booking.ID, &bookingBefore, booking)
+	if approval != nil {
+		a.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityApproval, approval.ID, before, approval)
+	}
+	return approval, nil
+}
+
+// auditedPlanStore records changes to plans and subscriptions. The requests counted
+// against the quota of a subscription aren't recorded: the requests themselves are.
+type auditedPlanStore struct {
+	PlanStore
+	audit auditLog
+}
+
+func (p auditedPlanStore) Insert(ctx context.Context, plan *Plan) error {
+	err := p.PlanStore.Insert(ctx, plan)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityPlan, plan.ID, nil, plan)
+	return nil
+}
+
+func (p auditedPlanStore) Update(ctx context.Context, plan *Plan) error {
+	before, err := auditBefore(p.PlanStore.Get(ctx, plan.ID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = p.PlanStore.Update(ctx, plan)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityPlan, plan.ID, before, plan)
+	return nil
+}
+
+func (p auditedPlanStore) Delete(ctx context.Context, id int64) error {
+	before, err := auditBefore(p.PlanStore.Get(ctx, id))
+	if err != nil {
+		return err
+	}
+	err = p.PlanStore.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntityPlan, id, before, nil)
+	return nil
+}
+
+func (p auditedPlanStore) Subscribe(ctx context.Context, sub *Subscription) error {
+	err := p.PlanStore.Subscribe(ctx, sub)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntitySubscription, sub.ID, nil, sub)
+	return nil
+}
+
+func (p auditedPlanStore) UpdateSubscription(ctx context.Context, sub *Subscription) error {
+	before, err := auditBefore(p.PlanStore.GetSubscription(ctx, sub.UserID, sub.CompanyID))
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		return ErrEditConflict
+	}
+	err = p.PlanStore.UpdateSubscription(ctx, sub)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntitySubscription, sub.ID, before, sub)
+	return nil
+}
+
+func (p auditedPlanStore) Unsubscribe(ctx context.Context, userID, companyID int64) error {
+	before, err := p.PlanStore.GetSubscription(ctx, userID, companyID)
+	if err != nil {
+		return err
+	}
+	err = p.PlanStore.Unsubscribe(ctx, userID, companyID)
+	if err != nil {
+		return err
+	}
+	p.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntitySubscription, before.ID, before, nil)
+	return nil
+}
+
+// auditedRegFormStore records registration forms as they are sent and deleted. The
+// store can't look a form up by ID, so deletes and restores are recorded without
+// the form's values.
+type auditedRegFormStore struct {
+	RegFormStore
+	audit auditLog
+}
+
+func (f auditedRegFormStore) Insert(ctx context.Context, regForm *RegForm) error {
+	err := f.RegFormStore.Insert(ctx, regForm)
+	if err != nil {
+		return err
+	}
+	f.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityRegForm, regForm.ID, nil, regForm)
+	return nil
+}
+
+func (f auditedRegFormStore) SoftDelete(ctx context.Context, id int64) error {
+	err := f.RegFormStore.SoftDelete(ctx, id)
+	if err != nil {
+		return err
+	}
+	f.audit.recordBestEffort(ctx, AuditActionDelete, AuditEntityRegForm, id, nil, nil)
+	return nil
+}
+
+func (f auditedRegFormStore) Restore(ctx context.Context, id int64) error {
+	err := f.RegFormStore.Restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	f.audit.recordBestEffort(ctx, AuditActionRestore, AuditEntityRegForm, id, nil, nil)
+	return nil
+}
+
+func (f auditedRegFormStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	ids, err := f.RegFormStore.Purge(ctx, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	f.audit.recordPurgeBestEffort(ctx, AuditEntityRegForm, ids)
+	return ids, nil
+}
+
+// auditedMessageStore records the messages posted, and read receipts under the ID
+// of the last message read.
+type auditedMessageStore struct {
+	MessageStore
+	audit auditLog
+}
+
+func (m auditedMessageStore) Insert(ctx context.Context, message *Message) error {
+	err := m.MessageStore.Insert(ctx, message)
+	if err != nil {
+		return err
+	}
+	m.audit.recordBestEffort(ctx, AuditActionCreate, AuditEntityMessage, message.ID, nil, message)
+	return nil
+}
+
+func (m auditedMessageStore) MarkRead(ctx context.Context, requestID, userID, upTo int64, internal bool) (int, error) {
+	n, err := m.MessageStore.MarkRead(ctx, requestID, userID, upTo, internal)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		after := map[string]int64{"request_id": requestID, "read_by": userID, "read": int64(n)}
+		m.audit.recordBestEffort(ctx, AuditActionUpdate, AuditEntityMessage, upTo, nil, after)
+	}
+	return n, nil
+}
+
+type auditedPersonalDataStore struct {
+	PersonalDataStore
+	audit auditLog
+}
+
+// Erase records that the user was erased, without saying what was erased.
+func (d auditedPersonalDataStore) Erase(ctx context.Context, userID int64) error {
+	err := d.PersonalDataStore.Erase(ctx, userID)
+	if err != nil {
+		return err
+	}
+	d.audit.recordBestEffort(ctx, AuditActionErase, AuditEntityUser, userID, nil, nil)
+	return nil
+}
@@ -0,0 +1,100 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokenAuditStore is an audit log that can't be written to.
+type brokenAuditStore struct {
+	AuditStore
+}
+
+func (brokenAuditStore) Insert(ctx context.Context, entry *AuditEntry) error {
+	return errors.New("audit log unavailable")
+}
+
+type errorRecorder struct {
+	errs []error
+}
+
+func (r *errorRecorder) PrintError(err error, properties map[string]string) {
+	r.errs = append(r.errs, err)
+}
+
+func TestAuditFailureDoesNotFailTheChange(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemoryModels()
+	logger := &errorRecorder{}
+	m := withBestEffortAudit(Models{
+		Booking: memory.Booking.(auditedBookingStore).BookingStore,
+		Audit:   brokenAuditStore{AuditStore: memory.Audit},
+	}, logger)
+
+	start := time.Now().Add(24 * time.Hour)
+	booking := &Booking{RequestID: 1, ServiceID: 1, UnitPrice: 1000, Quantity: 1, StartsAt: start, EndsAt: start.Add(time.Hour)}
+	err := m.Booking.Insert(ctx, booking)
+	if err != nil {
+		t.Fatalf("got error %v for a booking that was made", err)
+	}
+	booking.Quantity = 2
+	err = m.Booking.Update(ctx, booking)
+	if err != nil {
+		t.Fatalf("got error %v for a booking that was changed", err)
+	}
+
+	if len(logger.errs) != 2 {
+		t.Errorf("got %d errors logged; want 2", len(logger.errs))
+	}
+	stored, err := m.Booking.Get(ctx, booking.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Quantity != 2 {
+		t.Errorf("got quantity %d; want 2", stored.Quantity)
+	}
+}
+
+func TestRegFormsAreAuditedAndErased(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryModels()
+
+	user := &User{FirstName: "Ann", LastName: "Lee", Email: "ann@example.com", Username: "ann", UserType: UserTypeB2BClient}
+	err := user.Password.Set("pa55word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.User.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := &RegForm{CompanyName: "Acme", Email: "Ann@example.com", PhoneNumber: "+77010000000"}
+	err = m.RegForm.Insert(ctx, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := func() []*AuditEntry {
+		filters := Filters{Page: 1, PageSize: 10, Sort: "id", SortSafelist: []string{"id"}}
+		entries, _, err := m.Audit.List(ctx, AuditFilter{EntityType: AuditEntityRegForm}, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	entries := list()
+	if len(entries) != 1 || !strings.Contains(string(entries[0].Changes), form.PhoneNumber) {
+		t.Fatalf("got audit entries %v; want the form's creation", entries)
+	}
+
+	err = m.PersonalData.Erase(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := string(list()[0].Changes); changes != "{}" {
+		t.Errorf("got changes %s for the form of an erased user; want {}", changes)
+	}
+}
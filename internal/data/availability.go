@@ -0,0 +1,449 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	// Schedules name their time zone, which has to resolve wherever the server runs,
+	// zoneinfo files or not.
+	_ "time/tzdata"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+var (
+	// ErrNoSlot is returned when a booking doesn't match any slot of the service.
+	ErrNoSlot = errors.New("no such slot")
+	// ErrSlotUnavailable is returned by Reserve() when the slot doesn't have enough
+	// capacity left.
+	ErrSlotUnavailable = errors.New("the slot is fully booked")
+)
+
+// DateLayout is the format of the dates in availability exceptions and slot queries.
+const DateLayout = "2006-01-02"
+
+// TimeOfDay is a time of day in minutes since midnight, on the wall clock of the
+// schedule's time zone. It is written as "15:04" in JSON; "24:00" stands for the end
+// of the day.
+type TimeOfDay int
+
+func (t TimeOfDay) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%02d:%02d", t/60, t%60))
+}
+
+func (t *TimeOfDay) UnmarshalJSON(js []byte) error {
+	var s string
+	if err := json.Unmarshal(js, &s); err != nil {
+		return err
+	}
+	var hours, minutes int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); n != 2 || err != nil || len(s) != 5 {
+		return fmt.Errorf("invalid time of day %q, must be HH:MM", s)
+	}
+	if hours > 24 || minutes > 59 || hours == 24 && minutes != 0 {
+		return fmt.Errorf("invalid time of day %q", s)
+	}
+	*t = TimeOfDay(hours*60 + minutes)
+	return nil
+}
+
+// TimeWindow is a period of a day split into slots of SlotMinutes, each of which
+// can take Capacity units of bookings at once (see Booking.Quantity).
+type TimeWindow struct {
+	Start       TimeOfDay `json:"start"`
+	End         TimeOfDay `json:"end"`
+	SlotMinutes int       `json:"slot_minutes"`
+	Capacity    int       `json:"capacity"`
+}
+
+// WeeklyWindow is a window repeated every week on Weekday (0 is Sunday).
+type WeeklyWindow struct {
+	Weekday time.Weekday `json:"weekday"`
+	TimeWindow
+}
+
+// AvailabilityException replaces the weekly windows on one date. Without windows
+// the service is closed that day.
+type AvailabilityException struct {
+	Date    string       `json:"date"`
+	Windows []TimeWindow `json:"windows"`
+}
+
+type WeeklyWindows []WeeklyWindow
+
+func (w WeeklyWindows) Value() (driver.Value, error) {
+	if w == nil {
+		w = WeeklyWindows{}
+	}
+	return jsonValue(w)
+}
+
+func (w *WeeklyWindows) Scan(src interface{}) error {
+	return jsonScan(src, w)
+}
+
+type AvailabilityExceptions []AvailabilityException
+
+func (e AvailabilityExceptions) Value() (driver.Value, error) {
+	if e == nil {
+		e = AvailabilityExceptions{}
+	}
+	return jsonValue(e)
+}
+
+func (e *AvailabilityExceptions) Scan(src interface{}) error {
+	return jsonScan(src, e)
+}
+
+func jsonValue(v interface{}) (driver.Value, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(js), nil
+}
+
+func jsonScan(src interface{}, dst interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), dst)
+	case []byte:
+		return json.Unmarshal(src, dst)
+	default:
+		return errors.New("unsupported column type for JSON value")
+	}
+}
+
+// Schedule is the availability of a service. A service without a schedule has no
+// capacity limit and can be booked for any time, as it could before schedules
+// existed. Its windows and exception dates are on the wall clock of TimeZone, the
+// IANA name of the time zone the service is provided in, e.g. "Asia/Almaty".
+type Schedule struct {
+	ServiceID  int64                  `json:"service_id"`
+	TimeZone   string                 `json:"time_zone"`
+	Windows    WeeklyWindows          `json:"windows"`
+	Exceptions AvailabilityExceptions `json:"exceptions"`
+	UpdatedAt  NullTime               `json:"updated_at"`
+}
+
+// DefaultTimeZone is the time zone of the schedules that don't name one.
+const DefaultTimeZone = "UTC"
+
+// Location returns the time zone of the schedule. A time zone that doesn't resolve,
+// which ValidateSchedule() doesn't let through, is taken as UTC.
+func (s *Schedule) Location() *time.Location {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (s *Schedule) Empty() bool {
+	return len(s.Windows) == 0 && len(s.Exceptions) == 0
+}
+
+// Slot is a bookable period of a service. Available is what's left of Capacity
+// once the reservations made for the slot are taken off.
+type Slot struct {
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Capacity  int       `json:"capacity"`
+	Available int       `json:"available"`
+}
+
+// windowsOn returns the windows of the schedule on the day starting at day, which
+// is midnight in the schedule's time zone.
+func (s *Schedule) windowsOn(day time.Time) []TimeWindow {
+	date := day.Format(DateLayout)
+	for _, exception := range s.Exceptions {
+		if exception.Date == date {
+			return exception.Windows
+		}
+	}
+	windows := []TimeWindow{}
+	for _, window := range s.Windows {
+		if window.Weekday == day.Weekday() {
+			windows = append(windows, window.TimeWindow)
+		}
+	}
+	return windows
+}
+
+// Slots returns the slots of the schedule starting in [from, to), in order, with
+// their full capacity available. Their times are in the schedule's time zone.
+func (s *Schedule) Slots(from, to time.Time) []Slot {
+	loc := s.Location()
+	from, to = from.In(loc), to.In(loc)
+	slots := []Slot{}
+	// Days are stepped by date: with daylight saving time, not all of them are 24
+	// hours long.
+	for day := StartOfDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, window := range s.windowsOn(day) {
+			if window.SlotMinutes <= 0 {
+				continue
+			}
+			for start := window.Start; start+TimeOfDay(window.SlotMinutes) <= window.End; start += TimeOfDay(window.SlotMinutes) {
+				slot := Slot{
+					StartsAt:  atTimeOfDay(day, start),
+					EndsAt:    atTimeOfDay(day, start+TimeOfDay(window.SlotMinutes)),
+					Capacity:  window.Capacity,
+					Available: window.Capacity,
+				}
+				if !slot.StartsAt.Before(from) && slot.StartsAt.Before(to) {
+					slots = append(slots, slot)
+				}
+			}
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool { return slots[i].StartsAt.Before(slots[j].StartsAt) })
+	return slots
+}
+
+// StartOfDay returns midnight of the day of t, in the location of t.
+func StartOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// atTimeOfDay returns the time it is on the wall clock at t on the day starting at
+// day.
+func atTimeOfDay(day time.Time, t TimeOfDay) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, int(t), 0, 0, day.Location())
+}
+
+// SlotAt returns the slot that starts and ends exactly at the given times.
+func (s *Schedule) SlotAt(startsAt, endsAt time.Time) (Slot, bool) {
+	for _, slot := range s.Slots(startsAt, startsAt.Add(time.Minute)) {
+		if slot.StartsAt.Equal(startsAt) && slot.EndsAt.Equal(endsAt) {
+			return slot, true
+		}
+	}
+	return Slot{}, false
+}
+
+func validateTimeWindows(v *validator.Validator, key string, windows []TimeWindow) {
+	for _, window := range windows {
+		v.Check(window.Start < window.End, key, "each window must start before it ends")
+		v.Check(window.End <= 24*60, key, "each window must end by 24:00")
+		v.Check(window.SlotMinutes >= 5, key, "slots must be at least 5 minutes long")
+		v.Check(window.SlotMinutes > 0 && int(window.End-window.Start)%window.SlotMinutes == 0, key, "each window must be a whole number of slots long")
+		v.Check(window.Capacity >= 1, key, "capacity must be at least 1")
+		v.Check(window.Capacity <= 1000, key, "capacity must not be more than 1000")
+	}
+
+	sorted := append([]TimeWindow(nil), windows...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	for i := 1; i < len(sorted); i++ {
+		v.Check(sorted[i].Start >= sorted[i-1].End, key, "windows on the same day must not overlap")
+	}
+}
+
+func ValidateSchedule(v *validator.Validator, schedule *Schedule) {
+	_, err := time.LoadLocation(schedule.TimeZone)
+	v.Check(schedule.TimeZone != "" && err == nil, "time_zone", "must be an IANA time zone name, e.g. Asia/Almaty")
+
+	v.Check(len(schedule.Windows) <= 100, "windows", "must not contain more than 100 windows")
+	byDay := make(map[time.Weekday][]TimeWindow)
+	for _, window := range schedule.Windows {
+		v.Check(window.Weekday >= time.Sunday && window.Weekday <= time.Saturday, "windows", "weekday must be between 0 (Sunday) and 6 (Saturday)")
+		byDay[window.Weekday] = append(byDay[window.Weekday], window.TimeWindow)
+	}
+	for _, windows := range byDay {
+		validateTimeWindows(v, "windows", windows)
+	}
+
+	v.Check(len(schedule.Exceptions) <= 366, "exceptions", "must not contain more than 366 dates")
+	dates := make([]string, 0, len(schedule.Exceptions))
+	for _, exception := range schedule.Exceptions {
+		_, err = time.Parse(DateLayout, exception.Date)
+		v.Check(err == nil, "exceptions", "dates must be in YYYY-MM-DD format")
+		validateTimeWindows(v, "exceptions", exception.Windows)
+		dates = append(dates, exception.Date)
+	}
+	v.Check(validator.Unique(dates), "exceptions", "must not contain the same date twice")
+}
+
+// SlotReservation holds Units of the capacity of a slot for a booking. Bookings
+// keep the ID of their reservation and release it when they are cancelled or
+// moved.
+type SlotReservation struct {
+	ID        int64     `json:"id"`
+	ServiceID int64     `json:"service_id"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Units     int       `json:"units"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// reservedUnits adds up the units reserved for each slot, keyed by start time.
+func reservedUnits(reservations []*SlotReservation) map[int64]int {
+	units := make(map[int64]int)
+	for _, reservation := range reservations {
+		units[reservation.StartsAt.Unix()] += reservation.Units
+	}
+	return units
+}
+
+// FreeSlots returns the slots of the schedule starting in [from, to) that still
+// have capacity left after the given reservations.
+func FreeSlots(schedule *Schedule, reservations []*SlotReservation, from, to time.Time) []Slot {
+	units := reservedUnits(reservations)
+	free := []Slot{}
+	for _, slot := range schedule.Slots(from, to) {
+		slot.Available -= units[slot.StartsAt.Unix()]
+		if slot.Available > 0 {
+			free = append(free, slot)
+		}
+	}
+	return free
+}
+
+type AvailabilityModel struct {
+	DB *sql.DB
+}
+
+// GetSchedule returns the schedule of a service, or an empty one if it has none.
+func (m AvailabilityModel) GetSchedule(ctx context.Context, serviceID int64) (*Schedule, error) {
+	query := `
+SELECT service_id, time_zone, windows, exceptions, updated_at
+FROM availability
+WHERE service_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	schedule := Schedule{ServiceID: serviceID, TimeZone: DefaultTimeZone, Windows: WeeklyWindows{}, Exceptions: AvailabilityExceptions{}}
+	err := m.DB.QueryRowContext(ctx, query, serviceID).Scan(
+		&schedule.ServiceID,
+		&schedule.TimeZone,
+		&schedule.Windows,
+		&schedule.Exceptions,
+		&schedule.UpdatedAt,
+	)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// SetSchedule replaces the schedule of a service. Reservations already made are
+// kept even if their slot is no longer part of the schedule.
+func (m AvailabilityModel) SetSchedule(ctx context.Context, schedule *Schedule) error {
+	query := `
+INSERT INTO availability (service_id, time_zone, windows, exceptions, updated_at)
+VALUES ($1, $2, $3, $4, NOW())
+ON CONFLICT (service_id) DO UPDATE
+SET time_zone = EXCLUDED.time_zone, windows = EXCLUDED.windows, exceptions = EXCLUDED.exceptions, updated_at = NOW()
+RETURNING updated_at`
+	args := []interface{}{schedule.ServiceID, schedule.TimeZone, schedule.Windows, schedule.Exceptions}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&schedule.UpdatedAt)
+}
+
+// Reservations returns the reservations for the slots of a service starting in
+// [from, to).
+func (m AvailabilityModel) Reservations(ctx context.Context, serviceID int64, from, to time.Time) ([]*SlotReservation, error) {
+	query := `
+SELECT id, service_id, starts_at, ends_at, units, created_at
+FROM slot_reservation
+WHERE service_id = $1 AND starts_at >= $2 AND starts_at < $3
+ORDER BY starts_at, id`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, serviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []*SlotReservation{}
+	for rows.Next() {
+		var reservation SlotReservation
+		err := rows.Scan(
+			&reservation.ID,
+			&reservation.ServiceID,
+			&reservation.StartsAt,
+			&reservation.EndsAt,
+			&reservation.Units,
+			&reservation.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, &reservation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// Reserve takes units of the capacity of a slot, failing with ErrSlotUnavailable if
+// not enough is left. The service row is locked for the duration of the check, so
+// concurrent reservations for the same service are made one after the other and
+// can't overbook the slot between them.
+func (m AvailabilityModel) Reserve(ctx context.Context, serviceID int64, slot Slot, units int) (*SlotReservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT id FROM service WHERE id = $1 FOR UPDATE`, serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reserved int
+	query := `
+SELECT COALESCE(SUM(units), 0)
+FROM slot_reservation
+WHERE service_id = $1 AND starts_at = $2`
+	err = tx.QueryRowContext(ctx, query, serviceID, slot.StartsAt).Scan(&reserved)
+	if err != nil {
+		return nil, err
+	}
+	if reserved+units > slot.Capacity {
+		return nil, ErrSlotUnavailable
+	}
+
+	reservation := &SlotReservation{ServiceID: serviceID, StartsAt: slot.StartsAt, EndsAt: slot.EndsAt, Units: units}
+	query = `
+INSERT INTO slot_reservation (service_id, starts_at, ends_at, units)
+VALUES ($1, $2, $3, $4)
+RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, query, serviceID, slot.StartsAt, slot.EndsAt, units).Scan(&reservation.ID, &reservation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// Release gives the capacity held by a reservation back. Releasing a reservation
+// that doesn't exist is not an error.
+func (m AvailabilityModel) Release(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM slot_reservation WHERE id = $1`, id)
+	return err
+}
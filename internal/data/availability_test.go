@@ -0,0 +1,139 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+// everyDay returns weekly windows opening every day of the week.
+func everyDay(window TimeWindow) WeeklyWindows {
+	windows := WeeklyWindows{}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		windows = append(windows, WeeklyWindow{Weekday: day, TimeWindow: window})
+	}
+	return windows
+}
+
+func TestReserveConcurrently(t *testing.T) {
+	eachStore(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		service := seedService(t, m)
+
+		const capacity, attempts = 3, 20
+		schedule := &Schedule{
+			ServiceID: service.ID,
+			Windows:   everyDay(TimeWindow{Start: 9 * 60, End: 12 * 60, SlotMinutes: 60, Capacity: capacity}),
+		}
+		err := m.Availability.SetSchedule(ctx, schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := time.Now().AddDate(0, 0, 7).Truncate(24 * time.Hour)
+		slots := schedule.Slots(from, from.AddDate(0, 0, 1))
+		if len(slots) != 3 {
+			t.Fatalf("got %d slots; want 3", len(slots))
+		}
+
+		var (
+			wg          sync.WaitGroup
+			mu          sync.Mutex
+			reserved    int
+			unavailable int
+		)
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := m.Availability.Reserve(ctx, service.ID, slots[0], 1)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					reserved++
+				case errors.Is(err, ErrSlotUnavailable):
+					unavailable++
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if reserved != capacity || unavailable != attempts-capacity {
+			t.Errorf("got %d reservations and %d refusals; want %d and %d", reserved, unavailable, capacity, attempts-capacity)
+		}
+		reservations, err := m.Availability.Reservations(ctx, service.ID, from, from.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		free := FreeSlots(schedule, reservations, from, from.AddDate(0, 0, 1))
+		if len(free) != 2 || !free[0].StartsAt.Equal(slots[1].StartsAt) {
+			t.Errorf("got free slots %v; want the last two", free)
+		}
+	})
+}
+
+func TestSlotsInTimeZone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := &Schedule{
+		TimeZone: "Europe/Berlin",
+		Windows:  everyDay(TimeWindow{Start: 9 * 60, End: 10 * 60, SlotMinutes: 60, Capacity: 1}),
+		// The dates of exceptions are Berlin's too.
+		Exceptions: AvailabilityExceptions{{Date: "2030-04-01"}},
+	}
+
+	// Clocks go forward on the night of 30 to 31 March 2030.
+	from := time.Date(2030, 3, 30, 0, 0, 0, 0, berlin)
+	slots := schedule.Slots(from, from.AddDate(0, 0, 3))
+	want := []time.Time{
+		time.Date(2030, 3, 30, 8, 0, 0, 0, time.UTC),
+		time.Date(2030, 3, 31, 7, 0, 0, 0, time.UTC),
+	}
+	if len(slots) != len(want) {
+		t.Fatalf("got %d slots; want %d: %v", len(slots), len(want), slots)
+	}
+	for i, slot := range slots {
+		if !slot.StartsAt.Equal(want[i]) || slot.EndsAt.Sub(slot.StartsAt) != time.Hour {
+			t.Errorf("slot %d: got %v-%v; want an hour from %v", i, slot.StartsAt, slot.EndsAt, want[i])
+		}
+		if slot.StartsAt.Location().String() != "Europe/Berlin" {
+			t.Errorf("slot %d: got time zone %v; want Europe/Berlin", i, slot.StartsAt.Location())
+		}
+	}
+
+	if _, ok := schedule.SlotAt(want[0], want[0].Add(time.Hour)); !ok {
+		t.Error("SlotAt() doesn't find the slot at 09:00 in Berlin")
+	}
+	// 23:30 UTC on the 29th is already the 30th in Berlin.
+	if got := schedule.Slots(time.Date(2030, 3, 29, 23, 30, 0, 0, time.UTC), want[0].Add(time.Minute)); len(got) != 1 {
+		t.Errorf("got %d slots on the 30th from 23:30 UTC on the 29th; want 1", len(got))
+	}
+}
+
+func TestValidateScheduleTimeZone(t *testing.T) {
+	tests := []struct {
+		timeZone string
+		valid    bool
+	}{
+		{"UTC", true},
+		{"Asia/Almaty", true},
+		{"", false},
+		{"Mars/Olympus_Mons", false},
+	}
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateSchedule(v, &Schedule{TimeZone: tt.timeZone})
+		if v.Valid() != tt.valid {
+			t.Errorf("%q: got valid %t; want %t (%v)", tt.timeZone, v.Valid(), tt.valid, v.Errors)
+		}
+	}
+}
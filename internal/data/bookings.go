@@ -0,0 +1,404 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+// The partner providing a booked service first accepts or declines the booking.
+const (
+	PartnerStatusPending  = "pending"
+	PartnerStatusAccepted = "accepted"
+	PartnerStatusDeclined = "declined"
+)
+
+var PartnerStatuses = []string{PartnerStatusPending, PartnerStatusAccepted, PartnerStatusDeclined}
+
+// Once accepted, the partner reports how far they are with the booking. The status
+// only ever moves forward, see CanAdvanceFulfilment.
+const (
+	FulfilmentNotStarted = "not_started"
+	FulfilmentInProgress = "in_progress"
+	FulfilmentCompleted  = "completed"
+)
+
+var FulfilmentStatuses = []string{FulfilmentNotStarted, FulfilmentInProgress, FulfilmentCompleted}
+
+// Clients can reschedule or cancel a booking for free until FreeCancellationNotice
+// before it starts. Cancelling later costs LateCancellationFeePercent of the total,
+// unless the partner hadn't accepted the booking yet. Admins can reschedule at any
+// time and never charge a fee.
+const (
+	FreeCancellationNotice     = 24 * time.Hour
+	LateCancellationFeePercent = 50
+)
+
+var (
+	ErrBookingCancelled = errors.New("the booking has been cancelled")
+	ErrBookingStarted   = errors.New("the booking has already started")
+	ErrBookingTooLate   = errors.New("the booking starts too soon to be rescheduled, contact your concierge")
+)
+
+// Booking is a catalog service booked to fulfil a client's request. The partner
+// company providing the service sees it in their cabinet.
+//
+// UnitPrice is the price of the service for the client at the time of booking, so
+// later price changes don't affect bookings already made. ReservationID is the slot
+// reservation holding the capacity for the booking, 0 if the service has no
+// schedule or the booking was cancelled. InvoiceID is the invoice the booking was
+// billed on, see InvoiceStore.Generate.
+type Booking struct {
+	ID               int64     `json:"id"`
+	RequestID        int64     `json:"request_id"`
+	ServiceID        int64     `json:"service_id"`
+	UnitPrice        int       `json:"unit_price"`
+	Quantity         int       `json:"quantity"`
+	PartySize        int       `json:"party_size"`
+	StartsAt         time.Time `json:"starts_at"`
+	EndsAt           time.Time `json:"ends_at"`
+	PartnerStatus    string    `json:"partner_status"`
+	PartnerNote      string    `json:"partner_note"`
+	FulfilmentStatus string    `json:"fulfilment_status"`
+	CompletedAt      NullTime  `json:"completed_at"`
+	CancelledAt      NullTime  `json:"cancelled_at"`
+	CancelReason     string    `json:"cancel_reason"`
+	CancellationFee  int       `json:"cancellation_fee"`
+	ReservationID    int64     `json:"-"`
+	InvoiceID        int64     `json:"invoice_id,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        NullTime  `json:"updated_at"`
+	Version          int32     `json:"version"`
+}
+
+// Total is what the booking costs the client.
+func (b *Booking) Total() int {
+	return b.UnitPrice * b.Quantity
+}
+
+func (b *Booking) Cancelled() bool {
+	return b.CancelledAt.Valid
+}
+
+// CheckChangeable returns an error if the booking can't be rescheduled or cancelled
+// any more: once cancelled, started or being fulfilled it stays as it is.
+func (b *Booking) CheckChangeable(now time.Time) error {
+	switch {
+	case b.Cancelled():
+		return ErrBookingCancelled
+	case b.FulfilmentStatus != FulfilmentNotStarted || !now.Before(b.StartsAt):
+		return ErrBookingStarted
+	}
+	return nil
+}
+
+// WithinNotice reports whether the booking starts in less than
+// FreeCancellationNotice.
+func (b *Booking) WithinNotice(now time.Time) bool {
+	return b.StartsAt.Sub(now) < FreeCancellationNotice
+}
+
+// CancellationFeeAt returns what cancelling the booking at now costs the client.
+func (b *Booking) CancellationFeeAt(now time.Time) int {
+	if b.PartnerStatus != PartnerStatusAccepted || !b.WithinNotice(now) {
+		return 0
+	}
+	return b.Total() * LateCancellationFeePercent / 100
+}
+
+// Advance moves the fulfilment of the booking on, see CanAdvanceFulfilment, and
+// records when it was completed.
+func (b *Booking) Advance(status string) {
+	b.FulfilmentStatus = status
+	if status == FulfilmentCompleted {
+		b.CompletedAt = nullTimeNow()
+	}
+}
+
+// Reschedule moves the booking to a new window. The partner only agreed to the old
+// one, so the booking goes back to them for an answer.
+func (b *Booking) Reschedule(startsAt, endsAt time.Time) {
+	b.StartsAt = startsAt
+	b.EndsAt = endsAt
+	b.PartnerStatus = PartnerStatusPending
+	b.PartnerNote = ""
+}
+
+// Cancel cancels the booking, giving up its slot reservation. The caller releases
+// the reservation once the booking is saved.
+func (b *Booking) Cancel(reason string, fee int) {
+	b.CancelledAt = nullTimeNow()
+	b.CancelReason = reason
+	b.CancellationFee = fee
+	b.ReservationID = 0
+}
+
+func ValidateBooking(v *validator.Validator, booking *Booking) {
+	v.Check(booking.Quantity >= 1, "quantity", "must be at least 1")
+	v.Check(booking.Quantity <= 100, "quantity", "must not be more than 100")
+	v.Check(booking.PartySize >= 1, "party_size", "must be at least 1")
+	v.Check(booking.PartySize <= 100, "party_size", "must not be more than 100")
+	ValidateBookingWindow(v, booking.StartsAt, booking.EndsAt)
+}
+
+// ValidateBookingWindow checks the window a booking is scheduled for. Bookings
+// can't be made or moved into the past.
+func ValidateBookingWindow(v *validator.Validator, startsAt, endsAt time.Time) {
+	v.Check(!startsAt.IsZero(), "starts_at", "must be provided")
+	v.Check(!endsAt.IsZero(), "ends_at", "must be provided")
+	v.Check(startsAt.After(time.Now()), "starts_at", "must be in the future")
+	v.Check(endsAt.After(startsAt), "ends_at", "must be after starts_at")
+	v.Check(endsAt.Sub(startsAt) <= 30*24*time.Hour, "ends_at", "must not be more than 30 days after starts_at")
+}
+
+// CanAdvanceFulfilment reports whether the fulfilment status of a booking may be
+// changed from one value to another: forwards only, skipping steps is allowed.
+func CanAdvanceFulfilment(from, to string) bool {
+	position := func(status string) int {
+		for i, s := range FulfilmentStatuses {
+			if s == status {
+				return i
+			}
+		}
+		return -1
+	}
+	return position(to) > position(from)
+}
+
+// BookingFilter narrows down the bookings returned by List(). Zero values mean
+// "don't filter on this field". CompanyID matches the company providing the booked
+// service. SentToPartner leaves out the bookings that are waiting for the approval
+// of the client's company or were rejected by it, which the partner never gets.
+type BookingFilter struct {
+	CompanyID        int64
+	RequestID        int64
+	PartnerStatus    string
+	FulfilmentStatus string
+	SentToPartner    bool
+}
+
+func ValidateBookingFilter(v *validator.Validator, f BookingFilter) {
+	if f.PartnerStatus != "" {
+		v.Check(validator.In(f.PartnerStatus, PartnerStatuses...), "partner_status", "invalid partner status")
+	}
+	if f.FulfilmentStatus != "" {
+		v.Check(validator.In(f.FulfilmentStatus, FulfilmentStatuses...), "fulfilment_status", "invalid fulfilment status")
+	}
+}
+
+// BookingSortSafelist lists the values accepted for the sort parameter of List().
+var BookingSortSafelist = []string{"id", "created_at", "starts_at", "-id", "-created_at", "-starts_at"}
+
+type BookingModel struct {
+	DB *sql.DB
+}
+
+func (m BookingModel) Insert(ctx context.Context, booking *Booking) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return insertBooking(ctx, m.DB, booking)
+}
+
+func insertBooking(ctx context.Context, q queryer, booking *Booking) error {
+	query := `
+INSERT INTO booking (request_id, service_id, unit_price, quantity, party_size, starts_at, ends_at, partner_status, fulfilment_status, reservation_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, 0))
+RETURNING id, created_at, version`
+	args := []interface{}{
+		booking.RequestID,
+		booking.ServiceID,
+		booking.UnitPrice,
+		booking.Quantity,
+		booking.PartySize,
+		booking.StartsAt,
+		booking.EndsAt,
+		booking.PartnerStatus,
+		booking.FulfilmentStatus,
+		booking.ReservationID,
+	}
+
+	return q.QueryRowContext(ctx, query, args...).Scan(&booking.ID, &booking.CreatedAt, &booking.Version)
+}
+
+const bookingColumns = `id, request_id, service_id, unit_price, quantity, party_size, starts_at, ends_at, partner_status, partner_note,
+fulfilment_status, completed_at, cancelled_at, cancel_reason, cancellation_fee, COALESCE(reservation_id, 0),
+COALESCE(invoice_id, 0), created_at, updated_at, version`
+
+func scanBooking(row interface{ Scan(...interface{}) error }, booking *Booking) error {
+	return row.Scan(
+		&booking.ID,
+		&booking.RequestID,
+		&booking.ServiceID,
+		&booking.UnitPrice,
+		&booking.Quantity,
+		&booking.PartySize,
+		&booking.StartsAt,
+		&booking.EndsAt,
+		&booking.PartnerStatus,
+		&booking.PartnerNote,
+		&booking.FulfilmentStatus,
+		&booking.CompletedAt,
+		&booking.CancelledAt,
+		&booking.CancelReason,
+		&booking.CancellationFee,
+		&booking.ReservationID,
+		&booking.InvoiceID,
+		&booking.CreatedAt,
+		&booking.UpdatedAt,
+		&booking.Version,
+	)
+}
+
+func (m BookingModel) Get(ctx context.Context, id int64) (*Booking, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `SELECT ` + bookingColumns + ` FROM booking WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var booking Booking
+	err := scanBooking(m.DB.QueryRowContext(ctx, query, id), &booking)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &booking, nil
+}
+
+// Update saves the schedule and statuses of the booking; what was booked, at which
+// price and on which invoice can't be changed. It fails with ErrEditConflict if the booking was
+// changed since it was read, so that e.g. an accept and a cancellation racing each
+// other can't both succeed.
+func (m BookingModel) Update(ctx context.Context, booking *Booking) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return updateBooking(ctx, m.DB, booking)
+}
+
+func updateBooking(ctx context.Context, q queryer, booking *Booking) error {
+	query := `
+UPDATE booking
+SET starts_at = $1, ends_at = $2, partner_status = $3, partner_note = $4, fulfilment_status = $5,
+completed_at = $6, cancelled_at = $7, cancel_reason = $8, cancellation_fee = $9, reservation_id = NULLIF($10, 0),
+updated_at = NOW(), version = version + 1
+WHERE id = $11 AND version = $12
+RETURNING updated_at, version`
+	args := []interface{}{
+		booking.StartsAt,
+		booking.EndsAt,
+		booking.PartnerStatus,
+		booking.PartnerNote,
+		booking.FulfilmentStatus,
+		booking.CompletedAt,
+		booking.CancelledAt,
+		booking.CancelReason,
+		booking.CancellationFee,
+		booking.ReservationID,
+		booking.ID,
+		booking.Version,
+	}
+
+	err := q.QueryRowContext(ctx, query, args...).Scan(&booking.UpdatedAt, &booking.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns one page of bookings matching filter. Bookings of soft-deleted
+// requests are left out.
+func (m BookingModel) List(ctx context.Context, filter BookingFilter, filters Filters) ([]*Booking, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), booking.id, booking.request_id, booking.service_id, booking.unit_price, booking.quantity,
+booking.party_size, booking.starts_at, booking.ends_at, booking.partner_status, booking.partner_note,
+booking.fulfilment_status, booking.completed_at, booking.cancelled_at, booking.cancel_reason, booking.cancellation_fee,
+COALESCE(booking.reservation_id, 0), COALESCE(booking.invoice_id, 0), booking.created_at, booking.updated_at, booking.version
+FROM booking
+INNER JOIN service ON service.id = booking.service_id
+INNER JOIN request ON request.id = booking.request_id
+WHERE ($1 = 0 OR service.company_id = $1)
+AND ($2 = 0 OR booking.request_id = $2)
+AND ($3 = '' OR booking.partner_status = $3)
+AND ($4 = '' OR booking.fulfilment_status = $4)
+AND (NOT $5 OR NOT EXISTS (SELECT 1 FROM approval WHERE approval.booking_id = booking.id AND approval.status <> 'approved'))
+AND request.deleted_at IS NULL
+ORDER BY booking.%s %s, booking.id ASC
+LIMIT $6 OFFSET $7`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		filter.CompanyID,
+		filter.RequestID,
+		filter.PartnerStatus,
+		filter.FulfilmentStatus,
+		filter.SentToPartner,
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	bookings := []*Booking{}
+
+	for rows.Next() {
+		var booking Booking
+		err := rows.Scan(
+			&totalRecords,
+			&booking.ID,
+			&booking.RequestID,
+			&booking.ServiceID,
+			&booking.UnitPrice,
+			&booking.Quantity,
+			&booking.PartySize,
+			&booking.StartsAt,
+			&booking.EndsAt,
+			&booking.PartnerStatus,
+			&booking.PartnerNote,
+			&booking.FulfilmentStatus,
+			&booking.CompletedAt,
+			&booking.CancelledAt,
+			&booking.CancelReason,
+			&booking.CancellationFee,
+			&booking.ReservationID,
+			&booking.InvoiceID,
+			&booking.CreatedAt,
+			&booking.UpdatedAt,
+			&booking.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		bookings = append(bookings, &booking)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return bookings, metadata, nil
+}
@@ -13,51 +13,61 @@ type Company struct {
 	Name      string    `json:"name"`
 	FullName  string    `json:"full_name"`
 	CreatedAt time.Time `json:"created_at"`
-	DeletedAt time.Time `json:"deleted_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	DeletedAt NullTime  `json:"deleted_at"`
+	UpdatedAt NullTime  `json:"updated_at"`
 }
 
 type CompanyModel struct {
 	DB *sql.DB
 }
 
-func (c CompanyModel) Exists(id int) error {
+func (c CompanyModel) Exists(ctx context.Context, id int) error {
 	query := `SELECT id FROM company
-WHERE id = $1
+WHERE id = $1 AND ($2 OR deleted_at IS NULL)
 `
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	return c.DB.QueryRowContext(ctx, query, id).Scan()
+	var found int64
+	err := c.DB.QueryRowContext(ctx, query, id, withDeleted(ctx)).Scan(&found)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *CompanyModel) Insert(company *Company) error {
+func (c *CompanyModel) Insert(ctx context.Context, company *Company) error {
 	query := `
 INSERT INTO company (code, name, full_name)
 VALUES ($1, $2, $3)
 RETURNING id, created_at, updated_at`
 	args := []interface{}{company.Code, company.Name, company.FullName}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	return c.DB.QueryRowContext(ctx, query, args...).Scan(&company.ID, &company.CreatedAt, &company.UpdatedAt)
 }
 
-func (c CompanyModel) GetById(id int64) (*Company, error) {
+func (c CompanyModel) GetById(ctx context.Context, id int64) (*Company, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	query := `
 SELECT id, code, name, full_name, created_at, deleted_at, updated_at
 FROM company 
-WHERE id = $1  AND deleted_at IS NULL`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+WHERE id = $1 AND ($2 OR deleted_at IS NULL)`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var company Company
 
-	err := c.DB.QueryRowContext(ctx, query, id).Scan(
+	err := c.DB.QueryRowContext(ctx, query, id, withDeleted(ctx)).Scan(
 		&company.ID,
 		&company.Code,
 		&company.Name,
@@ -80,13 +90,13 @@ WHERE id = $1  AND deleted_at IS NULL`
 	return &company, nil
 }
 
-func (c *CompanyModel) Update(company *Company) error {
+func (c *CompanyModel) Update(ctx context.Context, company *Company) error {
 	query := `
 UPDATE company
 SET code = $1, name = $2, full_name = $3, updated_at = NOW()
 WHERE id = $4 AND deleted_at IS NULL`
 	args := []interface{}{company.Code, company.Name, company.FullName, company.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	_, err := c.DB.ExecContext(ctx, query, args...)
@@ -101,9 +111,27 @@ WHERE id = $4 AND deleted_at IS NULL`
 	return nil
 }
 
-func (c *CompanyModel) Delete(id int64) error {
+func (c *CompanyModel) Delete(ctx context.Context, id int64) error {
 	query := `DELETE FROM company WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	result, err := c.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (c *CompanyModel) SoftDelete(ctx context.Context, id int64) error {
+	query := `UPDATE company SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	result, err := c.DB.ExecContext(ctx, query, id)
 	if err != nil {
@@ -119,9 +147,9 @@ func (c *CompanyModel) Delete(id int64) error {
 	return nil
 }
 
-func (c *CompanyModel) SoftDelete(id int64) error {
-	query := `UPDATE company SET deleted_at = NOW() WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (c *CompanyModel) Restore(ctx context.Context, id int64) error {
+	query := `UPDATE company SET deleted_at = NULL, updated_at = NOW() WHERE id = $1 AND deleted_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	result, err := c.DB.ExecContext(ctx, query, id)
 	if err != nil {
@@ -136,3 +164,17 @@ func (c *CompanyModel) SoftDelete(id int64) error {
 	}
 	return nil
 }
+
+// Purge keeps companies that still have services, users, invoices or a deposit
+// account.
+func (c *CompanyModel) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	query := `
+DELETE FROM company
+WHERE deleted_at < $1
+AND NOT EXISTS (SELECT 1 FROM service WHERE service.company_id = company.id)
+AND NOT EXISTS (SELECT 1 FROM users WHERE users.company_id = company.id)
+AND NOT EXISTS (SELECT 1 FROM invoice WHERE invoice.company_id = company.id)
+AND NOT EXISTS (SELECT 1 FROM account WHERE account.company_id = company.id)
+RETURNING id`
+	return purgeRows(ctx, c.DB, query, deletedBefore)
+}
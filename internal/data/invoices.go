@@ -0,0 +1,563 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+var (
+	// ErrInvoiceIssued is returned by Generate() when the invoice of the company for
+	// the period has already been issued.
+	ErrInvoiceIssued = errors.New("the invoice for this period has already been issued")
+	// ErrNothingToInvoice is returned by Generate() when the company has nothing to
+	// be billed for.
+	ErrNothingToInvoice = errors.New("nothing to invoice")
+)
+
+// Invoices are generated as drafts, which finance checks before issuing them. An
+// issued invoice becomes overdue once its due date has passed without payment.
+const (
+	InvoiceDraft   = "draft"
+	InvoiceIssued  = "issued"
+	InvoicePaid    = "paid"
+	InvoiceOverdue = "overdue"
+)
+
+var InvoiceStatuses = []string{InvoiceDraft, InvoiceIssued, InvoicePaid, InvoiceOverdue}
+
+// InvoicePeriodLayout is the format of invoice periods: B2B companies are invoiced
+// monthly.
+const InvoicePeriodLayout = "2006-01"
+
+// InvoicePeriodBounds returns the start of a period and the start of the next one.
+func InvoicePeriodBounds(period string) (time.Time, time.Time, error) {
+	start, err := time.Parse(InvoicePeriodLayout, period)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// InvoiceNumber formats the n-th invoice number of a year, e.g. INV-2024-00042.
+func InvoiceNumber(year, n int) string {
+	return fmt.Sprintf("INV-%d-%05d", year, n)
+}
+
+// Invoice bills a B2B company for a month. It has no number until it is issued.
+type Invoice struct {
+	ID        int64          `json:"id"`
+	Number    string         `json:"number"`
+	CompanyID int64          `json:"company_id"`
+	Period    string         `json:"period"`
+	Status    string         `json:"status"`
+	Total     int            `json:"total"`
+	Lines     []*InvoiceLine `json:"lines,omitempty"`
+	IssuedAt  NullTime       `json:"issued_at"`
+	DueAt     NullTime       `json:"due_at"`
+	PaidAt    NullTime       `json:"paid_at"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt NullTime       `json:"updated_at"`
+	Version   int32          `json:"version"`
+}
+
+// InvoiceLine bills one booking. It copies what it needs from the booking, so
+// that the invoice reads the same whatever happens to the catalog later on.
+type InvoiceLine struct {
+	ID          int64  `json:"id"`
+	BookingID   int64  `json:"booking_id"`
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitPrice   int    `json:"unit_price"`
+	Amount      int    `json:"amount"`
+}
+
+// Open reports whether the invoice is waiting to be paid.
+func (i *Invoice) Open() bool {
+	return i.Status == InvoiceIssued || i.Status == InvoiceOverdue
+}
+
+func (i *Invoice) MarkPaid() {
+	i.Status = InvoicePaid
+	i.PaidAt = nullTimeNow()
+}
+
+// billable reports whether a booking is to be billed on the invoice of a period
+// ending at end: completed bookings, and cancelled ones that were charged a
+// cancellation fee, that haven't been billed yet. Bookings completed in earlier
+// months but not billed then are billed with the next invoice. Bookings paid from
+// the company's deposit aren't billed at all.
+func billable(booking *Booking, end time.Time) bool {
+	switch {
+	case booking.InvoiceID != 0:
+		return false
+	case booking.Cancelled():
+		return booking.CancellationFee > 0 && booking.CancelledAt.Time.Before(end)
+	default:
+		return booking.FulfilmentStatus == FulfilmentCompleted && booking.CompletedAt.Valid && booking.CompletedAt.Time.Before(end)
+	}
+}
+
+func newInvoiceLine(booking *Booking, serviceName string) *InvoiceLine {
+	date := booking.StartsAt.UTC().Format("02 Jan 2006")
+	if booking.Cancelled() {
+		return &InvoiceLine{
+			BookingID:   booking.ID,
+			Description: fmt.Sprintf("Late cancellation: %s, %s", serviceName, date),
+			Quantity:    1,
+			UnitPrice:   booking.CancellationFee,
+			Amount:      booking.CancellationFee,
+		}
+	}
+	return &InvoiceLine{
+		BookingID:   booking.ID,
+		Description: fmt.Sprintf("%s, %s", serviceName, date),
+		Quantity:    booking.Quantity,
+		UnitPrice:   booking.UnitPrice,
+		Amount:      booking.Total(),
+	}
+}
+
+// ValidateInvoicePeriod checks a period to generate invoices for. Only months that
+// are over can be invoiced, so that an invoice covers the whole month.
+func ValidateInvoicePeriod(v *validator.Validator, period string) {
+	_, end, err := InvoicePeriodBounds(period)
+	v.Check(err == nil, "period", "must be a month in YYYY-MM format")
+	v.Check(err != nil || !end.After(time.Now()), "period", "must be over")
+}
+
+// InvoiceFilter narrows down the invoices returned by List(). Zero values mean
+// "don't filter on this field".
+type InvoiceFilter struct {
+	CompanyID int64
+	Period    string
+	Status    string
+	// Issued leaves out drafts, which only finance sees.
+	Issued bool
+}
+
+func ValidateInvoiceFilter(v *validator.Validator, f InvoiceFilter) {
+	if f.Status != "" {
+		v.Check(validator.In(f.Status, InvoiceStatuses...), "status", "invalid status")
+	}
+	if f.Period != "" {
+		_, _, err := InvoicePeriodBounds(f.Period)
+		v.Check(err == nil, "period", "must be a month in YYYY-MM format")
+	}
+}
+
+// InvoiceSortSafelist lists the values accepted for the sort parameter of List().
+var InvoiceSortSafelist = []string{"id", "period", "created_at", "-id", "-period", "-created_at"}
+
+type InvoiceModel struct {
+	DB *sql.DB
+}
+
+// BillableCompanies returns the companies with bookings to be billed for a period
+// ending at end.
+func (m InvoiceModel) BillableCompanies(ctx context.Context, end time.Time) ([]int64, error) {
+	query := `
+SELECT DISTINCT users.company_id
+FROM booking
+INNER JOIN request ON request.id = booking.request_id
+INNER JOIN users ON users.id = request.client_id
+WHERE users.company_id IS NOT NULL AND booking.invoice_id IS NULL
+AND ((booking.cancelled_at IS NULL AND booking.fulfilment_status = 'completed' AND booking.completed_at < $1)
+OR (booking.cancelled_at < $1 AND booking.cancellation_fee > 0))
+AND NOT EXISTS (SELECT 1 FROM ledger_transaction WHERE ledger_transaction.booking_id = booking.id AND ledger_transaction.kind = 'debit')
+ORDER BY users.company_id`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Generate bills a company for a period: the bookings made by its users that are
+// billable (see billable()) are added to the company's draft invoice for the
+// period, which is created if needed. Generating again adds whatever became
+// billable since. It fails with ErrInvoiceIssued once the invoice has been issued,
+// and with ErrNothingToInvoice if there is no invoice and nothing to bill.
+func (m InvoiceModel) Generate(ctx context.Context, companyID int64, period string) (*Invoice, error) {
+	_, end, err := InvoicePeriodBounds(period)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the invoice makes concurrent runs for the same company and period
+	// wait for each other, so that no booking is billed twice.
+	query := `
+INSERT INTO invoice (company_id, period)
+VALUES ($1, $2)
+ON CONFLICT (company_id, period) DO NOTHING`
+	_, err = tx.ExecContext(ctx, query, companyID, period)
+	if err != nil {
+		return nil, err
+	}
+
+	var invoiceID int64
+	var status string
+	query = `
+SELECT id, status
+FROM invoice
+WHERE company_id = $1 AND period = $2
+FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, companyID, period).Scan(&invoiceID, &status)
+	if err != nil {
+		return nil, err
+	}
+	if status != InvoiceDraft {
+		return nil, ErrInvoiceIssued
+	}
+
+	query = `
+SELECT booking.id, booking.quantity, booking.unit_price, booking.starts_at, booking.cancelled_at,
+booking.cancellation_fee, service.name
+FROM booking
+INNER JOIN request ON request.id = booking.request_id
+INNER JOIN users ON users.id = request.client_id
+INNER JOIN service ON service.id = booking.service_id
+WHERE users.company_id = $1 AND booking.invoice_id IS NULL
+AND ((booking.cancelled_at IS NULL AND booking.fulfilment_status = 'completed' AND booking.completed_at < $2)
+OR (booking.cancelled_at < $2 AND booking.cancellation_fee > 0))
+AND NOT EXISTS (SELECT 1 FROM ledger_transaction WHERE ledger_transaction.booking_id = booking.id AND ledger_transaction.kind = 'debit')
+ORDER BY booking.starts_at, booking.id
+FOR UPDATE OF booking`
+	rows, err := tx.QueryContext(ctx, query, companyID, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []*InvoiceLine{}
+	for rows.Next() {
+		var booking Booking
+		var serviceName string
+		err := rows.Scan(
+			&booking.ID,
+			&booking.Quantity,
+			&booking.UnitPrice,
+			&booking.StartsAt,
+			&booking.CancelledAt,
+			&booking.CancellationFee,
+			&serviceName,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, newInvoiceLine(&booking, serviceName))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, line := range lines {
+		query = `
+INSERT INTO invoice_line (invoice_id, booking_id, description, quantity, unit_price, amount)
+VALUES ($1, $2, $3, $4, $5, $6)`
+		_, err = tx.ExecContext(ctx, query, invoiceID, line.BookingID, line.Description, line.Quantity, line.UnitPrice, line.Amount)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE booking SET invoice_id = $1 WHERE id = $2`, invoiceID, line.BookingID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM invoice_line WHERE invoice_id = $1`, invoiceID).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back drops the draft if it was only just created.
+	if count == 0 {
+		return nil, ErrNothingToInvoice
+	}
+
+	if len(lines) > 0 {
+		query = `
+UPDATE invoice
+SET total = (SELECT SUM(amount) FROM invoice_line WHERE invoice_id = $1), updated_at = NOW(), version = version + 1
+WHERE id = $1`
+		_, err = tx.ExecContext(ctx, query, invoiceID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return m.Get(ctx, invoiceID)
+}
+
+// Get returns an invoice with its lines.
+func (m InvoiceModel) Get(ctx context.Context, id int64) (*Invoice, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, COALESCE(number, ''), company_id, period, status, total, issued_at, due_at, paid_at, created_at, updated_at, version
+FROM invoice
+WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var invoice Invoice
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&invoice.ID,
+		&invoice.Number,
+		&invoice.CompanyID,
+		&invoice.Period,
+		&invoice.Status,
+		&invoice.Total,
+		&invoice.IssuedAt,
+		&invoice.DueAt,
+		&invoice.PaidAt,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+		&invoice.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	query = `
+SELECT id, booking_id, description, quantity, unit_price, amount
+FROM invoice_line
+WHERE invoice_id = $1
+ORDER BY id`
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invoice.Lines = []*InvoiceLine{}
+	for rows.Next() {
+		var line InvoiceLine
+		err := rows.Scan(&line.ID, &line.BookingID, &line.Description, &line.Quantity, &line.UnitPrice, &line.Amount)
+		if err != nil {
+			return nil, err
+		}
+		invoice.Lines = append(invoice.Lines, &line)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// List returns one page of invoices matching filter, without their lines.
+func (m InvoiceModel) List(ctx context.Context, filter InvoiceFilter, filters Filters) ([]*Invoice, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, COALESCE(number, ''), company_id, period, status, total, issued_at, due_at, paid_at,
+created_at, updated_at, version
+FROM invoice
+WHERE ($1 = 0 OR company_id = $1)
+AND ($2 = '' OR period = $2)
+AND ($3 = '' OR status = $3)
+AND (NOT $4 OR status <> 'draft')
+ORDER BY %s %s, id ASC
+LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		filter.CompanyID,
+		filter.Period,
+		filter.Status,
+		filter.Issued,
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	invoices := []*Invoice{}
+
+	for rows.Next() {
+		var invoice Invoice
+		err := rows.Scan(
+			&totalRecords,
+			&invoice.ID,
+			&invoice.Number,
+			&invoice.CompanyID,
+			&invoice.Period,
+			&invoice.Status,
+			&invoice.Total,
+			&invoice.IssuedAt,
+			&invoice.DueAt,
+			&invoice.PaidAt,
+			&invoice.CreatedAt,
+			&invoice.UpdatedAt,
+			&invoice.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		invoices = append(invoices, &invoice)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return invoices, metadata, nil
+}
+
+// Issue gives a draft invoice the next number of the current year and makes it
+// due at dueAt. It fails with ErrEditConflict if the invoice was changed since it
+// was read; the number is only taken if the invoice is issued.
+func (m InvoiceModel) Issue(ctx context.Context, invoice *Invoice, dueAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	year := time.Now().Year()
+	var n int
+	query := `
+INSERT INTO invoice_number (year, last)
+VALUES ($1, 1)
+ON CONFLICT (year) DO UPDATE SET last = invoice_number.last + 1
+RETURNING last`
+	err = tx.QueryRowContext(ctx, query, year).Scan(&n)
+	if err != nil {
+		return err
+	}
+
+	query = `
+UPDATE invoice
+SET number = $1, status = $2, issued_at = NOW(), due_at = $3, updated_at = NOW(), version = version + 1
+WHERE id = $4 AND version = $5 AND status = $6
+RETURNING number, status, issued_at, due_at, updated_at, version`
+	args := []interface{}{InvoiceNumber(year, n), InvoiceIssued, dueAt, invoice.ID, invoice.Version, InvoiceDraft}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(
+		&invoice.Number,
+		&invoice.Status,
+		&invoice.IssuedAt,
+		&invoice.DueAt,
+		&invoice.UpdatedAt,
+		&invoice.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Update saves the status of an issued invoice. It fails with ErrEditConflict if
+// the invoice was changed since it was read.
+func (m InvoiceModel) Update(ctx context.Context, invoice *Invoice) error {
+	query := `
+UPDATE invoice
+SET status = $1, paid_at = $2, updated_at = NOW(), version = version + 1
+WHERE id = $3 AND version = $4
+RETURNING updated_at, version`
+	args := []interface{}{invoice.Status, invoice.PaidAt, invoice.ID, invoice.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&invoice.UpdatedAt, &invoice.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkOverdue marks the issued invoices that were due before now as overdue and
+// returns their IDs.
+func (m InvoiceModel) MarkOverdue(ctx context.Context, now time.Time) ([]int64, error) {
+	query := `
+UPDATE invoice
+SET status = $1, updated_at = NOW(), version = version + 1
+WHERE status = $2 AND due_at < $3
+RETURNING id`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, InvoiceOverdue, InvoiceIssued, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,556 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDuplicateAccount is returned when opening a deposit for a user or company
+	// that already has one.
+	ErrDuplicateAccount = errors.New("a deposit account is already open for this owner")
+	// ErrInsufficientFunds is returned when posting a transaction would overdraw a
+	// deposit.
+	ErrInsufficientFunds = errors.New("insufficient funds in the deposit account")
+	// ErrBookingDebited is returned when debiting a booking that was already
+	// debited.
+	ErrBookingDebited = errors.New("the booking has already been debited")
+	// ErrRefundExceedsDebit is returned when refunding more of a booking than was
+	// debited for it and not refunded yet.
+	ErrRefundExceedsDebit = errors.New("the refund is more than what was debited for the booking")
+)
+
+// Kinds of account. Deposits hold the money prepaid by a client or a company. Cash
+// and revenue are the concierge's own accounts, one of each: money comes into
+// deposits from cash, goes to revenue when bookings are paid from them, and goes
+// back to cash when it is paid out.
+const (
+	AccountDeposit = "deposit"
+	AccountCash    = "cash"
+	AccountRevenue = "revenue"
+)
+
+var AccountKinds = []string{AccountDeposit, AccountCash, AccountRevenue}
+
+// Kinds of ledger transaction.
+const (
+	LedgerTopUp  = "top_up"
+	LedgerDebit  = "debit"
+	LedgerRefund = "refund"
+	LedgerPayout = "payout"
+)
+
+var LedgerTransactionKinds = []string{LedgerTopUp, LedgerDebit, LedgerRefund, LedgerPayout}
+
+// ledgerPostings gives, for each kind of transaction, the account on the other
+// side of the deposit and whether the money comes into the deposit (1) or goes out
+// of it (-1).
+var ledgerPostings = map[string]struct {
+	counter string
+	sign    int
+}{
+	LedgerTopUp:  {AccountCash, 1},
+	LedgerPayout: {AccountCash, -1},
+	LedgerDebit:  {AccountRevenue, -1},
+	LedgerRefund: {AccountRevenue, 1},
+}
+
+// Account is an account of the ledger. Deposits belong to either a user or a
+// company; the concierge's own accounts to neither. Balance is kept up to date as
+// transactions are posted, and is always the balance of the last entry.
+type Account struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	UserID    int64     `json:"user_id,omitempty"`
+	CompanyID int64     `json:"company_id,omitempty"`
+	Balance   int       `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int32     `json:"version"`
+}
+
+// LedgerTransaction moves Amount into or out of a deposit, depending on its Kind.
+// Posting it records two entries, one on the deposit and the opposite one on the
+// cash or revenue account, so that the entries of every transaction add up to
+// zero. Balance is the balance of the deposit once the transaction was posted.
+type LedgerTransaction struct {
+	ID             int64     `json:"id"`
+	AccountID      int64     `json:"account_id"`
+	Kind           string    `json:"kind"`
+	Amount         int       `json:"amount"`
+	Balance        int       `json:"balance"`
+	BookingID      int64     `json:"booking_id,omitempty"`
+	Note           string    `json:"note,omitempty"`
+	IdempotencyKey string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ledgerEntry is one side of a transaction: Amount is added to the account,
+// leaving it at Balance.
+type ledgerEntry struct {
+	TransactionID int64
+	AccountID     int64
+	Amount        int
+	Balance       int
+	CreatedAt     time.Time
+}
+
+// StatementLine is an entry of an account, with what its transaction was about.
+// Amount is negative for money going out of the account.
+type StatementLine struct {
+	TransactionID int64     `json:"transaction_id"`
+	Date          time.Time `json:"date"`
+	Kind          string    `json:"kind"`
+	BookingID     int64     `json:"booking_id,omitempty"`
+	Note          string    `json:"note,omitempty"`
+	Amount        int       `json:"amount"`
+	Balance       int       `json:"balance"`
+}
+
+// Statement lists the entries of an account from From, inclusive, to To,
+// exclusive.
+type Statement struct {
+	AccountID      int64            `json:"account_id"`
+	From           time.Time        `json:"from"`
+	To             time.Time        `json:"to"`
+	OpeningBalance int              `json:"opening_balance"`
+	ClosingBalance int              `json:"closing_balance"`
+	Lines          []*StatementLine `json:"lines"`
+}
+
+// close sets the closing balance from the lines.
+func (s *Statement) close() {
+	s.ClosingBalance = s.OpeningBalance
+	if len(s.Lines) > 0 {
+		s.ClosingBalance = s.Lines[len(s.Lines)-1].Balance
+	}
+}
+
+// MaxStatementDays is the longest period a statement can cover.
+const MaxStatementDays = 366
+
+func ValidateAccount(v *validator.Validator, account *Account) {
+	v.Check(account.UserID >= 0, "user_id", "must not be negative")
+	v.Check(account.CompanyID >= 0, "company_id", "must not be negative")
+	v.Check((account.UserID == 0) != (account.CompanyID == 0), "owner", "exactly one of user_id and company_id must be provided")
+}
+
+func ValidateLedgerTransaction(v *validator.Validator, txn *LedgerTransaction) {
+	v.Check(txn.Amount > 0, "amount", "must be greater than zero")
+	v.Check(txn.BookingID >= 0, "booking_id", "must not be negative")
+	v.Check(len(txn.Note) <= 500, "note", "must not be more than 500 bytes long")
+	if txn.Kind == LedgerDebit || txn.Kind == LedgerRefund {
+		v.Check(txn.BookingID != 0, "booking_id", "must be provided")
+	}
+}
+
+// ValidateStatementPeriod checks the first and last days a statement is asked for.
+func ValidateStatementPeriod(v *validator.Validator, from, to time.Time) {
+	v.Check(!to.Before(from), "to", "must not be before from")
+	v.Check(to.Before(from.AddDate(0, 0, MaxStatementDays)), "to", fmt.Sprintf("must be less than %d days after from", MaxStatementDays))
+}
+
+// AccountFilter narrows down the accounts returned by ListAccounts(). Zero values
+// mean "don't filter on this field".
+type AccountFilter struct {
+	Kind      string
+	UserID    int64
+	CompanyID int64
+}
+
+func ValidateAccountFilter(v *validator.Validator, f AccountFilter) {
+	if f.Kind != "" {
+		v.Check(validator.In(f.Kind, AccountKinds...), "kind", "invalid kind")
+	}
+}
+
+// AccountSortSafelist lists the values accepted for the sort parameter of
+// ListAccounts().
+var AccountSortSafelist = []string{"id", "balance", "created_at", "-id", "-balance", "-created_at"}
+
+type LedgerModel struct {
+	DB *sql.DB
+}
+
+// ledgerError turns the constraint violations the ledger can run into into the
+// errors the callers check for.
+func ledgerError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Constraint {
+		case "account_user", "account_company":
+			return ErrDuplicateAccount
+		case "account_deposit_balance":
+			return ErrInsufficientFunds
+		case "ledger_transaction_idempotency_key":
+			return ErrDuplicateIdempotencyKey
+		case "ledger_transaction_booking_debit":
+			return ErrBookingDebited
+		}
+	}
+	return err
+}
+
+// Open opens a deposit account for a user or a company. It fails with
+// ErrDuplicateAccount if they already have one.
+func (m LedgerModel) Open(ctx context.Context, account *Account) error {
+	query := `
+INSERT INTO account (kind, user_id, company_id)
+VALUES ($1, NULLIF($2, 0), NULLIF($3, 0))
+RETURNING id, balance, created_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	account.Kind = AccountDeposit
+	err := m.DB.QueryRowContext(ctx, query, account.Kind, account.UserID, account.CompanyID).Scan(
+		&account.ID,
+		&account.Balance,
+		&account.CreatedAt,
+		&account.Version,
+	)
+	if err != nil {
+		return ledgerError(err)
+	}
+	return nil
+}
+
+const accountColumns = `id, kind, COALESCE(user_id, 0), COALESCE(company_id, 0), balance, created_at, version`
+
+func (m LedgerModel) getAccountWhere(ctx context.Context, where string, args ...interface{}) (*Account, error) {
+	query := `SELECT ` + accountColumns + ` FROM account WHERE ` + where
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var account Account
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&account.ID,
+		&account.Kind,
+		&account.UserID,
+		&account.CompanyID,
+		&account.Balance,
+		&account.CreatedAt,
+		&account.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &account, nil
+}
+
+func (m LedgerModel) GetAccount(ctx context.Context, id int64) (*Account, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	return m.getAccountWhere(ctx, `id = $1`, id)
+}
+
+// GetAccountFor returns the deposit account a user pays from: their own, or else
+// the one of their company. companyID is 0 for users without a company.
+func (m LedgerModel) GetAccountFor(ctx context.Context, userID, companyID int64) (*Account, error) {
+	return m.getAccountWhere(ctx, `kind = 'deposit' AND (user_id = $1 OR ($2 <> 0 AND company_id = $2))
+ORDER BY user_id NULLS LAST
+LIMIT 1`, userID, companyID)
+}
+
+func (m LedgerModel) ListAccounts(ctx context.Context, filter AccountFilter, filters Filters) ([]*Account, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), %s
+FROM account
+WHERE ($1 = '' OR kind = $1)
+AND ($2 = 0 OR user_id = $2)
+AND ($3 = 0 OR company_id = $3)
+ORDER BY %s %s, id ASC
+LIMIT $4 OFFSET $5`, accountColumns, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{filter.Kind, filter.UserID, filter.CompanyID, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	accounts := []*Account{}
+
+	for rows.Next() {
+		var account Account
+		err := rows.Scan(
+			&totalRecords,
+			&account.ID,
+			&account.Kind,
+			&account.UserID,
+			&account.CompanyID,
+			&account.Balance,
+			&account.CreatedAt,
+			&account.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		accounts = append(accounts, &account)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return accounts, metadata, nil
+}
+
+// Post posts a transaction on a deposit account, filling in its ID, the balance it
+// leaves and when it was made. It fails with
+//   - ErrRecordNotFound if the account isn't a deposit;
+//   - ErrInsufficientFunds if the deposit would be overdrawn;
+//   - ErrDuplicateIdempotencyKey if a transaction with the same key was posted on
+//     the account already;
+//   - ErrBookingDebited if the booking of a debit was debited already;
+//   - ErrRefundExceedsDebit if a refund is more than what's left to refund of its
+//     booking.
+//
+// The accounts are locked while the transaction is posted, so that concurrent
+// postings on the same deposit, e.g. two bookings completed at once, are made one
+// after the other: the second one sees what the first one left.
+func (m LedgerModel) Post(ctx context.Context, txn *LedgerTransaction) error {
+	posting, ok := ledgerPostings[txn.Kind]
+	if !ok {
+		return fmt.Errorf("unknown ledger transaction kind %q", txn.Kind)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var counterID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM account WHERE kind = $1`, posting.counter).Scan(&counterID)
+	if err != nil {
+		return err
+	}
+
+	// Locking the accounts in the order of their IDs keeps concurrent postings from
+	// deadlocking.
+	query := `
+SELECT id, kind, balance
+FROM account
+WHERE id IN ($1, $2)
+ORDER BY id
+FOR UPDATE`
+	rows, err := tx.QueryContext(ctx, query, txn.AccountID, counterID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	balance, found := 0, false
+	for rows.Next() {
+		var id int64
+		var kind string
+		var b int
+		if err := rows.Scan(&id, &kind, &b); err != nil {
+			return err
+		}
+		if id == txn.AccountID && kind == AccountDeposit {
+			balance, found = b, true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if !found {
+		return ErrRecordNotFound
+	}
+
+	amount := posting.sign * txn.Amount
+	if balance+amount < 0 {
+		return ErrInsufficientFunds
+	}
+
+	if txn.Kind == LedgerRefund {
+		query = `
+SELECT COALESCE(SUM(CASE kind WHEN 'debit' THEN amount ELSE -amount END), 0)
+FROM ledger_transaction
+WHERE account_id = $1 AND booking_id = $2 AND kind IN ('debit', 'refund')`
+		var refundable int
+		err = tx.QueryRowContext(ctx, query, txn.AccountID, txn.BookingID).Scan(&refundable)
+		if err != nil {
+			return err
+		}
+		if txn.Amount > refundable {
+			return ErrRefundExceedsDebit
+		}
+	}
+
+	query = `
+INSERT INTO ledger_transaction (account_id, kind, amount, booking_id, note, idempotency_key)
+VALUES ($1, $2, $3, NULLIF($4, 0), $5, NULLIF($6, ''))
+RETURNING id, created_at`
+	args := []interface{}{txn.AccountID, txn.Kind, txn.Amount, txn.BookingID, txn.Note, txn.IdempotencyKey}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&txn.ID, &txn.CreatedAt)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	entries := []ledgerEntry{
+		{TransactionID: txn.ID, AccountID: txn.AccountID, Amount: amount},
+		{TransactionID: txn.ID, AccountID: counterID, Amount: -amount},
+	}
+	for _, entry := range entries {
+		query = `
+UPDATE account
+SET balance = balance + $1, version = version + 1
+WHERE id = $2
+RETURNING balance`
+		err = tx.QueryRowContext(ctx, query, entry.Amount, entry.AccountID).Scan(&entry.Balance)
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		query = `
+INSERT INTO ledger_entry (transaction_id, account_id, amount, balance, created_at)
+VALUES ($1, $2, $3, $4, $5)`
+		_, err = tx.ExecContext(ctx, query, entry.TransactionID, entry.AccountID, entry.Amount, entry.Balance, txn.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		if entry.AccountID == txn.AccountID {
+			txn.Balance = entry.Balance
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetTransaction returns the transaction posted on an account with an idempotency
+// key.
+func (m LedgerModel) GetTransaction(ctx context.Context, accountID int64, key string) (*LedgerTransaction, error) {
+	query := `
+SELECT t.id, t.account_id, t.kind, t.amount, e.balance, COALESCE(t.booking_id, 0), t.note,
+COALESCE(t.idempotency_key, ''), t.created_at
+FROM ledger_transaction t
+INNER JOIN ledger_entry e ON e.transaction_id = t.id AND e.account_id = t.account_id
+WHERE t.account_id = $1 AND t.idempotency_key = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var txn LedgerTransaction
+	err := m.DB.QueryRowContext(ctx, query, accountID, key).Scan(
+		&txn.ID,
+		&txn.AccountID,
+		&txn.Kind,
+		&txn.Amount,
+		&txn.Balance,
+		&txn.BookingID,
+		&txn.Note,
+		&txn.IdempotencyKey,
+		&txn.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &txn, nil
+}
+
+// BookingDebited reports whether a booking was paid from a deposit.
+func (m LedgerModel) BookingDebited(ctx context.Context, bookingID int64) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM ledger_transaction WHERE booking_id = $1 AND kind = 'debit')`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var debited bool
+	err := m.DB.QueryRowContext(ctx, query, bookingID).Scan(&debited)
+	return debited, err
+}
+
+// Statement returns the statement of an account for a period.
+func (m LedgerModel) Statement(ctx context.Context, accountID int64, from, to time.Time) (*Statement, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	// Both queries must see the same postings for the balances to add up.
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	statement := &Statement{AccountID: accountID, From: from, To: to, Lines: []*StatementLine{}}
+
+	// Entries are numbered in the order they were posted in, as posting locks the
+	// account: that is the order their balances follow.
+	query := `
+SELECT balance
+FROM ledger_entry
+WHERE account_id = $1 AND created_at < $2
+ORDER BY id DESC
+LIMIT 1`
+	err = tx.QueryRowContext(ctx, query, accountID, from).Scan(&statement.OpeningBalance)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	query = `
+SELECT t.id, e.created_at, t.kind, COALESCE(t.booking_id, 0), t.note, e.amount, e.balance
+FROM ledger_entry e
+INNER JOIN ledger_transaction t ON t.id = e.transaction_id
+WHERE e.account_id = $1 AND e.created_at >= $2 AND e.created_at < $3
+ORDER BY e.id`
+	rows, err := tx.QueryContext(ctx, query, accountID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line StatementLine
+		err := rows.Scan(
+			&line.TransactionID,
+			&line.Date,
+			&line.Kind,
+			&line.BookingID,
+			&line.Note,
+			&line.Amount,
+			&line.Balance,
+		)
+		if err != nil {
+			return nil, err
+		}
+		statement.Lines = append(statement.Lines, &line)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statement.close()
+	return statement, nil
+}
@@ -0,0 +1,155 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// seedDeposit opens a deposit topped up with balance for a new client, and returns
+// it along with n bookings of the client's for service.
+func seedDeposit(t *testing.T, m Models, service *Service, balance, n int) (*Account, []*Booking) {
+	t.Helper()
+
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano() % 1_000_000_000)
+	client := &User{FirstName: "Test", LastName: "Client", Email: "client" + suffix + "@example.com", Username: "client" + suffix, UserType: UserTypeClient, Activated: true}
+	err := client.Password.Set("pa55word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.User.Insert(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &Request{ClientID: client.ID, Type: "dinner", Description: "A table for two", Status: RequestStatusNew}
+	err = m.Request.Insert(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(48 * time.Hour)
+	bookings := make([]*Booking, n)
+	for i := range bookings {
+		bookings[i] = &Booking{
+			RequestID: request.ID, ServiceID: service.ID, UnitPrice: 1000, Quantity: 1, PartySize: 1,
+			StartsAt: start, EndsAt: start.Add(time.Hour),
+			PartnerStatus: PartnerStatusAccepted, FulfilmentStatus: "not_started",
+		}
+		err = m.Booking.Insert(ctx, bookings[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	account := &Account{UserID: client.ID}
+	err = m.Ledger.Open(ctx, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Ledger.Post(ctx, &LedgerTransaction{AccountID: account.ID, Kind: LedgerTopUp, Amount: balance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account, bookings
+}
+
+func TestPostDebitsConcurrently(t *testing.T) {
+	eachStore(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		service := seedService(t, m)
+
+		// The deposit covers three of the ten debits.
+		const amount, covered, attempts = 1000, 3, 10
+		account, bookings := seedDeposit(t, m, service, covered*amount, attempts)
+
+		var (
+			wg           sync.WaitGroup
+			mu           sync.Mutex
+			posted       int
+			insufficient int
+		)
+		for _, booking := range bookings {
+			wg.Add(1)
+			go func(booking *Booking) {
+				defer wg.Done()
+				txn := &LedgerTransaction{AccountID: account.ID, Kind: LedgerDebit, Amount: amount, BookingID: booking.ID}
+				err := m.Ledger.Post(ctx, txn)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					posted++
+				case errors.Is(err, ErrInsufficientFunds):
+					insufficient++
+				default:
+					t.Error(err)
+				}
+			}(booking)
+		}
+		wg.Wait()
+
+		if posted != covered || insufficient != attempts-covered {
+			t.Errorf("got %d debits and %d refusals; want %d and %d", posted, insufficient, covered, attempts-covered)
+		}
+		account, err := m.Ledger.GetAccount(ctx, account.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Balance != 0 {
+			t.Errorf("got balance %d; want 0", account.Balance)
+		}
+	})
+}
+
+func TestPostBookingDebitConcurrently(t *testing.T) {
+	eachStore(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		service := seedService(t, m)
+
+		const amount, attempts = 1000, 10
+		account, bookings := seedDeposit(t, m, service, attempts*amount, 1)
+
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			posted  int
+			debited int
+		)
+		for i := 0; i < attempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				txn := &LedgerTransaction{AccountID: account.ID, Kind: LedgerDebit, Amount: amount, BookingID: bookings[0].ID}
+				err := m.Ledger.Post(ctx, txn)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					posted++
+				case errors.Is(err, ErrBookingDebited):
+					debited++
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if posted != 1 || debited != attempts-1 {
+			t.Errorf("got %d debits and %d refusals; want 1 and %d", posted, debited, attempts-1)
+		}
+		account, err := m.Ledger.GetAccount(ctx, account.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (attempts - 1) * amount; account.Balance != want {
+			t.Errorf("got balance %d; want %d", account.Balance, want)
+		}
+	})
+}
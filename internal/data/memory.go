@@ -0,0 +1,2985 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryDB holds the rows of every in-memory store behind a single mutex, so that
+// stores which need to look at each other's tables (e.g. users and tokens in
+// GetForToken) see a consistent snapshot, just like they would inside PostgreSQL.
+type memoryDB struct {
+	mu sync.Mutex
+
+	nextID map[string]int64
+
+	services    map[int64]*Service
+	prices      map[int64]*Price
+	companies   map[int64]*Company
+	users       map[int64]*User
+	regForms    map[int64]*RegForm
+	tokens      []*Token
+	permissions map[int64]Permissions
+	requests    map[int64]*Request
+	bookings    map[int64]*Booking
+	changes     map[int64]*ServiceChange
+	schedules   map[int64]*Schedule
+	reserved    map[int64]*SlotReservation
+	invoices    map[int64]*Invoice
+	// invoiceNumbers holds the last invoice number handed out in each year.
+	invoiceNumbers map[int]int
+	payments       map[int64]*Payment
+	refunds        map[int64]*PaymentRefund
+	paymentEvents  map[string]bool
+	accounts       map[int64]*Account
+	ledger         map[int64]*LedgerTransaction
+	// entries are the ledger entries, in the order they were posted.
+	entries []*ledgerEntry
+	// controls holds the spending controls of each company.
+	controls      map[int64]*SpendingControls
+	approvals     map[int64]*Approval
+	plans         map[int64]*Plan
+	subscriptions map[int64]*Subscription
+	messages      map[int64]*Message
+	audit         []*AuditEntry
+}
+
+func (db *memoryDB) id(table string) int64 {
+	db.nextID[table]++
+	return db.nextID[table]
+}
+
+// The helpers below stand in for the foreign keys that stop Purge() from deleting
+// rows that are still referred to. The caller must hold db.mu.
+
+func (db *memoryDB) hasPrices(serviceID int64) bool {
+	for _, price := range db.prices {
+		if price.ServiceID == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *memoryDB) hasBookings(serviceID int64) bool {
+	for _, booking := range db.bookings {
+		if booking.ServiceID == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *memoryDB) hasServices(companyID int64) bool {
+	for _, service := range db.services {
+		if int64(service.CompanyID) == companyID {
+			return true
+		}
+	}
+	for _, user := range db.users {
+		if user.CompanyID == companyID {
+			return true
+		}
+	}
+	for _, invoice := range db.invoices {
+		if invoice.CompanyID == companyID {
+			return true
+		}
+	}
+	for _, account := range db.accounts {
+		if account.CompanyID == companyID {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *memoryDB) hasBilledBookings(requestID int64) bool {
+	for _, booking := range db.bookings {
+		if booking.RequestID == requestID && booking.InvoiceID != 0 {
+			return true
+		}
+	}
+	for _, payment := range db.payments {
+		if booking, ok := db.bookings[payment.BookingID]; ok && booking.RequestID == requestID {
+			return true
+		}
+	}
+	for _, txn := range db.ledger {
+		if booking, ok := db.bookings[txn.BookingID]; ok && booking.RequestID == requestID {
+			return true
+		}
+	}
+	return false
+}
+
+// debited reports whether a booking was paid from a deposit.
+func (db *memoryDB) debited(bookingID int64) bool {
+	for _, txn := range db.ledger {
+		if txn.Kind == LedgerDebit && txn.BookingID == bookingID {
+			return true
+		}
+	}
+	return false
+}
+
+// sentToPartner reports whether a booking either needed no approval or was
+// approved.
+func (db *memoryDB) sentToPartner(bookingID int64) bool {
+	for _, approval := range db.approvals {
+		if approval.BookingID == bookingID && approval.Status != ApprovalApproved {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *memoryDB) isReferenced(userID int64) bool {
+	for _, request := range db.requests {
+		if request.ClientID == userID {
+			return true
+		}
+	}
+	for _, service := range db.services {
+		if service.CreatedByID == userID {
+			return true
+		}
+	}
+	for _, change := range db.changes {
+		if change.ProposedByID == userID || change.ReviewedByID == userID {
+			return true
+		}
+	}
+	for _, account := range db.accounts {
+		if account.UserID == userID {
+			return true
+		}
+	}
+	for _, approval := range db.approvals {
+		if approval.DecidedByID == userID {
+			return true
+		}
+	}
+	for _, message := range db.messages {
+		if message.AuthorID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteReadReceipts removes the read receipts of a user, like the ON DELETE
+// CASCADE on message_read.user_id.
+func (db *memoryDB) deleteReadReceipts(userID int64) {
+	for _, message := range db.messages {
+		receipts := message.ReadBy[:0]
+		for _, receipt := range message.ReadBy {
+			if receipt.UserID != userID {
+				receipts = append(receipts, receipt)
+			}
+		}
+		message.ReadBy = receipts
+	}
+}
+
+// deleteApprovals removes the approval of a booking, like the ON DELETE CASCADE on
+// approval.booking_id.
+func (db *memoryDB) deleteApprovals(bookingID int64) {
+	for id, approval := range db.approvals {
+		if approval.BookingID == bookingID {
+			delete(db.approvals, id)
+		}
+	}
+}
+
+// deleteSubscription removes the subscription of a user or a company, like the ON
+// DELETE CASCADE on subscription.user_id and subscription.company_id.
+func (db *memoryDB) deleteSubscription(userID, companyID int64) {
+	for id, sub := range db.subscriptions {
+		if userID != 0 && sub.UserID == userID || companyID != 0 && sub.CompanyID == companyID {
+			delete(db.subscriptions, id)
+		}
+	}
+}
+
+// deleteFromControls removes the budget and approver role of a user, like the ON
+// DELETE CASCADE on budget.user_id and approver.user_id.
+func (db *memoryDB) deleteFromControls(userID int64) {
+	for _, controls := range db.controls {
+		budgets := controls.Budgets[:0]
+		for _, budget := range controls.Budgets {
+			if budget.UserID != userID {
+				budgets = append(budgets, budget)
+			}
+		}
+		controls.Budgets = budgets
+
+		approvers := controls.ApproverIDs[:0]
+		for _, id := range controls.ApproverIDs {
+			if id != userID {
+				approvers = append(approvers, id)
+			}
+		}
+		controls.ApproverIDs = approvers
+	}
+}
+
+func (db *memoryDB) deleteTokens(userID int64) {
+	tokens := db.tokens[:0]
+	for _, token := range db.tokens {
+		if token.UserID != userID {
+			tokens = append(tokens, token)
+		}
+	}
+	db.tokens = tokens
+}
+
+// NewMemoryModels returns a Models value backed by in-memory maps instead of
+// PostgreSQL. It is intended for handler tests using net/http/httptest and for
+// running the server locally without a database. The stores mirror the semantics of
+// their SQL counterparts: soft-deleted rows are hidden where the SQL filters on
+// deleted_at, and missing rows are reported as ErrRecordNotFound.
+func NewMemoryModels() Models {
+	db := &memoryDB{
+		nextID:      make(map[string]int64),
+		services:    make(map[int64]*Service),
+		prices:      make(map[int64]*Price),
+		companies:   make(map[int64]*Company),
+		users:       make(map[int64]*User),
+		regForms:    make(map[int64]*RegForm),
+		permissions: make(map[int64]Permissions),
+		requests:    make(map[int64]*Request),
+		bookings:    make(map[int64]*Booking),
+		changes:     make(map[int64]*ServiceChange),
+		schedules:   make(map[int64]*Schedule),
+		reserved:    make(map[int64]*SlotReservation),
+		invoices:    make(map[int64]*Invoice),
+
+		invoiceNumbers: make(map[int]int),
+		payments:       make(map[int64]*Payment),
+		refunds:        make(map[int64]*PaymentRefund),
+		paymentEvents:  make(map[string]bool),
+		accounts:       make(map[int64]*Account),
+		ledger:         make(map[int64]*LedgerTransaction),
+		controls:       make(map[int64]*SpendingControls),
+		approvals:      make(map[int64]*Approval),
+		plans:          make(map[int64]*Plan),
+		subscriptions:  make(map[int64]*Subscription),
+		messages:       make(map[int64]*Message),
+	}
+
+	// The concierge's own accounts, which the migration creates in PostgreSQL.
+	for _, kind := range []string{AccountCash, AccountRevenue} {
+		id := db.id("account")
+		db.accounts[id] = &Account{ID: id, Kind: kind, CreatedAt: time.Now(), Version: 1}
+	}
+
+	return withBestEffortAudit(Models{
+		Service:       &memoryServiceStore{db: db},
+		Price:         &memoryPriceStore{db: db},
+		Company:       &memoryCompanyStore{db: db},
+		User:          &memoryUserStore{db: db},
+		RegForm:       &memoryRegFormStore{db: db},
+		Token:         &memoryTokenStore{db: db},
+		Permissions:   &memoryPermissionStore{db: db},
+		Request:       &memoryRequestStore{db: db},
+		Booking:       &memoryBookingStore{db: db},
+		ServiceChange: &memoryServiceChangeStore{db: db},
+		Availability:  &memoryAvailabilityStore{db: db},
+		Invoice:       &memoryInvoiceStore{db: db},
+		Payment:       &memoryPaymentStore{db: db},
+		Ledger:        &memoryLedgerStore{db: db},
+		Approval:      &memoryApprovalStore{db: db},
+		Plan:          &memoryPlanStore{db: db},
+		Message:       &memoryMessageStore{db: db},
+		Audit:         &memoryAuditStore{db: db},
+		PersonalData:  &memoryPersonalDataStore{db: db},
+		System:        memorySystemStore{},
+	}, nil) // The memory audit store never fails, so there is nothing to log.
+}
+
+// storedPreferences returns p as it would read back from the preferences column.
+func storedPreferences(p Preferences) Preferences {
+	value, err := p.Value()
+	if err != nil {
+		panic(err)
+	}
+	var stored Preferences
+	err = stored.Scan(value)
+	if err != nil {
+		panic(err)
+	}
+	return stored
+}
+
+type memoryServiceStore struct {
+	db *memoryDB
+}
+
+func (s *memoryServiceStore) Insert(ctx context.Context, service *Service) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	service.ID = s.db.id("service")
+	service.CreatedAt = time.Now()
+	service.UpdatedAt = nullTime(service.CreatedAt)
+	row := *service
+	s.db.services[service.ID] = &row
+	return nil
+}
+
+func (s *memoryServiceStore) GetById(ctx context.Context, id int64) (*Service, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, ok := s.db.services[id]
+	if !ok || row.DeletedAt.Valid && !withDeleted(ctx) {
+		return nil, ErrRecordNotFound
+	}
+	service := *row
+	return &service, nil
+}
+
+func (s *memoryServiceStore) GetAllForCompany(ctx context.Context, companyID int64) ([]*Service, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	services := []*Service{}
+	for _, row := range s.db.services {
+		if int64(row.CompanyID) == companyID && (!row.DeletedAt.Valid || withDeleted(ctx)) {
+			service := *row
+			services = append(services, &service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, nil
+}
+
+func (s *memoryServiceStore) Update(ctx context.Context, service *Service) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, ok := s.db.services[service.ID]
+	if !ok || row.DeletedAt.Valid {
+		return ErrEditConflict
+	}
+	service.CreatedAt = row.CreatedAt
+	service.UpdatedAt = nullTimeNow()
+	updated := *service
+	s.db.services[service.ID] = &updated
+	return nil
+}
+
+func (s *memoryServiceStore) Delete(ctx context.Context, id int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.services[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(s.db.services, id)
+	return nil
+}
+
+func (s *memoryServiceStore) SoftDelete(ctx context.Context, id int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, ok := s.db.services[id]
+	if !ok || row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = nullTimeNow()
+	return nil
+}
+
+func (s *memoryServiceStore) Restore(ctx context.Context, id int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, ok := s.db.services[id]
+	if !ok || !row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = NullTime{}
+	row.UpdatedAt = nullTimeNow()
+	return nil
+}
+
+func (s *memoryServiceStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	ids := []int64{}
+	for id, row := range s.db.services {
+		if !row.DeletedAt.Valid || !row.DeletedAt.Time.Before(deletedBefore) || s.db.hasPrices(id) || s.db.hasBookings(id) {
+			continue
+		}
+		delete(s.db.services, id)
+		for changeID, change := range s.db.changes {
+			if change.ServiceID == id {
+				delete(s.db.changes, changeID)
+			}
+		}
+		delete(s.db.schedules, id)
+		for reservationID, reservation := range s.db.reserved {
+			if reservation.ServiceID == id {
+				delete(s.db.reserved, reservationID)
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+type memoryPriceStore struct {
+	db *memoryDB
+}
+
+func (p *memoryPriceStore) Insert(ctx context.Context, price *Price) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	price.ID = p.db.id("price")
+	price.CreatedAt = time.Now()
+	price.UpdatedAt = nullTime(price.CreatedAt)
+	row := *price
+	p.db.prices[price.ID] = &row
+	return nil
+}
+
+func (p *memoryPriceStore) Get(ctx context.Context, id int64) (*Price, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.prices[id]
+	if !ok || row.DeletedAt.Valid && !withDeleted(ctx) {
+		return nil, ErrRecordNotFound
+	}
+	price := *row
+	return &price, nil
+}
+
+func (p *memoryPriceStore) GetByServiceId(ctx context.Context, serviceID int64) ([]*Price, error) {
+	if serviceID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	prices := []*Price{}
+	for _, row := range p.db.prices {
+		if row.ServiceID == serviceID && (!row.DeletedAt.Valid || withDeleted(ctx)) {
+			price := *row
+			prices = append(prices, &price)
+		}
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].ID < prices[j].ID })
+	return prices, nil
+}
+
+func (p *memoryPriceStore) Update(ctx context.Context, price *Price) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.prices[price.ID]
+	if !ok || row.DeletedAt.Valid {
+		return ErrEditConflict
+	}
+	price.CreatedAt = row.CreatedAt
+	price.UpdatedAt = nullTimeNow()
+	updated := *price
+	p.db.prices[price.ID] = &updated
+	return nil
+}
+
+func (p *memoryPriceStore) Delete(ctx context.Context, id int64) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	if _, ok := p.db.prices[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(p.db.prices, id)
+	return nil
+}
+
+func (p *memoryPriceStore) SoftDelete(ctx context.Context, id int64) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.prices[id]
+	if !ok || row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = nullTimeNow()
+	return nil
+}
+
+func (p *memoryPriceStore) Restore(ctx context.Context, id int64) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.prices[id]
+	if !ok || !row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = NullTime{}
+	row.UpdatedAt = nullTimeNow()
+	return nil
+}
+
+func (p *memoryPriceStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	ids := []int64{}
+	for id, row := range p.db.prices {
+		if !row.DeletedAt.Valid || !row.DeletedAt.Time.Before(deletedBefore) {
+			continue
+		}
+		delete(p.db.prices, id)
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+type memoryCompanyStore struct {
+	db *memoryDB
+}
+
+func (c *memoryCompanyStore) Exists(ctx context.Context, id int) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	row, ok := c.db.companies[int64(id)]
+	if !ok || row.DeletedAt.Valid && !withDeleted(ctx) {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (c *memoryCompanyStore) Insert(ctx context.Context, company *Company) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	company.ID = c.db.id("company")
+	company.CreatedAt = time.Now()
+	company.UpdatedAt = nullTime(company.CreatedAt)
+	row := *company
+	c.db.companies[company.ID] = &row
+	return nil
+}
+
+func (c *memoryCompanyStore) GetById(ctx context.Context, id int64) (*Company, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	row, ok := c.db.companies[id]
+	if !ok || row.DeletedAt.Valid && !withDeleted(ctx) {
+		return nil, ErrRecordNotFound
+	}
+	company := *row
+	return &company, nil
+}
+
+func (c *memoryCompanyStore) Update(ctx context.Context, company *Company) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	row, ok := c.db.companies[company.ID]
+	if !ok || row.DeletedAt.Valid {
+		return ErrEditConflict
+	}
+	company.CreatedAt = row.CreatedAt
+	company.UpdatedAt = nullTimeNow()
+	updated := *company
+	c.db.companies[company.ID] = &updated
+	return nil
+}
+
+func (c *memoryCompanyStore) Delete(ctx context.Context, id int64) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if _, ok := c.db.companies[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(c.db.companies, id)
+	return nil
+}
+
+func (c *memoryCompanyStore) SoftDelete(ctx context.Context, id int64) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	row, ok := c.db.companies[id]
+	if !ok || row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = nullTimeNow()
+	return nil
+}
+
+func (c *memoryCompanyStore) Restore(ctx context.Context, id int64) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	row, ok := c.db.companies[id]
+	if !ok || !row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = NullTime{}
+	row.UpdatedAt = nullTimeNow()
+	return nil
+}
+
+func (c *memoryCompanyStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	ids := []int64{}
+	for id, row := range c.db.companies {
+		if !row.DeletedAt.Valid || !row.DeletedAt.Time.Before(deletedBefore) || c.db.hasServices(id) {
+			continue
+		}
+		delete(c.db.companies, id)
+		delete(c.db.controls, id)
+		c.db.deleteSubscription(0, id)
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+type memoryUserStore struct {
+	db *memoryDB
+}
+
+func (u *memoryUserStore) Insert(ctx context.Context, user *User) error {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	for _, row := range u.db.users {
+		if strings.EqualFold(row.Email, user.Email) {
+			return ErrDuplicateUsername
+		}
+	}
+
+	user.ID = u.db.id("users")
+	user.CreatedAt = time.Now()
+	row := *user
+	row.Preferences = storedPreferences(user.Preferences)
+	u.db.users[user.ID] = &row
+	return nil
+}
+
+func (u *memoryUserStore) find(ctx context.Context, match func(*User) bool) (*User, error) {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	for _, row := range u.db.users {
+		if match(row) && (!row.DeletedAt.Valid || withDeleted(ctx)) {
+			user := *row
+			return &user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (u *memoryUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return u.find(ctx, func(row *User) bool { return row.Email == email })
+}
+
+func (u *memoryUserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return u.find(ctx, func(row *User) bool { return row.Username == username })
+}
+
+func (u *memoryUserStore) GetAll(ctx context.Context) ([]*User, error) {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	users := []*User{}
+	for _, row := range u.db.users {
+		if row.DeletedAt.Valid && !withDeleted(ctx) {
+			continue
+		}
+		user := *row
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (u *memoryUserStore) Update(ctx context.Context, user *User) error {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	row, ok := u.db.users[user.ID]
+	if !ok || row.DeletedAt.Valid {
+		return ErrEditConflict
+	}
+	user.UpdatedAt = nullTimeNow()
+	updated := *user
+	updated.Preferences = storedPreferences(user.Preferences)
+	u.db.users[user.ID] = &updated
+	return nil
+}
+
+func (u *memoryUserStore) Delete(ctx context.Context, id int64) error {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	if _, ok := u.db.users[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(u.db.users, id)
+	return nil
+}
+
+func (u *memoryUserStore) SoftDelete(ctx context.Context, id int64) error {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	row, ok := u.db.users[id]
+	if !ok || row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = nullTimeNow()
+	return nil
+}
+
+func (u *memoryUserStore) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	for _, token := range u.db.tokens {
+		if string(token.Hash) != string(tokenHash[:]) || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+			continue
+		}
+		row, ok := u.db.users[token.UserID]
+		if !ok || row.DeletedAt.Valid {
+			break
+		}
+		user := *row
+		return &user, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (u *memoryUserStore) Get(ctx context.Context, id int64) (*User, error) {
+	return u.find(ctx, func(row *User) bool { return row.ID == id })
+}
+
+func (u *memoryUserStore) List(ctx context.Context, filter UserFilter, filters Filters) ([]*User, Metadata, error) {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	search := strings.ToLower(filter.Search)
+
+	users := []*User{}
+	for _, row := range u.db.users {
+		switch {
+		case filter.UserType != "" && row.UserType != filter.UserType:
+			continue
+		case filter.CompanyID != 0 && row.CompanyID != filter.CompanyID:
+			continue
+		case filter.Activated != nil && row.Activated != *filter.Activated:
+			continue
+		case filter.Deleted != nil && row.DeletedAt.Valid != *filter.Deleted:
+			continue
+		case row.DeletedAt.Valid && !withDeleted(ctx):
+			continue
+		case search != "" &&
+			!strings.Contains(strings.ToLower(row.FirstName+" "+row.LastName), search) &&
+			!strings.Contains(strings.ToLower(row.Email), search) &&
+			!strings.Contains(strings.ToLower(row.Username), search):
+			continue
+		}
+		user := *row
+		users = append(users, &user)
+	}
+
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		var less, equal bool
+		switch column {
+		case "first_name":
+			less, equal = a.FirstName < b.FirstName, a.FirstName == b.FirstName
+		case "last_name":
+			less, equal = a.LastName < b.LastName, a.LastName == b.LastName
+		case "email":
+			less, equal = a.Email < b.Email, a.Email == b.Email
+		case "username":
+			less, equal = a.Username < b.Username, a.Username == b.Username
+		case "user_type":
+			less, equal = a.UserType < b.UserType, a.UserType == b.UserType
+		case "created_at":
+			less, equal = a.CreatedAt.Before(b.CreatedAt), a.CreatedAt.Equal(b.CreatedAt)
+		default:
+			less, equal = a.ID < b.ID, a.ID == b.ID
+		}
+		if equal {
+			return a.ID < b.ID
+		}
+		return less != desc
+	})
+
+	metadata := calculateMetadata(len(users), filters.Page, filters.PageSize)
+
+	start := filters.offset()
+	if start > len(users) {
+		start = len(users)
+	}
+	end := start + filters.limit()
+	if end > len(users) {
+		end = len(users)
+	}
+	return users[start:end], metadata, nil
+}
+
+func (u *memoryUserStore) Restore(ctx context.Context, id int64) error {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	row, ok := u.db.users[id]
+	if !ok || !row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = NullTime{}
+	row.UpdatedAt = nullTimeNow()
+	return nil
+}
+
+// Purge keeps users who are still referred to by requests or services, and
+// removes the tokens of the others.
+func (u *memoryUserStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	ids := []int64{}
+	for id, row := range u.db.users {
+		if !row.DeletedAt.Valid || !row.DeletedAt.Time.Before(deletedBefore) || u.db.isReferenced(id) {
+			continue
+		}
+		delete(u.db.users, id)
+		u.db.deleteTokens(id)
+		u.db.deleteFromControls(id)
+		u.db.deleteSubscription(id, 0)
+		u.db.deleteReadReceipts(id)
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+type memoryRegFormStore struct {
+	db *memoryDB
+}
+
+func (r *memoryRegFormStore) Insert(ctx context.Context, regForm *RegForm) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	regForm.ID = r.db.id("regform")
+	regForm.CreatedAt = time.Now()
+	row := *regForm
+	r.db.regForms[regForm.ID] = &row
+	return nil
+}
+
+func (r *memoryRegFormStore) GetByDateAsc(ctx context.Context) ([]*RegForm, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	forms := []*RegForm{}
+	for _, row := range r.db.regForms {
+		if row.DeletedAt.Valid && !withDeleted(ctx) {
+			continue
+		}
+		form := *row
+		forms = append(forms, &form)
+	}
+	// Same ordering as the SQL implementation: newest first.
+	sort.Slice(forms, func(i, j int) bool {
+		if forms[i].CreatedAt.Equal(forms[j].CreatedAt) {
+			return forms[i].ID > forms[j].ID
+		}
+		return forms[i].CreatedAt.After(forms[j].CreatedAt)
+	})
+	return forms, nil
+}
+
+func (r *memoryRegFormStore) SoftDelete(ctx context.Context, id int64) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	row, ok := r.db.regForms[id]
+	if !ok || row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = nullTimeNow()
+	return nil
+}
+
+func (r *memoryRegFormStore) Restore(ctx context.Context, id int64) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	row, ok := r.db.regForms[id]
+	if !ok || !row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = NullTime{}
+	return nil
+}
+
+func (r *memoryRegFormStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	ids := []int64{}
+	for id, row := range r.db.regForms {
+		if !row.DeletedAt.Valid || !row.DeletedAt.Time.Before(deletedBefore) {
+			continue
+		}
+		delete(r.db.regForms, id)
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+type memoryTokenStore struct {
+	db *memoryDB
+}
+
+func (m *memoryTokenStore) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m *memoryTokenStore) Insert(ctx context.Context, token *Token) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	row := *token
+	m.db.tokens = append(m.db.tokens, &row)
+	return nil
+}
+
+func (m *memoryTokenStore) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	tokens := m.db.tokens[:0]
+	for _, token := range m.db.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	m.db.tokens = tokens
+	return nil
+}
+
+type memoryPermissionStore struct {
+	db *memoryDB
+}
+
+func (m *memoryPermissionStore) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	return append(Permissions(nil), m.db.permissions[userID]...), nil
+}
+
+type memoryRequestStore struct {
+	db *memoryDB
+}
+
+func (r *memoryRequestStore) Insert(ctx context.Context, request *Request) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	request.ID = r.db.id("request")
+	request.CreatedAt = time.Now()
+	row := *request
+	r.db.requests[request.ID] = &row
+	return nil
+}
+
+func (r *memoryRequestStore) GetByRequestID(ctx context.Context, id int64) (*Request, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	row, ok := r.db.requests[id]
+	if !ok || row.DeletedAt.Valid && !withDeleted(ctx) {
+		return nil, ErrRecordNotFound
+	}
+	request := *row
+	return &request, nil
+}
+
+func (r *memoryRequestStore) GetAllForClient(ctx context.Context, clientID int64) ([]*Request, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	requests := []*Request{}
+	for _, row := range r.db.requests {
+		if row.ClientID != clientID || row.DeletedAt.Valid && !withDeleted(ctx) {
+			continue
+		}
+		request := *row
+		requests = append(requests, &request)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].ID > requests[j].ID })
+	return requests, nil
+}
+
+func (r *memoryRequestStore) Update(ctx context.Context, request *Request) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	row, ok := r.db.requests[request.ID]
+	if !ok || row.DeletedAt.Valid {
+		return ErrEditConflict
+	}
+	request.CreatedAt = row.CreatedAt
+	request.UpdatedAt = nullTimeNow()
+	updated := *request
+	r.db.requests[request.ID] = &updated
+	return nil
+}
+
+func (r *memoryRequestStore) Delete(ctx context.Context, id int64) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	if _, ok := r.db.requests[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(r.db.requests, id)
+	return nil
+}
+
+func (r *memoryRequestStore) SoftDelete(ctx context.Context, id int64) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	row, ok := r.db.requests[id]
+	if !ok || row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = nullTimeNow()
+	return nil
+}
+
+func (r *memoryRequestStore) Restore(ctx context.Context, id int64) error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	row, ok := r.db.requests[id]
+	if !ok || !row.DeletedAt.Valid {
+		return ErrRecordNotFound
+	}
+	row.DeletedAt = NullTime{}
+	row.UpdatedAt = nullTimeNow()
+	return nil
+}
+
+func (r *memoryRequestStore) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+
+	ids := []int64{}
+	for id, row := range r.db.requests {
+		if !row.DeletedAt.Valid || !row.DeletedAt.Time.Before(deletedBefore) || r.db.hasBilledBookings(id) {
+			continue
+		}
+		delete(r.db.requests, id)
+		for bookingID, booking := range r.db.bookings {
+			if booking.RequestID == id {
+				delete(r.db.reserved, booking.ReservationID)
+				delete(r.db.bookings, bookingID)
+				r.db.deleteApprovals(bookingID)
+			}
+		}
+		for messageID, message := range r.db.messages {
+			if message.RequestID == id {
+				delete(r.db.messages, messageID)
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+type memoryBookingStore struct {
+	db *memoryDB
+}
+
+func (b *memoryBookingStore) Insert(ctx context.Context, booking *Booking) error {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	b.db.insertBooking(booking)
+	return nil
+}
+
+// insertBooking stores a new booking. The caller must hold db.mu.
+func (db *memoryDB) insertBooking(booking *Booking) {
+	booking.ID = db.id("booking")
+	booking.CreatedAt = time.Now()
+	booking.Version = 1
+	row := *booking
+	db.bookings[booking.ID] = &row
+}
+
+func (b *memoryBookingStore) Get(ctx context.Context, id int64) (*Booking, error) {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	row, ok := b.db.bookings[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	booking := *row
+	return &booking, nil
+}
+
+func (b *memoryBookingStore) Update(ctx context.Context, booking *Booking) error {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	return b.db.updateBooking(booking)
+}
+
+// updateBooking saves a booking. The caller must hold db.mu.
+func (db *memoryDB) updateBooking(booking *Booking) error {
+	row, ok := db.bookings[booking.ID]
+	if !ok || row.Version != booking.Version {
+		return ErrEditConflict
+	}
+	// Like the SQL, Update() leaves the invoice a booking is billed on alone.
+	booking.CreatedAt = row.CreatedAt
+	booking.InvoiceID = row.InvoiceID
+	booking.UpdatedAt = nullTimeNow()
+	booking.Version++
+	updated := *booking
+	db.bookings[booking.ID] = &updated
+	return nil
+}
+
+func (b *memoryBookingStore) List(ctx context.Context, filter BookingFilter, filters Filters) ([]*Booking, Metadata, error) {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	bookings := []*Booking{}
+	for _, row := range b.db.bookings {
+		service, ok := b.db.services[row.ServiceID]
+		if !ok {
+			continue
+		}
+		request, ok := b.db.requests[row.RequestID]
+		if !ok || request.DeletedAt.Valid {
+			continue
+		}
+		switch {
+		case filter.CompanyID != 0 && int64(service.CompanyID) != filter.CompanyID,
+			filter.RequestID != 0 && row.RequestID != filter.RequestID,
+			filter.PartnerStatus != "" && row.PartnerStatus != filter.PartnerStatus,
+			filter.FulfilmentStatus != "" && row.FulfilmentStatus != filter.FulfilmentStatus,
+			filter.SentToPartner && !b.db.sentToPartner(row.ID):
+			continue
+		}
+		booking := *row
+		bookings = append(bookings, &booking)
+	}
+
+	// IDs are handed out in created_at order, so sorting by either is the same.
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+	sort.Slice(bookings, func(i, j int) bool {
+		a, b := bookings[i], bookings[j]
+		if column == "starts_at" {
+			if a.StartsAt.Equal(b.StartsAt) {
+				return a.ID < b.ID
+			}
+			return a.StartsAt.Before(b.StartsAt) != desc
+		}
+		if desc {
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	})
+
+	metadata := calculateMetadata(len(bookings), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(bookings) {
+		start = len(bookings)
+	}
+	end := start + filters.limit()
+	if end > len(bookings) {
+		end = len(bookings)
+	}
+	return bookings[start:end], metadata, nil
+}
+
+type memoryServiceChangeStore struct {
+	db *memoryDB
+}
+
+// copyServiceChange returns a copy of change that doesn't share its Prices.
+func copyServiceChange(change *ServiceChange) *ServiceChange {
+	c := *change
+	c.Prices = append(ProposedPrices{}, change.Prices...)
+	return &c
+}
+
+func (s *memoryServiceChangeStore) Insert(ctx context.Context, change *ServiceChange) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, row := range s.db.changes {
+		if row.ServiceID == change.ServiceID && row.Status == ServiceChangePending && change.Status == ServiceChangePending {
+			return ErrPendingServiceChange
+		}
+	}
+
+	change.ID = s.db.id("service_change")
+	change.CreatedAt = time.Now()
+	change.Version = 1
+	s.db.changes[change.ID] = copyServiceChange(change)
+	return nil
+}
+
+func (s *memoryServiceChangeStore) Get(ctx context.Context, id int64) (*ServiceChange, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, ok := s.db.changes[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyServiceChange(row), nil
+}
+
+func (s *memoryServiceChangeStore) Update(ctx context.Context, change *ServiceChange) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, ok := s.db.changes[change.ID]
+	if !ok || row.Version != change.Version {
+		return ErrEditConflict
+	}
+	// Only the review can change, like in the SQL implementation.
+	updated := copyServiceChange(row)
+	updated.Status = change.Status
+	updated.ReviewedByID = change.ReviewedByID
+	updated.ReviewNote = change.ReviewNote
+	updated.ReviewedAt = change.ReviewedAt
+	updated.Version++
+	change.Version = updated.Version
+	s.db.changes[change.ID] = updated
+	return nil
+}
+
+func (s *memoryServiceChangeStore) List(ctx context.Context, filter ServiceChangeFilter, filters Filters) ([]*ServiceChange, Metadata, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	changes := []*ServiceChange{}
+	for _, row := range s.db.changes {
+		service, ok := s.db.services[row.ServiceID]
+		if !ok {
+			continue
+		}
+		switch {
+		case filter.CompanyID != 0 && int64(service.CompanyID) != filter.CompanyID,
+			filter.ServiceID != 0 && row.ServiceID != filter.ServiceID,
+			filter.Status != "" && row.Status != filter.Status:
+			continue
+		}
+		changes = append(changes, copyServiceChange(row))
+	}
+
+	desc := filters.sortDirection() == "DESC"
+	sort.Slice(changes, func(i, j int) bool {
+		if desc {
+			return changes[i].ID > changes[j].ID
+		}
+		return changes[i].ID < changes[j].ID
+	})
+
+	metadata := calculateMetadata(len(changes), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(changes) {
+		start = len(changes)
+	}
+	end := start + filters.limit()
+	if end > len(changes) {
+		end = len(changes)
+	}
+	return changes[start:end], metadata, nil
+}
+
+type memoryAuditStore struct {
+	db *memoryDB
+}
+
+func (m *memoryAuditStore) Insert(ctx context.Context, entry *AuditEntry) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	entry.ID = m.db.id("audit_log")
+	entry.CreatedAt = time.Now()
+	row := *entry
+	m.db.audit = append(m.db.audit, &row)
+	return nil
+}
+
+func (m *memoryAuditStore) List(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	entries := []*AuditEntry{}
+	for _, row := range m.db.audit {
+		switch {
+		case filter.ActorID != 0 && row.ActorID != filter.ActorID,
+			filter.EntityType != "" && row.EntityType != filter.EntityType,
+			filter.EntityID != 0 && row.EntityID != filter.EntityID,
+			filter.Action != "" && row.Action != filter.Action,
+			!filter.From.IsZero() && row.CreatedAt.Before(filter.From),
+			!filter.To.IsZero() && !row.CreatedAt.Before(filter.To):
+			continue
+		}
+		entry := *row
+		entries = append(entries, &entry)
+	}
+
+	// Entries are appended in id order, which is also created_at order.
+	desc := filters.sortDirection() == "DESC"
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return entries[i].ID > entries[j].ID
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	metadata := calculateMetadata(len(entries), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(entries) {
+		start = len(entries)
+	}
+	end := start + filters.limit()
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[start:end], metadata, nil
+}
+
+type memoryPersonalDataStore struct {
+	db *memoryDB
+}
+
+func (m *memoryPersonalDataStore) Export(ctx context.Context, userID int64) (*PersonalData, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	row, ok := m.db.users[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	user := *row
+
+	export := newPersonalData(&user)
+
+	for _, row := range m.db.requests {
+		if row.ClientID == userID {
+			request := *row
+			export.Requests = append(export.Requests, &request)
+		}
+	}
+	sort.Slice(export.Requests, func(i, j int) bool { return export.Requests[i].ID < export.Requests[j].ID })
+
+	for _, row := range m.db.messages {
+		if row.AuthorID == userID {
+			message := *row
+			message.Attachments = []*Attachment{}
+			for _, a := range row.Attachments {
+				attachment := *a
+				message.Attachments = append(message.Attachments, &attachment)
+			}
+			message.ReadBy = []*ReadReceipt{}
+			export.Messages = append(export.Messages, &message)
+		}
+	}
+	sort.Slice(export.Messages, func(i, j int) bool { return export.Messages[i].ID < export.Messages[j].ID })
+
+	own := m.db.ownEntities(userID, user.Email)
+
+	for _, row := range m.db.bookings {
+		if own[AuditEntityBooking][row.ID] {
+			booking := *row
+			export.Bookings = append(export.Bookings, &booking)
+		}
+	}
+	sort.Slice(export.Bookings, func(i, j int) bool { return export.Bookings[i].ID < export.Bookings[j].ID })
+
+	for _, row := range m.db.payments {
+		if row.UserID == userID {
+			payment := *row
+			export.Payments = append(export.Payments, &payment)
+		}
+	}
+	sort.Slice(export.Payments, func(i, j int) bool { return export.Payments[i].ID < export.Payments[j].ID })
+
+	for _, row := range m.db.refunds {
+		if own[AuditEntityPayment][row.PaymentID] {
+			refund := *row
+			export.Refunds = append(export.Refunds, &refund)
+		}
+	}
+	sort.Slice(export.Refunds, func(i, j int) bool { return export.Refunds[i].ID < export.Refunds[j].ID })
+
+	for _, row := range m.db.accounts {
+		if own[AuditEntityAccount][row.ID] {
+			account := *row
+			from, to := statementPeriod(&account, export.ExportedAt)
+			export.Accounts = append(export.Accounts, &account)
+			export.Statements = append(export.Statements, m.db.statement(account.ID, from, to))
+		}
+	}
+
+	for _, row := range m.db.subscriptions {
+		if row.UserID == userID {
+			sub := *row
+			plan := *m.db.plans[row.PlanID]
+			sub.Plan = &plan
+			export.Subscriptions = append(export.Subscriptions, &sub)
+		}
+	}
+
+	for _, row := range m.db.approvals {
+		if own[AuditEntityApproval][row.ID] {
+			approval := *row
+			approval.Reasons = append([]string{}, row.Reasons...)
+			export.Approvals = append(export.Approvals, &approval)
+		}
+	}
+	sort.Slice(export.Approvals, func(i, j int) bool { return export.Approvals[i].ID < export.Approvals[j].ID })
+
+	for _, token := range m.db.tokens {
+		if token.UserID == userID {
+			export.Tokens = append(export.Tokens, TokenSummary{Scope: token.Scope, Expiry: token.Expiry})
+		}
+	}
+	sort.Slice(export.Tokens, func(i, j int) bool { return export.Tokens[i].Expiry.Before(export.Tokens[j].Expiry) })
+
+	for _, row := range m.db.regForms {
+		if strings.EqualFold(row.Email, user.Email) {
+			form := *row
+			export.RegForms = append(export.RegForms, &form)
+		}
+	}
+	sort.Slice(export.RegForms, func(i, j int) bool { return export.RegForms[i].ID < export.RegForms[j].ID })
+
+	for _, row := range m.db.audit {
+		aboutUser := own[row.EntityType][row.EntityID]
+		if row.ActorID != userID && !aboutUser {
+			continue
+		}
+		entry := *row
+		if !aboutUser {
+			entry.Changes = json.RawMessage("{}")
+		}
+		export.AuditLog = append(export.AuditLog, &entry)
+	}
+
+	return export, nil
+}
+
+func (m *memoryPersonalDataStore) Erase(ctx context.Context, userID int64) error {
+	hash, err := randomPasswordHash()
+	if err != nil {
+		return err
+	}
+
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	user, ok := m.db.users[userID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	email := user.Email
+	own := m.db.ownEntities(userID, email)
+
+	user.FirstName = ""
+	user.LastName = ""
+	user.Email = erasedEmail(userID)
+	user.Username = erasedUsername(userID)
+	user.Password = password{hash: hash}
+	user.Activated = false
+	user.Preferences = DefaultPreferences()
+	if !user.DeletedAt.Valid {
+		user.DeletedAt = nullTimeNow()
+	}
+	user.UpdatedAt = nullTimeNow()
+
+	for _, request := range m.db.requests {
+		if request.ClientID == userID {
+			request.Description = ErasedRequestDescription
+			request.UpdatedAt = nullTimeNow()
+		}
+	}
+
+	for _, message := range m.db.messages {
+		if message.AuthorID == userID {
+			message.Body = ErasedMessageBody
+			message.Attachments = nil
+		}
+	}
+
+	for _, booking := range m.db.bookings {
+		if own[AuditEntityBooking][booking.ID] && (booking.CancelReason != "" || booking.PartnerNote != "") {
+			if booking.CancelReason != "" {
+				booking.CancelReason = ErasedNote
+			}
+			if booking.PartnerNote != "" {
+				booking.PartnerNote = ErasedNote
+			}
+			booking.UpdatedAt = nullTimeNow()
+			booking.Version++
+		}
+	}
+
+	for _, approval := range m.db.approvals {
+		if own[AuditEntityApproval][approval.ID] && approval.Note != "" {
+			approval.Note = ErasedNote
+			approval.Version++
+		}
+	}
+
+	for _, txn := range m.db.ledger {
+		if own[AuditEntityLedger][txn.ID] && txn.Note != "" {
+			txn.Note = ErasedNote
+		}
+	}
+
+	m.db.deleteTokens(userID)
+
+	for _, form := range m.db.regForms {
+		if strings.EqualFold(form.Email, email) {
+			form.Email = erasedEmail(userID)
+			form.PhoneNumber = ""
+		}
+	}
+
+	for _, entry := range m.db.audit {
+		if own[entry.EntityType][entry.EntityID] {
+			entry.Changes = json.RawMessage("{}")
+		}
+		if entry.ActorID == userID {
+			entry.IP = ""
+		}
+	}
+
+	return nil
+}
+
+// ownEntities returns the IDs of the rows holding the personal data of a user, by
+// audit entity type: the user, their requests and their bookings, the messages
+// they wrote, the registration forms sent from their email address, their
+// payments, deposit, deposit transactions and subscription, and the approvals they
+// asked for or decided.
+func (db *memoryDB) ownEntities(userID int64, email string) map[string]map[int64]bool {
+	own := map[string]map[int64]bool{
+		AuditEntityUser:         {userID: true},
+		AuditEntityRequest:      {},
+		AuditEntityBooking:      {},
+		AuditEntityMessage:      {},
+		AuditEntityRegForm:      {},
+		AuditEntityPayment:      {},
+		AuditEntityAccount:      {},
+		AuditEntityLedger:       {},
+		AuditEntitySubscription: {},
+		AuditEntityApproval:     {},
+	}
+	for _, request := range db.requests {
+		if request.ClientID == userID {
+			own[AuditEntityRequest][request.ID] = true
+		}
+	}
+	for _, booking := range db.bookings {
+		if own[AuditEntityRequest][booking.RequestID] {
+			own[AuditEntityBooking][booking.ID] = true
+		}
+	}
+	for _, payment := range db.payments {
+		if payment.UserID == userID {
+			own[AuditEntityPayment][payment.ID] = true
+		}
+	}
+	for _, account := range db.accounts {
+		if account.Kind == AccountDeposit && account.UserID == userID {
+			own[AuditEntityAccount][account.ID] = true
+		}
+	}
+	for _, txn := range db.ledger {
+		if own[AuditEntityAccount][txn.AccountID] {
+			own[AuditEntityLedger][txn.ID] = true
+		}
+	}
+	for _, sub := range db.subscriptions {
+		if sub.UserID == userID {
+			own[AuditEntitySubscription][sub.ID] = true
+		}
+	}
+	for _, approval := range db.approvals {
+		if approval.RequestedByID == userID || approval.DecidedByID == userID {
+			own[AuditEntityApproval][approval.ID] = true
+		}
+	}
+	for _, message := range db.messages {
+		if message.AuthorID == userID {
+			own[AuditEntityMessage][message.ID] = true
+		}
+	}
+	for _, form := range db.regForms {
+		if strings.EqualFold(form.Email, email) {
+			own[AuditEntityRegForm][form.ID] = true
+		}
+	}
+	return own
+}
+
+// memorySystemStore has no connection pool, so it reports empty statistics.
+type memorySystemStore struct{}
+
+func (memorySystemStore) Stats() sql.DBStats {
+	return sql.DBStats{}
+}
+
+func (memorySystemStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (memorySystemStore) MigrationVersion(ctx context.Context) (int64, bool, error) {
+	return 0, false, nil
+}
+
+type memoryAvailabilityStore struct {
+	db *memoryDB
+}
+
+func copySchedule(schedule *Schedule) *Schedule {
+	s := *schedule
+	s.Windows = append(WeeklyWindows{}, schedule.Windows...)
+	s.Exceptions = make(AvailabilityExceptions, 0, len(schedule.Exceptions))
+	for _, exception := range schedule.Exceptions {
+		exception.Windows = append([]TimeWindow{}, exception.Windows...)
+		s.Exceptions = append(s.Exceptions, exception)
+	}
+	return &s
+}
+
+func (a *memoryAvailabilityStore) GetSchedule(ctx context.Context, serviceID int64) (*Schedule, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	row, ok := a.db.schedules[serviceID]
+	if !ok {
+		return &Schedule{ServiceID: serviceID, TimeZone: DefaultTimeZone, Windows: WeeklyWindows{}, Exceptions: AvailabilityExceptions{}}, nil
+	}
+	return copySchedule(row), nil
+}
+
+func (a *memoryAvailabilityStore) SetSchedule(ctx context.Context, schedule *Schedule) error {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	schedule.UpdatedAt = nullTimeNow()
+	a.db.schedules[schedule.ServiceID] = copySchedule(schedule)
+	return nil
+}
+
+func (a *memoryAvailabilityStore) Reservations(ctx context.Context, serviceID int64, from, to time.Time) ([]*SlotReservation, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	reservations := []*SlotReservation{}
+	for _, row := range a.db.reserved {
+		if row.ServiceID != serviceID || row.StartsAt.Before(from) || !row.StartsAt.Before(to) {
+			continue
+		}
+		reservation := *row
+		reservations = append(reservations, &reservation)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		if reservations[i].StartsAt.Equal(reservations[j].StartsAt) {
+			return reservations[i].ID < reservations[j].ID
+		}
+		return reservations[i].StartsAt.Before(reservations[j].StartsAt)
+	})
+	return reservations, nil
+}
+
+// Reserve checks the capacity and takes it while holding db.mu, which makes it as
+// atomic as the locking transaction of AvailabilityModel.Reserve.
+func (a *memoryAvailabilityStore) Reserve(ctx context.Context, serviceID int64, slot Slot, units int) (*SlotReservation, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	reserved := 0
+	for _, row := range a.db.reserved {
+		if row.ServiceID == serviceID && row.StartsAt.Equal(slot.StartsAt) {
+			reserved += row.Units
+		}
+	}
+	if reserved+units > slot.Capacity {
+		return nil, ErrSlotUnavailable
+	}
+
+	reservation := &SlotReservation{
+		ID:        a.db.id("slot_reservation"),
+		ServiceID: serviceID,
+		StartsAt:  slot.StartsAt,
+		EndsAt:    slot.EndsAt,
+		Units:     units,
+		CreatedAt: time.Now(),
+	}
+	row := *reservation
+	a.db.reserved[reservation.ID] = &row
+	return reservation, nil
+}
+
+func (a *memoryAvailabilityStore) Release(ctx context.Context, id int64) error {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	delete(a.db.reserved, id)
+	return nil
+}
+
+type memoryInvoiceStore struct {
+	db *memoryDB
+}
+
+func copyInvoice(invoice *Invoice) *Invoice {
+	i := *invoice
+	i.Lines = make([]*InvoiceLine, 0, len(invoice.Lines))
+	for _, line := range invoice.Lines {
+		l := *line
+		i.Lines = append(i.Lines, &l)
+	}
+	return &i
+}
+
+// billableBookings returns the bookings of a company's users that are billable for
+// a period ending at end, in the order the SQL bills them. The caller must hold
+// db.mu.
+func (db *memoryDB) billableBookings(companyID int64, end time.Time) []*Booking {
+	bookings := []*Booking{}
+	for _, booking := range db.bookings {
+		request, ok := db.requests[booking.RequestID]
+		if !ok {
+			continue
+		}
+		client, ok := db.users[request.ClientID]
+		if !ok || client.CompanyID == 0 || client.CompanyID != companyID || !billable(booking, end) || db.debited(booking.ID) {
+			continue
+		}
+		bookings = append(bookings, booking)
+	}
+	sort.Slice(bookings, func(i, j int) bool {
+		if bookings[i].StartsAt.Equal(bookings[j].StartsAt) {
+			return bookings[i].ID < bookings[j].ID
+		}
+		return bookings[i].StartsAt.Before(bookings[j].StartsAt)
+	})
+	return bookings
+}
+
+func (m *memoryInvoiceStore) BillableCompanies(ctx context.Context, end time.Time) ([]int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	seen := make(map[int64]bool)
+	ids := []int64{}
+	for _, booking := range m.db.bookings {
+		request, ok := m.db.requests[booking.RequestID]
+		if !ok {
+			continue
+		}
+		client, ok := m.db.users[request.ClientID]
+		if !ok || client.CompanyID == 0 || seen[client.CompanyID] || !billable(booking, end) || m.db.debited(booking.ID) {
+			continue
+		}
+		seen[client.CompanyID] = true
+		ids = append(ids, client.CompanyID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (m *memoryInvoiceStore) Generate(ctx context.Context, companyID int64, period string) (*Invoice, error) {
+	_, end, err := InvoicePeriodBounds(period)
+	if err != nil {
+		return nil, err
+	}
+
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	var invoice *Invoice
+	for _, row := range m.db.invoices {
+		if row.CompanyID == companyID && row.Period == period {
+			invoice = row
+			break
+		}
+	}
+	if invoice != nil && invoice.Status != InvoiceDraft {
+		return nil, ErrInvoiceIssued
+	}
+
+	bookings := m.db.billableBookings(companyID, end)
+	if len(bookings) == 0 {
+		if invoice == nil {
+			return nil, ErrNothingToInvoice
+		}
+		return copyInvoice(invoice), nil
+	}
+
+	if invoice == nil {
+		invoice = &Invoice{
+			ID:        m.db.id("invoice"),
+			CompanyID: companyID,
+			Period:    period,
+			Status:    InvoiceDraft,
+			Lines:     []*InvoiceLine{},
+			CreatedAt: time.Now(),
+			Version:   1,
+		}
+		m.db.invoices[invoice.ID] = invoice
+	}
+
+	for _, booking := range bookings {
+		serviceName := ""
+		if service, ok := m.db.services[booking.ServiceID]; ok {
+			serviceName = service.Name
+		}
+		line := newInvoiceLine(booking, serviceName)
+		line.ID = m.db.id("invoice_line")
+		invoice.Lines = append(invoice.Lines, line)
+		invoice.Total += line.Amount
+		booking.InvoiceID = invoice.ID
+	}
+	invoice.UpdatedAt = nullTimeNow()
+	invoice.Version++
+	return copyInvoice(invoice), nil
+}
+
+func (m *memoryInvoiceStore) Get(ctx context.Context, id int64) (*Invoice, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	row, ok := m.db.invoices[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyInvoice(row), nil
+}
+
+func (m *memoryInvoiceStore) List(ctx context.Context, filter InvoiceFilter, filters Filters) ([]*Invoice, Metadata, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	invoices := []*Invoice{}
+	for _, row := range m.db.invoices {
+		switch {
+		case filter.CompanyID != 0 && row.CompanyID != filter.CompanyID,
+			filter.Period != "" && row.Period != filter.Period,
+			filter.Status != "" && row.Status != filter.Status,
+			filter.Issued && row.Status == InvoiceDraft:
+			continue
+		}
+		invoice := *row
+		invoice.Lines = nil
+		invoices = append(invoices, &invoice)
+	}
+
+	// IDs are handed out in created_at order, so sorting by either is the same.
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+	sort.Slice(invoices, func(i, j int) bool {
+		a, b := invoices[i], invoices[j]
+		if column == "period" && a.Period != b.Period {
+			return (a.Period < b.Period) != desc
+		}
+		if column == "period" || !desc {
+			return a.ID < b.ID
+		}
+		return a.ID > b.ID
+	})
+
+	metadata := calculateMetadata(len(invoices), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(invoices) {
+		start = len(invoices)
+	}
+	end := start + filters.limit()
+	if end > len(invoices) {
+		end = len(invoices)
+	}
+	return invoices[start:end], metadata, nil
+}
+
+func (m *memoryInvoiceStore) Issue(ctx context.Context, invoice *Invoice, dueAt time.Time) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	row, ok := m.db.invoices[invoice.ID]
+	if !ok || row.Version != invoice.Version || row.Status != InvoiceDraft {
+		return ErrEditConflict
+	}
+
+	year := time.Now().Year()
+	m.db.invoiceNumbers[year]++
+	row.Number = InvoiceNumber(year, m.db.invoiceNumbers[year])
+	row.Status = InvoiceIssued
+	row.IssuedAt = nullTimeNow()
+	row.DueAt = nullTime(dueAt)
+	row.UpdatedAt = nullTimeNow()
+	row.Version++
+
+	invoice.Number = row.Number
+	invoice.Status = row.Status
+	invoice.IssuedAt = row.IssuedAt
+	invoice.DueAt = row.DueAt
+	invoice.UpdatedAt = row.UpdatedAt
+	invoice.Version = row.Version
+	return nil
+}
+
+func (m *memoryInvoiceStore) Update(ctx context.Context, invoice *Invoice) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	row, ok := m.db.invoices[invoice.ID]
+	if !ok || row.Version != invoice.Version {
+		return ErrEditConflict
+	}
+	row.Status = invoice.Status
+	row.PaidAt = invoice.PaidAt
+	row.UpdatedAt = nullTimeNow()
+	row.Version++
+
+	invoice.UpdatedAt = row.UpdatedAt
+	invoice.Version = row.Version
+	return nil
+}
+
+func (m *memoryInvoiceStore) MarkOverdue(ctx context.Context, now time.Time) ([]int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	ids := []int64{}
+	for id, row := range m.db.invoices {
+		if row.Status != InvoiceIssued || !row.DueAt.Time.Before(now) {
+			continue
+		}
+		row.Status = InvoiceOverdue
+		row.UpdatedAt = nullTimeNow()
+		row.Version++
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+type memoryPaymentStore struct {
+	db *memoryDB
+}
+
+// Insert checks the same unique constraints as the payment table.
+func (p *memoryPaymentStore) Insert(ctx context.Context, payment *Payment) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	for _, row := range p.db.payments {
+		switch {
+		case row.UserID == payment.UserID && row.IdempotencyKey == payment.IdempotencyKey:
+			return ErrDuplicateIdempotencyKey
+		case row.BookingID == payment.BookingID && paid(row.Status) && paid(payment.Status):
+			return ErrBookingPaid
+		}
+	}
+
+	payment.ID = p.db.id("payment")
+	payment.CreatedAt = time.Now()
+	payment.Version = 1
+	row := *payment
+	p.db.payments[payment.ID] = &row
+	return nil
+}
+
+// paid reports whether a payment with status counts towards payment_booking_paid.
+func paid(status string) bool {
+	return status == PaymentAuthorized || status == PaymentCaptured
+}
+
+func (p *memoryPaymentStore) find(match func(*Payment) bool) (*Payment, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	for _, row := range p.db.payments {
+		if match(row) {
+			payment := *row
+			return &payment, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (p *memoryPaymentStore) Get(ctx context.Context, id int64) (*Payment, error) {
+	return p.find(func(row *Payment) bool { return row.ID == id })
+}
+
+func (p *memoryPaymentStore) GetByIdempotencyKey(ctx context.Context, userID int64, key string) (*Payment, error) {
+	return p.find(func(row *Payment) bool { return row.UserID == userID && row.IdempotencyKey == key })
+}
+
+func (p *memoryPaymentStore) GetByProviderRef(ctx context.Context, provider, ref string) (*Payment, error) {
+	return p.find(func(row *Payment) bool { return row.Provider == provider && row.ProviderRef == ref })
+}
+
+func (p *memoryPaymentStore) List(ctx context.Context, filter PaymentFilter, filters Filters) ([]*Payment, Metadata, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	payments := []*Payment{}
+	for _, row := range p.db.payments {
+		switch {
+		case filter.BookingID != 0 && row.BookingID != filter.BookingID,
+			filter.UserID != 0 && row.UserID != filter.UserID,
+			filter.Status != "" && row.Status != filter.Status:
+			continue
+		}
+		payment := *row
+		payments = append(payments, &payment)
+	}
+
+	// IDs are handed out in created_at order, so sorting by either is the same.
+	desc := filters.sortDirection() == "DESC"
+	sort.Slice(payments, func(i, j int) bool {
+		if desc {
+			return payments[i].ID > payments[j].ID
+		}
+		return payments[i].ID < payments[j].ID
+	})
+
+	metadata := calculateMetadata(len(payments), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(payments) {
+		start = len(payments)
+	}
+	end := start + filters.limit()
+	if end > len(payments) {
+		end = len(payments)
+	}
+	return payments[start:end], metadata, nil
+}
+
+func (p *memoryPaymentStore) Update(ctx context.Context, payment *Payment) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.payments[payment.ID]
+	if !ok || row.Version != payment.Version {
+		return ErrEditConflict
+	}
+	row.Status = payment.Status
+	row.Refunded = payment.Refunded
+	row.DeclineReason = payment.DeclineReason
+	row.UpdatedAt = nullTimeNow()
+	row.Version++
+
+	payment.UpdatedAt = row.UpdatedAt
+	payment.Version = row.Version
+	return nil
+}
+
+func (p *memoryPaymentStore) GetRefund(ctx context.Context, paymentID int64, key string) (*PaymentRefund, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	for _, row := range p.db.refunds {
+		if row.PaymentID == paymentID && row.IdempotencyKey == key {
+			refund := *row
+			return &refund, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (p *memoryPaymentStore) Refund(ctx context.Context, refund *PaymentRefund, refundedTotal int, status string) (*Payment, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	for _, row := range p.db.refunds {
+		if row.PaymentID == refund.PaymentID && row.IdempotencyKey == refund.IdempotencyKey {
+			return nil, ErrDuplicateIdempotencyKey
+		}
+	}
+	row, ok := p.db.payments[refund.PaymentID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	refund.ID = p.db.id("payment_refund")
+	refund.CreatedAt = time.Now()
+	stored := *refund
+	p.db.refunds[refund.ID] = &stored
+
+	if refundedTotal > row.Refunded {
+		row.Refunded = refundedTotal
+	}
+	if paymentStage[row.Status] < paymentStage[PaymentRefunded] {
+		row.Status = status
+	}
+	row.UpdatedAt = nullTimeNow()
+	row.Version++
+	payment := *row
+	return &payment, nil
+}
+
+func (p *memoryPaymentStore) EventSeen(ctx context.Context, provider, eventID string) (bool, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	return p.db.paymentEvents[provider+"\x00"+eventID], nil
+}
+
+func (p *memoryPaymentStore) RecordEvent(ctx context.Context, provider, eventID string) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	p.db.paymentEvents[provider+"\x00"+eventID] = true
+	return nil
+}
+
+type memoryLedgerStore struct {
+	db *memoryDB
+}
+
+// Open checks the same unique constraints as the account table.
+func (l *memoryLedgerStore) Open(ctx context.Context, account *Account) error {
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	for _, row := range l.db.accounts {
+		if (account.UserID != 0 && row.UserID == account.UserID) || (account.CompanyID != 0 && row.CompanyID == account.CompanyID) {
+			return ErrDuplicateAccount
+		}
+	}
+
+	account.ID = l.db.id("account")
+	account.Kind = AccountDeposit
+	account.Balance = 0
+	account.CreatedAt = time.Now()
+	account.Version = 1
+	row := *account
+	l.db.accounts[account.ID] = &row
+	return nil
+}
+
+func (l *memoryLedgerStore) GetAccount(ctx context.Context, id int64) (*Account, error) {
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	row, ok := l.db.accounts[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	account := *row
+	return &account, nil
+}
+
+func (l *memoryLedgerStore) GetAccountFor(ctx context.Context, userID, companyID int64) (*Account, error) {
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	var found *Account
+	for _, row := range l.db.accounts {
+		switch {
+		case row.Kind != AccountDeposit:
+		case row.UserID == userID:
+			account := *row
+			return &account, nil
+		case companyID != 0 && row.CompanyID == companyID:
+			found = row
+		}
+	}
+	if found == nil {
+		return nil, ErrRecordNotFound
+	}
+	account := *found
+	return &account, nil
+}
+
+func (l *memoryLedgerStore) ListAccounts(ctx context.Context, filter AccountFilter, filters Filters) ([]*Account, Metadata, error) {
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	accounts := []*Account{}
+	for _, row := range l.db.accounts {
+		switch {
+		case filter.Kind != "" && row.Kind != filter.Kind,
+			filter.UserID != 0 && row.UserID != filter.UserID,
+			filter.CompanyID != 0 && row.CompanyID != filter.CompanyID:
+			continue
+		}
+		account := *row
+		accounts = append(accounts, &account)
+	}
+
+	desc := filters.sortDirection() == "DESC"
+	sort.Slice(accounts, func(i, j int) bool {
+		a, b := accounts[i], accounts[j]
+		if filters.sortColumn() == "balance" && a.Balance != b.Balance {
+			return (a.Balance < b.Balance) != desc
+		}
+		if desc && filters.sortColumn() != "balance" {
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	})
+
+	metadata := calculateMetadata(len(accounts), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(accounts) {
+		start = len(accounts)
+	}
+	end := start + filters.limit()
+	if end > len(accounts) {
+		end = len(accounts)
+	}
+	return accounts[start:end], metadata, nil
+}
+
+// Post makes the same checks as the SQL version. Holding db.mu throughout stands
+// in for locking the accounts.
+func (l *memoryLedgerStore) Post(ctx context.Context, txn *LedgerTransaction) error {
+	posting, ok := ledgerPostings[txn.Kind]
+	if !ok {
+		return fmt.Errorf("unknown ledger transaction kind %q", txn.Kind)
+	}
+
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	account, ok := l.db.accounts[txn.AccountID]
+	if !ok || account.Kind != AccountDeposit {
+		return ErrRecordNotFound
+	}
+	var counter *Account
+	for _, row := range l.db.accounts {
+		if row.Kind == posting.counter {
+			counter = row
+		}
+	}
+
+	amount := posting.sign * txn.Amount
+	if account.Balance+amount < 0 {
+		return ErrInsufficientFunds
+	}
+
+	refundable := 0
+	for _, row := range l.db.ledger {
+		switch {
+		case row.AccountID == txn.AccountID && txn.IdempotencyKey != "" && row.IdempotencyKey == txn.IdempotencyKey:
+			return ErrDuplicateIdempotencyKey
+		case txn.Kind == LedgerDebit && row.Kind == LedgerDebit && row.BookingID == txn.BookingID:
+			return ErrBookingDebited
+		case row.AccountID != txn.AccountID || row.BookingID != txn.BookingID:
+		case row.Kind == LedgerDebit:
+			refundable += row.Amount
+		case row.Kind == LedgerRefund:
+			refundable -= row.Amount
+		}
+	}
+	if txn.Kind == LedgerRefund && txn.Amount > refundable {
+		return ErrRefundExceedsDebit
+	}
+
+	txn.ID = l.db.id("ledger_transaction")
+	txn.CreatedAt = time.Now()
+
+	for _, side := range []struct {
+		account *Account
+		amount  int
+	}{{account, amount}, {counter, -amount}} {
+		side.account.Balance += side.amount
+		side.account.Version++
+		l.db.entries = append(l.db.entries, &ledgerEntry{
+			TransactionID: txn.ID,
+			AccountID:     side.account.ID,
+			Amount:        side.amount,
+			Balance:       side.account.Balance,
+			CreatedAt:     txn.CreatedAt,
+		})
+	}
+	txn.Balance = account.Balance
+
+	row := *txn
+	l.db.ledger[txn.ID] = &row
+	return nil
+}
+
+func (l *memoryLedgerStore) GetTransaction(ctx context.Context, accountID int64, key string) (*LedgerTransaction, error) {
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	for _, row := range l.db.ledger {
+		if row.AccountID == accountID && row.IdempotencyKey == key {
+			txn := *row
+			return &txn, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (l *memoryLedgerStore) BookingDebited(ctx context.Context, bookingID int64) (bool, error) {
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	return l.db.debited(bookingID), nil
+}
+
+func (l *memoryLedgerStore) Statement(ctx context.Context, accountID int64, from, to time.Time) (*Statement, error) {
+	l.db.mu.Lock()
+	defer l.db.mu.Unlock()
+
+	return l.db.statement(accountID, from, to), nil
+}
+
+// statement returns the statement of an account for a period. The caller must hold
+// db.mu.
+func (db *memoryDB) statement(accountID int64, from, to time.Time) *Statement {
+	statement := &Statement{AccountID: accountID, From: from, To: to, Lines: []*StatementLine{}}
+
+	// Entries are appended in the order they are posted.
+	for _, entry := range db.entries {
+		switch {
+		case entry.AccountID != accountID || !entry.CreatedAt.Before(to):
+		case entry.CreatedAt.Before(from):
+			statement.OpeningBalance = entry.Balance
+		default:
+			txn := db.ledger[entry.TransactionID]
+			statement.Lines = append(statement.Lines, &StatementLine{
+				TransactionID: txn.ID,
+				Date:          entry.CreatedAt,
+				Kind:          txn.Kind,
+				BookingID:     txn.BookingID,
+				Note:          txn.Note,
+				Amount:        entry.Amount,
+				Balance:       entry.Balance,
+			})
+		}
+	}
+
+	statement.close()
+	return statement
+}
+
+type memoryApprovalStore struct {
+	db *memoryDB
+}
+
+// copyControls copies controls, so that callers can't change what's stored.
+func copyControls(controls *SpendingControls) *SpendingControls {
+	c := &SpendingControls{
+		CompanyID:   controls.CompanyID,
+		Budgets:     make([]*Budget, 0, len(controls.Budgets)),
+		Rules:       make([]*ApprovalRule, 0, len(controls.Rules)),
+		ApproverIDs: append([]int64{}, controls.ApproverIDs...),
+	}
+	for _, budget := range controls.Budgets {
+		b := *budget
+		c.Budgets = append(c.Budgets, &b)
+	}
+	for _, rule := range controls.Rules {
+		r := *rule
+		c.Rules = append(c.Rules, &r)
+	}
+	return c
+}
+
+func (a *memoryApprovalStore) Controls(ctx context.Context, companyID int64) (*SpendingControls, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	return a.controls(companyID), nil
+}
+
+// controls returns a copy of the spending controls of a company. The caller must
+// hold db.mu.
+func (a *memoryApprovalStore) controls(companyID int64) *SpendingControls {
+	controls, ok := a.db.controls[companyID]
+	if !ok {
+		return &SpendingControls{CompanyID: companyID, Budgets: []*Budget{}, Rules: []*ApprovalRule{}, ApproverIDs: []int64{}}
+	}
+	return copyControls(controls)
+}
+
+func (a *memoryApprovalStore) SetControls(ctx context.Context, controls *SpendingControls) error {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	stored := copyControls(controls)
+	// Budgets are read back company first, then by user, as from the budget table.
+	sort.SliceStable(stored.Budgets, func(i, j int) bool { return stored.Budgets[i].UserID < stored.Budgets[j].UserID })
+	sort.Slice(stored.ApproverIDs, func(i, j int) bool { return stored.ApproverIDs[i] < stored.ApproverIDs[j] })
+	a.db.controls[controls.CompanyID] = stored
+	return nil
+}
+
+func (a *memoryApprovalStore) Spent(ctx context.Context, companyID, userID int64, from, to time.Time) (int, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	return a.spent(companyID, userID, from, to), nil
+}
+
+// spent is Spent() for callers that hold db.mu.
+func (a *memoryApprovalStore) spent(companyID, userID int64, from, to time.Time) int {
+	spent := 0
+	for _, booking := range a.db.bookings {
+		request, ok := a.db.requests[booking.RequestID]
+		if !ok {
+			continue
+		}
+		client, ok := a.db.users[request.ClientID]
+		switch {
+		case !ok || client.CompanyID != companyID || (userID != 0 && client.ID != userID),
+			booking.StartsAt.Before(from) || !booking.StartsAt.Before(to):
+		case booking.Cancelled():
+			spent += booking.CancellationFee
+		default:
+			spent += booking.Total()
+		}
+	}
+	return spent
+}
+
+// InsertBooking makes the same checks as the SQL version. Holding db.mu throughout
+// stands in for locking the company.
+func (a *memoryApprovalStore) InsertBooking(ctx context.Context, client *User, booking *Booking) (*Approval, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	approval, err := bookingApproval(a.controls(client.CompanyID), client, booking, func(userID int64, from, to time.Time) (int, error) {
+		return a.spent(client.CompanyID, userID, from, to), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.db.insertBooking(booking)
+	if approval != nil {
+		approval.BookingID = booking.ID
+		a.insert(approval)
+	}
+	return approval, nil
+}
+
+func (a *memoryApprovalStore) Insert(ctx context.Context, approval *Approval) error {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	a.insert(approval)
+	return nil
+}
+
+// insert stores a new approval. The caller must hold db.mu.
+func (a *memoryApprovalStore) insert(approval *Approval) {
+	approval.ID = a.db.id("approval")
+	approval.CreatedAt = time.Now()
+	approval.Version = 1
+	row := *approval
+	row.Reasons = append([]string{}, approval.Reasons...)
+	a.db.approvals[approval.ID] = &row
+}
+
+func (a *memoryApprovalStore) find(match func(*Approval) bool) (*Approval, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	for _, row := range a.db.approvals {
+		if match(row) {
+			approval := *row
+			return &approval, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (a *memoryApprovalStore) Get(ctx context.Context, id int64) (*Approval, error) {
+	return a.find(func(row *Approval) bool { return row.ID == id })
+}
+
+func (a *memoryApprovalStore) GetForBooking(ctx context.Context, bookingID int64) (*Approval, error) {
+	return a.find(func(row *Approval) bool { return row.BookingID == bookingID })
+}
+
+func (a *memoryApprovalStore) List(ctx context.Context, filter ApprovalFilter, filters Filters) ([]*Approval, Metadata, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	approvals := []*Approval{}
+	for _, row := range a.db.approvals {
+		switch {
+		case filter.CompanyID != 0 && row.CompanyID != filter.CompanyID,
+			filter.Status != "" && row.Status != filter.Status:
+			continue
+		}
+		approval := *row
+		approvals = append(approvals, &approval)
+	}
+
+	desc := filters.sortDirection() == "DESC"
+	sort.Slice(approvals, func(i, j int) bool {
+		x, y := approvals[i], approvals[j]
+		if filters.sortColumn() == "amount" && x.Amount != y.Amount {
+			return (x.Amount < y.Amount) != desc
+		}
+		if desc && filters.sortColumn() != "amount" {
+			return x.ID > y.ID
+		}
+		return x.ID < y.ID
+	})
+
+	metadata := calculateMetadata(len(approvals), filters.Page, filters.PageSize)
+	start := filters.offset()
+	if start > len(approvals) {
+		start = len(approvals)
+	}
+	end := start + filters.limit()
+	if end > len(approvals) {
+		end = len(approvals)
+	}
+	return approvals[start:end], metadata, nil
+}
+
+func (a *memoryApprovalStore) Decide(ctx context.Context, approval *Approval, booking *Booking) error {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	// Both are checked before either is saved, as the SQL rolls back.
+	row, ok := a.db.approvals[approval.ID]
+	if !ok || row.Version != approval.Version {
+		return ErrEditConflict
+	}
+	if current, ok := a.db.bookings[booking.ID]; !ok || current.Version != booking.Version {
+		return ErrEditConflict
+	}
+
+	a.update(row, approval)
+	if approval.Status == ApprovalRejected {
+		booking.Cancel("Rejected by the company: "+approval.Note, 0)
+		return a.db.updateBooking(booking)
+	}
+	return nil
+}
+
+func (a *memoryApprovalStore) CancelBooking(ctx context.Context, booking *Booking, reason string, fee int) (*Approval, error) {
+	a.db.mu.Lock()
+	defer a.db.mu.Unlock()
+
+	if current, ok := a.db.bookings[booking.ID]; !ok || current.Version != booking.Version {
+		return nil, ErrEditConflict
+	}
+	booking.Cancel(reason, fee)
+	err := a.db.updateBooking(booking)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range a.db.approvals {
+		if row.BookingID == booking.ID && row.Status == ApprovalPending {
+			row.Status = ApprovalWithdrawn
+			row.Version++
+			approval := *row
+			approval.Reasons = append([]string{}, row.Reasons...)
+			return &approval, nil
+		}
+	}
+	return nil, nil
+}
+
+// update saves the decision on approval to its row. The caller must hold db.mu.
+func (a *memoryApprovalStore) update(row, approval *Approval) {
+	approval.Version++
+	row.Status = approval.Status
+	row.DecidedByID = approval.DecidedByID
+	row.Note = approval.Note
+	row.DecidedAt = approval.DecidedAt
+	row.Version = approval.Version
+}
+
+type memoryPlanStore struct {
+	db *memoryDB
+}
+
+// nameTaken reports whether another plan than id is called name. The caller must
+// hold db.mu.
+func (p *memoryPlanStore) nameTaken(name string, id int64) bool {
+	for _, row := range p.db.plans {
+		if row.Name == name && row.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *memoryPlanStore) Insert(ctx context.Context, plan *Plan) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	if p.nameTaken(plan.Name, 0) {
+		return ErrDuplicatePlanName
+	}
+
+	plan.ID = p.db.id("plan")
+	plan.CreatedAt = time.Now()
+	plan.Version = 1
+	row := *plan
+	p.db.plans[plan.ID] = &row
+	return nil
+}
+
+func (p *memoryPlanStore) Get(ctx context.Context, id int64) (*Plan, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.plans[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	plan := *row
+	return &plan, nil
+}
+
+func (p *memoryPlanStore) List(ctx context.Context) ([]*Plan, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	plans := []*Plan{}
+	for _, row := range p.db.plans {
+		plan := *row
+		plans = append(plans, &plan)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		if plans[i].MonthlyFee != plans[j].MonthlyFee {
+			return plans[i].MonthlyFee < plans[j].MonthlyFee
+		}
+		return plans[i].ID < plans[j].ID
+	})
+	return plans, nil
+}
+
+func (p *memoryPlanStore) Update(ctx context.Context, plan *Plan) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.plans[plan.ID]
+	if !ok || row.Version != plan.Version {
+		return ErrEditConflict
+	}
+	if p.nameTaken(plan.Name, plan.ID) {
+		return ErrDuplicatePlanName
+	}
+
+	plan.Version++
+	stored := *plan
+	p.db.plans[plan.ID] = &stored
+	return nil
+}
+
+func (p *memoryPlanStore) Delete(ctx context.Context, id int64) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	if _, ok := p.db.plans[id]; !ok {
+		return ErrRecordNotFound
+	}
+	for _, sub := range p.db.subscriptions {
+		if sub.PlanID == id {
+			return ErrPlanInUse
+		}
+	}
+	delete(p.db.plans, id)
+	return nil
+}
+
+// subscription returns a copy of a stored subscription with its plan, as read
+// back from the database. The caller must hold db.mu.
+func (p *memoryPlanStore) subscription(row *Subscription) *Subscription {
+	sub := *row
+	plan := *p.db.plans[row.PlanID]
+	sub.Plan = &plan
+	return &sub
+}
+
+func (p *memoryPlanStore) Subscribe(ctx context.Context, sub *Subscription) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	if _, ok := p.db.plans[sub.PlanID]; !ok {
+		return ErrRecordNotFound
+	}
+	for _, row := range p.db.subscriptions {
+		if sub.UserID != 0 && row.UserID == sub.UserID || sub.CompanyID != 0 && row.CompanyID == sub.CompanyID {
+			return ErrDuplicateSubscription
+		}
+	}
+
+	sub.ID = p.db.id("subscription")
+	sub.PeriodStart = sub.RenewsAt.AddDate(0, -1, 0)
+	sub.RequestsUsed = 0
+	sub.CreatedAt = time.Now()
+	sub.Version = 1
+	row := *sub
+	row.Plan = nil
+	p.db.subscriptions[sub.ID] = &row
+	return nil
+}
+
+func (p *memoryPlanStore) GetSubscription(ctx context.Context, userID, companyID int64) (*Subscription, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	for _, row := range p.db.subscriptions {
+		if userID != 0 && row.UserID == userID || userID == 0 && row.CompanyID == companyID {
+			return p.subscription(row), nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (p *memoryPlanStore) GetSubscriptionFor(ctx context.Context, userID, companyID int64) (*Subscription, error) {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	var found *Subscription
+	for _, row := range p.db.subscriptions {
+		switch {
+		case row.UserID == userID:
+			return p.subscription(row), nil
+		case companyID != 0 && row.CompanyID == companyID:
+			found = row
+		}
+	}
+	if found == nil {
+		return nil, ErrRecordNotFound
+	}
+	return p.subscription(found), nil
+}
+
+func (p *memoryPlanStore) UpdateSubscription(ctx context.Context, sub *Subscription) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.subscriptions[sub.ID]
+	if !ok || row.Version != sub.Version {
+		return ErrEditConflict
+	}
+	if _, ok := p.db.plans[sub.PlanID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	row.PlanID = sub.PlanID
+	row.PeriodStart = sub.PeriodStart
+	row.RenewsAt = sub.RenewsAt
+	row.RequestsUsed = sub.RequestsUsed
+	row.Version++
+	sub.Version = row.Version
+	return nil
+}
+
+func (p *memoryPlanStore) Unsubscribe(ctx context.Context, userID, companyID int64) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	for id, row := range p.db.subscriptions {
+		if userID != 0 && row.UserID == userID || userID == 0 && row.CompanyID == companyID {
+			delete(p.db.subscriptions, id)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (p *memoryPlanStore) UseQuota(ctx context.Context, sub *Subscription, now time.Time) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.subscriptions[sub.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	locked := p.subscription(row)
+	locked.Renew(now)
+	if !locked.QuotaLeft() {
+		*sub = *locked
+		return ErrQuotaExceeded
+	}
+
+	row.PeriodStart = locked.PeriodStart
+	row.RenewsAt = locked.RenewsAt
+	row.RequestsUsed = locked.RequestsUsed + 1
+	row.Version++
+	*sub = *p.subscription(row)
+	return nil
+}
+
+func (p *memoryPlanStore) ReleaseQuota(ctx context.Context, sub *Subscription) error {
+	p.db.mu.Lock()
+	defer p.db.mu.Unlock()
+
+	row, ok := p.db.subscriptions[sub.ID]
+	if ok && row.PeriodStart.Equal(sub.PeriodStart) && row.RequestsUsed > 0 {
+		row.RequestsUsed--
+		row.Version++
+	}
+	return nil
+}
+
+type memoryMessageStore struct {
+	db *memoryDB
+}
+
+// copyMessage copies a stored message without the content of its attachments, as
+// List() reads it back.
+func copyMessage(row *Message) *Message {
+	message := *row
+	message.Attachments = []*Attachment{}
+	for _, attachment := range row.Attachments {
+		a := *attachment
+		a.Content = nil
+		message.Attachments = append(message.Attachments, &a)
+	}
+	message.ReadBy = []*ReadReceipt{}
+	for _, receipt := range row.ReadBy {
+		r := *receipt
+		message.ReadBy = append(message.ReadBy, &r)
+	}
+	return &message
+}
+
+func (m *memoryMessageStore) Insert(ctx context.Context, message *Message) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	message.ID = m.db.id("message")
+	message.CreatedAt = time.Now()
+	if message.Attachments == nil {
+		message.Attachments = []*Attachment{}
+	}
+	message.ReadBy = []*ReadReceipt{}
+
+	row := *message
+	row.Attachments = []*Attachment{}
+	for _, attachment := range message.Attachments {
+		attachment.ID = m.db.id("message_attachment")
+		attachment.MessageID = message.ID
+		a := *attachment
+		a.Content = append([]byte{}, attachment.Content...)
+		row.Attachments = append(row.Attachments, &a)
+	}
+	m.db.messages[message.ID] = &row
+	return nil
+}
+
+func (m *memoryMessageStore) List(ctx context.Context, requestID int64, internal bool, cursor MessageCursor) ([]*Message, int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	messages := []*Message{}
+	for _, row := range m.db.messages {
+		if row.RequestID != requestID || row.Internal && !internal || row.ID <= cursor.After {
+			continue
+		}
+		messages = append(messages, copyMessage(row))
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	next := int64(0)
+	if len(messages) > cursor.Limit {
+		messages = messages[:cursor.Limit]
+		next = messages[len(messages)-1].ID
+	}
+	return messages, next, nil
+}
+
+func (m *memoryMessageStore) GetAttachment(ctx context.Context, id int64) (*Attachment, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	for _, message := range m.db.messages {
+		for _, row := range message.Attachments {
+			if row.ID == id {
+				attachment := *row
+				attachment.Content = append([]byte{}, row.Content...)
+				attachment.RequestID = message.RequestID
+				attachment.Internal = message.Internal
+				return &attachment, nil
+			}
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m *memoryMessageStore) MarkRead(ctx context.Context, requestID, userID, upTo int64, internal bool) (int, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	read := 0
+	now := time.Now()
+	for _, message := range m.db.messages {
+		if message.RequestID != requestID || message.ID > upTo || message.AuthorID == userID || message.Internal && !internal {
+			continue
+		}
+		seen := false
+		for _, receipt := range message.ReadBy {
+			if receipt.UserID == userID {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			message.ReadBy = append(message.ReadBy, &ReadReceipt{UserID: userID, ReadAt: now})
+			read++
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+	"github.com/lib/pq"
+)
+
+// Limits on the attachments of a message. They are kept in the database, so they
+// are meant for documents and photos, not videos.
+const (
+	MaxMessageAttachments = 5
+	MaxAttachmentSize     = 5 << 20
+)
+
+// ErasedMessageBody replaces the body of the messages written by an erased user.
+const ErasedMessageBody = "[erased]"
+
+// Message is a message of the thread of a request, written by its client or by
+// the concierge. Internal messages are notes the concierge keeps for itself; the
+// client never sees them. ReadBy lists who has read the message, apart from its
+// author.
+type Message struct {
+	ID          int64          `json:"id"`
+	RequestID   int64          `json:"request_id"`
+	AuthorID    int64          `json:"author_id"`
+	Body        string         `json:"body"`
+	Internal    bool           `json:"internal"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Attachments []*Attachment  `json:"attachments"`
+	ReadBy      []*ReadReceipt `json:"read_by"`
+}
+
+// Attachment is a file attached to a message. Its content is only loaded by
+// GetAttachment(), along with the request and visibility of its message.
+type Attachment struct {
+	ID          int64  `json:"id"`
+	MessageID   int64  `json:"message_id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Content     []byte `json:"-"`
+	RequestID   int64  `json:"-"`
+	Internal    bool   `json:"-"`
+}
+
+// ReadReceipt records when a user first read a message.
+type ReadReceipt struct {
+	UserID int64     `json:"user_id"`
+	ReadAt time.Time `json:"read_at"`
+}
+
+func ValidateMessage(v *validator.Validator, message *Message) {
+	v.Check(strings.TrimSpace(message.Body) != "" || len(message.Attachments) > 0, "body", "must be provided")
+	v.Check(len(message.Body) <= 5000, "body", "must not be more than 5000 bytes long")
+	v.Check(len(message.Attachments) <= MaxMessageAttachments, "attachments", "must not be more than 5 files")
+	for _, attachment := range message.Attachments {
+		v.Check(attachment.Filename != "", "attachments", "must have file names")
+		v.Check(len(attachment.Filename) <= 255, "attachments", "must not have file names more than 255 bytes long")
+		v.Check(attachment.Size > 0, "attachments", "must not be empty")
+		v.Check(attachment.Size <= MaxAttachmentSize, "attachments", "must not be larger than 5 MB each")
+	}
+}
+
+// MessageCursor pages through a thread, oldest message first: a page holds the
+// first Limit messages after the message with ID After, 0 for the beginning of the
+// thread. The ID of the last message of a page is the cursor of the next one.
+type MessageCursor struct {
+	After int64
+	Limit int
+}
+
+func ValidateMessageCursor(v *validator.Validator, c MessageCursor) {
+	v.Check(c.After >= 0, "cursor", "must not be negative")
+	v.Check(c.Limit > 0, "limit", "must be greater than zero")
+	v.Check(c.Limit <= 100, "limit", "must be a maximum of 100")
+}
+
+type MessageModel struct {
+	DB *sql.DB
+}
+
+// Insert posts a message with its attachments.
+func (m MessageModel) Insert(ctx context.Context, message *Message) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+INSERT INTO message (request_id, author_id, body, internal)
+VALUES ($1, $2, $3, $4)
+RETURNING id, created_at`
+	args := []interface{}{message.RequestID, message.AuthorID, message.Body, message.Internal}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&message.ID, &message.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range message.Attachments {
+		query = `
+INSERT INTO message_attachment (message_id, filename, content_type, size, content)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id`
+		args = []interface{}{message.ID, attachment.Filename, attachment.ContentType, attachment.Size, attachment.Content}
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&attachment.ID)
+		if err != nil {
+			return err
+		}
+		attachment.MessageID = message.ID
+	}
+
+	if message.ReadBy == nil {
+		message.ReadBy = []*ReadReceipt{}
+	}
+	if message.Attachments == nil {
+		message.Attachments = []*Attachment{}
+	}
+	return tx.Commit()
+}
+
+// List returns a page of the thread of a request, with the internal messages if
+// internal is true, and the cursor of the next page, 0 if this one is the last.
+func (m MessageModel) List(ctx context.Context, requestID int64, internal bool, cursor MessageCursor) ([]*Message, int64, error) {
+	query := `
+SELECT id, request_id, author_id, body, internal, created_at
+FROM message
+WHERE request_id = $1 AND ($2 OR NOT internal) AND id > $3
+ORDER BY id
+LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	// One more message than asked for tells whether there is a next page.
+	rows, err := m.DB.QueryContext(ctx, query, requestID, internal, cursor.After, cursor.Limit+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	byID := make(map[int64]*Message)
+	ids := []int64{}
+	for rows.Next() {
+		message := Message{Attachments: []*Attachment{}, ReadBy: []*ReadReceipt{}}
+		err := rows.Scan(
+			&message.ID,
+			&message.RequestID,
+			&message.AuthorID,
+			&message.Body,
+			&message.Internal,
+			&message.CreatedAt,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, &message)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	next := int64(0)
+	if len(messages) > cursor.Limit {
+		messages = messages[:cursor.Limit]
+		next = messages[len(messages)-1].ID
+	}
+	for _, message := range messages {
+		byID[message.ID] = message
+		ids = append(ids, message.ID)
+	}
+	if len(ids) == 0 {
+		return messages, next, nil
+	}
+
+	query = `
+SELECT id, message_id, filename, content_type, size
+FROM message_attachment
+WHERE message_id = ANY($1)
+ORDER BY id`
+	rows, err = m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attachment Attachment
+		err := rows.Scan(&attachment.ID, &attachment.MessageID, &attachment.Filename, &attachment.ContentType, &attachment.Size)
+		if err != nil {
+			return nil, 0, err
+		}
+		message := byID[attachment.MessageID]
+		message.Attachments = append(message.Attachments, &attachment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	query = `
+SELECT message_id, user_id, read_at
+FROM message_read
+WHERE message_id = ANY($1)
+ORDER BY read_at, user_id`
+	rows, err = m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int64
+		var receipt ReadReceipt
+		err := rows.Scan(&messageID, &receipt.UserID, &receipt.ReadAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		message := byID[messageID]
+		message.ReadBy = append(message.ReadBy, &receipt)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return messages, next, nil
+}
+
+// GetAttachment returns an attachment with its content.
+func (m MessageModel) GetAttachment(ctx context.Context, id int64) (*Attachment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+SELECT a.id, a.message_id, a.filename, a.content_type, a.size, a.content, m.request_id, m.internal
+FROM message_attachment a
+INNER JOIN message m ON m.id = a.message_id
+WHERE a.id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var attachment Attachment
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&attachment.ID,
+		&attachment.MessageID,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.Content,
+		&attachment.RequestID,
+		&attachment.Internal,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &attachment, nil
+}
+
+// MarkRead records that a user has read the thread of a request up to the message
+// with ID upTo, internal messages included if internal is true. Their own messages
+// and the messages they had read already are left alone. It returns how many
+// messages were newly read.
+func (m MessageModel) MarkRead(ctx context.Context, requestID, userID, upTo int64, internal bool) (int, error) {
+	query := `
+INSERT INTO message_read (message_id, user_id)
+SELECT id, $2
+FROM message
+WHERE request_id = $1 AND id <= $3 AND author_id <> $2 AND ($4 OR NOT internal)
+ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, requestID, userID, upTo, internal)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
@@ -1,10 +1,26 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
+// defaultTimeout is the deadline applied to every query on top of whatever deadline
+// the caller's context already carries. The caller's context (usually the HTTP
+// request context) still wins if it is cancelled first, e.g. when the client
+// disconnects or the server is shutting down.
+const defaultTimeout = 3 * time.Second
+
+// queryer is what *sql.DB and *sql.Tx have in common, so that a query can be
+// written once for models to run on their own and inside a transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
 // looking up a movie that doesn't exist in our database.
 var (
@@ -12,26 +28,231 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// The store interfaces below describe everything the handlers need from the data
+// layer. The PostgreSQL-backed *Model types implement them for production, and the
+// in-memory stores returned by NewMemoryModels() implement them for tests.
+
+type ServiceStore interface {
+	SoftDeleteStore
+	Insert(ctx context.Context, service *Service) error
+	GetById(ctx context.Context, id int64) (*Service, error)
+	GetAllForCompany(ctx context.Context, companyID int64) ([]*Service, error)
+	Update(ctx context.Context, service *Service) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type PriceStore interface {
+	SoftDeleteStore
+	Insert(ctx context.Context, price *Price) error
+	Get(ctx context.Context, id int64) (*Price, error)
+	GetByServiceId(ctx context.Context, serviceID int64) ([]*Price, error)
+	Update(ctx context.Context, price *Price) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type CompanyStore interface {
+	SoftDeleteStore
+	Exists(ctx context.Context, id int) error
+	Insert(ctx context.Context, company *Company) error
+	GetById(ctx context.Context, id int64) (*Company, error)
+	Update(ctx context.Context, company *Company) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type UserStore interface {
+	SoftDeleteStore
+	Insert(ctx context.Context, user *User) error
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	GetAll(ctx context.Context) ([]*User, error)
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, id int64) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	Get(ctx context.Context, id int64) (*User, error)
+	List(ctx context.Context, filter UserFilter, filters Filters) ([]*User, Metadata, error)
+}
+
+type RegFormStore interface {
+	SoftDeleteStore
+	Insert(ctx context.Context, regForm *RegForm) error
+	GetByDateAsc(ctx context.Context) ([]*RegForm, error)
+}
+
+type TokenStore interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+}
+
+type PermissionStore interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+}
+
+type RequestStore interface {
+	SoftDeleteStore
+	Insert(ctx context.Context, request *Request) error
+	GetByRequestID(ctx context.Context, id int64) (*Request, error)
+	GetAllForClient(ctx context.Context, clientID int64) ([]*Request, error)
+	Update(ctx context.Context, request *Request) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type BookingStore interface {
+	Insert(ctx context.Context, booking *Booking) error
+	Get(ctx context.Context, id int64) (*Booking, error)
+	Update(ctx context.Context, booking *Booking) error
+	List(ctx context.Context, filter BookingFilter, filters Filters) ([]*Booking, Metadata, error)
+}
+
+type ServiceChangeStore interface {
+	Insert(ctx context.Context, change *ServiceChange) error
+	Get(ctx context.Context, id int64) (*ServiceChange, error)
+	Update(ctx context.Context, change *ServiceChange) error
+	List(ctx context.Context, filter ServiceChangeFilter, filters Filters) ([]*ServiceChange, Metadata, error)
+}
+
+type AvailabilityStore interface {
+	GetSchedule(ctx context.Context, serviceID int64) (*Schedule, error)
+	SetSchedule(ctx context.Context, schedule *Schedule) error
+	Reservations(ctx context.Context, serviceID int64, from, to time.Time) ([]*SlotReservation, error)
+	Reserve(ctx context.Context, serviceID int64, slot Slot, units int) (*SlotReservation, error)
+	Release(ctx context.Context, id int64) error
+}
+
+type InvoiceStore interface {
+	BillableCompanies(ctx context.Context, end time.Time) ([]int64, error)
+	Generate(ctx context.Context, companyID int64, period string) (*Invoice, error)
+	Get(ctx context.Context, id int64) (*Invoice, error)
+	List(ctx context.Context, filter InvoiceFilter, filters Filters) ([]*Invoice, Metadata, error)
+	Issue(ctx context.Context, invoice *Invoice, dueAt time.Time) error
+	Update(ctx context.Context, invoice *Invoice) error
+	MarkOverdue(ctx context.Context, now time.Time) ([]int64, error)
+}
+
+type PaymentStore interface {
+	Insert(ctx context.Context, payment *Payment) error
+	Get(ctx context.Context, id int64) (*Payment, error)
+	GetByIdempotencyKey(ctx context.Context, userID int64, key string) (*Payment, error)
+	GetByProviderRef(ctx context.Context, provider, ref string) (*Payment, error)
+	List(ctx context.Context, filter PaymentFilter, filters Filters) ([]*Payment, Metadata, error)
+	Update(ctx context.Context, payment *Payment) error
+	GetRefund(ctx context.Context, paymentID int64, key string) (*PaymentRefund, error)
+	Refund(ctx context.Context, refund *PaymentRefund, refundedTotal int, status string) (*Payment, error)
+	EventSeen(ctx context.Context, provider, eventID string) (bool, error)
+	RecordEvent(ctx context.Context, provider, eventID string) error
+}
+
+type LedgerStore interface {
+	Open(ctx context.Context, account *Account) error
+	GetAccount(ctx context.Context, id int64) (*Account, error)
+	GetAccountFor(ctx context.Context, userID, companyID int64) (*Account, error)
+	ListAccounts(ctx context.Context, filter AccountFilter, filters Filters) ([]*Account, Metadata, error)
+	Post(ctx context.Context, txn *LedgerTransaction) error
+	GetTransaction(ctx context.Context, accountID int64, key string) (*LedgerTransaction, error)
+	BookingDebited(ctx context.Context, bookingID int64) (bool, error)
+	Statement(ctx context.Context, accountID int64, from, to time.Time) (*Statement, error)
+}
+
+type ApprovalStore interface {
+	Controls(ctx context.Context, companyID int64) (*SpendingControls, error)
+	SetControls(ctx context.Context, controls *SpendingControls) error
+	Spent(ctx context.Context, companyID, userID int64, from, to time.Time) (int, error)
+	InsertBooking(ctx context.Context, client *User, booking *Booking) (*Approval, error)
+	Insert(ctx context.Context, approval *Approval) error
+	Get(ctx context.Context, id int64) (*Approval, error)
+	GetForBooking(ctx context.Context, bookingID int64) (*Approval, error)
+	List(ctx context.Context, filter ApprovalFilter, filters Filters) ([]*Approval, Metadata, error)
+	Decide(ctx context.Context, approval *Approval, booking *Booking) error
+	CancelBooking(ctx context.Context, booking *Booking, reason string, fee int) (*Approval, error)
+}
+
+type PlanStore interface {
+	Insert(ctx context.Context, plan *Plan) error
+	Get(ctx context.Context, id int64) (*Plan, error)
+	List(ctx context.Context) ([]*Plan, error)
+	Update(ctx context.Context, plan *Plan) error
+	Delete(ctx context.Context, id int64) error
+	Subscribe(ctx context.Context, sub *Subscription) error
+	GetSubscription(ctx context.Context, userID, companyID int64) (*Subscription, error)
+	GetSubscriptionFor(ctx context.Context, userID, companyID int64) (*Subscription, error)
+	UpdateSubscription(ctx context.Context, sub *Subscription) error
+	Unsubscribe(ctx context.Context, userID, companyID int64) error
+	UseQuota(ctx context.Context, sub *Subscription, now time.Time) error
+	ReleaseQuota(ctx context.Context, sub *Subscription) error
+}
+
+type MessageStore interface {
+	Insert(ctx context.Context, message *Message) error
+	List(ctx context.Context, requestID int64, internal bool, cursor MessageCursor) ([]*Message, int64, error)
+	GetAttachment(ctx context.Context, id int64) (*Attachment, error)
+	MarkRead(ctx context.Context, requestID, userID, upTo int64, internal bool) (int, error)
+}
+
+type AuditStore interface {
+	Insert(ctx context.Context, entry *AuditEntry) error
+	List(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error)
+}
+
+type PersonalDataStore interface {
+	Export(ctx context.Context, userID int64) (*PersonalData, error)
+	Erase(ctx context.Context, userID int64) error
+}
+
+type SystemStore interface {
+	Stats() sql.DBStats
+	Ping(ctx context.Context) error
+	MigrationVersion(ctx context.Context) (int64, bool, error)
+}
+
 type Models struct {
-	Service     ServiceModel
-	Price       PriceModel
-	Company     CompanyModel
-	User        UserModel
-	RegForm     RegFormModel
-	Token       TokenModel
-	Permissions PermissionModel
-	Request     RequestModel
-}
-
-func NewModels(db *sql.DB) Models {
-	return Models{
-		Service:     ServiceModel{DB: db},
-		Price:       PriceModel{DB: db},
-		Company:     CompanyModel{DB: db},
-		User:        UserModel{DB: db},
-		RegForm:     RegFormModel{DB: db},
-		Token:       TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Request:     RequestModel{DB: db},
-	}
+	Service       ServiceStore
+	Price         PriceStore
+	Company       CompanyStore
+	User          UserStore
+	RegForm       RegFormStore
+	Token         TokenStore
+	Permissions   PermissionStore
+	Request       RequestStore
+	Booking       BookingStore
+	ServiceChange ServiceChangeStore
+	Availability  AvailabilityStore
+	Invoice       InvoiceStore
+	Payment       PaymentStore
+	Ledger        LedgerStore
+	Approval      ApprovalStore
+	Plan          PlanStore
+	Message       MessageStore
+	Audit         AuditStore
+	PersonalData  PersonalDataStore
+	System        SystemStore
+}
+
+// NewModels returns the PostgreSQL-backed stores. Changes made through the Service,
+// Price, Company, User, RegForm, Request, Booking, ServiceChange, Invoice, Payment,
+// Ledger, Approval, Plan and Message stores and to service schedules are recorded
+// in the audit log, on a best effort basis (see withBestEffortAudit()); entries
+// that can't be written are reported to logger.
+func NewModels(db *sql.DB, logger ErrorLogger) Models {
+	return withBestEffortAudit(Models{
+		Service:       &ServiceModel{DB: db},
+		Price:         &PriceModel{DB: db},
+		Company:       &CompanyModel{DB: db},
+		User:          UserModel{DB: db},
+		RegForm:       &RegFormModel{DB: db},
+		Token:         TokenModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Request:       RequestModel{DB: db},
+		Booking:       BookingModel{DB: db},
+		ServiceChange: ServiceChangeModel{DB: db},
+		Availability:  AvailabilityModel{DB: db},
+		Invoice:       InvoiceModel{DB: db},
+		Payment:       PaymentModel{DB: db},
+		Ledger:        LedgerModel{DB: db},
+		Approval:      ApprovalModel{DB: db},
+		Plan:          PlanModel{DB: db},
+		Message:       MessageModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		PersonalData:  PersonalDataModel{DB: db},
+		System:        SystemModel{DB: db},
+	}, logger)
 }
@@ -0,0 +1,405 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDuplicateIdempotencyKey is returned when a payment or refund is recorded
+	// with an idempotency key that has already been used for one.
+	ErrDuplicateIdempotencyKey = errors.New("duplicate idempotency key")
+	// ErrBookingPaid is returned when recording a payment for a booking that
+	// already has one authorized or captured.
+	ErrBookingPaid = errors.New("the booking has already been paid")
+)
+
+// Payments are authorized when the client pays, which holds the money on their
+// card, and captured later on. Declined payments are recorded as failed, so that
+// retrying with the same idempotency key gives the same answer.
+const (
+	PaymentAuthorized = "authorized"
+	PaymentCaptured   = "captured"
+	PaymentRefunded   = "refunded"
+	PaymentVoided     = "voided"
+	PaymentFailed     = "failed"
+)
+
+var PaymentStatuses = []string{PaymentAuthorized, PaymentCaptured, PaymentRefunded, PaymentVoided, PaymentFailed}
+
+// paymentStage orders the statuses: a payment only ever moves to a later stage,
+// so that webhooks delivered out of order can't take it back.
+var paymentStage = map[string]int{
+	PaymentAuthorized: 1,
+	PaymentCaptured:   2,
+	PaymentRefunded:   3,
+	PaymentVoided:     3,
+	PaymentFailed:     3,
+}
+
+// Payment is a client paying for a booking through a payment processor. Provider
+// names the processor and ProviderRef is its ID of the payment. Refunded is the
+// total refunded so far; the payment is refunded once all of it is.
+type Payment struct {
+	ID             int64     `json:"id"`
+	BookingID      int64     `json:"booking_id"`
+	UserID         int64     `json:"user_id"`
+	Amount         int       `json:"amount"`
+	Refunded       int       `json:"refunded"`
+	Currency       string    `json:"currency"`
+	Status         string    `json:"status"`
+	Provider       string    `json:"provider"`
+	ProviderRef    string    `json:"provider_ref"`
+	DeclineReason  string    `json:"decline_reason,omitempty"`
+	IdempotencyKey string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      NullTime  `json:"updated_at"`
+	Version        int32     `json:"version"`
+}
+
+// PaymentRefund is one refund of a payment.
+type PaymentRefund struct {
+	ID             int64     `json:"id"`
+	PaymentID      int64     `json:"payment_id"`
+	Amount         int       `json:"amount"`
+	IdempotencyKey string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Move moves the payment on to status, reporting whether it did: payments never
+// go back to an earlier status.
+func (p *Payment) Move(status string) bool {
+	if paymentStage[status] <= paymentStage[p.Status] {
+		return false
+	}
+	p.Status = status
+	return true
+}
+
+// Refundable is what can still be refunded.
+func (p *Payment) Refundable() int {
+	return p.Amount - p.Refunded
+}
+
+// ValidateIdempotencyKey checks the key a client sends in the Idempotency-Key
+// header, which is typically a UUID.
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(key != "", "idempotency_key", "must be provided in the Idempotency-Key header")
+	v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+}
+
+// PaymentFilter narrows down the payments returned by List(). Zero values mean
+// "don't filter on this field".
+type PaymentFilter struct {
+	BookingID int64
+	UserID    int64
+	Status    string
+}
+
+func ValidatePaymentFilter(v *validator.Validator, f PaymentFilter) {
+	if f.Status != "" {
+		v.Check(validator.In(f.Status, PaymentStatuses...), "status", "invalid status")
+	}
+}
+
+// PaymentSortSafelist lists the values accepted for the sort parameter of List().
+var PaymentSortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+type PaymentModel struct {
+	DB *sql.DB
+}
+
+// paymentInsertError turns the unique violations an insert can run into into the
+// errors the callers check for.
+func paymentInsertError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+		switch pqErr.Constraint {
+		case "payment_idempotency_key", "payment_refund_idempotency_key":
+			return ErrDuplicateIdempotencyKey
+		case "payment_booking_paid":
+			return ErrBookingPaid
+		}
+	}
+	return err
+}
+
+// Insert records a payment. It fails with ErrDuplicateIdempotencyKey if the user
+// already made a payment with the same key, and with ErrBookingPaid if the booking
+// is already paid.
+func (m PaymentModel) Insert(ctx context.Context, payment *Payment) error {
+	query := `
+INSERT INTO payment (booking_id, user_id, amount, currency, status, provider, provider_ref, decline_reason, idempotency_key)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+RETURNING id, created_at, version`
+	args := []interface{}{
+		payment.BookingID,
+		payment.UserID,
+		payment.Amount,
+		payment.Currency,
+		payment.Status,
+		payment.Provider,
+		payment.ProviderRef,
+		payment.DeclineReason,
+		payment.IdempotencyKey,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&payment.ID, &payment.CreatedAt, &payment.Version)
+	if err != nil {
+		return paymentInsertError(err)
+	}
+	return nil
+}
+
+const paymentColumns = `id, booking_id, user_id, amount, refunded, currency, status, provider, provider_ref, decline_reason,
+idempotency_key, created_at, updated_at, version`
+
+func scanPayment(row interface{ Scan(...interface{}) error }, payment *Payment) error {
+	return row.Scan(
+		&payment.ID,
+		&payment.BookingID,
+		&payment.UserID,
+		&payment.Amount,
+		&payment.Refunded,
+		&payment.Currency,
+		&payment.Status,
+		&payment.Provider,
+		&payment.ProviderRef,
+		&payment.DeclineReason,
+		&payment.IdempotencyKey,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+		&payment.Version,
+	)
+}
+
+func (m PaymentModel) getWhere(ctx context.Context, where string, args ...interface{}) (*Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payment WHERE ` + where
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var payment Payment
+	err := scanPayment(m.DB.QueryRowContext(ctx, query, args...), &payment)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &payment, nil
+}
+
+func (m PaymentModel) Get(ctx context.Context, id int64) (*Payment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	return m.getWhere(ctx, `id = $1`, id)
+}
+
+// GetByIdempotencyKey returns the payment a user made with an idempotency key.
+func (m PaymentModel) GetByIdempotencyKey(ctx context.Context, userID int64, key string) (*Payment, error) {
+	return m.getWhere(ctx, `user_id = $1 AND idempotency_key = $2`, userID, key)
+}
+
+// GetByProviderRef returns the payment a processor knows by ref.
+func (m PaymentModel) GetByProviderRef(ctx context.Context, provider, ref string) (*Payment, error) {
+	return m.getWhere(ctx, `provider = $1 AND provider_ref = $2`, provider, ref)
+}
+
+func (m PaymentModel) List(ctx context.Context, filter PaymentFilter, filters Filters) ([]*Payment, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), %s
+FROM payment
+WHERE ($1 = 0 OR booking_id = $1)
+AND ($2 = 0 OR user_id = $2)
+AND ($3 = '' OR status = $3)
+ORDER BY %s %s, id ASC
+LIMIT $4 OFFSET $5`, paymentColumns, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{filter.BookingID, filter.UserID, filter.Status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	payments := []*Payment{}
+
+	for rows.Next() {
+		var payment Payment
+		err := rows.Scan(
+			&totalRecords,
+			&payment.ID,
+			&payment.BookingID,
+			&payment.UserID,
+			&payment.Amount,
+			&payment.Refunded,
+			&payment.Currency,
+			&payment.Status,
+			&payment.Provider,
+			&payment.ProviderRef,
+			&payment.DeclineReason,
+			&payment.IdempotencyKey,
+			&payment.CreatedAt,
+			&payment.UpdatedAt,
+			&payment.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		payments = append(payments, &payment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return payments, metadata, nil
+}
+
+// Update saves the status of a payment. It fails with ErrEditConflict if the
+// payment was changed since it was read.
+func (m PaymentModel) Update(ctx context.Context, payment *Payment) error {
+	query := `
+UPDATE payment
+SET status = $1, refunded = $2, decline_reason = $3, updated_at = NOW(), version = version + 1
+WHERE id = $4 AND version = $5
+RETURNING updated_at, version`
+	args := []interface{}{payment.Status, payment.Refunded, payment.DeclineReason, payment.ID, payment.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&payment.UpdatedAt, &payment.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRefund returns the refund of a payment made with an idempotency key.
+func (m PaymentModel) GetRefund(ctx context.Context, paymentID int64, key string) (*PaymentRefund, error) {
+	query := `
+SELECT id, payment_id, amount, idempotency_key, created_at
+FROM payment_refund
+WHERE payment_id = $1 AND idempotency_key = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var refund PaymentRefund
+	err := m.DB.QueryRowContext(ctx, query, paymentID, key).Scan(
+		&refund.ID,
+		&refund.PaymentID,
+		&refund.Amount,
+		&refund.IdempotencyKey,
+		&refund.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &refund, nil
+}
+
+// Refund records a refund made at the processor and returns the refunded payment,
+// which moves on to status unless a webhook already took it further.
+// refundedTotal is the total the processor reports as refunded: it is the one
+// source of truth, as refunds can also be made from the processor's dashboard and
+// reported by webhooks before or after this is called. The refund fails with
+// ErrDuplicateIdempotencyKey if it was already recorded.
+func (m PaymentModel) Refund(ctx context.Context, refund *PaymentRefund, refundedTotal int, status string) (*Payment, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+INSERT INTO payment_refund (payment_id, amount, idempotency_key)
+VALUES ($1, $2, $3)
+RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, query, refund.PaymentID, refund.Amount, refund.IdempotencyKey).Scan(&refund.ID, &refund.CreatedAt)
+	if err != nil {
+		return nil, paymentInsertError(err)
+	}
+
+	query = `
+UPDATE payment
+SET refunded = GREATEST(refunded, $1),
+status = CASE WHEN status IN ('refunded', 'voided', 'failed') THEN status ELSE $2 END,
+updated_at = NOW(), version = version + 1
+WHERE id = $3
+RETURNING ` + paymentColumns
+	var payment Payment
+	err = scanPayment(tx.QueryRowContext(ctx, query, refundedTotal, status, refund.PaymentID), &payment)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// EventSeen reports whether a webhook event of a processor has been handled.
+func (m PaymentModel) EventSeen(ctx context.Context, provider, eventID string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM payment_event WHERE provider = $1 AND event_id = $2)`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var seen bool
+	err := m.DB.QueryRowContext(ctx, query, provider, eventID).Scan(&seen)
+	return seen, err
+}
+
+// RecordEvent records that a webhook event of a processor has been handled.
+func (m PaymentModel) RecordEvent(ctx context.Context, provider, eventID string) error {
+	query := `
+INSERT INTO payment_event (provider, event_id)
+VALUES ($1, $2)
+ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, provider, eventID)
+	return err
+}
@@ -0,0 +1,497 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PersonalData is everything we hold about one user, as returned by a data export.
+// The attachments of the messages come with their content, which is left out of
+// the JSON encoding.
+type PersonalData struct {
+	ExportedAt    time.Time        `json:"exported_at"`
+	User          *User            `json:"user"`
+	Requests      []*Request       `json:"requests"`
+	Messages      []*Message       `json:"messages"`
+	Bookings      []*Booking       `json:"bookings"`
+	Payments      []*Payment       `json:"payments"`
+	Refunds       []*PaymentRefund `json:"refunds"`
+	Accounts      []*Account       `json:"accounts"`
+	Statements    []*Statement     `json:"statements"`
+	Subscriptions []*Subscription  `json:"subscriptions"`
+	Approvals     []*Approval      `json:"approvals"`
+	Tokens        []TokenSummary   `json:"tokens"`
+	RegForms      []*RegForm       `json:"registration_forms"`
+	AuditLog      []*AuditEntry    `json:"audit_log"`
+}
+
+// newPersonalData returns an empty export of user.
+func newPersonalData(user *User) *PersonalData {
+	return &PersonalData{
+		ExportedAt:    time.Now(),
+		User:          user,
+		Requests:      []*Request{},
+		Messages:      []*Message{},
+		Bookings:      []*Booking{},
+		Payments:      []*Payment{},
+		Refunds:       []*PaymentRefund{},
+		Accounts:      []*Account{},
+		Statements:    []*Statement{},
+		Subscriptions: []*Subscription{},
+		Approvals:     []*Approval{},
+		Tokens:        []TokenSummary{},
+		RegForms:      []*RegForm{},
+		AuditLog:      []*AuditEntry{},
+	}
+}
+
+// statementPeriod is the period the statement of an account covers in an export:
+// every day from the one it was opened on to the one of the export.
+func statementPeriod(account *Account, exportedAt time.Time) (from, to time.Time) {
+	return account.CreatedAt.Truncate(24 * time.Hour), exportedAt.Truncate(24*time.Hour).AddDate(0, 0, 1)
+}
+
+// TokenSummary describes a token without revealing it.
+type TokenSummary struct {
+	Scope  string    `json:"scope"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// ErasedRequestDescription replaces the description of an erased user's requests.
+const ErasedRequestDescription = "[erased]"
+
+// ErasedNote replaces the free-text notes and reasons left on an erased user's
+// bookings, approvals and deposit.
+const ErasedNote = "[erased]"
+
+// erasedEmail and erasedUsername are unique per user, so the anonymized row still
+// satisfies the unique constraints on users.
+func erasedEmail(userID int64) string {
+	return fmt.Sprintf("erased-%d@erased.invalid", userID)
+}
+
+func erasedUsername(userID int64) string {
+	return fmt.Sprintf("erased-%d", userID)
+}
+
+// randomPasswordHash returns the hash of a random password nobody knows, so that an
+// erased account can't be logged into.
+func randomPasswordHash() ([]byte, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword(randomBytes, 12)
+}
+
+// ownEntities matches the audit entries about the rows holding the personal data of
+// the user $1 with email address $2: the user, their requests and their bookings,
+// the messages they wrote, the registration forms sent from their email address,
+// their payments, deposit, deposit transactions and subscription, and the
+// approvals they asked for or decided.
+const ownEntities = `((entity_type = 'user' AND entity_id = $1)
+	OR (entity_type = 'request' AND entity_id IN (SELECT id FROM request WHERE client_id = $1))
+	OR (entity_type = 'booking' AND entity_id IN (SELECT booking.id FROM booking
+		INNER JOIN request ON request.id = booking.request_id WHERE request.client_id = $1))
+	OR (entity_type = 'message' AND entity_id IN (SELECT id FROM message WHERE author_id = $1))
+	OR (entity_type = 'reg_form' AND entity_id IN (SELECT id FROM RegForm WHERE lower(email) = lower($2)))
+	OR (entity_type = 'payment' AND entity_id IN (SELECT id FROM payment WHERE user_id = $1))
+	OR (entity_type = 'account' AND entity_id IN (SELECT id FROM account WHERE user_id = $1))
+	OR (entity_type = 'ledger_transaction' AND entity_id IN (SELECT t.id FROM ledger_transaction t
+		INNER JOIN account ON account.id = t.account_id WHERE account.user_id = $1))
+	OR (entity_type = 'subscription' AND entity_id IN (SELECT id FROM subscription WHERE user_id = $1))
+	OR (entity_type = 'approval' AND entity_id IN (SELECT id FROM approval WHERE requested_by_id = $1 OR decided_by_id = $1)))`
+
+type PersonalDataModel struct {
+	DB *sql.DB
+}
+
+// Export collects the rows of every table that hold data about the user, soft
+// deleted ones included: the user, their requests and the bookings made for them,
+// the messages they wrote with their attachments, their payments and refunds,
+// their deposit and its statement, their subscription, the approvals they asked
+// for or decided, tokens, the registration forms sent from their email address,
+// and the audit entries about them or made by them.
+func (m PersonalDataModel) Export(ctx context.Context, userID int64) (*PersonalData, error) {
+	user, err := UserModel{DB: m.DB}.Get(ContextWithDeleted(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	export := newPersonalData(user)
+
+	rows, err := m.DB.QueryContext(ctx, `
+SELECT id, client_id, type, description, status, COALESCE(assignee_id, 0), created_at, respond_by, deleted_at, updated_at
+FROM request
+WHERE client_id = $1
+ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var request Request
+		err := rows.Scan(&request.ID, &request.ClientID, &request.Type, &request.Description, &request.Status,
+			&request.AssigneeID, &request.CreatedAt, &request.RespondBy, &request.DeletedAt, &request.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		export.Requests = append(export.Requests, &request)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT id, request_id, author_id, body, internal, created_at
+FROM message
+WHERE author_id = $1
+ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		message := Message{Attachments: []*Attachment{}, ReadBy: []*ReadReceipt{}}
+		err := rows.Scan(&message.ID, &message.RequestID, &message.AuthorID, &message.Body, &message.Internal, &message.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		export.Messages = append(export.Messages, &message)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT a.id, a.message_id, a.filename, a.content_type, a.size, a.content
+FROM message_attachment a
+INNER JOIN message ON message.id = a.message_id
+WHERE message.author_id = $1
+ORDER BY a.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make(map[int64]*Message, len(export.Messages))
+	for _, message := range export.Messages {
+		messages[message.ID] = message
+	}
+	for rows.Next() {
+		var attachment Attachment
+		err := rows.Scan(&attachment.ID, &attachment.MessageID, &attachment.Filename, &attachment.ContentType,
+			&attachment.Size, &attachment.Content)
+		if err != nil {
+			return nil, err
+		}
+		message := messages[attachment.MessageID]
+		message.Attachments = append(message.Attachments, &attachment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT `+bookingColumns+`
+FROM booking
+WHERE request_id IN (SELECT id FROM request WHERE client_id = $1)
+ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var booking Booking
+		err := scanBooking(rows, &booking)
+		if err != nil {
+			return nil, err
+		}
+		export.Bookings = append(export.Bookings, &booking)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT `+paymentColumns+`
+FROM payment
+WHERE user_id = $1
+ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var payment Payment
+		err := scanPayment(rows, &payment)
+		if err != nil {
+			return nil, err
+		}
+		export.Payments = append(export.Payments, &payment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT r.id, r.payment_id, r.amount, r.idempotency_key, r.created_at
+FROM payment_refund r
+INNER JOIN payment ON payment.id = r.payment_id
+WHERE payment.user_id = $1
+ORDER BY r.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var refund PaymentRefund
+		err := rows.Scan(&refund.ID, &refund.PaymentID, &refund.Amount, &refund.IdempotencyKey, &refund.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		export.Refunds = append(export.Refunds, &refund)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only the user's own deposit: that of their company is the company's.
+	ledger := LedgerModel{DB: m.DB}
+	account, err := ledger.getAccountWhere(ctx, `kind = 'deposit' AND user_id = $1`, userID)
+	switch {
+	case errors.Is(err, ErrRecordNotFound):
+	case err != nil:
+		return nil, err
+	default:
+		from, to := statementPeriod(account, export.ExportedAt)
+		statement, err := ledger.Statement(ctx, account.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		export.Accounts = append(export.Accounts, account)
+		export.Statements = append(export.Statements, statement)
+	}
+
+	// A company's subscription is the company's.
+	sub, err := PlanModel{DB: m.DB}.getSubscriptionWhere(ctx, `s.user_id = $1`, userID)
+	switch {
+	case errors.Is(err, ErrRecordNotFound):
+	case err != nil:
+		return nil, err
+	default:
+		export.Subscriptions = append(export.Subscriptions, sub)
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT `+approvalColumns+`
+FROM approval
+WHERE requested_by_id = $1 OR decided_by_id = $1
+ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var approval Approval
+		err := scanApproval(rows, &approval)
+		if err != nil {
+			return nil, err
+		}
+		export.Approvals = append(export.Approvals, &approval)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT scope, expiry
+FROM tokens
+WHERE user_id = $1
+ORDER BY expiry`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token TokenSummary
+		err := rows.Scan(&token.Scope, &token.Expiry)
+		if err != nil {
+			return nil, err
+		}
+		export.Tokens = append(export.Tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+SELECT id, company_name, email, phone_number, created_at, deleted_at
+FROM RegForm
+WHERE lower(email) = lower($1)
+ORDER BY id`, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var form RegForm
+		err := rows.Scan(&form.ID, &form.CompanyName, &form.Email, &form.PhoneNumber, &form.CreatedAt, &form.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		export.RegForms = append(export.RegForms, &form)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Changes the user made to other people's rows are listed without their values,
+	// which are those people's personal data.
+	rows, err = m.DB.QueryContext(ctx, `
+WITH own AS (
+	SELECT id,
+		`+ownEntities+` AS about_user
+	FROM audit_log
+)
+SELECT audit_log.id, COALESCE(actor_id, 0), action, entity_type, entity_id,
+	CASE WHEN own.about_user THEN changes ELSE '{}' END, ip, request_id, created_at
+FROM audit_log
+INNER JOIN own ON own.id = audit_log.id
+WHERE actor_id = $1 OR own.about_user
+ORDER BY audit_log.id`, userID, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+		err := rows.Scan(&entry.ID, &entry.ActorID, &entry.Action, &entry.EntityType, &entry.EntityID,
+			&changes, &entry.IP, &entry.RequestID, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.Changes = changes
+		export.AuditLog = append(export.AuditLog, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// Erase anonymizes the user's personal data in a single transaction while keeping
+// every row, so that requests and financial records still add up:
+//
+//   - the user's name, email, username and preferences are replaced, the password
+//     is reset to a random one, and the account is deactivated and soft deleted;
+//   - their requests keep their type and status but lose their description;
+//   - the messages they wrote stay in their threads but lose their body and
+//     attachments;
+//   - the bookings made for them lose their cancellation reason and partner note,
+//     the approvals they asked for or decided lose their note, and the
+//     transactions of their deposit lose their note;
+//   - their tokens are deleted;
+//   - registration forms sent from their email address lose the email and phone;
+//   - audit entries about any of the rows above lose their before/after values,
+//     and the entries they made lose the IP address.
+func (m PersonalDataModel) Erase(ctx context.Context, userID int64) error {
+	hash, err := randomPasswordHash()
+	if err != nil {
+		return err
+	}
+	preferences := DefaultPreferences()
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRowContext(ctx, `SELECT email FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`
+UPDATE users
+SET first_name = '', last_name = '', email = $2, username = $3, password_hash = $4, activated = false,
+	preferences = $5, deleted_at = COALESCE(deleted_at, NOW()), updated_at = NOW()
+WHERE id = $1`, []interface{}{userID, erasedEmail(userID), erasedUsername(userID), hash, preferences}},
+		{`
+UPDATE request
+SET description = $2, updated_at = NOW()
+WHERE client_id = $1`, []interface{}{userID, ErasedRequestDescription}},
+		{`
+UPDATE message
+SET body = $2
+WHERE author_id = $1`, []interface{}{userID, ErasedMessageBody}},
+		{`
+DELETE FROM message_attachment
+WHERE message_id IN (SELECT id FROM message WHERE author_id = $1)`, []interface{}{userID}},
+		{`
+UPDATE booking
+SET cancel_reason = CASE WHEN cancel_reason = '' THEN '' ELSE $2 END,
+	partner_note = CASE WHEN partner_note = '' THEN '' ELSE $2 END,
+	updated_at = NOW(), version = version + 1
+WHERE request_id IN (SELECT id FROM request WHERE client_id = $1)
+AND (cancel_reason <> '' OR partner_note <> '')`, []interface{}{userID, ErasedNote}},
+		{`
+UPDATE approval
+SET note = $2, version = version + 1
+WHERE (requested_by_id = $1 OR decided_by_id = $1) AND note <> ''`, []interface{}{userID, ErasedNote}},
+		{`
+UPDATE ledger_transaction
+SET note = $2
+WHERE account_id IN (SELECT id FROM account WHERE user_id = $1) AND note <> ''`, []interface{}{userID, ErasedNote}},
+		{`
+DELETE FROM tokens
+WHERE user_id = $1`, []interface{}{userID}},
+		// Before the forms lose the email address they are found by.
+		{`
+UPDATE audit_log
+SET changes = '{}'
+WHERE ` + ownEntities, []interface{}{userID, email}},
+		{`
+UPDATE RegForm
+SET email = $2, phone_number = ''
+WHERE lower(email) = lower($1)`, []interface{}{email, erasedEmail(userID)}},
+		{`
+UPDATE audit_log
+SET ip = ''
+WHERE actor_id = $1`, []interface{}{userID}},
+	}
+
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement.query, statement.args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
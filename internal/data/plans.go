@@ -0,0 +1,472 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDuplicatePlanName is returned when creating or renaming a plan with the
+	// name of another one.
+	ErrDuplicatePlanName = errors.New("a plan with this name already exists")
+	// ErrPlanInUse is returned when deleting a plan someone is subscribed to.
+	ErrPlanInUse = errors.New("the plan has subscribers")
+	// ErrDuplicateSubscription is returned when subscribing a user or company that
+	// is already subscribed to a plan.
+	ErrDuplicateSubscription = errors.New("a subscription already exists for this owner")
+	// ErrQuotaExceeded is returned when the requests included in a plan have all
+	// been made for the current period.
+	ErrQuotaExceeded = errors.New("the request quota of the plan is used up")
+)
+
+// Plan is a subscription plan sold to clients and companies, e.g. Basic, Premium
+// or Private. RequestQuota is the number of requests included each month, 0 for
+// unlimited; ResponseHours how long the concierge takes at most to answer a
+// request, 0 for no commitment; Discount the percentage taken off the price of the
+// services booked.
+type Plan struct {
+	ID            int64     `json:"id"`
+	Name          string    `json:"name"`
+	RequestQuota  int       `json:"request_quota"`
+	ResponseHours int       `json:"response_hours"`
+	Discount      int       `json:"discount"`
+	MonthlyFee    int       `json:"monthly_fee"`
+	CreatedAt     time.Time `json:"created_at"`
+	Version       int32     `json:"version"`
+}
+
+// DiscountedPrice returns price with the discount of the plan taken off, rounded
+// in the client's favour.
+func (p *Plan) DiscountedPrice(price int) int {
+	return price - (price*p.Discount+99)/100
+}
+
+// RespondBy returns when a request made at created has to be answered by, or NULL
+// if the plan doesn't commit to a response time.
+func (p *Plan) RespondBy(created time.Time) NullTime {
+	if p.ResponseHours == 0 {
+		return NullTime{}
+	}
+	return nullTime(created.Add(time.Duration(p.ResponseHours) * time.Hour))
+}
+
+func ValidatePlan(v *validator.Validator, plan *Plan) {
+	v.Check(strings.TrimSpace(plan.Name) != "", "name", "must be provided")
+	v.Check(len(plan.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(plan.RequestQuota >= 0, "request_quota", "must not be negative")
+	v.Check(plan.ResponseHours >= 0, "response_hours", "must not be negative")
+	v.Check(plan.ResponseHours <= 24*31, "response_hours", "must not be more than a month")
+	v.Check(plan.Discount >= 0, "discount", "must not be negative")
+	v.Check(plan.Discount < 100, "discount", "must be less than 100")
+	v.Check(plan.MonthlyFee >= 0, "monthly_fee", "must not be negative")
+}
+
+// Subscription subscribes a user or a company to a plan. It renews monthly, on
+// RenewsAt: RequestsUsed counts the requests made since PeriodStart. Plan is the
+// plan subscribed to, as it is now.
+type Subscription struct {
+	ID           int64     `json:"id"`
+	PlanID       int64     `json:"plan_id"`
+	UserID       int64     `json:"user_id,omitempty"`
+	CompanyID    int64     `json:"company_id,omitempty"`
+	PeriodStart  time.Time `json:"period_start"`
+	RenewsAt     time.Time `json:"renews_at"`
+	RequestsUsed int       `json:"requests_used"`
+	CreatedAt    time.Time `json:"created_at"`
+	Version      int32     `json:"version"`
+	Plan         *Plan     `json:"plan,omitempty"`
+}
+
+// Renew moves the subscription on to the period now falls in, starting the count
+// of requests over, if it was due for renewal. Stored subscriptions catch up the
+// next time their quota is used.
+func (s *Subscription) Renew(now time.Time) {
+	for !now.Before(s.RenewsAt) {
+		s.PeriodStart = s.RenewsAt
+		s.RenewsAt = s.RenewsAt.AddDate(0, 1, 0)
+		s.RequestsUsed = 0
+	}
+}
+
+// QuotaLeft reports whether another request can be made in the current period.
+func (s *Subscription) QuotaLeft() bool {
+	return s.Plan.RequestQuota == 0 || s.RequestsUsed < s.Plan.RequestQuota
+}
+
+// ValidateSubscription checks a new or changed subscription. The first period
+// lasts a month at most, so the subscription must renew within a month of now.
+func ValidateSubscription(v *validator.Validator, sub *Subscription, now time.Time) {
+	v.Check(sub.PlanID > 0, "plan_id", "must be provided")
+	v.Check((sub.UserID == 0) != (sub.CompanyID == 0), "owner", "exactly one of user_id and company_id must be provided")
+	v.Check(sub.RenewsAt.After(now), "renews_at", "must be in the future")
+	v.Check(!sub.RenewsAt.After(now.AddDate(0, 1, 0)), "renews_at", "must be within a month")
+}
+
+type PlanModel struct {
+	DB *sql.DB
+}
+
+// planError turns the constraint violations plans and subscriptions can run into
+// into the errors the callers check for.
+func planError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Constraint {
+		case "plan_name_key":
+			return ErrDuplicatePlanName
+		case "subscription_plan_id_fkey":
+			// The same constraint stops plans with subscribers from being deleted
+			// and subscriptions to plans that don't exist from being made.
+			if strings.HasPrefix(pqErr.Message, "update or delete") {
+				return ErrPlanInUse
+			}
+			return ErrRecordNotFound
+		case "subscription_user", "subscription_company":
+			return ErrDuplicateSubscription
+		}
+	}
+	return err
+}
+
+func (m PlanModel) Insert(ctx context.Context, plan *Plan) error {
+	query := `
+INSERT INTO plan (name, request_quota, response_hours, discount, monthly_fee)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, created_at, version`
+	args := []interface{}{plan.Name, plan.RequestQuota, plan.ResponseHours, plan.Discount, plan.MonthlyFee}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&plan.ID, &plan.CreatedAt, &plan.Version)
+	if err != nil {
+		return planError(err)
+	}
+	return nil
+}
+
+const planColumns = `id, name, request_quota, response_hours, discount, monthly_fee, created_at, version`
+
+func (m PlanModel) Get(ctx context.Context, id int64) (*Plan, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + planColumns + ` FROM plan WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var plan Plan
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&plan.ID,
+		&plan.Name,
+		&plan.RequestQuota,
+		&plan.ResponseHours,
+		&plan.Discount,
+		&plan.MonthlyFee,
+		&plan.CreatedAt,
+		&plan.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &plan, nil
+}
+
+// List returns all the plans, cheapest first. There are only ever a handful of
+// them.
+func (m PlanModel) List(ctx context.Context) ([]*Plan, error) {
+	query := `SELECT ` + planColumns + ` FROM plan ORDER BY monthly_fee, id`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []*Plan{}
+	for rows.Next() {
+		var plan Plan
+		err := rows.Scan(
+			&plan.ID,
+			&plan.Name,
+			&plan.RequestQuota,
+			&plan.ResponseHours,
+			&plan.Discount,
+			&plan.MonthlyFee,
+			&plan.CreatedAt,
+			&plan.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &plan)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+func (m PlanModel) Update(ctx context.Context, plan *Plan) error {
+	query := `
+UPDATE plan
+SET name = $1, request_quota = $2, response_hours = $3, discount = $4, monthly_fee = $5, version = version + 1
+WHERE id = $6 AND version = $7
+RETURNING version`
+	args := []interface{}{plan.Name, plan.RequestQuota, plan.ResponseHours, plan.Discount, plan.MonthlyFee, plan.ID, plan.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&plan.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return planError(err)
+		}
+	}
+	return nil
+}
+
+// Delete deletes a plan. It fails with ErrPlanInUse if anyone is subscribed to it.
+func (m PlanModel) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM plan WHERE id = $1`, id)
+	if err != nil {
+		return planError(err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Subscribe subscribes a user or a company to a plan, filling in the start of the
+// first period, a month before the subscription renews. It fails with
+// ErrDuplicateSubscription if they are subscribed already, and with
+// ErrRecordNotFound if the plan doesn't exist.
+func (m PlanModel) Subscribe(ctx context.Context, sub *Subscription) error {
+	query := `
+INSERT INTO subscription (plan_id, user_id, company_id, period_start, renews_at)
+VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4, $5)
+RETURNING id, requests_used, created_at, version`
+
+	sub.PeriodStart = sub.RenewsAt.AddDate(0, -1, 0)
+	args := []interface{}{sub.PlanID, sub.UserID, sub.CompanyID, sub.PeriodStart, sub.RenewsAt}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&sub.ID, &sub.RequestsUsed, &sub.CreatedAt, &sub.Version)
+	if err != nil {
+		return planError(err)
+	}
+	return nil
+}
+
+const subscriptionColumns = `s.id, s.plan_id, COALESCE(s.user_id, 0), COALESCE(s.company_id, 0), s.period_start, s.renews_at, s.requests_used, s.created_at, s.version,
+p.id, p.name, p.request_quota, p.response_hours, p.discount, p.monthly_fee, p.created_at, p.version`
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (*Subscription, error) {
+	sub := Subscription{Plan: &Plan{}}
+	err := row.Scan(
+		&sub.ID,
+		&sub.PlanID,
+		&sub.UserID,
+		&sub.CompanyID,
+		&sub.PeriodStart,
+		&sub.RenewsAt,
+		&sub.RequestsUsed,
+		&sub.CreatedAt,
+		&sub.Version,
+		&sub.Plan.ID,
+		&sub.Plan.Name,
+		&sub.Plan.RequestQuota,
+		&sub.Plan.ResponseHours,
+		&sub.Plan.Discount,
+		&sub.Plan.MonthlyFee,
+		&sub.Plan.CreatedAt,
+		&sub.Plan.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &sub, nil
+}
+
+func (m PlanModel) getSubscriptionWhere(ctx context.Context, where string, args ...interface{}) (*Subscription, error) {
+	query := `
+SELECT ` + subscriptionColumns + `
+FROM subscription s
+INNER JOIN plan p ON p.id = s.plan_id
+WHERE ` + where
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return scanSubscription(m.DB.QueryRowContext(ctx, query, args...))
+}
+
+// GetSubscription returns the subscription of a user, if userID isn't 0, or else
+// of a company.
+func (m PlanModel) GetSubscription(ctx context.Context, userID, companyID int64) (*Subscription, error) {
+	if userID != 0 {
+		return m.getSubscriptionWhere(ctx, `s.user_id = $1`, userID)
+	}
+	return m.getSubscriptionWhere(ctx, `s.company_id = $1`, companyID)
+}
+
+// GetSubscriptionFor returns the subscription a user is covered by: their own, or
+// else the one of their company. companyID is 0 for users without a company.
+func (m PlanModel) GetSubscriptionFor(ctx context.Context, userID, companyID int64) (*Subscription, error) {
+	return m.getSubscriptionWhere(ctx, `s.user_id = $1 OR ($2 <> 0 AND s.company_id = $2)
+ORDER BY s.user_id NULLS LAST
+LIMIT 1`, userID, companyID)
+}
+
+// UpdateSubscription moves a subscription to another plan or renewal date. The
+// requests already made in the current period still count.
+func (m PlanModel) UpdateSubscription(ctx context.Context, sub *Subscription) error {
+	query := `
+UPDATE subscription
+SET plan_id = $1, period_start = $2, renews_at = $3, requests_used = $4, version = version + 1
+WHERE id = $5 AND version = $6
+RETURNING version`
+	args := []interface{}{sub.PlanID, sub.PeriodStart, sub.RenewsAt, sub.RequestsUsed, sub.ID, sub.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&sub.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return planError(err)
+		}
+	}
+	return nil
+}
+
+// Unsubscribe ends the subscription of a user, if userID isn't 0, or else of a
+// company.
+func (m PlanModel) Unsubscribe(ctx context.Context, userID, companyID int64) error {
+	query := `DELETE FROM subscription WHERE user_id = $1`
+	owner := userID
+	if userID == 0 {
+		query, owner = `DELETE FROM subscription WHERE company_id = $1`, companyID
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, owner)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// UseQuota counts a request against a subscription, renewing it first if it's due,
+// and fills sub in with what was stored. It fails with ErrQuotaExceeded if the
+// quota of the plan is used up for the current period.
+//
+// The subscription is locked while its quota is checked, so that requests made at
+// the same time, e.g. by employees of the same company, can't go over it.
+func (m PlanModel) UseQuota(ctx context.Context, sub *Subscription, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+SELECT ` + subscriptionColumns + `
+FROM subscription s
+INNER JOIN plan p ON p.id = s.plan_id
+WHERE s.id = $1
+FOR UPDATE OF s`
+	locked, err := scanSubscription(tx.QueryRowContext(ctx, query, sub.ID))
+	if err != nil {
+		return err
+	}
+
+	locked.Renew(now)
+	if !locked.QuotaLeft() {
+		*sub = *locked
+		return ErrQuotaExceeded
+	}
+	locked.RequestsUsed++
+
+	query = `
+UPDATE subscription
+SET period_start = $1, renews_at = $2, requests_used = $3, version = version + 1
+WHERE id = $4
+RETURNING version`
+	err = tx.QueryRowContext(ctx, query, locked.PeriodStart, locked.RenewsAt, locked.RequestsUsed, locked.ID).Scan(&locked.Version)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	*sub = *locked
+	return nil
+}
+
+// ReleaseQuota gives back a request counted by UseQuota() that ended up not being
+// made. Nothing is given back once the subscription has renewed since.
+func (m PlanModel) ReleaseQuota(ctx context.Context, sub *Subscription) error {
+	query := `
+UPDATE subscription
+SET requests_used = requests_used - 1, version = version + 1
+WHERE id = $1 AND period_start = $2 AND requests_used > 0`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, sub.ID, sub.PeriodStart)
+	return err
+}
@@ -0,0 +1,182 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+// Contact channels a client can ask the concierge to use.
+const (
+	ContactChannelEmail    = "email"
+	ContactChannelPhone    = "phone"
+	ContactChannelSMS      = "sms"
+	ContactChannelWhatsApp = "whatsapp"
+	ContactChannelTelegram = "telegram"
+)
+
+var ContactChannels = []string{ContactChannelEmail, ContactChannelPhone, ContactChannelSMS, ContactChannelWhatsApp, ContactChannelTelegram}
+
+// LanguageRX matches a two-letter ISO 639-1 language code such as "en" or "kk".
+var LanguageRX = regexp.MustCompile("^[a-z]{2}$")
+
+// Preferences is what concierge staff need to know to serve a client well. It is
+// stored as a JSON document in the users.preferences column.
+type Preferences struct {
+	DietaryNeeds       []string             `json:"dietary_needs"`
+	PreferredLanguages []string             `json:"preferred_languages"`
+	ContactChannel     string               `json:"contact_channel"`
+	Notifications      NotificationSettings `json:"notifications"`
+	// Notes holds free-form remarks. Preferences saved before they became a JSON
+	// document end up here when they are read.
+	Notes string `json:"notes"`
+}
+
+type NotificationSettings struct {
+	RequestUpdates bool `json:"request_updates"`
+	Email          bool `json:"email"`
+	SMS            bool `json:"sms"`
+	Push           bool `json:"push"`
+	Marketing      bool `json:"marketing"`
+}
+
+// DefaultPreferences are given to new users: keep them informed about their own
+// requests by email, nothing else.
+func DefaultPreferences() Preferences {
+	return Preferences{
+		DietaryNeeds:       []string{},
+		PreferredLanguages: []string{},
+		ContactChannel:     ContactChannelEmail,
+		Notifications: NotificationSettings{
+			RequestUpdates: true,
+			Email:          true,
+		},
+	}
+}
+
+// Value implements driver.Valuer so Preferences can be written straight to the
+// preferences column.
+func (p Preferences) Value() (driver.Value, error) {
+	if p.DietaryNeeds == nil {
+		p.DietaryNeeds = []string{}
+	}
+	if p.PreferredLanguages == nil {
+		p.PreferredLanguages = []string{}
+	}
+	js, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(js), nil
+}
+
+// Scan implements sql.Scanner. Empty values become DefaultPreferences(), and legacy
+// values that aren't JSON objects are kept as Notes so nothing is lost.
+func (p *Preferences) Scan(src interface{}) error {
+	var raw string
+	switch src := src.(type) {
+	case nil:
+		raw = ""
+	case string:
+		raw = src
+	case []byte:
+		raw = string(src)
+	default:
+		return errors.New("preferences: unsupported column type")
+	}
+
+	*p = DefaultPreferences()
+
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	if !strings.HasPrefix(raw, "{") || json.Unmarshal([]byte(raw), p) != nil {
+		*p = DefaultPreferences()
+		p.Notes = raw
+	}
+	if p.DietaryNeeds == nil {
+		p.DietaryNeeds = []string{}
+	}
+	if p.PreferredLanguages == nil {
+		p.PreferredLanguages = []string{}
+	}
+	if p.ContactChannel == "" {
+		p.ContactChannel = ContactChannelEmail
+	}
+	return nil
+}
+
+// PreferencesPatch describes a partial update of Preferences: nil fields are left
+// unchanged.
+type PreferencesPatch struct {
+	DietaryNeeds       []string                   `json:"dietary_needs"`
+	PreferredLanguages []string                   `json:"preferred_languages"`
+	ContactChannel     *string                    `json:"contact_channel"`
+	Notifications      *NotificationSettingsPatch `json:"notifications"`
+	Notes              *string                    `json:"notes"`
+}
+
+type NotificationSettingsPatch struct {
+	RequestUpdates *bool `json:"request_updates"`
+	Email          *bool `json:"email"`
+	SMS            *bool `json:"sms"`
+	Push           *bool `json:"push"`
+	Marketing      *bool `json:"marketing"`
+}
+
+// Apply copies every field set in patch onto p.
+func (p *Preferences) Apply(patch PreferencesPatch) {
+	if patch.DietaryNeeds != nil {
+		p.DietaryNeeds = patch.DietaryNeeds
+	}
+	if patch.PreferredLanguages != nil {
+		p.PreferredLanguages = patch.PreferredLanguages
+	}
+	if patch.ContactChannel != nil {
+		p.ContactChannel = *patch.ContactChannel
+	}
+	if patch.Notes != nil {
+		p.Notes = *patch.Notes
+	}
+	if n := patch.Notifications; n != nil {
+		if n.RequestUpdates != nil {
+			p.Notifications.RequestUpdates = *n.RequestUpdates
+		}
+		if n.Email != nil {
+			p.Notifications.Email = *n.Email
+		}
+		if n.SMS != nil {
+			p.Notifications.SMS = *n.SMS
+		}
+		if n.Push != nil {
+			p.Notifications.Push = *n.Push
+		}
+		if n.Marketing != nil {
+			p.Notifications.Marketing = *n.Marketing
+		}
+	}
+}
+
+func ValidatePreferences(v *validator.Validator, p Preferences) {
+	v.Check(len(p.DietaryNeeds) <= 20, "preferences.dietary_needs", "must not contain more than 20 entries")
+	v.Check(validator.Unique(p.DietaryNeeds), "preferences.dietary_needs", "must not contain duplicate values")
+	for _, need := range p.DietaryNeeds {
+		v.Check(strings.TrimSpace(need) != "", "preferences.dietary_needs", "must not contain empty values")
+		v.Check(len(need) <= 100, "preferences.dietary_needs", "entries must not be more than 100 bytes long")
+	}
+
+	v.Check(len(p.PreferredLanguages) <= 10, "preferences.preferred_languages", "must not contain more than 10 entries")
+	v.Check(validator.Unique(p.PreferredLanguages), "preferences.preferred_languages", "must not contain duplicate values")
+	for _, language := range p.PreferredLanguages {
+		v.Check(validator.Matches(language, LanguageRX), "preferences.preferred_languages", "must contain two-letter ISO 639-1 codes such as \"en\"")
+	}
+
+	v.Check(validator.In(p.ContactChannel, ContactChannels...), "preferences.contact_channel", "must be one of "+strings.Join(ContactChannels, ", "))
+
+	v.Check(len(p.Notes) <= 2000, "preferences.notes", "must not be more than 2000 bytes long")
+}
@@ -12,35 +12,37 @@ type RegForm struct {
 	Email       string    `json:"email"`
 	PhoneNumber string    `json:"phone_number"`
 	CreatedAt   time.Time `json:"created_at"`
+	DeletedAt   NullTime  `json:"deleted_at"`
 }
 
 type RegFormModel struct {
 	DB *sql.DB
 }
 
-func (r *RegFormModel) Insert(regForm *RegForm) error {
+func (r *RegFormModel) Insert(ctx context.Context, regForm *RegForm) error {
 	query := `
 INSERT INTO RegForm (company_name, email, phone_number)
 VALUES ($1, $2, $3)
 RETURNING id, created_at`
 	args := []interface{}{regForm.CompanyName, regForm.Email, regForm.PhoneNumber}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	return r.DB.QueryRowContext(ctx, query, args...).Scan(&regForm.ID, &regForm.CreatedAt)
 }
 
-func (r *RegFormModel) GetByDateAsc() ([]*RegForm, error) {
+func (r *RegFormModel) GetByDateAsc(ctx context.Context) ([]*RegForm, error) {
 	query := `
-    SELECT id, company_name, email, phone_number, created_at
+    SELECT id, company_name, email, phone_number, created_at, deleted_at
     FROM RegForm
+    WHERE $1 OR deleted_at IS NULL
     ORDER BY created_at DESC`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	rows, err := r.DB.QueryContext(ctx, query)
+	rows, err := r.DB.QueryContext(ctx, query, withDeleted(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -49,12 +51,62 @@ func (r *RegFormModel) GetByDateAsc() ([]*RegForm, error) {
 	forms := []*RegForm{}
 	for rows.Next() {
 		form := &RegForm{}
-		err := rows.Scan(&form.ID, &form.CompanyName, &form.Email, &form.PhoneNumber, &form.CreatedAt)
+		err := rows.Scan(&form.ID, &form.CompanyName, &form.Email, &form.PhoneNumber, &form.CreatedAt, &form.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
 		forms = append(forms, form)
 	}
 
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
 	return forms, nil
 }
+
+func (r *RegFormModel) SoftDelete(ctx context.Context, id int64) error {
+	query := `UPDATE RegForm SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := r.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *RegFormModel) Restore(ctx context.Context, id int64) error {
+	query := `UPDATE RegForm SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := r.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *RegFormModel) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	query := `
+DELETE FROM RegForm
+WHERE deleted_at < $1
+RETURNING id`
+	return purgeRows(ctx, r.DB, query, deletedBefore)
+}
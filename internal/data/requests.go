@@ -4,34 +4,58 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+// Statuses of a request. RequestStatusNew is the status of a request the concierge
+// hasn't picked up yet; the concierge moves it on from there.
+const (
+	RequestStatusNew        = "new"
+	RequestStatusInProgress = "in_progress"
+	RequestStatusDone       = "done"
+	RequestStatusCancelled  = "cancelled"
 )
 
+var RequestStatuses = []string{RequestStatusNew, RequestStatusInProgress, RequestStatusDone, RequestStatusCancelled}
+
 type Request struct {
-	ID          int64          `json:"id"`
-	ClientID    int64          `json:"client_id"`
-	Type        string         `json:"type"`
-	Description string         `json:"description"`
-	Status      string         `json:"status"`
-	CreatedAt   time.Time      `json:"created_at"`
-	DeletedAt   sql.NullString `json:"deleted_at"`
-	UpdatedAt   sql.NullString `json:"updated_at"`
+	ID          int64     `json:"id"`
+	ClientID    int64     `json:"client_id"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	AssigneeID  int64     `json:"assignee_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	RespondBy   NullTime  `json:"respond_by"`
+	DeletedAt   NullTime  `json:"deleted_at"`
+	UpdatedAt   NullTime  `json:"updated_at"`
+}
+
+func ValidateRequest(v *validator.Validator, request *Request) {
+	v.Check(strings.TrimSpace(request.Type) != "", "type", "must be provided")
+	v.Check(len(request.Type) <= 100, "type", "must not be more than 100 bytes long")
+	v.Check(len(request.Description) <= 2000, "description", "must not be more than 2000 bytes long")
+	v.Check(validator.In(request.Status, RequestStatuses...), "status", "invalid status")
+	v.Check(request.AssigneeID >= 0, "assignee_id", "must not be negative")
 }
 
 type RequestModel struct {
 	DB *sql.DB
 }
 
-func (r RequestModel) Insert(request *Request) error {
+func (r RequestModel) Insert(ctx context.Context, request *Request) error {
 	query := `
-INSERT INTO request (client_id, type, description, status, created_at) 
-VALUES ($1, $2, $3, $4, NOW()) 
-RETURNING id`
-	args := []interface{}{request.ClientID, request.Type, request.Description, request.Status}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+INSERT INTO request (client_id, type, description, status, created_at, respond_by) 
+VALUES ($1, $2, $3, $4, NOW(), $5) 
+RETURNING id, created_at`
+	args := []interface{}{request.ClientID, request.Type, request.Description, request.Status, request.RespondBy}
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	err := r.DB.QueryRowContext(ctx, query, args...).Scan(&request.ID)
+	err := r.DB.QueryRowContext(ctx, query, args...).Scan(&request.ID, &request.CreatedAt)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"` ||
@@ -44,23 +68,25 @@ RETURNING id`
 	return nil
 }
 
-func (r RequestModel) GetByRequestID(id int64) (*Request, error) {
+func (r RequestModel) GetByRequestID(ctx context.Context, id int64) (*Request, error) {
 	query := `
-SELECT * 
+SELECT id, client_id, type, description, status, COALESCE(assignee_id, 0), created_at, respond_by, deleted_at, updated_at
 FROM request 
-WHERE id = $1 AND deleted_at IS NULL`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+WHERE id = $1 AND ($2 OR deleted_at IS NULL)`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var request Request
 
-	err := r.DB.QueryRowContext(ctx, query, id).Scan(
+	err := r.DB.QueryRowContext(ctx, query, id, withDeleted(ctx)).Scan(
 		&request.ID,
 		&request.ClientID,
 		&request.Type,
 		&request.Description,
 		&request.Status,
+		&request.AssigneeID,
 		&request.CreatedAt,
+		&request.RespondBy,
 		&request.DeletedAt,
 		&request.UpdatedAt,
 	)
@@ -75,12 +101,59 @@ WHERE id = $1 AND deleted_at IS NULL`
 	return &request, nil
 }
 
-func (m RequestModel) Update(request *Request) error {
+// GetAllForClient returns the requests of a client, newest first.
+func (r RequestModel) GetAllForClient(ctx context.Context, clientID int64) ([]*Request, error) {
+	query := `
+SELECT id, client_id, type, description, status, COALESCE(assignee_id, 0), created_at, respond_by, deleted_at, updated_at
+FROM request
+WHERE client_id = $1 AND ($2 OR deleted_at IS NULL)
+ORDER BY id DESC`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := r.DB.QueryContext(ctx, query, clientID, withDeleted(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*Request{}
+	for rows.Next() {
+		var request Request
+		err := rows.Scan(
+			&request.ID,
+			&request.ClientID,
+			&request.Type,
+			&request.Description,
+			&request.Status,
+			&request.AssigneeID,
+			&request.CreatedAt,
+			&request.RespondBy,
+			&request.DeletedAt,
+			&request.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, &request)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (m RequestModel) Update(ctx context.Context, request *Request) error {
 	query := `
 UPDATE request
-SET type = $1, description = $2, status = $3, updated_at = $4
-WHERE id = $5 AND deleted_at IS NULL`
-	_, err := m.DB.Exec(query, request.Type, request.Description, request.Status, time.Now(), request.ID)
+SET type = $1, description = $2, status = $3, assignee_id = NULLIF($4, 0), updated_at = $5
+WHERE id = $6 AND deleted_at IS NULL`
+	args := []interface{}{request.Type, request.Description, request.Status, request.AssigneeID, time.Now(), request.ID}
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -91,11 +164,11 @@ WHERE id = $5 AND deleted_at IS NULL`
 	}
 	return nil
 }
-func (r RequestModel) Delete(id int64) error {
+func (r RequestModel) Delete(ctx context.Context, id int64) error {
 	query := `
 DELETE FROM request
 WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	result, err := r.DB.ExecContext(ctx, query, id)
@@ -112,12 +185,12 @@ WHERE id = $1`
 	return nil
 }
 
-func (r RequestModel) SoftDelete(id int64) error {
+func (r RequestModel) SoftDelete(ctx context.Context, id int64) error {
 	query := `
 UPDATE request
 SET deleted_at = NOW() 
-WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+WHERE id = $1 AND deleted_at IS NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	result, err := r.DB.ExecContext(ctx, query, id)
@@ -133,3 +206,47 @@ WHERE id = $1`
 	}
 	return nil
 }
+
+func (r RequestModel) Restore(ctx context.Context, id int64) error {
+	query := `
+UPDATE request
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := r.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Purge also removes the bookings of the purged requests, see the ON DELETE CASCADE
+// on booking.request_id, and releases the slots they had reserved. Soft-deleted
+// requests keep their reservations so that they can still be restored. Requests with
+// invoiced or paid bookings are kept, as the invoices, payments and ledger still
+// refer to them.
+func (r RequestModel) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	query := `
+WITH purged AS (
+	DELETE FROM request
+	WHERE deleted_at < $1
+	AND NOT EXISTS (SELECT 1 FROM booking WHERE booking.request_id = request.id AND booking.invoice_id IS NOT NULL)
+	AND NOT EXISTS (SELECT 1 FROM payment INNER JOIN booking ON booking.id = payment.booking_id WHERE booking.request_id = request.id)
+	AND NOT EXISTS (SELECT 1 FROM ledger_transaction INNER JOIN booking ON booking.id = ledger_transaction.booking_id WHERE booking.request_id = request.id)
+	RETURNING id
+), released AS (
+	DELETE FROM slot_reservation
+	WHERE id IN (SELECT reservation_id FROM booking WHERE request_id IN (SELECT id FROM purged))
+)
+SELECT id FROM purged`
+	return purgeRows(ctx, r.DB, query, deletedBefore)
+}
@@ -0,0 +1,254 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/concierge/service/internal/validator"
+)
+
+// ErrPendingServiceChange is returned when proposing a change to a service that
+// already has one awaiting approval.
+var ErrPendingServiceChange = errors.New("service change already pending")
+
+// Partners can't edit their services directly: their changes are proposed and only
+// applied once an admin approves them.
+const (
+	ServiceChangePending  = "pending"
+	ServiceChangeApproved = "approved"
+	ServiceChangeRejected = "rejected"
+)
+
+var ServiceChangeStatuses = []string{ServiceChangePending, ServiceChangeApproved, ServiceChangeRejected}
+
+// PricedUserTypes lists the user types services are priced for.
+var PricedUserTypes = []string{UserTypeClient, UserTypeB2BClient}
+
+// ServiceChange is a change to a service proposed by a partner. It holds the
+// complete new description and price list, not just the fields that differ, so
+// that approving it leaves the service exactly as the partner saw it.
+type ServiceChange struct {
+	ID           int64          `json:"id"`
+	ServiceID    int64          `json:"service_id"`
+	ProposedByID int64          `json:"proposed_by_id"`
+	Description  string         `json:"description"`
+	Prices       ProposedPrices `json:"prices"`
+	Status       string         `json:"status"`
+	ReviewedByID int64          `json:"reviewed_by_id,omitempty"`
+	ReviewNote   string         `json:"review_note"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ReviewedAt   NullTime       `json:"reviewed_at"`
+	Version      int32          `json:"version"`
+}
+
+// ProposedPrice is the price of a service for one user type.
+type ProposedPrice struct {
+	UserType string `json:"user_type"`
+	Price    int    `json:"price"`
+}
+
+// ProposedPrices is stored as a JSON array in the service_change.prices column.
+type ProposedPrices []ProposedPrice
+
+func (p ProposedPrices) Value() (driver.Value, error) {
+	if p == nil {
+		p = ProposedPrices{}
+	}
+	return jsonValue(p)
+}
+
+func (p *ProposedPrices) Scan(src interface{}) error {
+	return jsonScan(src, p)
+}
+
+// Review records an admin's decision on the change.
+func (c *ServiceChange) Review(status string, reviewerID int64, note string) {
+	c.Status = status
+	c.ReviewedByID = reviewerID
+	c.ReviewNote = note
+	c.ReviewedAt = nullTimeNow()
+}
+
+func ValidateServiceChange(v *validator.Validator, change *ServiceChange) {
+	v.Check(strings.TrimSpace(change.Description) != "", "description", "must be provided")
+	v.Check(len(change.Description) <= 2000, "description", "must not be more than 2000 bytes long")
+
+	v.Check(len(change.Prices) <= len(PricedUserTypes), "prices", "must not contain more than one price per user type")
+	userTypes := make([]string, 0, len(change.Prices))
+	for _, price := range change.Prices {
+		v.Check(validator.In(price.UserType, PricedUserTypes...), "prices", "user types must be one of "+strings.Join(PricedUserTypes, ", "))
+		v.Check(price.Price >= 0, "prices", "must not be negative")
+		userTypes = append(userTypes, price.UserType)
+	}
+	v.Check(validator.Unique(userTypes), "prices", "must not contain more than one price per user type")
+}
+
+// ServiceChangeFilter narrows down the changes returned by List(). Zero values
+// mean "don't filter on this field". CompanyID matches the company providing the
+// service.
+type ServiceChangeFilter struct {
+	CompanyID int64
+	ServiceID int64
+	Status    string
+}
+
+// ServiceChangeSortSafelist lists the values accepted for the sort parameter of
+// List().
+var ServiceChangeSortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+type ServiceChangeModel struct {
+	DB *sql.DB
+}
+
+func (m ServiceChangeModel) Insert(ctx context.Context, change *ServiceChange) error {
+	query := `
+INSERT INTO service_change (service_id, proposed_by_id, description, prices, status)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, created_at, version`
+	args := []interface{}{change.ServiceID, change.ProposedByID, change.Description, change.Prices, change.Status}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&change.ID, &change.CreatedAt, &change.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), `"service_change_pending_idx"`):
+			return ErrPendingServiceChange
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m ServiceChangeModel) Get(ctx context.Context, id int64) (*ServiceChange, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, service_id, proposed_by_id, description, prices, status, COALESCE(reviewed_by_id, 0), review_note, created_at, reviewed_at, version
+FROM service_change
+WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var change ServiceChange
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&change.ID,
+		&change.ServiceID,
+		&change.ProposedByID,
+		&change.Description,
+		&change.Prices,
+		&change.Status,
+		&change.ReviewedByID,
+		&change.ReviewNote,
+		&change.CreatedAt,
+		&change.ReviewedAt,
+		&change.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &change, nil
+}
+
+// Update saves the review of a change. Like BookingModel.Update it fails with
+// ErrEditConflict if the change was updated since it was read, so a change can't
+// be both approved and rejected.
+func (m ServiceChangeModel) Update(ctx context.Context, change *ServiceChange) error {
+	query := `
+UPDATE service_change
+SET status = $1, reviewed_by_id = NULLIF($2, 0), review_note = $3, reviewed_at = $4, version = version + 1
+WHERE id = $5 AND version = $6
+RETURNING version`
+	args := []interface{}{change.Status, change.ReviewedByID, change.ReviewNote, change.ReviewedAt, change.ID, change.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&change.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m ServiceChangeModel) List(ctx context.Context, filter ServiceChangeFilter, filters Filters) ([]*ServiceChange, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), service_change.id, service_change.service_id, service_change.proposed_by_id, service_change.description,
+service_change.prices, service_change.status, COALESCE(service_change.reviewed_by_id, 0), service_change.review_note,
+service_change.created_at, service_change.reviewed_at, service_change.version
+FROM service_change
+INNER JOIN service ON service.id = service_change.service_id
+WHERE ($1 = 0 OR service.company_id = $1)
+AND ($2 = 0 OR service_change.service_id = $2)
+AND ($3 = '' OR service_change.status = $3)
+ORDER BY service_change.%s %s, service_change.id ASC
+LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		filter.CompanyID,
+		filter.ServiceID,
+		filter.Status,
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	changes := []*ServiceChange{}
+
+	for rows.Next() {
+		var change ServiceChange
+		err := rows.Scan(
+			&totalRecords,
+			&change.ID,
+			&change.ServiceID,
+			&change.ProposedByID,
+			&change.Description,
+			&change.Prices,
+			&change.Status,
+			&change.ReviewedByID,
+			&change.ReviewNote,
+			&change.CreatedAt,
+			&change.ReviewedAt,
+			&change.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		changes = append(changes, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return changes, metadata, nil
+}
@@ -15,8 +15,8 @@ type Service struct {
 	CreatedByID int64     `json:"created_by_id"`
 	CompanyID   int       `json:"company_id"`
 	CreatedAt   time.Time `json:"created_at"`
-	DeletedAt   time.Time `json:"deleted_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	DeletedAt   NullTime  `json:"deleted_at"`
+	UpdatedAt   NullTime  `json:"updated_at"`
 }
 
 type ServiceModel struct {
@@ -24,30 +24,30 @@ type ServiceModel struct {
 }
 
 // cs employee can add new services which further would be presented in client's panel
-func (s *ServiceModel) Insert(service *Service) error {
+func (s *ServiceModel) Insert(ctx context.Context, service *Service) error {
 	query := `
 INSERT INTO service (name, description, type, created_by_id, company_id)
 VALUES ($1, $2, $3, $4, $5)
 RETURNING id, created_at, updated_at`
 	args := []interface{}{service.Name, service.Description, service.Type, service.CreatedByID, service.CompanyID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	return s.DB.QueryRowContext(ctx, query, args...).Scan(&service.ID, &service.CreatedAt, &service.UpdatedAt)
 }
 
 // get services, companies, employee and prices
-func (s *ServiceModel) GetById(id int64) (*Service, error) {
+func (s *ServiceModel) GetById(ctx context.Context, id int64) (*Service, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	query := `
 SELECT id, name, description, type, created_by_id, company_id, created_at, deleted_at, updated_at
 FROM service
-WHERE id = $1  AND deleted_at IS NULL`
+WHERE id = $1 AND ($2 OR deleted_at IS NULL)`
 	var service Service
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
-	err := s.DB.QueryRowContext(ctx, query, id).Scan(
+	err := s.DB.QueryRowContext(ctx, query, id, withDeleted(ctx)).Scan(
 		&service.ID,
 		&service.Name,
 		&service.Description,
@@ -69,13 +69,55 @@ WHERE id = $1  AND deleted_at IS NULL`
 	return &service, nil
 }
 
-func (s *ServiceModel) Update(service *Service) error {
+// GetAllForCompany returns the services provided by a company.
+func (s *ServiceModel) GetAllForCompany(ctx context.Context, companyID int64) ([]*Service, error) {
+	query := `
+SELECT id, name, description, type, created_by_id, company_id, created_at, deleted_at, updated_at
+FROM service
+WHERE company_id = $1 AND ($2 OR deleted_at IS NULL)
+ORDER BY id`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, companyID, withDeleted(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := []*Service{}
+	for rows.Next() {
+		var service Service
+		err := rows.Scan(
+			&service.ID,
+			&service.Name,
+			&service.Description,
+			&service.Type,
+			&service.CreatedByID,
+			&service.CompanyID,
+			&service.CreatedAt,
+			&service.DeletedAt,
+			&service.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, &service)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+func (s *ServiceModel) Update(ctx context.Context, service *Service) error {
 	query := `
 UPDATE service
 SET name = $1, description = $2, type = $3, created_by_id = $4, company_id = $5, updated_at = NOW()
 WHERE id = $6 AND deleted_at IS NULL`
 	args := []interface{}{service.Name, service.Description, service.Type, service.CreatedByID, service.CompanyID, service.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	_, err := s.DB.ExecContext(ctx, query, args...)
 	if err != nil {
@@ -89,9 +131,9 @@ WHERE id = $6 AND deleted_at IS NULL`
 	return nil
 }
 
-func (s *ServiceModel) Delete(id int64) error {
+func (s *ServiceModel) Delete(ctx context.Context, id int64) error {
 	query := `DELETE FROM service WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	result, err := s.DB.ExecContext(ctx, query, id)
 	if err != nil {
@@ -107,12 +149,12 @@ func (s *ServiceModel) Delete(id int64) error {
 	return nil
 }
 
-func (s *ServiceModel) SoftDelete(id int64) error {
+func (s *ServiceModel) SoftDelete(ctx context.Context, id int64) error {
 	query := `
 UPDATE service
 SET deleted_at = NOW()
 WHERE id = $1 AND deleted_at IS NULL`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	result, err := s.DB.ExecContext(ctx, query, id)
@@ -129,28 +171,62 @@ WHERE id = $1 AND deleted_at IS NULL`
 	return nil
 }
 
+func (s *ServiceModel) Restore(ctx context.Context, id int64) error {
+	query := `
+UPDATE service
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Purge keeps services that still have prices or bookings. Changes proposed for a
+// service go with it.
+func (s *ServiceModel) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	query := `
+DELETE FROM service
+WHERE deleted_at < $1
+AND NOT EXISTS (SELECT 1 FROM price WHERE price.service_id = service.id)
+AND NOT EXISTS (SELECT 1 FROM booking WHERE booking.service_id = service.id)
+RETURNING id`
+	return purgeRows(ctx, s.DB, query, deletedBefore)
+}
+
 type Price struct {
 	ID        int64     `json:"id"`
 	ServiceID int64     `json:"service_id"`
 	Price     int       `json:"price"`
 	UserType  string    `json:"user_type"`
 	CreatedAt time.Time `json:"created_at"`
-	DeletedAt time.Time `json:"deleted_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	DeletedAt NullTime  `json:"deleted_at"`
+	UpdatedAt NullTime  `json:"updated_at"`
 }
 
 type PriceModel struct {
 	DB *sql.DB
 }
 
-func (p *PriceModel) Insert(price *Price) error { // TODO: проверить существует ли id
+func (p *PriceModel) Insert(ctx context.Context, price *Price) error { // TODO: проверить существует ли id
 	query := `
 INSERT INTO price (service_id, price, user_type)
 VALUES ($1, $2, $3)
 RETURNING id, created_at, updated_at`
 	args := []interface{}{price.ServiceID, price.Price, price.UserType}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	err := p.DB.QueryRowContext(ctx, query, args...).Scan(&price.ID, &price.CreatedAt, &price.UpdatedAt)
@@ -160,20 +236,53 @@ RETURNING id, created_at, updated_at`
 	return nil
 }
 
+func (p *PriceModel) Get(ctx context.Context, id int64) (*Price, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, service_id, price, user_type, created_at, deleted_at, updated_at
+FROM price
+WHERE id = $1 AND ($2 OR deleted_at IS NULL)`
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var price Price
+	err := p.DB.QueryRowContext(ctx, query, id, withDeleted(ctx)).Scan(
+		&price.ID,
+		&price.ServiceID,
+		&price.Price,
+		&price.UserType,
+		&price.CreatedAt,
+		&price.DeletedAt,
+		&price.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &price, nil
+}
+
 // get all prices for a specific service
-func (p *PriceModel) GetByServiceId(serviceID int64) ([]*Price, error) {
+func (p *PriceModel) GetByServiceId(ctx context.Context, serviceID int64) ([]*Price, error) {
 	if serviceID < 1 {
 		return nil, ErrRecordNotFound
 	}
 	query := `
 SELECT id, service_id, price, user_type, created_at, deleted_at, updated_at
 FROM price
-WHERE service_id = $1 AND deleted_at IS NULL`
+WHERE service_id = $1 AND ($2 OR deleted_at IS NULL)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	rows, err := p.DB.QueryContext(ctx, query, serviceID)
+	rows, err := p.DB.QueryContext(ctx, query, serviceID, withDeleted(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -210,13 +319,14 @@ WHERE service_id = $1 AND deleted_at IS NULL`
 	return prices, nil
 }
 
-func (p *PriceModel) Update(price *Price) error {
+func (p *PriceModel) Update(ctx context.Context, price *Price) error {
 	query := `
 UPDATE price
 SET price = $1, user_type = $2, service_id = $3, updated_at = NOW()
-WHERE id = $4 AND deleted_at IS NULL`
+WHERE id = $4 AND deleted_at IS NULL
+RETURNING updated_at`
 	args := []interface{}{price.Price, price.UserType, price.ServiceID, price.ID}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	err := p.DB.QueryRowContext(ctx, query, args...).Scan(&price.UpdatedAt)
 	if err != nil {
@@ -230,9 +340,9 @@ WHERE id = $4 AND deleted_at IS NULL`
 	return nil
 }
 
-func (p *PriceModel) Delete(id int64) error {
+func (p *PriceModel) Delete(ctx context.Context, id int64) error {
 	query := `DELETE FROM price WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	result, err := p.DB.ExecContext(ctx, query, id)
 	if err != nil {
@@ -248,12 +358,12 @@ func (p *PriceModel) Delete(id int64) error {
 	return nil
 }
 
-func (p *PriceModel) SoftDelete(id int64) error {
+func (p *PriceModel) SoftDelete(ctx context.Context, id int64) error {
 	query := `
 UPDATE price
 SET deleted_at = NOW()
-WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+WHERE id = $1 AND deleted_at IS NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 	result, err := p.DB.ExecContext(ctx, query, id)
 	if err != nil {
@@ -268,3 +378,32 @@ WHERE id = $1`
 	}
 	return nil
 }
+
+func (p *PriceModel) Restore(ctx context.Context, id int64) error {
+	query := `
+UPDATE price
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	result, err := p.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (p *PriceModel) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	query := `
+DELETE FROM price
+WHERE deleted_at < $1
+RETURNING id`
+	return purgeRows(ctx, p.DB, query, deletedBefore)
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// SoftDeleteStore is the soft-delete capability shared by every store whose table
+// has a deleted_at column:
+//
+//   - SoftDelete sets deleted_at. The row disappears from reads but can be brought
+//     back with Restore.
+//   - Reads (Get*, List, ...) hide soft-deleted rows, unless the context was made
+//     with ContextWithDeleted().
+//   - Updates never touch soft-deleted rows; they have to be restored first.
+//   - Purge hard-deletes the rows soft-deleted before a cutoff and returns their
+//     IDs. Rows that other rows still refer to are kept until those are purged too.
+type SoftDeleteStore interface {
+	SoftDelete(ctx context.Context, id int64) error
+	Restore(ctx context.Context, id int64) error
+	Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error)
+}
+
+type withDeletedContextKey struct{}
+
+// ContextWithDeleted returns a copy of ctx in which reads also return soft-deleted
+// rows. Admin screens use it to find rows to restore.
+func ContextWithDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withDeletedContextKey{}, true)
+}
+
+// withDeleted reports whether reads made with ctx should include soft-deleted rows.
+func withDeleted(ctx context.Context) bool {
+	include, _ := ctx.Value(withDeletedContextKey{}).(bool)
+	return include
+}
+
+// PurgeDeleted purges every soft-deletable store of rows deleted before
+// deletedBefore, children before parents, and returns the number of rows removed
+// per table. It stops at the first error.
+func (m Models) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (map[string]int, error) {
+	stores := []struct {
+		table string
+		store SoftDeleteStore
+	}{
+		{"request", m.Request},
+		{"price", m.Price},
+		{"service", m.Service},
+		{"company", m.Company},
+		{"regform", m.RegForm},
+		{"users", m.User},
+	}
+
+	purged := make(map[string]int)
+	for _, s := range stores {
+		ids, err := s.store.Purge(ctx, deletedBefore)
+		if err != nil {
+			return purged, err
+		}
+		purged[s.table] = len(ids)
+	}
+	return purged, nil
+}
+
+// NullTime is a timestamp column that may be NULL, such as deleted_at and
+// updated_at. It is encoded in JSON as null or an RFC 3339 string.
+type NullTime struct {
+	sql.NullTime
+}
+
+func nullTime(t time.Time) NullTime {
+	return NullTime{sql.NullTime{Time: t, Valid: !t.IsZero()}}
+}
+
+func nullTimeNow() NullTime {
+	return nullTime(time.Now())
+}
+
+func (t NullTime) MarshalJSON() ([]byte, error) {
+	if !t.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Time)
+}
+
+func (t *NullTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*t = NullTime{}
+		return nil
+	}
+	t.Valid = true
+	return json.Unmarshal(b, &t.Time)
+}
+
+// purgeRows runs a DELETE ... RETURNING id query for Purge() and collects the IDs.
+func purgeRows(ctx context.Context, db *sql.DB, query string, deletedBefore time.Time) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// ErrNoMigrations is returned by MigrationVersion() when the schema_migrations table
+// maintained by golang-migrate doesn't exist or is empty.
+var ErrNoMigrations = errors.New("no migrations have been applied")
+
+// SystemModel exposes information about the database connection pool itself rather
+// than about any particular table.
+type SystemModel struct {
+	DB *sql.DB
+}
+
+// Stats returns the connection pool statistics of the underlying sql.DB.
+func (s SystemModel) Stats() sql.DBStats {
+	return s.DB.Stats()
+}
+
+// Ping verifies that a connection to the database can be established.
+func (s SystemModel) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return s.DB.PingContext(ctx)
+}
+
+// MigrationVersion returns the schema version recorded by golang-migrate and whether
+// the last migration failed half-way (dirty).
+func (s SystemModel) MigrationVersion(ctx context.Context) (int64, bool, error) {
+	query := `
+SELECT version, dirty
+FROM schema_migrations
+LIMIT 1`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var version int64
+	var dirty bool
+
+	err := s.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		// Match on the SQLSTATE code rather than the message, which is localized by
+		// the server.
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, ErrNoMigrations
+		case errors.As(err, &pqErr) && pqErr.Code == "42P01": // undefined_table
+			return 0, false, ErrNoMigrations
+		default:
+			return 0, false, err
+		}
+	}
+	return version, dirty, nil
+}
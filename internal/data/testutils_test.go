@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// testDSNEnv names the environment variable with the DSN of a PostgreSQL database,
+// migrated to the latest version, to run the store tests against as well as the
+// in-memory stores. The tests add rows of their own and leave them there.
+const testDSNEnv = "CONCIERGE_TEST_DB_DSN"
+
+// eachStore runs test against the in-memory models and, if testDSNEnv is set, the
+// PostgreSQL ones.
+func eachStore(t *testing.T, test func(t *testing.T, m Models)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryModels())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(testDSNEnv)
+		if dsn == "" {
+			t.Skipf("%s is not set", testDSNEnv)
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		test(t, NewModels(db, nil))
+	})
+}
+
+// seedService creates a service, along with the company providing it and the
+// admin who added it. Names are unique so that the rows don't clash with those of
+// earlier runs against the same database.
+func seedService(t *testing.T, m Models) *Service {
+	t.Helper()
+
+	ctx := context.Background()
+	unique := time.Now().UnixNano() % 1_000_000_000
+	suffix := fmt.Sprint(unique)
+	admin := &User{FirstName: "Test", LastName: "Admin", Email: "admin" + suffix + "@example.com", Username: "admin" + suffix, UserType: UserTypeAdmin, Activated: true}
+	err := admin.Password.Set("pa55word123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.User.Insert(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	company := &Company{Code: int(unique), Name: "Resto " + suffix, FullName: "Resto " + suffix + " LLP"}
+	err = m.Company.Insert(ctx, company)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &Service{Name: "Dinner", Description: "A table for the evening", Type: "restaurant", CompanyID: int(company.ID), CreatedByID: admin.ID}
+	err = m.Service.Insert(ctx, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
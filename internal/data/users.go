@@ -5,8 +5,10 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/concierge/service/internal/validator"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
 	"time"
 )
 
@@ -15,25 +17,45 @@ var (
 )
 var AnonymousUser = &User{}
 
+// The user types (roles) known to the application. requirePermission() compares
+// User.UserType against these.
+const (
+	UserTypeAdmin     = "admin"
+	UserTypeCSManager = "csmanager"
+	UserTypeClient    = "client"
+	UserTypeB2BClient = "b2bclient"
+	UserTypePartner   = "partner"
+)
+
+// UserTypes lists every valid value of User.UserType.
+var UserTypes = []string{UserTypeAdmin, UserTypeCSManager, UserTypeClient, UserTypeB2BClient, UserTypePartner}
+
 type User struct {
-	ID          int64          `json:"id"`
-	FirstName   string         `json:"first_name"`
-	LastName    string         `json:"last_name"`
-	Email       string         `json:"email"`
-	Username    string         `json:"username"`
-	Password    password       `json:"password_hash"`
-	Activated   bool           `json:"activated"`
-	UserType    string         `json:"user_type"`
-	Preferences string         `json:"preferences"`
-	CreatedAt   time.Time      `json:"created_at"`
-	DeletedAt   sql.NullString `json:"deleted_at"`
-	UpdatedAt   sql.NullString `json:"updated_at"`
+	ID          int64       `json:"id"`
+	FirstName   string      `json:"first_name"`
+	LastName    string      `json:"last_name"`
+	Email       string      `json:"email"`
+	Username    string      `json:"username"`
+	Password    password    `json:"-"`
+	Activated   bool        `json:"activated"`
+	UserType    string      `json:"user_type"`
+	CompanyID   int64       `json:"company_id,omitempty"`
+	Preferences Preferences `json:"preferences"`
+	CreatedAt   time.Time   `json:"created_at"`
+	DeletedAt   NullTime    `json:"deleted_at"`
+	UpdatedAt   NullTime    `json:"updated_at"`
 }
 
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// IsClient reports whether the user is a B2C or B2B client, the users requests are
+// made for.
+func (u *User) IsClient() bool {
+	return u.UserType == UserTypeClient || u.UserType == UserTypeB2BClient
+}
+
 type UserModel struct {
 	DB *sql.DB
 }
@@ -75,6 +97,20 @@ func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
+func ValidateUserType(v *validator.Validator, userType string) {
+	v.Check(userType != "", "user_type", "must be provided")
+	v.Check(validator.In(userType, UserTypes...), "user_type", "must be one of "+strings.Join(UserTypes, ", "))
+}
+
+// ValidateUserCompany checks the company a user belongs to: partners work for the
+// company providing their services and must have one, B2B clients may have one,
+// and nobody else does.
+func ValidateUserCompany(v *validator.Validator, user *User) {
+	v.Check(user.CompanyID >= 0, "company_id", "must not be negative")
+	v.Check(user.UserType != UserTypePartner || user.CompanyID != 0, "company_id", "must be provided for partners")
+	v.Check(user.CompanyID == 0 || validator.In(user.UserType, UserTypePartner, UserTypeB2BClient), "company_id", "can only be set for partners and B2B clients")
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.FirstName != "", "firstname", "must be provided")
 	v.Check(len(user.FirstName) <= 500, "firstname", "must not be more than 500 bytes long")
@@ -98,13 +134,13 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
-func (u UserModel) Insert(user *User) error {
+func (u UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
-INSERT INTO users (first_name, last_name, email, username, password_hash, activated, user_type, preferences, created_at) 
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW()) 
+INSERT INTO users (first_name, last_name, email, username, password_hash, activated, user_type, company_id, preferences, created_at) 
+VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, 0), $9, NOW()) 
 RETURNING id`
-	args := []interface{}{user.FirstName, user.LastName, user.Email, user.Username, user.Password.hash, user.Activated, user.UserType, user.Preferences}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []interface{}{user.FirstName, user.LastName, user.Email, user.Username, user.Password.hash, user.Activated, user.UserType, user.CompanyID, user.Preferences}
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	err := u.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID)
@@ -120,17 +156,17 @@ RETURNING id`
 	return nil
 }
 
-func (u UserModel) GetByEmail(email string) (*User, error) {
+func (u UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-SELECT id, first_name, last_name, email, username, password_hash, activated, user_type, preferences, created_at, deleted_at, updated_at
+SELECT id, first_name, last_name, email, username, password_hash, activated, user_type, COALESCE(company_id, 0), preferences, created_at, deleted_at, updated_at
 FROM users
-WHERE email = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+WHERE email = $1 AND ($2 OR deleted_at IS NULL)`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var csEmployee User
 
-	err := u.DB.QueryRowContext(ctx, query, email).Scan(
+	err := u.DB.QueryRowContext(ctx, query, email, withDeleted(ctx)).Scan(
 		&csEmployee.ID,
 		&csEmployee.FirstName,
 		&csEmployee.LastName,
@@ -139,6 +175,7 @@ WHERE email = $1`
 		&csEmployee.Password.hash,
 		&csEmployee.Activated,
 		&csEmployee.UserType,
+		&csEmployee.CompanyID,
 		&csEmployee.Preferences,
 		&csEmployee.CreatedAt,
 		&csEmployee.DeletedAt,
@@ -155,17 +192,17 @@ WHERE email = $1`
 	return &csEmployee, nil
 }
 
-func (u UserModel) GetByUsername(username string) (*User, error) {
+func (u UserModel) GetByUsername(ctx context.Context, username string) (*User, error) {
 	query := `
-SELECT id, first_name, last_name, email, username, password_hash, activated, user_type, preferences, created_at, deleted_at, updated_at
+SELECT id, first_name, last_name, email, username, password_hash, activated, user_type, COALESCE(company_id, 0), preferences, created_at, deleted_at, updated_at
 FROM users
-WHERE username = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+WHERE username = $1 AND ($2 OR deleted_at IS NULL)`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var csEmployee User
 
-	err := u.DB.QueryRowContext(ctx, query, username).Scan(
+	err := u.DB.QueryRowContext(ctx, query, username, withDeleted(ctx)).Scan(
 		&csEmployee.ID,
 		&csEmployee.FirstName,
 		&csEmployee.LastName,
@@ -174,6 +211,7 @@ WHERE username = $1`
 		&csEmployee.Password.hash,
 		&csEmployee.Activated,
 		&csEmployee.UserType,
+		&csEmployee.CompanyID,
 		&csEmployee.Preferences,
 		&csEmployee.CreatedAt,
 		&csEmployee.DeletedAt,
@@ -191,16 +229,17 @@ WHERE username = $1`
 	return &csEmployee, nil
 }
 
-func (u UserModel) GetAll() ([]*User, error) {
+func (u UserModel) GetAll(ctx context.Context) ([]*User, error) {
 	// Declare the SQL statement
 	query := `
-SELECT id, first_name, last_name, email, username, password_hash, activated, user_type, preferences, created_at, deleted_at, updated_at
-FROM users`
+SELECT id, first_name, last_name, email, username, password_hash, activated, user_type, COALESCE(company_id, 0), preferences, created_at, deleted_at, updated_at
+FROM users
+WHERE $1 OR deleted_at IS NULL`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	rows, err := u.DB.QueryContext(ctx, query)
+	rows, err := u.DB.QueryContext(ctx, query, withDeleted(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -221,6 +260,7 @@ FROM users`
 			&csEmployee.Password.hash,
 			&csEmployee.Activated,
 			&csEmployee.UserType,
+			&csEmployee.CompanyID,
 			&csEmployee.Preferences,
 			&csEmployee.CreatedAt,
 			&csEmployee.DeletedAt,
@@ -239,11 +279,11 @@ FROM users`
 	return employees, nil
 }
 
-func (u UserModel) Update(user *User) error {
+func (u UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 UPDATE users
-SET first_name = $1, last_name = $2, email = $3, username = $4, password_hash = $5, activated = $6, user_type = $7, preferences = $8, updated_at = NOW()
-WHERE id = $9 AND deleted_at IS NULL
+SET first_name = $1, last_name = $2, email = $3, username = $4, password_hash = $5, activated = $6, user_type = $7, company_id = NULLIF($8, 0), preferences = $9, updated_at = NOW()
+WHERE id = $10 AND deleted_at IS NULL
 RETURNING updated_at`
 
 	args := []interface{}{
@@ -254,11 +294,12 @@ RETURNING updated_at`
 		user.Password.hash,
 		user.Activated,
 		user.UserType,
+		user.CompanyID,
 		user.Preferences,
 		user.ID,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	err := u.DB.QueryRowContext(ctx, query, args...).Scan(&user.UpdatedAt)
@@ -273,12 +314,12 @@ RETURNING updated_at`
 	return nil
 }
 
-func (u UserModel) Delete(id int64) error {
+func (u UserModel) Delete(ctx context.Context, id int64) error {
 	query := `
 DELETE FROM users
 WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	result, err := u.DB.ExecContext(ctx, query, id)
@@ -295,12 +336,12 @@ WHERE id = $1`
 	return nil
 }
 
-func (u UserModel) SoftDelete(id int64) error {
+func (u UserModel) SoftDelete(ctx context.Context, id int64) error {
 	query := `
 UPDATE users
 SET deleted_at = NOW() 
-WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+WHERE id = $1 AND deleted_at IS NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	result, err := u.DB.ExecContext(ctx, query, id)
@@ -317,25 +358,27 @@ WHERE id = $1`
 	return nil
 }
 
-func (u UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (u UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
-	// Set up the SQL query.
+	// Set up the SQL query. Soft-deleted users never authenticate, whatever the
+	// context says.
 	query := `
-SELECT users.id, first_name, last_name, email, username, password_hash, activated, user_type, preferences, created_at, deleted_at, updated_at
+SELECT users.id, first_name, last_name, email, username, password_hash, activated, user_type, COALESCE(company_id, 0), preferences, created_at, deleted_at, updated_at
 FROM users
 INNER JOIN tokens
 ON users.id = tokens.user_id
 WHERE tokens.hash = $1
 AND tokens.scope = $2
-AND tokens.expiry > $3`
+AND tokens.expiry > $3
+AND users.deleted_at IS NULL`
 	// Create a slice containing the query arguments. Notice how we use the [:] operator
 	// to get a slice containing the token hash, rather than passing in the array (which
 	// is not supported by the pq driver), and that we pass the current time as the
 	// value to check against the token expiry.
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var user User
@@ -351,6 +394,7 @@ AND tokens.expiry > $3`
 		&user.Password.hash,
 		&user.Activated,
 		&user.UserType,
+		&user.CompanyID,
 		&user.Preferences,
 		&user.CreatedAt,
 		&user.DeletedAt,
@@ -367,3 +411,169 @@ AND tokens.expiry > $3`
 	// Return the matching user.
 	return &user, nil
 }
+
+// UserFilter narrows down the users returned by List(). Zero values mean "don't
+// filter on this field".
+type UserFilter struct {
+	UserType  string
+	CompanyID int64
+	Activated *bool
+	Deleted   *bool
+	Search    string
+}
+
+// UserSortSafelist lists the values accepted for the sort parameter of List().
+var UserSortSafelist = []string{
+	"id", "first_name", "last_name", "email", "username", "user_type", "created_at",
+	"-id", "-first_name", "-last_name", "-email", "-username", "-user_type", "-created_at",
+}
+
+func (u UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, first_name, last_name, email, username, password_hash, activated, user_type, COALESCE(company_id, 0), preferences, created_at, deleted_at, updated_at
+FROM users
+WHERE id = $1 AND ($2 OR deleted_at IS NULL)`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var user User
+
+	err := u.DB.QueryRowContext(ctx, query, id, withDeleted(ctx)).Scan(
+		&user.ID,
+		&user.FirstName,
+		&user.LastName,
+		&user.Email,
+		&user.Username,
+		&user.Password.hash,
+		&user.Activated,
+		&user.UserType,
+		&user.CompanyID,
+		&user.Preferences,
+		&user.CreatedAt,
+		&user.DeletedAt,
+		&user.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// List returns one page of users matching filter, along with the pagination
+// metadata. Search matches anywhere in the full name, email or username.
+func (u UserModel) List(ctx context.Context, filter UserFilter, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, first_name, last_name, email, username, password_hash, activated, user_type, COALESCE(company_id, 0), preferences, created_at, deleted_at, updated_at
+FROM users
+WHERE ($1 = '' OR user_type = $1)
+AND ($2::boolean IS NULL OR activated = $2)
+AND ($3::boolean IS NULL OR (deleted_at IS NOT NULL) = $3)
+AND ($4 = '' OR (first_name || ' ' || last_name) ILIKE $5 OR email ILIKE $5 OR username ILIKE $5)
+AND ($6 OR deleted_at IS NULL)
+AND ($9 = 0 OR company_id = $9)
+ORDER BY %s %s, id ASC
+LIMIT $7 OFFSET $8`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		filter.UserType,
+		filter.Activated,
+		filter.Deleted,
+		filter.Search,
+		likePattern(filter.Search),
+		withDeleted(ctx),
+		filters.limit(),
+		filters.offset(),
+		filter.CompanyID,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rows, err := u.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.FirstName,
+			&user.LastName,
+			&user.Email,
+			&user.Username,
+			&user.Password.hash,
+			&user.Activated,
+			&user.UserType,
+			&user.CompanyID,
+			&user.Preferences,
+			&user.CreatedAt,
+			&user.DeletedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
+// Restore undoes SoftDelete().
+func (u UserModel) Restore(ctx context.Context, id int64) error {
+	query := `
+UPDATE users
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := u.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Purge keeps users who are still referred to by requests, services, service
+// changes, approvals they decided, messages they wrote or a deposit account. Their
+// tokens, budgets, approver roles and read receipts go with them.
+func (u UserModel) Purge(ctx context.Context, deletedBefore time.Time) ([]int64, error) {
+	query := `
+DELETE FROM users
+WHERE deleted_at < $1
+AND NOT EXISTS (SELECT 1 FROM request WHERE request.client_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM service WHERE service.created_by_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM service_change WHERE service_change.proposed_by_id = users.id OR service_change.reviewed_by_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM account WHERE account.user_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM approval WHERE approval.decided_by_id = users.id)
+AND NOT EXISTS (SELECT 1 FROM message WHERE message.author_id = users.id)
+RETURNING id`
+	return purgeRows(ctx, u.DB, query, deletedBefore)
+}
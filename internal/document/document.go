@@ -0,0 +1,85 @@
+// Package document renders the documents the service hands out to clients, such as
+// invoices, from the templates embedded in it.
+package document
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"io"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/concierge/service/internal/data"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+var funcs = map[string]interface{}{
+	"money":  Money,
+	"date":   date,
+	"period": PeriodName,
+}
+
+var (
+	htmlTemplates = htmltemplate.Must(htmltemplate.New("").Funcs(funcs).ParseFS(templateFS, "templates/*.html"))
+	textTemplates = texttemplate.Must(texttemplate.New("").Funcs(funcs).ParseFS(templateFS, "templates/*.txt"))
+)
+
+// Invoice is the data the invoice templates are executed with.
+type Invoice struct {
+	*data.Invoice
+	Company *data.Company
+}
+
+// InvoiceHTML writes the invoice as an HTML page.
+func InvoiceHTML(w io.Writer, invoice Invoice) error {
+	return htmlTemplates.ExecuteTemplate(w, "invoice.html", invoice)
+}
+
+// InvoicePDF writes the invoice as a PDF file. The PDF is the text rendering of the
+// invoice typeset in a monospaced font, which keeps its columns aligned.
+func InvoicePDF(w io.Writer, invoice Invoice) error {
+	text := new(bytes.Buffer)
+	err := textTemplates.ExecuteTemplate(text, "invoice.txt", invoice)
+	if err != nil {
+		return err
+	}
+	return writePDF(w, strings.Split(text.String(), "\n"))
+}
+
+// Money formats an amount with its thousands separated, e.g. 1 250 000.
+func Money(amount int) string {
+	digits := strconv.Itoa(amount)
+	sign := ""
+	if amount < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	var b strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(digit)
+	}
+	return sign + b.String()
+}
+
+func date(t data.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.UTC().Format("02 Jan 2006")
+}
+
+// PeriodName turns an invoice period into the name of its month, e.g. March 2024.
+func PeriodName(period string) string {
+	start, err := time.Parse(data.InvoicePeriodLayout, period)
+	if err != nil {
+		return period
+	}
+	return start.Format("January 2006")
+}
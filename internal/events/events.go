@@ -0,0 +1,273 @@
+// Package events fans out what happens to requests and bookings to the users
+// watching them, while they are connected. The Hub lives in memory: it is meant to
+// push changes to open pages as they happen, not to deliver them reliably, so
+// anything a subscriber misses can always be read again from the API.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Subscribe() once the hub has been closed.
+var ErrClosed = errors.New("events: hub closed")
+
+// Audience is who an event is for: the users with the given IDs, the concierge
+// (CS managers and admins) and the partners of a company. The zero value is no
+// one.
+type Audience struct {
+	UserIDs   []int64
+	Concierge bool
+	CompanyID int64
+}
+
+// Event is something that happened, with its data already encoded as JSON so that
+// it is only encoded once however many subscribers it goes to. IDs increase with
+// every event published by a hub.
+type Event struct {
+	ID        int64
+	Type      string
+	Data      json.RawMessage
+	CreatedAt time.Time
+
+	to Audience
+}
+
+// Subscriber is someone listening to a hub: a user, who also hears the concierge
+// events if Concierge is set, and the events of the partner company CompanyID if
+// it isn't 0.
+type Subscriber struct {
+	UserID    int64
+	Concierge bool
+	CompanyID int64
+
+	events chan *Event
+}
+
+// Events returns the channel the events for the subscriber are sent on. It is
+// closed when the subscriber falls too far behind or the hub is closed.
+func (s *Subscriber) Events() <-chan *Event {
+	return s.events
+}
+
+// hears reports whether an event is for the subscriber.
+func (s *Subscriber) hears(e *Event) bool {
+	if e.to.Concierge && s.Concierge {
+		return true
+	}
+	if e.to.CompanyID != 0 && e.to.CompanyID == s.CompanyID {
+		return true
+	}
+	for _, id := range e.to.UserIDs {
+		if id == s.UserID {
+			return true
+		}
+	}
+	return false
+}
+
+type subscriberSet map[*Subscriber]struct{}
+
+// Hub hands the events published to it to the subscribers they are for. Sending
+// never blocks the publisher: a subscriber whose buffer is full is dropped, and is
+// expected to subscribe again with the ID of the last event it got. The hub keeps
+// its most recent events so that they can be replayed then. The zero value is not
+// usable; create one with NewHub().
+type Hub struct {
+	mu      sync.Mutex
+	closed  bool
+	lastID  int64
+	dropped int64
+
+	// Subscribers are indexed by who they are, so that publishing an event only
+	// looks at the ones it is for, however many are connected.
+	byUser     map[int64]subscriberSet
+	byCompany  map[int64]subscriberSet
+	concierge  subscriberSet
+	count      int
+	bufferSize int
+
+	// history is a ring of the last len(history) events; next is where the next
+	// one goes.
+	history []*Event
+	next    int
+}
+
+// NewHub returns a hub that buffers up to bufferSize events per subscriber and
+// keeps the last historySize events for replays.
+func NewHub(bufferSize, historySize int) *Hub {
+	return &Hub{
+		byUser:     make(map[int64]subscriberSet),
+		byCompany:  make(map[int64]subscriberSet),
+		concierge:  make(subscriberSet),
+		bufferSize: bufferSize,
+		history:    make([]*Event, historySize),
+	}
+}
+
+// Publish sends an event to the subscribers in its audience. data is encoded as
+// JSON.
+func (h *Hub) Publish(eventType string, data interface{}, to Audience) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+
+	h.lastID++
+	e := &Event{ID: h.lastID, Type: eventType, Data: js, CreatedAt: time.Now(), to: to}
+	if len(h.history) > 0 {
+		h.history[h.next] = e
+		h.next = (h.next + 1) % len(h.history)
+	}
+
+	// A subscriber can be in the audience more than once, e.g. a CS manager who
+	// is also one of the users; they get the event once.
+	sent := make(subscriberSet)
+	send := func(subs subscriberSet) {
+		for s := range subs {
+			if _, ok := sent[s]; ok {
+				continue
+			}
+			sent[s] = struct{}{}
+			select {
+			case s.events <- e:
+			default:
+				h.remove(s)
+				h.dropped++
+			}
+		}
+	}
+
+	for _, id := range to.UserIDs {
+		send(h.byUser[id])
+	}
+	if to.Concierge {
+		send(h.concierge)
+	}
+	if to.CompanyID != 0 {
+		send(h.byCompany[to.CompanyID])
+	}
+	return nil
+}
+
+// Subscribe adds a subscriber to the hub. If lastID isn't 0, it also returns the
+// events for the subscriber published since the event with that ID, oldest first;
+// complete is false if some of them are no longer kept, in which case the
+// subscriber should read what it missed from the API instead.
+func (h *Hub) Subscribe(s *Subscriber, lastID int64) (missed []*Event, complete bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false, ErrClosed
+	}
+
+	complete = true
+	if lastID > 0 {
+		missed, complete = h.since(s, lastID)
+	}
+
+	s.events = make(chan *Event, h.bufferSize)
+	add(h.byUser, s.UserID, s)
+	if s.Concierge {
+		h.concierge[s] = struct{}{}
+	}
+	if s.CompanyID != 0 {
+		add(h.byCompany, s.CompanyID, s)
+	}
+	h.count++
+	return missed, complete, nil
+}
+
+// since returns the events kept for s with an ID above lastID, and whether every
+// such event was still kept.
+func (h *Hub) since(s *Subscriber, lastID int64) ([]*Event, bool) {
+	events := []*Event{}
+	for i := range h.history {
+		e := h.history[(h.next+i)%len(h.history)]
+		if e != nil && e.ID > lastID && s.hears(e) {
+			events = append(events, e)
+		}
+	}
+	// An ID the hub hasn't given out yet (e.g. one from before a restart) can't be
+	// trusted either.
+	oldest := h.lastID - int64(len(h.history)) + 1
+	return events, lastID <= h.lastID && lastID+1 >= oldest
+}
+
+// Unsubscribe removes a subscriber from the hub and closes its channel. It does
+// nothing if the subscriber was already removed.
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+func (h *Hub) remove(s *Subscriber) {
+	subs, ok := h.byUser[s.UserID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[s]; !ok {
+		return
+	}
+
+	del(h.byUser, s.UserID, s)
+	delete(h.concierge, s)
+	if s.CompanyID != 0 {
+		del(h.byCompany, s.CompanyID, s)
+	}
+	h.count--
+	close(s.events)
+}
+
+// Close removes every subscriber, closing their channels, and stops the hub from
+// taking new ones. Events published afterwards are discarded.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, subs := range h.byUser {
+		for s := range subs {
+			h.remove(s)
+		}
+	}
+}
+
+// Subscribers returns the number of subscribers currently connected.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Dropped returns the number of subscribers dropped so far for falling behind.
+func (h *Hub) Dropped() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
+
+func add(index map[int64]subscriberSet, key int64, s *Subscriber) {
+	subs, ok := index[key]
+	if !ok {
+		subs = make(subscriberSet)
+		index[key] = subs
+	}
+	subs[s] = struct{}{}
+}
+
+func del(index map[int64]subscriberSet, key int64, s *Subscriber) {
+	subs := index[key]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(index, key)
+	}
+}
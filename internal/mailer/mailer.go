@@ -2,9 +2,12 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"errors"
 	"github.com/go-mail/mail/v2"
 	"html/template"
+	"io"
 	"time"
 )
 
@@ -17,6 +20,10 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
+// ErrNotConfigured is returned when a zero-value Mailer (one not created with New)
+// is asked to talk to an SMTP server.
+var ErrNotConfigured = errors.New("mailer: no SMTP server configured")
+
 // Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
 // SMTP server) and the sender information for your emails (the name and address you
 // want the email to be from, such as "Alice Smith <alice@example.com>").
@@ -37,10 +44,21 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
+// Attachment is a file attached to an email, such as an invoice PDF.
+type Attachment struct {
+	Filename string
+	Data     []byte
+}
+
 // Define a Send() method on the Mailer type. This takes the recipient email address
 // as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an interface{} parameter.
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+// dynamic data for the templates as an interface{} parameter, followed by the files
+// to attach, if any.
+func (m Mailer) Send(recipient, templateFile string, data interface{}, attachments ...Attachment) error {
+	if m.dialer == nil {
+		return ErrNotConfigured
+	}
+
 	// Use the ParseFS() method to parse the required template file from the embedded
 	// file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
@@ -78,6 +96,15 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	msg.SetHeader("Subject", subject.String())
 	msg.SetBody("text/plain", plainBody.String())
 	msg.AddAlternative("text/html", htmlBody.String())
+	// The attachments are copied from memory on every attempt below, as a reader
+	// would be used up by the first one.
+	for _, attachment := range attachments {
+		content := attachment.Data
+		msg.Attach(attachment.Filename, mail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		}))
+	}
 	// Call the DialAndSend() method on the dialer, passing in the message to send. This
 	// opens a connection to the SMTP server, sends the message, then closes the
 	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
@@ -99,3 +126,30 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 
 	return err
 }
+
+// Ping opens a connection to the SMTP server, authenticates if credentials are
+// configured, and closes it again without sending anything. It is used by the
+// readiness check to verify the mail transport is reachable. Ping gives up when ctx
+// is done; the dialer can't be interrupted, so a connection that is made afterwards
+// is closed in the background.
+func (m Mailer) Ping(ctx context.Context) error {
+	if m.dialer == nil {
+		return ErrNotConfigured
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		sender, err := m.dialer.Dial()
+		if err == nil {
+			err = sender.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
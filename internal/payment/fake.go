@@ -0,0 +1,223 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment method tokens the fake declines. Any other token is approved.
+const (
+	FakeDeclinedCard      = "tok_declined"
+	FakeInsufficientFunds = "tok_insufficient_funds"
+)
+
+// FakeSignatureHeader carries the signature of the webhooks of the fake, in the
+// format t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">.
+const FakeSignatureHeader = "Fake-Signature"
+
+// webhookTolerance is how old a signed webhook may be, which limits replays.
+const webhookTolerance = 5 * time.Minute
+
+type fakePayment struct {
+	amount   int
+	status   string
+	refunded int
+}
+
+// Fake is a payment processor that lives in memory. It is deterministic: the
+// reference of a payment is derived from the idempotency key it was authorized
+// with, and whether it is declined only depends on its payment method, see
+// FakeDeclinedCard and FakeInsufficientFunds. It forgets its payments when the
+// process exits.
+type Fake struct {
+	secret []byte
+	now    func() time.Time
+
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+	results  map[string]Result
+}
+
+// NewFake returns a Fake whose webhooks are signed with secret.
+func NewFake(secret string) *Fake {
+	return &Fake{
+		secret:   []byte(secret),
+		now:      time.Now,
+		payments: make(map[string]*fakePayment),
+		results:  make(map[string]Result),
+	}
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error) {
+	if req.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := "authorize:" + req.IdempotencyKey
+	if result, ok := f.results[key]; ok {
+		return &result, nil
+	}
+
+	sum := sha256.Sum256([]byte(req.IdempotencyKey))
+	result := Result{Ref: "fake_" + hex.EncodeToString(sum[:12]), Status: StatusAuthorized}
+	switch req.PaymentMethod {
+	case FakeDeclinedCard:
+		result.Status, result.DeclineReason = StatusDeclined, "card_declined"
+	case FakeInsufficientFunds:
+		result.Status, result.DeclineReason = StatusDeclined, "insufficient_funds"
+	default:
+		f.payments[result.Ref] = &fakePayment{amount: req.Amount, status: StatusAuthorized}
+	}
+	f.results[key] = result
+	return &result, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, ref string, amount int, idempotencyKey string) (*Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := "capture:" + idempotencyKey
+	if result, ok := f.results[key]; ok {
+		return &result, nil
+	}
+
+	p, ok := f.payments[ref]
+	switch {
+	case !ok:
+		return nil, ErrUnknownPayment
+	case p.status != StatusAuthorized || amount <= 0 || amount > p.amount:
+		return nil, ErrInvalidAmount
+	}
+	p.amount = amount
+	p.status = StatusCaptured
+
+	result := Result{Ref: ref, Status: p.status}
+	f.results[key] = result
+	return &result, nil
+}
+
+func (f *Fake) Refund(ctx context.Context, ref string, amount int, idempotencyKey string) (*Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := "refund:" + idempotencyKey
+	if result, ok := f.results[key]; ok {
+		return &result, nil
+	}
+
+	p, ok := f.payments[ref]
+	if !ok {
+		return nil, ErrUnknownPayment
+	}
+	switch p.status {
+	case StatusAuthorized:
+		p.status = StatusVoided
+	case StatusCaptured:
+		if amount <= 0 || amount > p.amount-p.refunded {
+			return nil, ErrInvalidAmount
+		}
+		p.refunded += amount
+		if p.refunded == p.amount {
+			p.status = StatusRefunded
+		}
+	default:
+		return nil, ErrInvalidAmount
+	}
+
+	result := Result{Ref: ref, Status: p.status, Refunded: p.refunded}
+	f.results[key] = result
+	return &result, nil
+}
+
+// fakeEvent is the body of the webhooks of the fake.
+type fakeEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Payment string `json:"payment"`
+	Amount  int    `json:"amount"`
+	Reason  string `json:"reason,omitempty"`
+	Created int64  `json:"created"`
+}
+
+// Webhook returns the body and the signature header of the webhook the fake would
+// send to report event, e.g. to try out the webhook endpoint locally.
+func (f *Fake) Webhook(event Event) ([]byte, http.Header, error) {
+	payload, err := json.Marshal(fakeEvent{
+		ID:      event.ID,
+		Type:    event.Type,
+		Payment: event.Ref,
+		Amount:  event.Amount,
+		Reason:  event.Reason,
+		Created: event.CreatedAt.Unix(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timestamp := strconv.FormatInt(f.now().Unix(), 10)
+	header := make(http.Header)
+	header.Set(FakeSignatureHeader, fmt.Sprintf("t=%s,v1=%s", timestamp, f.sign(timestamp, payload)))
+	return payload, header, nil
+}
+
+func (f *Fake) sign(timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *Fake) VerifyWebhook(payload []byte, header http.Header) (*Event, error) {
+	var timestamp, signature string
+	for _, part := range strings.Split(header.Get(FakeSignatureHeader), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(f.secret) == 0 {
+		return nil, ErrInvalidSignature
+	}
+	if age := f.now().Sub(time.Unix(unix, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return nil, ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(f.sign(timestamp, payload))) {
+		return nil, ErrInvalidSignature
+	}
+
+	var body fakeEvent
+	err = json.Unmarshal(payload, &body)
+	if err != nil {
+		return nil, fmt.Errorf("payment: malformed webhook: %w", err)
+	}
+	return &Event{
+		ID:        body.ID,
+		Type:      body.Type,
+		Ref:       body.Payment,
+		Amount:    body.Amount,
+		Reason:    body.Reason,
+		CreatedAt: time.Unix(body.Created, 0),
+	}, nil
+}
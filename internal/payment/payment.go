@@ -0,0 +1,92 @@
+// Package payment talks to the payment processor that takes the money for bookings.
+// Handlers only use the Gateway interface, so a real processor can be plugged in by
+// implementing it; Fake stands in for one during development and in tests.
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned by VerifyWebhook() for requests that weren't
+	// signed by the processor, or were signed too long ago to be trusted.
+	ErrInvalidSignature = errors.New("payment: invalid webhook signature")
+	// ErrUnknownPayment is returned for a processor reference the processor
+	// doesn't know.
+	ErrUnknownPayment = errors.New("payment: unknown payment")
+	// ErrInvalidAmount is returned when capturing or refunding more than the
+	// payment allows.
+	ErrInvalidAmount = errors.New("payment: invalid amount")
+)
+
+// Statuses of a payment at the processor, see Result.
+const (
+	StatusAuthorized = "authorized"
+	StatusCaptured   = "captured"
+	StatusRefunded   = "refunded"
+	StatusVoided     = "voided"
+	StatusDeclined   = "declined"
+)
+
+// Types of the events the processor reports through webhooks.
+const (
+	EventCaptured = "payment.captured"
+	EventRefunded = "payment.refunded"
+	EventFailed   = "payment.failed"
+)
+
+// Gateway is a payment processor. Every call that moves money takes an idempotency
+// key: calling again with the same key returns the result of the first call rather
+// than moving the money twice, so that a call whose outcome is unknown, e.g.
+// after a timeout, can safely be retried.
+type Gateway interface {
+	// Name identifies the processor in the payments recorded with it.
+	Name() string
+	// Authorize holds the amount on the client's payment method. A declined
+	// payment isn't an error: the result says why it was declined.
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error)
+	// Capture takes the money held by an authorization.
+	Capture(ctx context.Context, ref string, amount int, idempotencyKey string) (*Result, error)
+	// Refund gives back some of the money captured, or releases an authorization
+	// that hasn't been captured.
+	Refund(ctx context.Context, ref string, amount int, idempotencyKey string) (*Result, error)
+	// VerifyWebhook checks that a webhook request comes from the processor and
+	// returns the event it reports.
+	VerifyWebhook(payload []byte, header http.Header) (*Event, error)
+}
+
+type AuthorizeRequest struct {
+	Amount   int
+	Currency string
+	// PaymentMethod is the token the processor's client-side library gave the
+	// client for their card, so that card details never reach us.
+	PaymentMethod string
+	// Reference is what the payment is for, shown in the processor's dashboard.
+	Reference      string
+	IdempotencyKey string
+}
+
+// Result is the state of a payment at the processor after a call.
+type Result struct {
+	// Ref is the processor's ID of the payment.
+	Ref           string
+	Status        string
+	DeclineReason string
+	// Refunded is the total refunded so far, refunds made outside of the API
+	// included.
+	Refunded int
+}
+
+// Event is a change in a payment reported by the processor. Amount is the amount
+// captured for EventCaptured and the total refunded for EventRefunded.
+type Event struct {
+	ID        string
+	Type      string
+	Ref       string
+	Amount    int
+	Reason    string
+	CreatedAt time.Time
+}
@@ -0,0 +1 @@
+-- Nothing to undo: the column and index belong to 000001 now.
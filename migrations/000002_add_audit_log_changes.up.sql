@@ -0,0 +1,11 @@
+-- audit_log is now created with its changes column and created_at index in
+-- 000001. This migration is kept so that databases created before that still get
+-- them, and does nothing on the others.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'audit_log' AND column_name = 'details') THEN
+        ALTER TABLE audit_log RENAME COLUMN details TO changes;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
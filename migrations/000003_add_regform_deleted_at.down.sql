@@ -0,0 +1 @@
+ALTER TABLE regform DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,5 @@
+ALTER TABLE regform ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+ALTER TABLE service ALTER COLUMN deleted_at DROP NOT NULL;
+ALTER TABLE price ALTER COLUMN deleted_at DROP NOT NULL;
+ALTER TABLE company ALTER COLUMN deleted_at DROP NOT NULL;
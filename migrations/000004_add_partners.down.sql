@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS service_change;
+DROP TABLE IF EXISTS booking;
+ALTER TABLE users DROP COLUMN IF EXISTS company_id;
@@ -0,0 +1,35 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS company_id bigint REFERENCES company;
+
+CREATE INDEX IF NOT EXISTS users_company_id_idx ON users (company_id);
+
+CREATE TABLE IF NOT EXISTS booking (
+    id bigserial PRIMARY KEY,
+    request_id bigint NOT NULL REFERENCES request ON DELETE CASCADE,
+    service_id bigint NOT NULL REFERENCES service,
+    partner_status text NOT NULL DEFAULT 'pending',
+    partner_note text NOT NULL DEFAULT '',
+    fulfilment_status text NOT NULL DEFAULT 'not_started',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS booking_request_id_idx ON booking (request_id);
+CREATE INDEX IF NOT EXISTS booking_service_id_idx ON booking (service_id);
+
+CREATE TABLE IF NOT EXISTS service_change (
+    id bigserial PRIMARY KEY,
+    service_id bigint NOT NULL REFERENCES service ON DELETE CASCADE,
+    proposed_by_id bigint NOT NULL REFERENCES users,
+    description text NOT NULL,
+    prices jsonb NOT NULL DEFAULT '[]',
+    status text NOT NULL DEFAULT 'pending',
+    reviewed_by_id bigint REFERENCES users,
+    review_note text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    reviewed_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- A service has at most one change awaiting approval at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS service_change_pending_idx ON service_change (service_id) WHERE status = 'pending';
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS request_client_id_idx;
+
+ALTER TABLE booking DROP COLUMN IF EXISTS cancellation_fee;
+ALTER TABLE booking DROP COLUMN IF EXISTS cancel_reason;
+ALTER TABLE booking DROP COLUMN IF EXISTS cancelled_at;
+ALTER TABLE booking DROP COLUMN IF EXISTS ends_at;
+ALTER TABLE booking DROP COLUMN IF EXISTS starts_at;
+ALTER TABLE booking DROP COLUMN IF EXISTS party_size;
+ALTER TABLE booking DROP COLUMN IF EXISTS quantity;
+ALTER TABLE booking DROP COLUMN IF EXISTS unit_price;
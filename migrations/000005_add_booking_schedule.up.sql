@@ -0,0 +1,15 @@
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS unit_price integer NOT NULL DEFAULT 0;
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS quantity integer NOT NULL DEFAULT 1;
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS party_size integer NOT NULL DEFAULT 1;
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS starts_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS ends_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS cancelled_at timestamp(0) with time zone;
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS cancel_reason text NOT NULL DEFAULT '';
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS cancellation_fee integer NOT NULL DEFAULT 0;
+
+-- The defaults above only fill in the bookings made before scheduling existed; new
+-- bookings always come with their own window.
+ALTER TABLE booking ALTER COLUMN starts_at DROP DEFAULT;
+ALTER TABLE booking ALTER COLUMN ends_at DROP DEFAULT;
+
+CREATE INDEX IF NOT EXISTS request_client_id_idx ON request (client_id);
@@ -0,0 +1,3 @@
+ALTER TABLE booking DROP COLUMN IF EXISTS reservation_id;
+DROP TABLE IF EXISTS slot_reservation;
+DROP TABLE IF EXISTS availability;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS availability (
+    service_id bigint PRIMARY KEY REFERENCES service ON DELETE CASCADE,
+    windows jsonb NOT NULL DEFAULT '[]',
+    exceptions jsonb NOT NULL DEFAULT '[]',
+    updated_at timestamp(0) with time zone
+);
+
+CREATE TABLE IF NOT EXISTS slot_reservation (
+    id bigserial PRIMARY KEY,
+    service_id bigint NOT NULL REFERENCES service ON DELETE CASCADE,
+    starts_at timestamp(0) with time zone NOT NULL,
+    ends_at timestamp(0) with time zone NOT NULL,
+    units integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS slot_reservation_service_id_starts_at_idx ON slot_reservation (service_id, starts_at);
+
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS reservation_id bigint REFERENCES slot_reservation ON DELETE SET NULL;
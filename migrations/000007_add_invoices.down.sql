@@ -0,0 +1,5 @@
+ALTER TABLE booking DROP COLUMN IF EXISTS invoice_id;
+DROP TABLE IF EXISTS invoice_number;
+DROP TABLE IF EXISTS invoice_line;
+DROP TABLE IF EXISTS invoice;
+ALTER TABLE booking DROP COLUMN IF EXISTS completed_at;
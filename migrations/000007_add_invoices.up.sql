@@ -0,0 +1,41 @@
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS completed_at timestamp(0) with time zone;
+
+-- Bookings completed before completed_at existed are dated by their end.
+UPDATE booking SET completed_at = ends_at WHERE fulfilment_status = 'completed' AND completed_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS invoice (
+    id bigserial PRIMARY KEY,
+    number text UNIQUE,
+    company_id bigint NOT NULL REFERENCES company,
+    period text NOT NULL,
+    status text NOT NULL DEFAULT 'draft',
+    total integer NOT NULL DEFAULT 0,
+    issued_at timestamp(0) with time zone,
+    due_at timestamp(0) with time zone,
+    paid_at timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1,
+    UNIQUE (company_id, period)
+);
+
+CREATE TABLE IF NOT EXISTS invoice_line (
+    id bigserial PRIMARY KEY,
+    invoice_id bigint NOT NULL REFERENCES invoice ON DELETE CASCADE,
+    booking_id bigint NOT NULL REFERENCES booking,
+    description text NOT NULL,
+    quantity integer NOT NULL,
+    unit_price integer NOT NULL,
+    amount integer NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS invoice_line_invoice_id_idx ON invoice_line (invoice_id);
+
+-- The last invoice number handed out in each year. Numbers are only taken when an
+-- invoice is issued, so that they have no gaps.
+CREATE TABLE IF NOT EXISTS invoice_number (
+    year integer PRIMARY KEY,
+    last integer NOT NULL
+);
+
+ALTER TABLE booking ADD COLUMN IF NOT EXISTS invoice_id bigint REFERENCES invoice;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS payment_event;
+DROP TABLE IF EXISTS payment_refund;
+DROP TABLE IF EXISTS payment;
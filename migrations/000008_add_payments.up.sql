@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS payment (
+    id bigserial PRIMARY KEY,
+    booking_id bigint NOT NULL REFERENCES booking,
+    user_id bigint NOT NULL REFERENCES users,
+    amount integer NOT NULL,
+    refunded integer NOT NULL DEFAULT 0,
+    currency text NOT NULL,
+    status text NOT NULL,
+    provider text NOT NULL,
+    provider_ref text NOT NULL,
+    decline_reason text NOT NULL DEFAULT '',
+    idempotency_key text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT payment_idempotency_key UNIQUE (user_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS payment_booking_id_idx ON payment (booking_id);
+CREATE INDEX IF NOT EXISTS payment_provider_ref_idx ON payment (provider, provider_ref);
+
+-- A booking is paid at most once: declined, voided and refunded payments don't
+-- count.
+CREATE UNIQUE INDEX IF NOT EXISTS payment_booking_paid ON payment (booking_id) WHERE status IN ('authorized', 'captured');
+
+CREATE TABLE IF NOT EXISTS payment_refund (
+    id bigserial PRIMARY KEY,
+    payment_id bigint NOT NULL REFERENCES payment ON DELETE CASCADE,
+    amount integer NOT NULL,
+    idempotency_key text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    CONSTRAINT payment_refund_idempotency_key UNIQUE (payment_id, idempotency_key)
+);
+
+-- The webhook events already handled, so that redelivered ones are skipped.
+CREATE TABLE IF NOT EXISTS payment_event (
+    provider text NOT NULL,
+    event_id text NOT NULL,
+    received_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (provider, event_id)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS ledger_entry;
+DROP TABLE IF EXISTS ledger_transaction;
+DROP TABLE IF EXISTS account;
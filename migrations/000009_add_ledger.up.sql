@@ -0,0 +1,51 @@
+-- Accounts of the ledger. Deposits hold the money a client, or the company of B2B
+-- clients, prepaid; cash and revenue are the concierge's own accounts, which money
+-- comes into deposits from and goes to when bookings are debited.
+CREATE TABLE IF NOT EXISTS account (
+    id bigserial PRIMARY KEY,
+    kind text NOT NULL,
+    user_id bigint REFERENCES users,
+    company_id bigint REFERENCES company,
+    balance integer NOT NULL DEFAULT 0,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT account_user UNIQUE (user_id),
+    CONSTRAINT account_company UNIQUE (company_id),
+    CONSTRAINT account_deposit_owner CHECK (kind <> 'deposit' OR ((user_id IS NULL) <> (company_id IS NULL))),
+    -- Backs up the check made when posting: a deposit is never overdrawn.
+    CONSTRAINT account_deposit_balance CHECK (kind <> 'deposit' OR balance >= 0)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS account_system_kind ON account (kind) WHERE kind <> 'deposit';
+
+INSERT INTO account (kind) VALUES ('cash'), ('revenue') ON CONFLICT DO NOTHING;
+
+-- A transaction moves money into or out of a deposit. Its entries, one per
+-- account, add up to zero.
+CREATE TABLE IF NOT EXISTS ledger_transaction (
+    id bigserial PRIMARY KEY,
+    account_id bigint NOT NULL REFERENCES account,
+    kind text NOT NULL,
+    amount integer NOT NULL CHECK (amount > 0),
+    booking_id bigint REFERENCES booking,
+    note text NOT NULL DEFAULT '',
+    idempotency_key text,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    CONSTRAINT ledger_transaction_idempotency_key UNIQUE (account_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS ledger_transaction_booking_id_idx ON ledger_transaction (booking_id);
+
+-- A booking is debited at most once.
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_transaction_booking_debit ON ledger_transaction (booking_id) WHERE kind = 'debit';
+
+CREATE TABLE IF NOT EXISTS ledger_entry (
+    id bigserial PRIMARY KEY,
+    transaction_id bigint NOT NULL REFERENCES ledger_transaction,
+    account_id bigint NOT NULL REFERENCES account,
+    amount integer NOT NULL,
+    balance integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entry_account_id_idx ON ledger_entry (account_id, created_at, id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS approval;
+DROP TABLE IF EXISTS approver;
+DROP TABLE IF EXISTS approval_rule;
+DROP TABLE IF EXISTS budget;
@@ -0,0 +1,44 @@
+-- The spending controls of a company: monthly budgets for the company as a whole
+-- (user_id NULL) and for some of its employees, the rules that decide which
+-- bookings need approval, and the employees who approve them. They are set all at
+-- once, so they go with the company.
+CREATE TABLE IF NOT EXISTS budget (
+    company_id bigint NOT NULL REFERENCES company ON DELETE CASCADE,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    monthly_limit integer NOT NULL CHECK (monthly_limit > 0)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS budget_company_idx ON budget (company_id) WHERE user_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS budget_user_idx ON budget (company_id, user_id) WHERE user_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS approval_rule (
+    id bigserial PRIMARY KEY,
+    company_id bigint NOT NULL REFERENCES company ON DELETE CASCADE,
+    kind text NOT NULL,
+    threshold integer NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS approval_rule_company_id_idx ON approval_rule (company_id);
+
+CREATE TABLE IF NOT EXISTS approver (
+    company_id bigint NOT NULL REFERENCES company ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    PRIMARY KEY (company_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS approval (
+    id bigserial PRIMARY KEY,
+    booking_id bigint NOT NULL UNIQUE REFERENCES booking ON DELETE CASCADE,
+    company_id bigint NOT NULL REFERENCES company,
+    requested_by_id bigint NOT NULL REFERENCES users,
+    amount integer NOT NULL,
+    reasons text[] NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    decided_by_id bigint REFERENCES users,
+    note text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    decided_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS approval_company_id_idx ON approval (company_id, status);
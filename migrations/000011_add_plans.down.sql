@@ -0,0 +1,3 @@
+ALTER TABLE request DROP COLUMN IF EXISTS respond_by;
+DROP TABLE IF EXISTS subscription;
+DROP TABLE IF EXISTS plan;
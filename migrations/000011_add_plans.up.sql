@@ -0,0 +1,38 @@
+-- Subscription plans sold to clients and companies: how many requests a month they
+-- include (0 for unlimited), how quickly the concierge answers a request, in
+-- hours (0 for no commitment), and the discount, in percent, on the price of the
+-- services booked.
+CREATE TABLE IF NOT EXISTS plan (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    request_quota integer NOT NULL DEFAULT 0 CHECK (request_quota >= 0),
+    response_hours integer NOT NULL DEFAULT 0 CHECK (response_hours >= 0),
+    discount integer NOT NULL DEFAULT 0 CHECK (discount >= 0 AND discount < 100),
+    monthly_fee integer NOT NULL DEFAULT 0 CHECK (monthly_fee >= 0),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT plan_name_key UNIQUE (name)
+);
+
+-- A user or a company is subscribed to at most one plan. Subscriptions renew
+-- monthly: requests_used counts the requests made since period_start, and starts
+-- over at renews_at.
+CREATE TABLE IF NOT EXISTS subscription (
+    id bigserial PRIMARY KEY,
+    plan_id bigint NOT NULL REFERENCES plan,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    company_id bigint REFERENCES company ON DELETE CASCADE,
+    period_start timestamp(0) with time zone NOT NULL,
+    renews_at timestamp(0) with time zone NOT NULL,
+    requests_used integer NOT NULL DEFAULT 0,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT subscription_user UNIQUE (user_id),
+    CONSTRAINT subscription_company UNIQUE (company_id),
+    CONSTRAINT subscription_owner CHECK ((user_id IS NULL) <> (company_id IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS subscription_plan_id_idx ON subscription (plan_id);
+
+-- When the concierge has to answer a request by, under the plan of its client.
+ALTER TABLE request ADD COLUMN IF NOT EXISTS respond_by timestamp(0) with time zone;
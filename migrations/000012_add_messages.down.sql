@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS message_read;
+DROP TABLE IF EXISTS message_attachment;
+DROP TABLE IF EXISTS message;
@@ -0,0 +1,33 @@
+-- The thread of messages of a request, between its client and the concierge.
+-- Internal messages are notes the concierge keeps for itself, which the client
+-- never sees. Messages are never edited or deleted: they are the record of what
+-- was agreed.
+CREATE TABLE IF NOT EXISTS message (
+    id bigserial PRIMARY KEY,
+    request_id bigint NOT NULL REFERENCES request ON DELETE CASCADE,
+    author_id bigint NOT NULL REFERENCES users,
+    body text NOT NULL,
+    internal boolean NOT NULL DEFAULT false,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS message_request_id_idx ON message (request_id, id);
+
+CREATE TABLE IF NOT EXISTS message_attachment (
+    id bigserial PRIMARY KEY,
+    message_id bigint NOT NULL REFERENCES message ON DELETE CASCADE,
+    filename text NOT NULL,
+    content_type text NOT NULL,
+    size integer NOT NULL,
+    content bytea NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS message_attachment_message_id_idx ON message_attachment (message_id);
+
+-- Read receipts: when each user first read a message.
+CREATE TABLE IF NOT EXISTS message_read (
+    message_id bigint NOT NULL REFERENCES message ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    read_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id)
+);
@@ -0,0 +1 @@
+ALTER TABLE availability DROP COLUMN IF EXISTS time_zone;
@@ -0,0 +1,3 @@
+-- The windows of a schedule are on the wall clock of its time zone. Schedules set
+-- before it could be named were built in UTC, so that is what they keep.
+ALTER TABLE availability ADD COLUMN IF NOT EXISTS time_zone text NOT NULL DEFAULT 'UTC';
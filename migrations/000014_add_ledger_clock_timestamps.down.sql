@@ -0,0 +1,7 @@
+ALTER TABLE ledger_entry
+    ALTER COLUMN created_at TYPE timestamp(0) with time zone,
+    ALTER COLUMN created_at SET DEFAULT NOW();
+
+ALTER TABLE ledger_transaction
+    ALTER COLUMN created_at TYPE timestamp(0) with time zone,
+    ALTER COLUMN created_at SET DEFAULT NOW();
@@ -0,0 +1,10 @@
+-- Postings are dated when they are made, to the microsecond, rather than when
+-- their database transaction started, to the second: as they are made while the
+-- accounts are locked, their dates then follow the order they were posted in.
+ALTER TABLE ledger_transaction
+    ALTER COLUMN created_at TYPE timestamp with time zone,
+    ALTER COLUMN created_at SET DEFAULT clock_timestamp();
+
+ALTER TABLE ledger_entry
+    ALTER COLUMN created_at TYPE timestamp with time zone,
+    ALTER COLUMN created_at SET DEFAULT clock_timestamp();
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS request_assignee_id_idx;
+
+ALTER TABLE request DROP COLUMN IF EXISTS assignee_id;
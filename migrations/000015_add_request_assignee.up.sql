@@ -0,0 +1,4 @@
+-- The concierge manager working on a request, if it has been assigned.
+ALTER TABLE request ADD COLUMN IF NOT EXISTS assignee_id bigint REFERENCES users;
+
+CREATE INDEX IF NOT EXISTS request_assignee_id_idx ON request (assignee_id);
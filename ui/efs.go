@@ -0,0 +1,12 @@
+// Package ui holds the web interface: the HTML templates rendered by the server and
+// the static assets the pages load. Both are embedded into the binary, so the server
+// no longer has to be started from the repository root.
+package ui
+
+import "embed"
+
+// Files contains the templates (html) and the static assets (css, img, js, vendor).
+// Raw sources like ui/scss and the ui/pages mock-ups are deliberately left out.
+//
+//go:embed "html" "css" "img" "js" "vendor"
+var Files embed.FS